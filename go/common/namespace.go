@@ -144,6 +144,14 @@ func (n Namespace) IsKeyManager() bool {
 	return n.flags()&NamespaceKeyManager != 0
 }
 
+// Validate checks whether the namespace identifier is well-formed.
+func (n Namespace) Validate() error {
+	if !n.isValid() {
+		return ErrMalformedNamespace
+	}
+	return nil
+}
+
 func (n Namespace) isValid() bool {
 	return n.flags()&flagsReserved == 0
 }
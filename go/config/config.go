@@ -138,6 +138,14 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("metrics: %w", err)
 	}
 
+	// Background storage maintenance prunes the node database directly, bypassing the runtime
+	// history pruner and its checks, so the two must not be enabled together.
+	if c.Storage.Maintenance.Interval > 0 && c.Runtime.Prune.Strategy != "none" {
+		return fmt.Errorf("storage: maintenance cannot be enabled together with the runtime history pruner (strategy: %s)",
+			c.Runtime.Prune.Strategy,
+		)
+	}
+
 	return nil
 }
 
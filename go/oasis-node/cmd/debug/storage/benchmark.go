@@ -2,30 +2,33 @@ package storage
 
 import (
 	"context"
-	"crypto/rand"
-	"fmt"
-	"io"
 	"os"
+	"os/signal"
 	"runtime"
 	"runtime/pprof"
-	"strconv"
-	"testing"
+	"syscall"
 
 	"github.com/spf13/cobra"
 	flag "github.com/spf13/pflag"
 	"github.com/spf13/viper"
 
 	"github.com/oasisprotocol/oasis-core/go/common"
-	"github.com/oasisprotocol/oasis-core/go/common/crypto/hash"
 	"github.com/oasisprotocol/oasis-core/go/common/logging"
 	cmdCommon "github.com/oasisprotocol/oasis-core/go/oasis-node/cmd/common"
-	storageAPI "github.com/oasisprotocol/oasis-core/go/storage/api"
 	"github.com/oasisprotocol/oasis-core/go/worker/storage"
 )
 
 const (
-	cfgProfileCPU = "benchmark.profile_cpu"
-	cfgProfileMEM = "benchmark.profile_mem"
+	cfgProfileCPU   = "benchmark.profile_cpu"
+	cfgProfileMEM   = "benchmark.profile_mem"
+	cfgSoakDuration = "benchmark.soak_duration"
+	cfgOutput       = "benchmark.output"
+
+	cfgMaxTotalDuration = "benchmark.max_total_duration"
+
+	cfgEvictionPolicy = "benchmark.eviction_policy"
+
+	cfgMemLimit = "benchmark.mem_limit"
 )
 
 var (
@@ -47,6 +50,16 @@ func doBenchmark(_ *cobra.Command, _ []string) { // nolint: gocyclo
 
 	var err error
 
+	// Interrupting the benchmark stops the current stage and keeps the results collected so far.
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	policies, err := evictionPolicyNames(viper.GetString(cfgEvictionPolicy))
+	if err != nil {
+		logger.Error("failed to select eviction policies", "err", err)
+		return
+	}
+
 	// Initialize the data directory.
 	dataDir := cmdCommon.DataDir()
 	if dataDir == "" {
@@ -98,177 +111,61 @@ func doBenchmark(_ *cobra.Command, _ []string) { // nolint: gocyclo
 		defer pprof.StopCPUProfile()
 	}
 
-	// Benchmark MKVS storage (single-insert).
-	for _, sz := range []int{
-		256, 512, 1024, 4096, 8192, 16384, 32768,
-	} {
-		buf := make([]byte, sz)
-		key := []byte(strconv.Itoa(sz))
-
-		// This will store the new MKVS tree root for later lookups.
-		var newRoot storageAPI.Root
-		newRoot.Namespace = ns
-		newRoot.Version = 1
-		newRoot.Hash.Empty()
-
-		// Apply.
-		res := testing.Benchmark(func(b *testing.B) {
-			b.SetBytes(int64(sz))
-			var root, unknown hash.Hash
-			root.Empty()
-			// We don't want to optimize-away Apply ops, so give a bogus expected root.
-			unknown.FromBytes([]byte("Unknown new root"))
-			for i := 0; i < b.N; i++ {
-				b.StopTimer()
-				_, _ = io.ReadFull(rand.Reader, buf)
-				wl := storageAPI.WriteLog{storageAPI.LogEntry{Key: key, Value: buf}}
-				b.StartTimer()
+	if soakDuration := viper.GetDuration(cfgSoakDuration); soakDuration > 0 {
+		// Run the soak test instead of the fixed benchmarks.
+		logger.Info("starting soak test",
+			"duration", soakDuration,
+		)
 
-				err = storage.Apply(context.Background(), &storageAPI.ApplyRequest{
-					Namespace: ns,
-					SrcRound:  0,
-					SrcRoot:   root,
-					DstRound:  1,
-					DstRoot:   unknown,
-					WriteLog:  wl,
-				})
-				if err != nil {
-					b.Fatalf("failed to Apply(): %v", err)
-				}
-			}
-		})
-		if err != nil {
-			logger.Error("failed to Apply()", "err", err)
-		} else {
-			logger.Info("Apply",
-				"sz", sz,
-				"ns_per_op", res.NsPerOp(),
+		err = runSoak(ctx, storage, ns, soakDuration, soakReportInterval, func(stats *soakStats) {
+			logger.Info("Soak",
+				"elapsed", stats.Elapsed,
+				"round", stats.Round,
+				"applies", stats.Applies,
+				"gets", stats.Gets,
+				"applies_per_sec", stats.AppliesPerSec,
+				"gets_per_sec", stats.GetsPerSec,
+				"rss_bytes", stats.RSSBytes,
+				"heap_bytes", stats.HeapBytes,
+				"db_size_bytes", stats.DBSizeBytes,
+				"cache_nodes", stats.CacheNodes,
+				"cache_value_bytes", stats.CacheValueBytes,
 			)
-		}
-
-		// SyncGet.
-		res = testing.Benchmark(func(b *testing.B) {
-			b.SetBytes(int64(sz))
-			for i := 0; i < b.N; i++ {
-				_, err = storage.SyncGet(context.Background(), &storageAPI.GetRequest{
-					Tree: storageAPI.TreeID{
-						Root:     newRoot,
-						Position: newRoot.Hash,
-					},
-					Key: key,
-				})
-				if err != nil {
-					b.Fatalf("failed to SyncGet(): %v", err)
-				}
-			}
 		})
 		if err != nil {
-			logger.Error("failed to SyncGet()", "err", err)
-		} else {
-			logger.Info("SyncGet",
-				"sz", sz,
-				"ns_per_op", res.NsPerOp(),
-			)
+			logger.Error("soak test failed", "err", err)
 		}
+		return
 	}
 
-	// Benchmark MKVS batch-insert.
-	for _, bsz := range []int{
-		1, 2, 4, 8, 16, 32,
-	} {
-		for _, sz := range []int{
-			256, 512, 1024, 4096, 8192, 16384,
-		} {
-			// Apply batch.
-			res := testing.Benchmark(func(b *testing.B) {
-				b.SetBytes(int64(bsz * sz))
-				var root, unknown hash.Hash
-				root.Empty()
-				// We don't want to optimize-away Apply ops, so give a bogus expected root.
-				unknown.FromBytes([]byte("Unknown new root"))
-				for i := 0; i < b.N; i++ {
-					// Prepare batch.
-					b.StopTimer()
-					var wl storageAPI.WriteLog
-					for j := 0; j < bsz; j++ {
-						buf := make([]byte, sz)
-						_, _ = io.ReadFull(rand.Reader, buf)
-						key := []byte(fmt.Sprintf("bsz=%d,sz=%d,j=%d", bsz, sz, j))
-						wl = append(wl, storageAPI.LogEntry{Key: key, Value: buf})
-					}
-					b.StartTimer()
-
-					err = storage.Apply(context.Background(), &storageAPI.ApplyRequest{
-						Namespace: ns,
-						SrcRound:  0,
-						SrcRoot:   root,
-						DstRound:  1,
-						DstRoot:   unknown,
-						WriteLog:  wl,
-					})
-					if err != nil {
-						b.Fatalf("failed to Apply(): %v", err)
-					}
-				}
-			})
-			if err != nil {
-				logger.Error("failed to Apply()", "err", err)
-			} else {
-				logger.Info("Apply",
-					"bsz", bsz,
-					"sz", sz,
-					"ns_per_op", res.NsPerOp(),
-				)
-			}
-		}
-	}
-
-	// Benchmark concurrent MKVS Apply with same write log.
-	testValues := [][]byte{
-		[]byte("Thou seest Me as Time who kills, Time who brings all to doom,"),
-		[]byte("The Slayer Time, Ancient of Days, come hither to consume;"),
-		[]byte("Excepting thee, of all these hosts of hostile chiefs arrayed,"),
-		[]byte("There shines not one shall leave alive the battlefield!"),
-	}
-	var expectedNewRoot hash.Hash
-	_ = expectedNewRoot.UnmarshalHex("131859d5048d5b11677ffed800b0329962960efae70b4def7023c380c2f075ee")
-	var emptyRoot hash.Hash
-	emptyRoot.Empty()
-
-	var wl storageAPI.WriteLog
-	blen := 0
-	for i, v := range testValues {
-		wl = append(wl, storageAPI.LogEntry{Key: []byte(strconv.Itoa(i)), Value: v})
-		blen = blen + len(v)
+	var results benchmarkResults
+	budget := newBenchmarkBudget(viper.GetDuration(cfgMaxTotalDuration))
+	err = runStorageBenchmarks(ctx, storage, ns, policies, logger, budget, viper.GetInt64(cfgMemLimit),
+		func(stage string, keyvals ...interface{}) {
+			logger.Info(stage, keyvals...)
+			results.add(stage, keyvals...)
+		},
+		func(stage string, keyvals ...interface{}) {
+			logger.Info("skipping stage, total time budget exhausted",
+				append([]interface{}{"stage", stage}, keyvals...)...,
+			)
+			results.addSkipped(stage, keyvals...)
+		},
+	)
+	if err != nil {
+		logger.Warn("benchmark interrupted, keeping partial results",
+			"err", err,
+			"completed", len(results.Results),
+		)
+		results.Interrupted = true
 	}
 
-	var cerr error
-	res := testing.Benchmark(func(b *testing.B) {
-		b.SetBytes(int64(blen))
-		b.SetParallelism(100)
-		b.RunParallel(func(pb *testing.PB) {
-			for pb.Next() {
-				cerr = storage.Apply(context.Background(), &storageAPI.ApplyRequest{
-					Namespace: ns,
-					SrcRound:  0,
-					SrcRoot:   emptyRoot,
-					DstRound:  1,
-					DstRoot:   expectedNewRoot,
-					WriteLog:  wl,
-				})
-				if cerr != nil {
-					b.Fatalf("failed to Apply(): %v", cerr)
-				}
-			}
-		})
-	})
-	if cerr != nil {
-		logger.Error("failed to Apply() concurrently", "err", cerr)
-	} else {
-		logger.Info("ApplyConcurrently",
-			"sz", blen,
-			"ns_per_op", res.NsPerOp(),
-		)
+	if output := viper.GetString(cfgOutput); output != "" {
+		if err = results.writeFile(output); err != nil {
+			logger.Error("failed to write benchmark results",
+				"err", err,
+			)
+		}
 	}
 
 	if viper.GetBool(cfgProfileMEM) {
@@ -293,6 +190,11 @@ func doBenchmark(_ *cobra.Command, _ []string) { // nolint: gocyclo
 func init() {
 	storageBenchmarkFlags.Bool(cfgProfileCPU, false, "Enable CPU profiling in benchmark")
 	storageBenchmarkFlags.Bool(cfgProfileMEM, false, "Enable memory profiling in benchmark")
+	storageBenchmarkFlags.Duration(cfgSoakDuration, 0, "Run a continuous soak test for the given duration instead of the benchmarks")
+	storageBenchmarkFlags.Duration(cfgMaxTotalDuration, 0, "Skip remaining benchmark stages once the total run time approaches the given duration (unbounded if zero)")
+	storageBenchmarkFlags.String(cfgOutput, "", "Write benchmark results to the given JSON file (also on interrupt)")
+	storageBenchmarkFlags.String(cfgEvictionPolicy, "", "Cache eviction policy to benchmark (lru, lfu or arc; all if empty)")
+	storageBenchmarkFlags.Int64(cfgMemLimit, 0, "Repeat the cache-sensitive benchmark stages with the soft memory limit set to the given number of bytes (disabled if zero)")
 	_ = viper.BindPFlags(storageBenchmarkFlags)
 	storageBenchmarkFlags.AddFlagSet(storage.Flags)
 }
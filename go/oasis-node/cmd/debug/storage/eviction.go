@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/oasisprotocol/oasis-core/go/common"
+	storageAPI "github.com/oasisprotocol/oasis-core/go/storage/api"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs"
+)
+
+const (
+	// evictionKeyCount is the number of keys in the tree used by the eviction benchmark.
+	evictionKeyCount = 10000
+	// evictionLookups is the number of lookups performed for each eviction policy.
+	evictionLookups = 100000
+	// evictionNodeCapacity is the internal node capacity of the cache in the eviction benchmark.
+	evictionNodeCapacity = 1000
+	// evictionValueCapacity is the value capacity of the cache in the eviction benchmark.
+	evictionValueCapacity = 64 * 1024
+	// evictionValueSize is the size of values in the eviction benchmark.
+	evictionValueSize = 64
+	// evictionZipfS is the skew of the key access distribution in the eviction benchmark.
+	evictionZipfS = 1.1
+)
+
+// evictionPolicies are the cache eviction policies that can be benchmarked, in the order
+// they are benchmarked in.
+var evictionPolicies = []struct {
+	name    string
+	factory mkvs.EvictionPolicyFactory
+}{
+	{"lru", mkvs.NewLRUPolicy},
+	{"lfu", mkvs.NewLFUPolicy},
+	{"arc", mkvs.NewARCPolicy},
+}
+
+// evictionStats are the results of the eviction benchmark for a single policy.
+type evictionStats struct {
+	// Policy is the name of the eviction policy.
+	Policy string
+	// Stats are the cache statistics after all lookups.
+	Stats mkvs.CacheStats
+}
+
+// evictionPolicyNames returns the names of the eviction policies selected by the given flag
+// value. An empty value selects all policies.
+func evictionPolicyNames(flagValue string) ([]string, error) {
+	var names []string
+	for _, p := range evictionPolicies {
+		if flagValue == "" || strings.EqualFold(flagValue, p.name) {
+			names = append(names, p.name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("unknown eviction policy: %s", flagValue)
+	}
+	return names, nil
+}
+
+// runEvictionBenchmark compares the cache hit rates of the given eviction policies by
+// performing the same skewed sequence of lookups against a tree with a small cache, calling
+// report with the results for each policy.
+func runEvictionBenchmark(
+	ctx context.Context,
+	backend storageAPI.LocalBackend,
+	ns common.Namespace,
+	policies []string,
+	keyCount int,
+	lookups int,
+	report func(*evictionStats),
+) error {
+	// Populate the tree.
+	var root storageAPI.Root
+	root.Namespace = ns
+	root.Type = storageAPI.RootTypeState
+	root.Hash.Empty()
+
+	rng := rand.New(rand.NewSource(1)) // nolint: gosec
+	keys := make([][]byte, keyCount)
+	tree := mkvs.NewWithRoot(nil, backend.NodeDB(), root)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("eviction key %d", i))
+		value := make([]byte, evictionValueSize)
+		_, _ = rng.Read(value)
+		if err := tree.Insert(ctx, keys[i], value); err != nil {
+			tree.Close()
+			return fmt.Errorf("failed to Insert(): %w", err)
+		}
+	}
+	root.Version++
+	_, rootHash, err := tree.Commit(ctx, ns, root.Version)
+	tree.Close()
+	if err != nil {
+		return fmt.Errorf("failed to Commit(): %w", err)
+	}
+	root.Hash = rootHash
+
+	// Spread popular keys over the whole tree.
+	rng.Shuffle(len(keys), func(i, j int) {
+		keys[i], keys[j] = keys[j], keys[i]
+	})
+
+	for _, name := range policies {
+		var factory mkvs.EvictionPolicyFactory
+		for _, p := range evictionPolicies {
+			if p.name == name {
+				factory = p.factory
+			}
+		}
+		if factory == nil {
+			return fmt.Errorf("unknown eviction policy: %s", name)
+		}
+
+		// Use the same access sequence for all policies.
+		zipf := rand.NewZipf(rand.New(rand.NewSource(2)), evictionZipfS, 1, uint64(keyCount-1)) // nolint: gosec
+		tree = mkvs.NewWithRoot(nil, backend.NodeDB(), root,
+			mkvs.Capacity(evictionNodeCapacity, evictionValueCapacity),
+			mkvs.WithEvictionPolicy(factory),
+		)
+		for i := 0; i < lookups; i++ {
+			if _, err = tree.Get(ctx, keys[zipf.Uint64()]); err != nil {
+				tree.Close()
+				return fmt.Errorf("failed to Get(): %w", err)
+			}
+		}
+
+		report(&evictionStats{
+			Policy: name,
+			Stats:  tree.CacheStats(),
+		})
+		tree.Close()
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/oasisprotocol/oasis-core/go/common"
+	storageAPI "github.com/oasisprotocol/oasis-core/go/storage/api"
+	"github.com/oasisprotocol/oasis-core/go/storage/database"
+)
+
+func TestEvictionBenchmark(t *testing.T) {
+	require := require.New(t)
+
+	names, err := evictionPolicyNames("")
+	require.NoError(err, "evictionPolicyNames")
+	require.Equal([]string{"lru", "lfu", "arc"}, names, "all policies should be selected by default")
+	names, err = evictionPolicyNames("LFU")
+	require.NoError(err, "evictionPolicyNames")
+	require.Equal([]string{"lfu"}, names)
+	_, err = evictionPolicyNames("fifo")
+	require.Error(err, "unknown policies should be rejected")
+
+	ns := common.NewTestNamespaceFromSeed([]byte("storage eviction test ns"), 0)
+	cfg := storageAPI.Config{
+		Backend:      database.BackendNameBadgerDB,
+		DB:           t.TempDir(),
+		Namespace:    ns,
+		MaxCacheSize: 16 * 1024 * 1024,
+		NoFsync:      true,
+	}
+	backend, err := database.New(&cfg)
+	require.NoError(err, "database.New")
+	defer backend.Cleanup()
+
+	names, _ = evictionPolicyNames("")
+	var reports []evictionStats
+	err = runEvictionBenchmark(context.Background(), backend, ns, names, 2000, 5000, func(stats *evictionStats) {
+		reports = append(reports, *stats)
+	})
+	require.NoError(err, "runEvictionBenchmark")
+
+	require.Len(reports, len(names), "each policy should be reported")
+	for i, report := range reports {
+		require.Equal(names[i], report.Policy)
+		require.NotZero(report.Stats.Hits, "policy %s should have cache hits", report.Policy)
+		require.NotZero(report.Stats.Misses, "policy %s should have cache misses", report.Policy)
+		require.Greater(report.Stats.HitRate(), 0.0)
+		require.Less(report.Stats.HitRate(), 1.0)
+	}
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/oasisprotocol/oasis-core/go/common"
+	storageAPI "github.com/oasisprotocol/oasis-core/go/storage/api"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+)
+
+// nodeDepthTiers are the depths (in nodes below the root) at which GetNode is benchmarked.
+var nodeDepthTiers = []int{0, 8, 16, 32, 63}
+
+// nodeDepthStats are the results of the GetNode benchmark for a single depth tier.
+type nodeDepthStats struct {
+	// Depth is the number of nodes between the root and the benchmarked node.
+	Depth int
+	// NsPerOp is the average GetNode latency in nanoseconds.
+	NsPerOp int64
+}
+
+// nodeDepthKeys returns keys that force a chain of internal nodes, such that the internal
+// node splitting on bit i is exactly i nodes below the root.
+//
+// The all-zero key runs down the whole chain while each other key branches off it at a
+// distinct bit.
+func nodeDepthKeys(maxDepth int) []node.Key {
+	keyLen := (maxDepth + 8) / 8
+	keys := []node.Key{make(node.Key, keyLen)}
+	for i := 0; i <= maxDepth; i++ {
+		keys = append(keys, make(node.Key, keyLen).SetBit(node.Depth(i), true))
+	}
+	return keys
+}
+
+// runNodeDepthBenchmark measures the latency of fetching a single node from the node
+// database at each of the given depths, calling report with the results for each depth.
+//
+// Since every node is fetched directly by its pointer, this isolates the cost of
+// dereferencing a node from the cost of traversing the tree to it.
+func runNodeDepthBenchmark(
+	ctx context.Context,
+	backend storageAPI.LocalBackend,
+	ns common.Namespace,
+	depths []int,
+	report func(*nodeDepthStats),
+) error {
+	var maxDepth int
+	for _, d := range depths {
+		if d < 0 {
+			return fmt.Errorf("invalid depth: %d", d)
+		}
+		if d > maxDepth {
+			maxDepth = d
+		}
+	}
+
+	// Build a tree with internal nodes at all depths up to the maximum.
+	var root storageAPI.Root
+	root.Namespace = ns
+	root.Type = storageAPI.RootTypeState
+	root.Hash.Empty()
+
+	tree := mkvs.NewWithRoot(nil, backend.NodeDB(), root)
+	for _, key := range nodeDepthKeys(maxDepth) {
+		if err := tree.Insert(ctx, key, []byte("node depth benchmark")); err != nil {
+			tree.Close()
+			return fmt.Errorf("failed to Insert(): %w", err)
+		}
+	}
+	root.Version++
+	_, rootHash, err := tree.Commit(ctx, ns, root.Version)
+	tree.Close()
+	if err != nil {
+		return fmt.Errorf("failed to Commit(): %w", err)
+	}
+	root.Hash = rootHash
+
+	// Follow the chain to find the node pointer at each depth.
+	ndb := backend.NodeDB()
+	ptrs := make([]*node.Pointer, maxDepth+1)
+	ptr := &node.Pointer{Clean: true, Hash: root.Hash}
+	for d := 0; d <= maxDepth; d++ {
+		ptrs[d] = ptr
+		nd, gerr := ndb.GetNode(root, ptr)
+		if gerr != nil {
+			return fmt.Errorf("failed to GetNode() at depth %d: %w", d, gerr)
+		}
+		n, ok := nd.(*node.InternalNode)
+		if !ok {
+			return fmt.Errorf("unexpected leaf node at depth %d", d)
+		}
+		ptr = &node.Pointer{Clean: true, Hash: n.Left.Hash}
+	}
+
+	for _, d := range depths {
+		var berr error
+		res := testing.Benchmark(func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, berr = ndb.GetNode(root, ptrs[d]); berr != nil {
+					b.Fatalf("failed to GetNode(): %v", berr)
+				}
+			}
+		})
+		if berr != nil {
+			return fmt.Errorf("failed to GetNode() at depth %d: %w", d, berr)
+		}
+
+		report(&nodeDepthStats{
+			Depth:   d,
+			NsPerOp: res.NsPerOp(),
+		})
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/oasisprotocol/oasis-core/go/common"
+	storageAPI "github.com/oasisprotocol/oasis-core/go/storage/api"
+	"github.com/oasisprotocol/oasis-core/go/storage/database"
+)
+
+func TestNodeDepthBenchmark(t *testing.T) {
+	require := require.New(t)
+
+	ns := common.NewTestNamespaceFromSeed([]byte("storage node depth test ns"), 0)
+	cfg := storageAPI.Config{
+		Backend:      database.BackendNameBadgerDB,
+		DB:           t.TempDir(),
+		Namespace:    ns,
+		MaxCacheSize: 16 * 1024 * 1024,
+		NoFsync:      true,
+	}
+	backend, err := database.New(&cfg)
+	require.NoError(err, "database.New")
+	defer backend.Cleanup()
+
+	var reports []nodeDepthStats
+	err = runNodeDepthBenchmark(context.Background(), backend, ns, nodeDepthTiers, func(stats *nodeDepthStats) {
+		reports = append(reports, *stats)
+	})
+	require.NoError(err, "runNodeDepthBenchmark")
+
+	require.Len(reports, len(nodeDepthTiers), "each depth tier should be reported")
+	for i, report := range reports {
+		require.Equal(nodeDepthTiers[i], report.Depth)
+		require.Greater(report.NsPerOp, int64(0), "depth %d should record latency", report.Depth)
+	}
+
+	err = runNodeDepthBenchmark(context.Background(), backend, ns, []int{-1}, func(*nodeDepthStats) {})
+	require.Error(err, "negative depths should be rejected")
+}
@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/prometheus/procfs"
+
+	"github.com/oasisprotocol/oasis-core/go/common"
+	storageAPI "github.com/oasisprotocol/oasis-core/go/storage/api"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/writelog"
+)
+
+const (
+	// soakReportInterval is the interval at which soak test statistics are reported.
+	soakReportInterval = 10 * time.Second
+	// soakKeyCount is the number of distinct keys used by the soak workload.
+	soakKeyCount = 4096
+	// soakBatchSize is the number of write log entries applied in each round.
+	soakBatchSize = 16
+	// soakValueSize is the size of values written by the soak workload.
+	soakValueSize = 256
+)
+
+// soakStats are the statistics reported periodically during a soak test.
+type soakStats struct {
+	// Elapsed is the time elapsed since the start of the soak test.
+	Elapsed time.Duration
+	// Round is the last applied round.
+	Round uint64
+
+	// Applies is the total number of Apply operations.
+	Applies uint64
+	// Gets is the total number of SyncGet operations.
+	Gets uint64
+	// AppliesPerSec is the Apply throughput since the previous report.
+	AppliesPerSec float64
+	// GetsPerSec is the SyncGet throughput since the previous report.
+	GetsPerSec float64
+
+	// RSSBytes is the resident set size of the process.
+	RSSBytes uint64
+	// HeapBytes is the number of bytes of allocated heap objects.
+	HeapBytes uint64
+	// DBSizeBytes is the size of the node database.
+	DBSizeBytes int64
+	// CacheNodes is the number of internal nodes held in the cache of the soak tree.
+	CacheNodes uint64
+	// CacheValueBytes is the size of values held in the cache of the soak tree.
+	CacheValueBytes uint64
+}
+
+// runSoak runs a continuous mixed Apply/SyncGet workload against the given storage backend
+// until the duration elapses or the context is canceled, calling report with statistics
+// every reportInterval and once more at the end.
+//
+// The roots to apply are computed using a single tree that is kept for the whole soak test, so
+// that growth of its cache shows up in the reported statistics.
+func runSoak(
+	ctx context.Context,
+	backend storageAPI.LocalBackend,
+	ns common.Namespace,
+	duration time.Duration,
+	reportInterval time.Duration,
+	report func(*soakStats),
+) error {
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	start := time.Now()
+	ticker := time.NewTicker(reportInterval)
+	defer ticker.Stop()
+
+	var root storageAPI.Root
+	root.Namespace = ns
+	root.Type = storageAPI.RootTypeState
+	root.Hash.Empty()
+
+	tree := mkvs.NewWithRoot(nil, backend.NodeDB(), root)
+	defer tree.Close()
+
+	var (
+		stats     soakStats
+		lastStats soakStats
+		lastTime  = start
+	)
+	doReport := func() {
+		now := time.Now()
+		interval := now.Sub(lastTime).Seconds()
+
+		stats.Elapsed = now.Sub(start)
+		if interval > 0 {
+			stats.AppliesPerSec = float64(stats.Applies-lastStats.Applies) / interval
+			stats.GetsPerSec = float64(stats.Gets-lastStats.Gets) / interval
+		}
+		stats.RSSBytes = soakRSS()
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		stats.HeapBytes = ms.HeapAlloc
+		stats.DBSizeBytes, _ = backend.NodeDB().Size()
+		cacheStats := tree.CacheStats()
+		stats.CacheNodes = cacheStats.InternalNodes
+		stats.CacheValueBytes = cacheStats.ValueSize
+
+		report(&stats)
+		lastStats = stats
+		lastTime = now
+	}
+
+	value := make([]byte, soakValueSize)
+	for {
+		select {
+		case <-ctx.Done():
+			doReport()
+			return nil
+		case <-ticker.C:
+			doReport()
+		default:
+		}
+
+		// Prepare a batch of updates to random keys.
+		var wl storageAPI.WriteLog
+		keys := make([][]byte, 0, soakBatchSize)
+		for i := 0; i < soakBatchSize; i++ {
+			_, _ = io.ReadFull(rand.Reader, value)
+			key := []byte(fmt.Sprintf("soak key %d", (int(value[0])<<8|int(value[1]))%soakKeyCount))
+			wl = append(wl, storageAPI.LogEntry{Key: key, Value: append([]byte{}, value...)})
+			keys = append(keys, key)
+		}
+
+		// Operations interrupted by the end of the soak test are not failures.
+		newRoot, err := soakComputeRoot(ctx, tree, root, wl)
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			return err
+		}
+
+		err = backend.Apply(ctx, &storageAPI.ApplyRequest{
+			Namespace: ns,
+			RootType:  root.Type,
+			SrcRound:  root.Version,
+			SrcRoot:   root.Hash,
+			DstRound:  newRoot.Version,
+			DstRoot:   newRoot.Hash,
+			WriteLog:  wl,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			return fmt.Errorf("failed to Apply(): %w", err)
+		}
+		// The new root has already been stored by Apply, so this only marks the pending nodes
+		// of the soak tree as committed.
+		if _, err = tree.CommitKnown(ctx, newRoot); err != nil {
+			return fmt.Errorf("failed to commit soak tree: %w", err)
+		}
+		if err = backend.NodeDB().Finalize([]storageAPI.Root{newRoot}); err != nil {
+			return fmt.Errorf("failed to Finalize(): %w", err)
+		}
+		stats.Applies++
+		stats.Round = newRoot.Version
+		root = newRoot
+
+		for _, key := range keys {
+			_, err = backend.SyncGet(ctx, &storageAPI.GetRequest{
+				Tree: storageAPI.TreeID{
+					Root:     root,
+					Position: root.Hash,
+				},
+				Key: key,
+			})
+			if err != nil {
+				if ctx.Err() != nil {
+					break
+				}
+				return fmt.Errorf("failed to SyncGet(): %w", err)
+			}
+			stats.Gets++
+		}
+	}
+}
+
+// soakComputeRoot computes the root resulting from applying the write log to the given tree
+// at the given root. The updates are kept pending in the tree.
+func soakComputeRoot(
+	ctx context.Context,
+	tree mkvs.Tree,
+	root storageAPI.Root,
+	wl storageAPI.WriteLog,
+) (storageAPI.Root, error) {
+	if err := tree.ApplyWriteLog(ctx, writelog.NewStaticIterator(wl)); err != nil {
+		return storageAPI.Root{}, fmt.Errorf("failed to apply write log: %w", err)
+	}
+	newRoot := root
+	newRoot.Version++
+	_, newHash, err := tree.Commit(ctx, root.Namespace, newRoot.Version, mkvs.NoPersist())
+	if err != nil {
+		return storageAPI.Root{}, fmt.Errorf("failed to compute new root: %w", err)
+	}
+	newRoot.Hash = newHash
+	return newRoot, nil
+}
+
+// soakRSS returns the resident set size of the current process or zero if it is not available.
+func soakRSS() uint64 {
+	proc, err := procfs.NewProc(os.Getpid())
+	if err != nil {
+		return 0
+	}
+	status, err := proc.NewStatus()
+	if err != nil {
+		return 0
+	}
+	return status.VmRSS
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/oasisprotocol/oasis-core/go/common"
+	storageAPI "github.com/oasisprotocol/oasis-core/go/storage/api"
+	"github.com/oasisprotocol/oasis-core/go/storage/database"
+)
+
+func TestSoak(t *testing.T) {
+	require := require.New(t)
+
+	ns := common.NewTestNamespaceFromSeed([]byte("storage soak test ns"), 0)
+	cfg := storageAPI.Config{
+		Backend:      database.BackendNameBadgerDB,
+		DB:           t.TempDir(),
+		Namespace:    ns,
+		MaxCacheSize: 16 * 1024 * 1024,
+		NoFsync:      true,
+	}
+	backend, err := database.New(&cfg)
+	require.NoError(err, "database.New")
+	defer backend.Cleanup()
+
+	var reports []soakStats
+	err = runSoak(context.Background(), backend, ns, 500*time.Millisecond, 100*time.Millisecond, func(stats *soakStats) {
+		reports = append(reports, *stats)
+	})
+	require.NoError(err, "runSoak")
+
+	require.GreaterOrEqual(len(reports), 3, "soak test should report periodically")
+	for i := 1; i < len(reports); i++ {
+		require.Greater(reports[i].Elapsed, reports[i-1].Elapsed, "elapsed time should increase")
+		require.GreaterOrEqual(reports[i].Applies, reports[i-1].Applies, "applies should not decrease")
+	}
+	last := reports[len(reports)-1]
+	require.NotZero(last.Applies, "soak test should apply updates")
+	require.NotZero(last.Gets, "soak test should perform lookups")
+	require.EqualValues(last.Applies, last.Round, "each apply should advance the round")
+	require.NotZero(last.HeapBytes, "heap size should be reported")
+	require.NotZero(last.CacheNodes, "cache node count should be reported")
+	require.NotZero(last.CacheValueBytes, "cache value size should be reported")
+}
@@ -0,0 +1,419 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oasisprotocol/oasis-core/go/common"
+	"github.com/oasisprotocol/oasis-core/go/common/crypto/hash"
+	"github.com/oasisprotocol/oasis-core/go/common/logging"
+	storageAPI "github.com/oasisprotocol/oasis-core/go/storage/api"
+)
+
+// benchmarkResult is the result of a single benchmark stage run.
+type benchmarkResult struct {
+	// Stage is the name of the benchmark stage.
+	Stage string `json:"stage"`
+	// Fields are the parameters and measurements of the stage run.
+	Fields map[string]interface{} `json:"fields"`
+	// Skipped is true in case the stage run was skipped because the total time budget was
+	// exhausted. Skipped stage runs only have their parameters in Fields.
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// benchmarkResults collects the results of benchmark stage runs.
+type benchmarkResults struct {
+	sync.Mutex
+
+	// Interrupted is true in case the benchmark was interrupted before all stages completed.
+	Interrupted bool `json:"interrupted"`
+	// Results are the results of all completed stage runs in the order they completed in.
+	Results []benchmarkResult `json:"results"`
+}
+
+// add records the result of a stage run given as alternating field names and values.
+func (r *benchmarkResults) add(stage string, keyvals ...interface{}) {
+	r.append(stage, false, keyvals)
+}
+
+// addSkipped records a skipped stage run with its parameters given as alternating field names
+// and values.
+func (r *benchmarkResults) addSkipped(stage string, keyvals ...interface{}) {
+	r.append(stage, true, keyvals)
+}
+
+func (r *benchmarkResults) append(stage string, skipped bool, keyvals []interface{}) {
+	fields := make(map[string]interface{}, len(keyvals)/2)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fields[fmt.Sprint(keyvals[i])] = keyvals[i+1]
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.Results = append(r.Results, benchmarkResult{
+		Stage:   stage,
+		Fields:  fields,
+		Skipped: skipped,
+	})
+}
+
+// writeFile writes the collected results to the given file as JSON.
+func (r *benchmarkResults) writeFile(path string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal benchmark results: %w", err)
+	}
+	if err = os.WriteFile(path, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write benchmark results: %w", err)
+	}
+	return nil
+}
+
+// recordFunc records the result of a stage run given as alternating field names and values.
+type recordFunc func(stage string, keyvals ...interface{})
+
+// benchmarkStageReserve is the minimum remaining time budget required to start a stage run.
+//
+// Each stage run takes at least the default benchmark time of one second.
+const benchmarkStageReserve = time.Second
+
+// benchmarkBudget bounds the total wall time of the benchmark stages.
+type benchmarkBudget struct {
+	// deadline is the time by which all stage runs should complete.
+	deadline time.Time
+	// reserve is the minimum remaining time required to start a stage run.
+	reserve time.Duration
+}
+
+// newBenchmarkBudget creates a new budget of the given total duration starting now. A zero
+// duration means that the benchmark is not bounded, in which case nil is returned.
+func newBenchmarkBudget(maxTotalDuration time.Duration) *benchmarkBudget {
+	if maxTotalDuration <= 0 {
+		return nil
+	}
+	return &benchmarkBudget{
+		deadline: time.Now().Add(maxTotalDuration),
+		reserve:  benchmarkStageReserve,
+	}
+}
+
+// exhausted returns true in case there is not enough time left to start another stage run.
+func (b *benchmarkBudget) exhausted() bool {
+	return b != nil && time.Until(b.deadline) < b.reserve
+}
+
+// withMemoryLimit calls fn with the soft memory limit of the process set to the given number of
+// bytes and restores the previous limit once fn returns.
+func withMemoryLimit(limit int64, fn func() error) error {
+	prev := debug.SetMemoryLimit(limit)
+	defer debug.SetMemoryLimit(prev)
+
+	return fn()
+}
+
+// runStorageBenchmarks runs the fixed storage benchmark stages against the given backend,
+// calling record for each completed stage run. Failed stage runs are logged and skipped.
+//
+// Once the given time budget is exhausted, the remaining stage runs are not started and skip
+// is called for each of them instead. A nil budget never gets exhausted.
+//
+// In case memLimit is positive, the cache-sensitive stages are run a second time with the soft
+// memory limit of the process set to memLimit bytes. These stage runs are recorded with an
+// additional mem_limit field.
+//
+// In case the context is canceled, the stage run in progress is abandoned and the context
+// error is returned. All stage runs completed up to that point have been recorded.
+func runStorageBenchmarks( // nolint: gocyclo
+	ctx context.Context,
+	backend storageAPI.LocalBackend,
+	ns common.Namespace,
+	evictionPolicyNames []string,
+	logger *logging.Logger,
+	budget *benchmarkBudget,
+	memLimit int64,
+	record recordFunc,
+	skip recordFunc,
+) error {
+	var err error
+
+	// skipStage reports whether the given stage run should be skipped, recording it as such.
+	skipStage := func(stage string, keyvals ...interface{}) bool {
+		if !budget.exhausted() {
+			return false
+		}
+		skip(stage, keyvals...)
+		return true
+	}
+
+	// Benchmark MKVS storage (single-insert).
+	for _, sz := range []int{
+		256, 512, 1024, 4096, 8192, 16384, 32768,
+	} {
+		buf := make([]byte, sz)
+		key := []byte(strconv.Itoa(sz))
+
+		// This will store the new MKVS tree root for later lookups.
+		var newRoot storageAPI.Root
+		newRoot.Namespace = ns
+		newRoot.Version = 1
+		newRoot.Hash.Empty()
+
+		// Apply.
+		if !skipStage("Apply", "sz", sz) {
+			res := testing.Benchmark(func(b *testing.B) {
+				b.SetBytes(int64(sz))
+				var root, unknown hash.Hash
+				root.Empty()
+				// We don't want to optimize-away Apply ops, so give a bogus expected root.
+				unknown.FromBytes([]byte("Unknown new root"))
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					if err = ctx.Err(); err != nil {
+						b.FailNow()
+					}
+					_, _ = io.ReadFull(rand.Reader, buf)
+					wl := storageAPI.WriteLog{storageAPI.LogEntry{Key: key, Value: buf}}
+					b.StartTimer()
+
+					err = backend.Apply(ctx, &storageAPI.ApplyRequest{
+						Namespace: ns,
+						SrcRound:  0,
+						SrcRoot:   root,
+						DstRound:  1,
+						DstRoot:   unknown,
+						WriteLog:  wl,
+					})
+					if err != nil {
+						b.Fatalf("failed to Apply(): %v", err)
+					}
+				}
+			})
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				logger.Error("failed to Apply()", "err", err)
+			} else {
+				record("Apply",
+					"sz", sz,
+					"ns_per_op", res.NsPerOp(),
+				)
+			}
+		}
+
+		// SyncGet.
+		if !skipStage("SyncGet", "sz", sz) {
+			res := testing.Benchmark(func(b *testing.B) {
+				b.SetBytes(int64(sz))
+				for i := 0; i < b.N; i++ {
+					if err = ctx.Err(); err != nil {
+						b.FailNow()
+					}
+					_, err = backend.SyncGet(ctx, &storageAPI.GetRequest{
+						Tree: storageAPI.TreeID{
+							Root:     newRoot,
+							Position: newRoot.Hash,
+						},
+						Key: key,
+					})
+					if err != nil {
+						b.Fatalf("failed to SyncGet(): %v", err)
+					}
+				}
+			})
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				logger.Error("failed to SyncGet()", "err", err)
+			} else {
+				record("SyncGet",
+					"sz", sz,
+					"ns_per_op", res.NsPerOp(),
+				)
+			}
+		}
+	}
+
+	// Benchmark MKVS batch-insert.
+	for _, bsz := range []int{
+		1, 2, 4, 8, 16, 32,
+	} {
+		for _, sz := range []int{
+			256, 512, 1024, 4096, 8192, 16384,
+		} {
+			// Apply batch.
+			if !skipStage("Apply", "bsz", bsz, "sz", sz) {
+				res := testing.Benchmark(func(b *testing.B) {
+					b.SetBytes(int64(bsz * sz))
+					var root, unknown hash.Hash
+					root.Empty()
+					// We don't want to optimize-away Apply ops, so give a bogus expected root.
+					unknown.FromBytes([]byte("Unknown new root"))
+					for i := 0; i < b.N; i++ {
+						// Prepare batch.
+						b.StopTimer()
+						if err = ctx.Err(); err != nil {
+							b.FailNow()
+						}
+						var wl storageAPI.WriteLog
+						for j := 0; j < bsz; j++ {
+							buf := make([]byte, sz)
+							_, _ = io.ReadFull(rand.Reader, buf)
+							key := []byte(fmt.Sprintf("bsz=%d,sz=%d,j=%d", bsz, sz, j))
+							wl = append(wl, storageAPI.LogEntry{Key: key, Value: buf})
+						}
+						b.StartTimer()
+
+						err = backend.Apply(ctx, &storageAPI.ApplyRequest{
+							Namespace: ns,
+							SrcRound:  0,
+							SrcRoot:   root,
+							DstRound:  1,
+							DstRoot:   unknown,
+							WriteLog:  wl,
+						})
+						if err != nil {
+							b.Fatalf("failed to Apply(): %v", err)
+						}
+					}
+				})
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if err != nil {
+					logger.Error("failed to Apply()", "err", err)
+				} else {
+					record("Apply",
+						"bsz", bsz,
+						"sz", sz,
+						"ns_per_op", res.NsPerOp(),
+					)
+				}
+			}
+		}
+	}
+
+	// Benchmark concurrent MKVS Apply with same write log.
+	if !skipStage("ApplyConcurrently") {
+		testValues := [][]byte{
+			[]byte("Thou seest Me as Time who kills, Time who brings all to doom,"),
+			[]byte("The Slayer Time, Ancient of Days, come hither to consume;"),
+			[]byte("Excepting thee, of all these hosts of hostile chiefs arrayed,"),
+			[]byte("There shines not one shall leave alive the battlefield!"),
+		}
+		var expectedNewRoot hash.Hash
+		_ = expectedNewRoot.UnmarshalHex("131859d5048d5b11677ffed800b0329962960efae70b4def7023c380c2f075ee")
+		var emptyRoot hash.Hash
+		emptyRoot.Empty()
+
+		var wl storageAPI.WriteLog
+		blen := 0
+		for i, v := range testValues {
+			wl = append(wl, storageAPI.LogEntry{Key: []byte(strconv.Itoa(i)), Value: v})
+			blen = blen + len(v)
+		}
+
+		var cerr error
+		res := testing.Benchmark(func(b *testing.B) {
+			b.SetBytes(int64(blen))
+			b.SetParallelism(100)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if ctx.Err() != nil {
+						return
+					}
+					cerr = backend.Apply(ctx, &storageAPI.ApplyRequest{
+						Namespace: ns,
+						SrcRound:  0,
+						SrcRoot:   emptyRoot,
+						DstRound:  1,
+						DstRoot:   expectedNewRoot,
+						WriteLog:  wl,
+					})
+					if cerr != nil {
+						b.Fatalf("failed to Apply(): %v", cerr)
+					}
+				}
+			})
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if cerr != nil {
+			logger.Error("failed to Apply() concurrently", "err", cerr)
+		} else {
+			record("ApplyConcurrently",
+				"sz", blen,
+				"ns_per_op", res.NsPerOp(),
+			)
+		}
+	}
+
+	// runCacheStages runs the cache-sensitive stages, adding the given fields to each recorded
+	// stage run.
+	runCacheStages := func(fields ...interface{}) error {
+		// Benchmark cache eviction policies under a skewed access pattern.
+		if !skipStage("CacheEviction", fields...) {
+			err = runEvictionBenchmark(ctx, backend, ns, evictionPolicyNames, evictionKeyCount, evictionLookups, func(stats *evictionStats) {
+				record("CacheEviction", append([]interface{}{
+					"policy", stats.Policy,
+					"hits", stats.Stats.Hits,
+					"misses", stats.Stats.Misses,
+					"hit_rate", stats.Stats.HitRate(),
+				}, fields...)...)
+			})
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				logger.Error("failed to benchmark eviction policies", "err", err)
+			}
+		}
+
+		// Benchmark GetNode latency at increasing tree depths.
+		if !skipStage("GetNode", fields...) {
+			err = runNodeDepthBenchmark(ctx, backend, ns, nodeDepthTiers, func(stats *nodeDepthStats) {
+				record("GetNode", append([]interface{}{
+					"depth", stats.Depth,
+					"ns_per_op", stats.NsPerOp,
+				}, fields...)...)
+			})
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				logger.Error("failed to benchmark GetNode", "err", err)
+			}
+		}
+		return nil
+	}
+	if err = runCacheStages(); err != nil {
+		return err
+	}
+
+	// Repeat the cache-sensitive stages under memory pressure.
+	if memLimit > 0 {
+		err = withMemoryLimit(memLimit, func() error {
+			return runCacheStages("mem_limit", memLimit)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/oasisprotocol/oasis-core/go/common"
+	"github.com/oasisprotocol/oasis-core/go/common/logging"
+	storageAPI "github.com/oasisprotocol/oasis-core/go/storage/api"
+	"github.com/oasisprotocol/oasis-core/go/storage/database"
+)
+
+func newTestBackend(t *testing.T, ns common.Namespace) storageAPI.LocalBackend {
+	cfg := storageAPI.Config{
+		Backend:      database.BackendNameBadgerDB,
+		DB:           t.TempDir(),
+		Namespace:    ns,
+		MaxCacheSize: 16 * 1024 * 1024,
+		NoFsync:      true,
+	}
+	backend, err := database.New(&cfg)
+	require.NoError(t, err, "database.New")
+	t.Cleanup(backend.Cleanup)
+	return backend
+}
+
+func TestStorageBenchmarksInterrupt(t *testing.T) {
+	require := require.New(t)
+
+	ns := common.NewTestNamespaceFromSeed([]byte("storage benchmark test ns"), 0)
+	backend := newTestBackend(t, ns)
+
+	// Simulate an interrupt after the first two stage runs complete.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var results benchmarkResults
+	err := runStorageBenchmarks(ctx, backend, ns, []string{"lru"}, logging.GetLogger("test"), nil, 0,
+		func(stage string, keyvals ...interface{}) {
+			results.add(stage, keyvals...)
+			if len(results.Results) == 2 {
+				cancel()
+			}
+		},
+		func(stage string, _ ...interface{}) {
+			t.Errorf("stage %s should not be skipped without a time budget", stage)
+		},
+	)
+	require.ErrorIs(err, context.Canceled, "interrupted benchmark should return the context error")
+	results.Interrupted = true
+
+	require.Len(results.Results, 2, "stage runs completed before the interrupt should be recorded")
+	for _, result := range results.Results {
+		require.NotEmpty(result.Stage)
+		require.Contains(result.Fields, "sz")
+		require.Contains(result.Fields, "ns_per_op")
+	}
+
+	// Partial results should be written to the output file.
+	output := filepath.Join(t.TempDir(), "results.json")
+	err = results.writeFile(output)
+	require.NoError(err, "writeFile")
+
+	data, err := os.ReadFile(output)
+	require.NoError(err, "ReadFile")
+	var written struct {
+		Interrupted bool `json:"interrupted"`
+		Results     []struct {
+			Stage  string                 `json:"stage"`
+			Fields map[string]interface{} `json:"fields"`
+		} `json:"results"`
+	}
+	err = json.Unmarshal(data, &written)
+	require.NoError(err, "Unmarshal")
+	require.True(written.Interrupted)
+	require.Len(written.Results, 2)
+	for i, result := range written.Results {
+		require.Equal(results.Results[i].Stage, result.Stage)
+		require.EqualValues(results.Results[i].Fields["sz"], result.Fields["sz"])
+		require.EqualValues(results.Results[i].Fields["ns_per_op"], result.Fields["ns_per_op"])
+	}
+}
+
+func TestStorageBenchmarksBudget(t *testing.T) {
+	require := require.New(t)
+
+	require.Nil(newBenchmarkBudget(0), "zero duration should not bound the benchmark")
+	require.False(newBenchmarkBudget(0).exhausted())
+	require.False(newBenchmarkBudget(time.Hour).exhausted())
+	require.True(newBenchmarkBudget(time.Millisecond).exhausted())
+
+	ns := common.NewTestNamespaceFromSeed([]byte("storage benchmark test ns"), 0)
+	backend := newTestBackend(t, ns)
+
+	// Exhaust the budget once the first stage run completes.
+	budget := &benchmarkBudget{deadline: time.Now().Add(time.Hour)}
+	var results benchmarkResults
+	err := runStorageBenchmarks(context.Background(), backend, ns, []string{"lru"}, logging.GetLogger("test"), budget, 0,
+		func(stage string, keyvals ...interface{}) {
+			results.add(stage, keyvals...)
+			budget.deadline = time.Now()
+		},
+		results.addSkipped,
+	)
+	require.NoError(err, "runStorageBenchmarks")
+
+	// The completed stage run should be reported normally and all later ones skipped.
+	require.True(len(results.Results) > 1, "later stage runs should be recorded as skipped")
+	completed := results.Results[0]
+	require.False(completed.Skipped)
+	require.Contains(completed.Fields, "ns_per_op")
+	stages := make(map[string]bool)
+	for _, result := range results.Results[1:] {
+		require.True(result.Skipped, "stage %s should be skipped", result.Stage)
+		require.NotContains(result.Fields, "ns_per_op")
+		stages[result.Stage] = true
+	}
+	for _, stage := range []string{"Apply", "ApplyConcurrently", "CacheEviction", "GetNode"} {
+		require.True(stages[stage], "stage %s should be skipped", stage)
+	}
+
+	// Skipped stage runs should be marked as such in the output file.
+	output := filepath.Join(t.TempDir(), "results.json")
+	err = results.writeFile(output)
+	require.NoError(err, "writeFile")
+
+	data, err := os.ReadFile(output)
+	require.NoError(err, "ReadFile")
+	var written struct {
+		Results []struct {
+			Stage   string `json:"stage"`
+			Skipped bool   `json:"skipped"`
+		} `json:"results"`
+	}
+	err = json.Unmarshal(data, &written)
+	require.NoError(err, "Unmarshal")
+	require.Len(written.Results, len(results.Results))
+	require.False(written.Results[0].Skipped)
+	for _, result := range written.Results[1:] {
+		require.True(result.Skipped)
+	}
+}
+
+func TestStorageBenchmarksMemLimit(t *testing.T) {
+	require := require.New(t)
+
+	// Query the current limit without changing it.
+	prev := debug.SetMemoryLimit(-1)
+
+	const limit = 256 * 1024 * 1024
+	var called bool
+	err := withMemoryLimit(limit, func() error {
+		called = true
+		require.EqualValues(limit, debug.SetMemoryLimit(-1), "memory limit should apply during the stage")
+		return context.Canceled
+	})
+	require.ErrorIs(err, context.Canceled, "stage error should be propagated")
+	require.True(called)
+	require.EqualValues(prev, debug.SetMemoryLimit(-1), "memory limit should be restored after the stage")
+}
@@ -3,6 +3,7 @@ package api
 
 import (
 	"context"
+	"time"
 
 	"github.com/oasisprotocol/oasis-core/go/common"
 	"github.com/oasisprotocol/oasis-core/go/common/crypto/hash"
@@ -39,6 +40,15 @@ var (
 	ErrUnsupported = errors.New(ModuleName, 4, "storage: method not supported by backend")
 	// ErrLimitReached means that a configured limit has been reached.
 	ErrLimitReached = errors.New(ModuleName, 5, "storage: limit reached")
+	// ErrDuplicateKeys is the error returned when a write log contains
+	// duplicate keys and duplicate keys are rejected.
+	ErrDuplicateKeys = errors.New(ModuleName, 6, "storage: duplicate keys in write log")
+	// ErrTooStale is the error returned when the latest available root is older than the
+	// requested staleness bound.
+	ErrTooStale = errors.New(ModuleName, 7, "storage: latest root is too stale")
+	// ErrValueRejected is the error returned when a write log entry is rejected by the
+	// configured value validator.
+	ErrValueRejected = errors.New(ModuleName, 8, "storage: value rejected by validator")
 
 	// The following errors are reimports from NodeDB.
 
@@ -69,6 +79,24 @@ var (
 	ErrReadOnly = nodedb.ErrReadOnly
 )
 
+// SyncMode controls when the storage backend syncs applied updates to disk.
+type SyncMode = nodedb.SyncMode
+
+const (
+	// SyncModeNone never explicitly syncs and relies on the operating system to flush writes.
+	// Any updates applied since the last flush may be lost on a crash.
+	SyncModeNone = nodedb.SyncModeNone
+	// SyncModeBatch syncs after every SyncModeBatchSize applied updates. At most the updates
+	// applied since the last sync may be lost on a crash.
+	SyncModeBatch = nodedb.SyncModeBatch
+	// SyncModeAlways syncs on every commit. Applied updates are never lost on a crash.
+	SyncModeAlways = nodedb.SyncModeAlways
+
+	// SyncModeBatchSize is the number of applied updates after which the batch sync mode
+	// syncs to disk.
+	SyncModeBatchSize = 64
+)
+
 // Config is the storage backend configuration.
 type Config struct { // nolint: maligned
 	// Backend is the database backend.
@@ -89,11 +117,48 @@ type Config struct { // nolint: maligned
 	// NoFsync will disable fsync() where possible.
 	NoFsync bool
 
+	// SyncMode controls when applied updates are synced to disk. If set, it
+	// overrides NoFsync.
+	SyncMode SyncMode
+
 	// MemoryOnly will make the storage memory-only (if the backend supports it).
 	MemoryOnly bool
 
 	// ReadOnly will make the storage read-only.
 	ReadOnly bool
+
+	// DeepLeafWarningDepth is the bit depth above which newly created leaves are reported as
+	// a warning during Apply. Zero disables the warning.
+	DeepLeafWarningDepth uint16
+
+	// MaintenanceInterval is the interval at which background maintenance prunes old versions.
+	// Zero disables background maintenance.
+	MaintenanceInterval time.Duration
+
+	// MaintenanceKeepLast is the number of versions before the latest finalized version that
+	// background maintenance retains.
+	MaintenanceKeepLast uint64
+
+	// HotKeyReportInterval is the interval at which the most accessed keys are logged. Zero
+	// disables hot-key tracking.
+	HotKeyReportInterval time.Duration
+
+	// HotKeyWindow is the duration of the sliding window over which key accesses are counted.
+	HotKeyWindow time.Duration
+
+	// HotKeySampleRate is the sample rate of counted key accesses, see mkvs.NewHotKeyTracker.
+	HotKeySampleRate uint64
+
+	// HotKeyCapacity is the maximum number of keys tracked per window.
+	HotKeyCapacity int
+
+	// HotKeyTopN is the number of most accessed keys to log.
+	HotKeyTopN int
+
+	// ValueValidator is called with the key and value of each write log entry storing a value
+	// during Apply. In case it returns an error for any entry, the whole write log is rejected
+	// without applying anything. Entries removing keys are not validated.
+	ValueValidator func(key, value []byte) error
 }
 
 // ToNodeDB converts from a Config to a node DB Config.
@@ -102,13 +167,24 @@ func (cfg *Config) ToNodeDB() *nodedb.Config {
 		DB:               cfg.DB,
 		Namespace:        cfg.Namespace,
 		MaxCacheSize:     cfg.MaxCacheSize,
-		NoFsync:          cfg.NoFsync,
+		NoFsync:          cfg.noFsync(),
 		MemoryOnly:       cfg.MemoryOnly,
 		ReadOnly:         cfg.ReadOnly,
 		DiscardWriteLogs: cfg.DiscardWriteLogs,
 	}
 }
 
+func (cfg *Config) noFsync() bool {
+	switch cfg.SyncMode {
+	case SyncModeNone, SyncModeBatch:
+		return true
+	case SyncModeAlways:
+		return false
+	default:
+		return cfg.NoFsync
+	}
+}
+
 // WriteLog is a write log.
 //
 // The keys in the write log must be unique.
@@ -186,6 +262,13 @@ type ApplyRequest struct {
 	DstRound  uint64           `json:"dst_round"`
 	DstRoot   hash.Hash        `json:"dst_root"`
 	WriteLog  WriteLog         `json:"writelog"`
+
+	// RejectDuplicateKeys specifies that the request should be rejected
+	// without applying anything if the write log contains duplicate keys.
+	//
+	// By default, entries are applied in order so the last entry for a
+	// given key wins.
+	RejectDuplicateKeys bool `json:"reject_duplicate_keys,omitempty"`
 }
 
 // SyncOptions are the sync options.
@@ -233,6 +316,10 @@ type LocalBackend interface {
 	// The expected new root is used to check if the new root after all the
 	// operations are applied already exists in the local DB.  If it does, the
 	// Apply is ignored.
+	//
+	// The expected new root is a precondition. The computed root is compared
+	// against it before the new root is committed and in case they differ,
+	// ErrExpectedRootMismatch is returned and no new root is recorded.
 	Apply(ctx context.Context, request *ApplyRequest) error
 
 	// Checkpointer returns the checkpoint creator/restorer for this storage backend.
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/oasisprotocol/oasis-core/go/common/logging"
+	nodedb "github.com/oasisprotocol/oasis-core/go/storage/mkvs/db/api"
+)
+
+// MaintenanceStats are the statistics of work done by background maintenance.
+type MaintenanceStats struct {
+	// Runs is the number of completed maintenance runs.
+	Runs uint64
+	// Failures is the number of failed maintenance runs.
+	Failures uint64
+	// PrunedVersions is the number of versions pruned from the node database.
+	PrunedVersions uint64
+}
+
+// Maintainer periodically prunes old finalized versions from a node database in the
+// background, retaining the configured number of versions before the latest finalized one.
+//
+// Pruning removes all nodes that are no longer reachable from any retained root, so nodes
+// orphaned by later versions are reclaimed once the versions referencing them are pruned.
+//
+// The maintainer prunes the node database directly, so it must not be used together with the
+// runtime history pruner, which prunes storage through its own prune handlers.
+type Maintainer struct {
+	sync.Mutex
+
+	ndb      nodedb.NodeDB
+	interval time.Duration
+	keepLast uint64
+
+	cancelFn context.CancelFunc
+	doneCh   chan struct{}
+
+	stats MaintenanceStats
+
+	logger *logging.Logger
+}
+
+// NewMaintainer creates a new background maintainer for the given node database.
+//
+// The maintainer is not started until Start is called.
+func NewMaintainer(ndb nodedb.NodeDB, interval time.Duration, keepLast uint64) (*Maintainer, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("storage: invalid maintenance interval: %s", interval)
+	}
+
+	return &Maintainer{
+		ndb:      ndb,
+		interval: interval,
+		keepLast: keepLast,
+		logger:   logging.GetLogger("storage/maintenance"),
+	}, nil
+}
+
+// Start starts background maintenance. Starting an already running maintainer is a no-op.
+func (m *Maintainer) Start() {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.cancelFn != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancelFn = cancel
+	m.doneCh = make(chan struct{})
+	go m.worker(ctx, m.doneCh)
+}
+
+// Stop stops background maintenance and waits for any in-progress run to abort. Stopping a
+// maintainer that is not running is a no-op.
+func (m *Maintainer) Stop() {
+	m.Lock()
+	cancel, doneCh := m.cancelFn, m.doneCh
+	m.cancelFn, m.doneCh = nil, nil
+	m.Unlock()
+
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-doneCh
+}
+
+// Stats returns the statistics of work done so far.
+func (m *Maintainer) Stats() MaintenanceStats {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.stats
+}
+
+// RunOnce performs a single maintenance run and returns the number of pruned versions.
+func (m *Maintainer) RunOnce(ctx context.Context) (uint64, error) {
+	var (
+		pruned uint64
+		err    error
+	)
+	if latest, ok := m.ndb.GetLatestVersion(); ok && latest >= m.keepLast {
+		pruned, err = pruneVersions(ctx, m.ndb, latest-m.keepLast)
+	}
+
+	m.Lock()
+	m.stats.PrunedVersions += pruned
+	if err != nil {
+		m.stats.Failures++
+	} else {
+		m.stats.Runs++
+	}
+	m.Unlock()
+
+	maintenancePrunedVersions.Add(float64(pruned))
+	if err != nil {
+		maintenanceFailures.Inc()
+		return pruned, err
+	}
+	maintenanceRuns.Inc()
+	return pruned, nil
+}
+
+func (m *Maintainer) worker(ctx context.Context, doneCh chan struct{}) {
+	defer close(doneCh)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pruned, err := m.RunOnce(ctx)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			m.logger.Error("storage maintenance failed",
+				"err", err,
+			)
+		case pruned > 0:
+			m.logger.Debug("pruned old versions",
+				"pruned_versions", pruned,
+				"earliest_version", m.ndb.GetEarliestVersion(),
+			)
+		}
+	}
+}
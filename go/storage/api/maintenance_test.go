@@ -0,0 +1,148 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintainer(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	ndb, cleanup := newTestNodeDB(t)
+	defer cleanup()
+
+	rc, err := NewRootCache(ndb)
+	require.NoError(err, "NewRootCache()")
+
+	_, err = NewMaintainer(ndb, 0, 2)
+	require.Error(err, "NewMaintainer should fail with a zero interval")
+
+	const (
+		numRounds = 10
+		keepLast  = 2
+	)
+
+	m, err := NewMaintainer(ndb, 5*time.Millisecond, keepLast)
+	require.NoError(err, "NewMaintainer()")
+	m.Start()
+	m.Start()
+
+	// applyRound applies and finalizes the given round, updating a shared key and adding a
+	// key of its own.
+	applyRound := func(root Root, round uint64) Root {
+		wl := WriteLog{
+			{Key: []byte("shared"), Value: []byte(fmt.Sprintf("round %d", round))},
+			{Key: []byte(fmt.Sprintf("key %d", round)), Value: []byte("value")},
+		}
+		newRoot := expectedNewRoot(t, ndb, root, round, wl)
+		_, aerr := rc.Apply(ctx, root, newRoot, wl)
+		require.NoError(aerr, "Apply(%d)", round)
+		require.NoError(ndb.Finalize([]Root{newRoot}), "Finalize(%d)", round)
+		return newRoot
+	}
+
+	root := Root{Namespace: testNs, Type: RootTypeState}
+	root.Hash.Empty()
+	var (
+		roots   []Root
+		latest  Root
+		latestL sync.Mutex
+	)
+	root = applyRound(root, 0)
+	roots = append(roots, root)
+	latest = root
+
+	// Concurrently read the latest root while new rounds are applied and maintenance runs.
+	readCtx, cancelReads := context.WithCancel(ctx)
+	defer cancelReads()
+	readErrCh := make(chan error, 1)
+	go func() {
+		defer close(readErrCh)
+		for readCtx.Err() == nil {
+			latestL.Lock()
+			r := latest
+			latestL.Unlock()
+
+			tree, rerr := rc.GetTree(r)
+			if rerr != nil {
+				readErrCh <- rerr
+				return
+			}
+			value, rerr := tree.Get(readCtx, []byte("shared"))
+			tree.Close()
+			switch {
+			case readCtx.Err() != nil:
+				return
+			case rerr != nil:
+				readErrCh <- rerr
+				return
+			case string(value) != fmt.Sprintf("round %d", r.Version):
+				readErrCh <- fmt.Errorf("unexpected value in root %d: %s", r.Version, value)
+				return
+			}
+		}
+	}()
+
+	for round := uint64(1); round < numRounds; round++ {
+		root = applyRound(root, round)
+		roots = append(roots, root)
+
+		latestL.Lock()
+		latest = root
+		latestL.Unlock()
+
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	// Obsolete versions should eventually be reclaimed.
+	require.Eventually(func() bool {
+		return ndb.GetEarliestVersion() == numRounds-1-keepLast
+	}, 5*time.Second, 5*time.Millisecond, "maintenance should prune obsolete versions")
+
+	cancelReads()
+	require.NoError(<-readErrCh, "concurrent reads should not be disrupted")
+
+	m.Lock()
+	doneCh := m.doneCh
+	m.Unlock()
+
+	m.Stop()
+	m.Stop()
+
+	// Stopping should wait for the worker to exit, so no more maintenance can run afterwards.
+	select {
+	case <-doneCh:
+	default:
+		require.Fail("maintenance worker should have exited after Stop")
+	}
+
+	stats := m.Stats()
+	require.NotZero(stats.Runs, "maintenance should have run")
+	require.Zero(stats.Failures)
+	require.EqualValues(numRounds-1-keepLast, stats.PrunedVersions)
+
+	for _, r := range roots {
+		if r.Version < numRounds-1-keepLast {
+			require.False(rc.HasRoot(r), "root %d should be pruned", r.Version)
+			continue
+		}
+		require.True(rc.HasRoot(r), "root %d should be retained", r.Version)
+	}
+
+	// Maintenance should no longer run after being stopped.
+	applyRound(root, numRounds)
+	require.EqualValues(numRounds-1-keepLast, ndb.GetEarliestVersion(), "stopped maintainer should not prune")
+	require.Equal(stats, m.Stats())
+
+	// Running maintenance manually should prune the remaining obsolete version.
+	pruned, err := m.RunOnce(ctx)
+	require.NoError(err, "RunOnce")
+	require.EqualValues(1, pruned)
+	require.EqualValues(numRounds-keepLast, ndb.GetEarliestVersion())
+}
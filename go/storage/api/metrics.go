@@ -41,11 +41,33 @@ var (
 		[]string{"call"},
 	)
 
+	maintenanceRuns = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "oasis_storage_maintenance_runs",
+			Help: "Number of completed background storage maintenance runs.",
+		},
+	)
+	maintenanceFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "oasis_storage_maintenance_failures",
+			Help: "Number of failed background storage maintenance runs.",
+		},
+	)
+	maintenancePrunedVersions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "oasis_storage_maintenance_pruned_versions",
+			Help: "Number of versions pruned by background storage maintenance.",
+		},
+	)
+
 	storageCollectors = []prometheus.Collector{
 		storageFailures,
 		storageCalls,
 		storageLatency,
 		storageValueSize,
+		maintenanceRuns,
+		maintenanceFailures,
+		maintenancePrunedVersions,
 	}
 
 	labelApply           = prometheus.Labels{"call": "apply"}
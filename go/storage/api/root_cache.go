@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/oasisprotocol/oasis-core/go/common/crypto/hash"
 	"github.com/oasisprotocol/oasis-core/go/storage/mkvs"
@@ -11,17 +12,21 @@ import (
 
 // RootCache is a LRU based tree cache.
 type RootCache struct {
-	localDB nodedb.NodeDB
+	localDB     nodedb.NodeDB
+	treeOptions []mkvs.Option
 }
 
 // GetTree gets a tree entry from the cache by the root iff present, or creates
 // a new tree with the specified root in the node database.
 func (rc *RootCache) GetTree(root Root) (mkvs.Tree, error) {
-	return mkvs.NewWithRoot(nil, rc.localDB, root), nil
+	return mkvs.NewWithRoot(nil, rc.localDB, root, rc.treeOptions...), nil
 }
 
 // Apply applies the write log, bypassing the apply operation iff the new root
 // already is in the node database.
+//
+// The computed root is checked against the expected new root before it is committed.
+// In case of a mismatch, ErrExpectedRootMismatch is returned and no new root is recorded.
 func (rc *RootCache) Apply(
 	ctx context.Context,
 	root Root,
@@ -38,7 +43,7 @@ func (rc *RootCache) Apply(
 	// Check if we already have the expected new root in our local DB.
 	if !rc.localDB.HasRoot(expectedNewRoot) {
 		// We don't, apply operations.
-		tree := mkvs.NewWithRoot(nil, rc.localDB, root)
+		tree := mkvs.NewWithRoot(nil, rc.localDB, root, rc.treeOptions...)
 		defer tree.Close()
 
 		if err := tree.ApplyWriteLog(ctx, writelog.NewStaticIterator(writeLog)); err != nil {
@@ -58,12 +63,111 @@ func (rc *RootCache) Apply(
 	return &r, nil
 }
 
+// ApplyAndPrune applies the write log as Apply does and then prunes all finalized versions
+// preceding the last keepLastN versions before the version of the expected new root.
+//
+// Versions that have not yet been finalized are never pruned, neither is the latest finalized
+// version. Pruning only removes nodes that are not reachable from any retained root.
+//
+// In case pruning fails after the write log has been applied, the new root is returned together
+// with the error.
+func (rc *RootCache) ApplyAndPrune(
+	ctx context.Context,
+	root Root,
+	expectedNewRoot Root,
+	writeLog WriteLog,
+	keepLastN uint64,
+) (*hash.Hash, error) {
+	r, err := rc.Apply(ctx, root, expectedNewRoot, writeLog)
+	if err != nil {
+		return nil, err
+	}
+	if expectedNewRoot.Version < keepLastN {
+		return r, nil
+	}
+
+	if _, err = pruneVersions(ctx, rc.localDB, expectedNewRoot.Version-keepLastN); err != nil {
+		return r, fmt.Errorf("storage: failed to prune after apply: %w", err)
+	}
+	return r, nil
+}
+
+// pruneVersions prunes all finalized versions preceding the given version and returns the
+// number of pruned versions.
+//
+// Versions that have not yet been finalized are never pruned, neither is the latest finalized
+// version.
+func pruneVersions(ctx context.Context, ndb nodedb.NodeDB, preserveFrom uint64) (uint64, error) {
+	var pruned uint64
+	for version := ndb.GetEarliestVersion(); version < preserveFrom; version++ {
+		if err := ctx.Err(); err != nil {
+			return pruned, err
+		}
+
+		err := ndb.Prune(version)
+		switch err {
+		case nil:
+			pruned++
+		case nodedb.ErrNotFinalized, nodedb.ErrCannotPruneLatestVersion:
+			// Nothing more can be pruned until more versions are finalized.
+			return pruned, nil
+		default:
+			return pruned, err
+		}
+	}
+	return pruned, nil
+}
+
+// GetLatest looks up the given key in the root of the given type at the latest finalized
+// version and returns the value together with the root that was used.
+//
+// In case the latest finalized version is more than maxStaleRounds behind the current round,
+// ErrTooStale is returned.
+func (rc *RootCache) GetLatest(
+	ctx context.Context,
+	currentRound uint64,
+	rootType RootType,
+	key []byte,
+	maxStaleRounds uint64,
+) ([]byte, Root, error) {
+	version, ok := rc.localDB.GetLatestVersion()
+	if !ok {
+		return nil, Root{}, ErrRootNotFound
+	}
+	if version < currentRound && currentRound-version > maxStaleRounds {
+		return nil, Root{}, fmt.Errorf("%w: latest version %d, current round %d", ErrTooStale, version, currentRound)
+	}
+
+	roots, err := rc.localDB.GetRootsForVersion(version)
+	if err != nil {
+		return nil, Root{}, err
+	}
+	for _, root := range roots {
+		if root.Type != rootType {
+			continue
+		}
+
+		tree := mkvs.NewWithRoot(nil, rc.localDB, root, rc.treeOptions...)
+		defer tree.Close()
+
+		var value []byte
+		if value, err = tree.Get(ctx, key); err != nil {
+			return nil, Root{}, err
+		}
+		return value, root, nil
+	}
+	return nil, Root{}, ErrRootNotFound
+}
+
 func (rc *RootCache) HasRoot(root Root) bool {
 	return rc.localDB.HasRoot(root)
 }
 
-func NewRootCache(localDB nodedb.NodeDB) (*RootCache, error) {
+// NewRootCache creates a new root cache, using the given options for trees created to apply
+// write logs.
+func NewRootCache(localDB nodedb.NodeDB, treeOptions ...mkvs.Option) (*RootCache, error) {
 	return &RootCache{
-		localDB: localDB,
+		localDB:     localDB,
+		treeOptions: treeOptions,
 	}, nil
 }
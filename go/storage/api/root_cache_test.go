@@ -0,0 +1,249 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/oasisprotocol/oasis-core/go/common"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs"
+	nodedb "github.com/oasisprotocol/oasis-core/go/storage/mkvs/db/api"
+	badgerDb "github.com/oasisprotocol/oasis-core/go/storage/mkvs/db/badger"
+)
+
+var testNs = common.NewTestNamespaceFromSeed([]byte("root cache test ns"), 0)
+
+func newTestNodeDB(t *testing.T) (nodedb.NodeDB, func()) {
+	dir, err := os.MkdirTemp("", "oasis-storage-root-cache-test")
+	require.NoError(t, err, "TempDir()")
+
+	ndb, err := badgerDb.New(&nodedb.Config{
+		DB:           dir,
+		NoFsync:      true,
+		Namespace:    testNs,
+		MaxCacheSize: 16 * 1024 * 1024,
+	})
+	require.NoError(t, err, "New()")
+
+	return ndb, func() {
+		ndb.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// expectedNewRoot computes the root resulting from applying the write log without persisting it.
+func expectedNewRoot(t *testing.T, ndb nodedb.NodeDB, root Root, round uint64, wl WriteLog) Root {
+	ctx := context.Background()
+
+	tree := mkvs.NewWithRoot(nil, ndb, root)
+	defer tree.Close()
+	for _, entry := range wl {
+		require.NoError(t, tree.Insert(ctx, entry.Key, entry.Value), "Insert")
+	}
+	newRoot := Root{Namespace: root.Namespace, Version: round, Type: root.Type}
+	var err error
+	_, newRoot.Hash, err = tree.Commit(ctx, root.Namespace, round, mkvs.NoPersist())
+	require.NoError(t, err, "Commit")
+	return newRoot
+}
+
+func TestRootCacheApplyAndPrune(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	ndb, cleanup := newTestNodeDB(t)
+	defer cleanup()
+
+	rc, err := NewRootCache(ndb)
+	require.NoError(err, "NewRootCache()")
+
+	const (
+		numRounds = 6
+		keepLastN = 2
+	)
+
+	// Each round updates a shared key and adds a key of its own.
+	root := Root{Namespace: testNs, Type: RootTypeState}
+	root.Hash.Empty()
+	var roots []Root
+	for round := uint64(0); round < numRounds; round++ {
+		wl := WriteLog{
+			{Key: []byte("shared"), Value: []byte(fmt.Sprintf("round %d", round))},
+			{Key: []byte(fmt.Sprintf("key %d", round)), Value: []byte("value")},
+		}
+
+		newRoot := expectedNewRoot(t, ndb, root, round, wl)
+
+		_, err = rc.ApplyAndPrune(ctx, root, newRoot, wl, keepLastN)
+		require.NoError(err, "ApplyAndPrune(%d)", round)
+		require.NoError(ndb.Finalize([]Root{newRoot}), "Finalize(%d)", round)
+
+		roots = append(roots, newRoot)
+		root = newRoot
+	}
+
+	// Versions before the retention window of the last applied round should be gone.
+	latest := uint64(numRounds - 1)
+	require.EqualValues(latest-keepLastN, ndb.GetEarliestVersion())
+	for _, r := range roots {
+		if r.Version < latest-keepLastN {
+			require.False(rc.HasRoot(r), "root %d should be pruned", r.Version)
+			continue
+		}
+		require.True(rc.HasRoot(r), "root %d should be retained", r.Version)
+
+		// Retained roots should be fully readable.
+		var tree mkvs.Tree
+		tree, err = rc.GetTree(r)
+		require.NoError(err, "GetTree")
+		var value []byte
+		value, err = tree.Get(ctx, []byte("shared"))
+		require.NoError(err, "Get")
+		require.EqualValues(fmt.Sprintf("round %d", r.Version), string(value))
+		for round := uint64(0); round <= r.Version; round++ {
+			value, err = tree.Get(ctx, []byte(fmt.Sprintf("key %d", round)))
+			require.NoError(err, "Get")
+			require.EqualValues("value", string(value), "key %d should be readable in root %d", round, r.Version)
+		}
+		tree.Close()
+	}
+}
+
+// failingPruneNodeDB is a node database where pruning always fails.
+type failingPruneNodeDB struct {
+	nodedb.NodeDB
+}
+
+var errPruneFailed = errors.New("prune failed")
+
+func (d *failingPruneNodeDB) Prune(uint64) error {
+	return errPruneFailed
+}
+
+func TestRootCacheApplyAndPruneFailure(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	ndb, cleanup := newTestNodeDB(t)
+	defer cleanup()
+
+	rc, err := NewRootCache(&failingPruneNodeDB{ndb})
+	require.NoError(err, "NewRootCache()")
+
+	root := Root{Namespace: testNs, Type: RootTypeState}
+	root.Hash.Empty()
+	wl := WriteLog{{Key: []byte("key"), Value: []byte("round 0")}}
+	newRoot := expectedNewRoot(t, ndb, root, 0, wl)
+	_, err = rc.Apply(ctx, root, newRoot, wl)
+	require.NoError(err, "Apply()")
+	require.NoError(ndb.Finalize([]Root{newRoot}), "Finalize()")
+	root = newRoot
+
+	// Applying the next round tries to prune the first one.
+	wl = WriteLog{{Key: []byte("key"), Value: []byte("round 1")}}
+	newRoot = expectedNewRoot(t, ndb, root, 1, wl)
+	r, err := rc.ApplyAndPrune(ctx, root, newRoot, wl, 0)
+	require.ErrorIs(err, errPruneFailed, "ApplyAndPrune()")
+	require.NotNil(r, "applied root should be returned when pruning fails")
+	require.Equal(newRoot.Hash, *r)
+	require.True(rc.HasRoot(newRoot), "write log should be applied when pruning fails")
+}
+
+func TestRootCacheGetLatest(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	ndb, cleanup := newTestNodeDB(t)
+	defer cleanup()
+
+	rc, err := NewRootCache(ndb)
+	require.NoError(err, "NewRootCache()")
+
+	// Nothing has been finalized yet.
+	_, _, err = rc.GetLatest(ctx, 0, RootTypeState, []byte("key"), 10)
+	require.ErrorIs(err, ErrRootNotFound)
+
+	// Finalize rounds 0 to 2, each storing its round number under the same key.
+	root := Root{Namespace: testNs, Type: RootTypeState}
+	root.Hash.Empty()
+	for round := uint64(0); round <= 2; round++ {
+		wl := WriteLog{{Key: []byte("key"), Value: []byte(fmt.Sprintf("round %d", round))}}
+		newRoot := expectedNewRoot(t, ndb, root, round, wl)
+		_, err = rc.Apply(ctx, root, newRoot, wl)
+		require.NoError(err, "Apply(%d)", round)
+		require.NoError(ndb.Finalize([]Root{newRoot}), "Finalize(%d)", round)
+		root = newRoot
+	}
+
+	for _, tc := range []struct {
+		currentRound   uint64
+		maxStaleRounds uint64
+		err            error
+	}{
+		{2, 0, nil},
+		{3, 1, nil},
+		{4, 2, nil},
+		{4, 1, ErrTooStale},
+		{10, 5, ErrTooStale},
+	} {
+		var (
+			value    []byte
+			usedRoot Root
+		)
+		value, usedRoot, err = rc.GetLatest(ctx, tc.currentRound, RootTypeState, []byte("key"), tc.maxStaleRounds)
+		if tc.err != nil {
+			require.ErrorIs(err, tc.err, "GetLatest(%d, %d)", tc.currentRound, tc.maxStaleRounds)
+			continue
+		}
+		require.NoError(err, "GetLatest(%d, %d)", tc.currentRound, tc.maxStaleRounds)
+		require.Equal(root, usedRoot, "the latest finalized root should be used")
+		require.LessOrEqual(tc.currentRound-usedRoot.Version, tc.maxStaleRounds, "staleness bound should be respected")
+		require.EqualValues("round 2", string(value))
+	}
+
+	// Roots of other types are not available.
+	_, _, err = rc.GetLatest(ctx, 2, RootTypeIO, []byte("key"), 0)
+	require.ErrorIs(err, ErrRootNotFound)
+}
+
+func TestRootCacheTreeOptions(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	ndb, cleanup := newTestNodeDB(t)
+	defer cleanup()
+
+	xor := func(_, value []byte) ([]byte, error) {
+		transformed := make([]byte, len(value))
+		for i := range value {
+			transformed[i] = value[i] ^ 0xaa
+		}
+		return transformed, nil
+	}
+	rc, err := NewRootCache(ndb, mkvs.WithValueTransform(xor, xor))
+	require.NoError(err, "NewRootCache()")
+
+	root := Root{Namespace: testNs, Type: RootTypeState}
+	root.Hash.Empty()
+	wl := WriteLog{{Key: []byte("key"), Value: []byte("value")}}
+	newRoot := expectedNewRoot(t, ndb, root, 0, wl)
+	_, err = rc.Apply(ctx, root, newRoot, wl)
+	require.NoError(err, "Apply()")
+	require.NoError(ndb.Finalize([]Root{newRoot}), "Finalize()")
+
+	// Reads should use the same tree options as Apply.
+	value, _, err := rc.GetLatest(ctx, 0, RootTypeState, []byte("key"), 0)
+	require.NoError(err, "GetLatest()")
+	require.EqualValues("value", string(value), "GetLatest should use the tree options")
+
+	tree, err := rc.GetTree(newRoot)
+	require.NoError(err, "GetTree()")
+	defer tree.Close()
+	value, err = tree.Get(ctx, []byte("key"))
+	require.NoError(err, "Get()")
+	require.EqualValues("value", string(value), "GetTree should use the tree options")
+}
@@ -6,11 +6,16 @@ import (
 	"fmt"
 	"io"
 	"path/filepath"
+	"sync"
+	"time"
 
+	"github.com/oasisprotocol/oasis-core/go/common/logging"
 	"github.com/oasisprotocol/oasis-core/go/storage/api"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs"
 	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/checkpoint"
 	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/db"
 	dbApi "github.com/oasisprotocol/oasis-core/go/storage/mkvs/db/api"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
 )
 
 const (
@@ -31,20 +36,57 @@ type databaseBackend struct {
 	ndb          dbApi.NodeDB
 	checkpointer checkpoint.CreateRestorer
 	rootCache    *api.RootCache
+	maintainer   *api.Maintainer
 
 	initCh chan struct{}
 
 	readOnly bool
+
+	valueValidator func(key, value []byte) error
+
+	// hotKeys is the tracker of key accesses via trees of the root cache if enabled.
+	hotKeys *mkvs.HotKeyTracker
+	// hotKeysStopCh stops periodic hot-key reports and hotKeysDoneCh is closed once they stop.
+	hotKeysStopCh chan struct{}
+	hotKeysDoneCh chan struct{}
+
+	syncMode api.SyncMode
+	// syncLock protects unsyncedApplies.
+	syncLock        sync.Mutex
+	unsyncedApplies uint64
 }
 
 // New constructs a new database backed storage Backend instance.
 func New(cfg *api.Config) (api.LocalBackend, error) {
+	if err := cfg.SyncMode.Validate(); err != nil {
+		return nil, fmt.Errorf("storage/database: %w", err)
+	}
+
 	ndb, err := db.New(cfg.Backend, cfg.ToNodeDB())
 	if err != nil {
 		return nil, fmt.Errorf("storage/database: failed to create node database: %w", err)
 	}
 
-	rootCache, err := api.NewRootCache(ndb)
+	var treeOptions []mkvs.Option
+	if cfg.DeepLeafWarningDepth > 0 {
+		logger := logging.GetLogger("storage/database")
+		treeOptions = append(treeOptions, mkvs.WithDeepLeafHook(node.Depth(cfg.DeepLeafWarningDepth), func(key node.Key, bitDepth node.Depth) {
+			logger.Warn("applied update created a deep leaf",
+				"key", key,
+				"bit_depth", bitDepth,
+				"threshold", cfg.DeepLeafWarningDepth,
+			)
+		}))
+	}
+
+	var hotKeys *mkvs.HotKeyTracker
+	if cfg.HotKeyReportInterval > 0 {
+		// Share a single tracker among all trees as the root cache creates a tree per request.
+		hotKeys = mkvs.NewHotKeyTracker(cfg.HotKeyWindow, cfg.HotKeySampleRate, cfg.HotKeyCapacity)
+		treeOptions = append(treeOptions, mkvs.WithHotKeyTracker(hotKeys))
+	}
+
+	rootCache, err := api.NewRootCache(ndb, treeOptions...)
 	if err != nil {
 		ndb.Close()
 		return nil, fmt.Errorf("storage/database: failed to create root cache: %w", err)
@@ -66,16 +108,72 @@ func New(cfg *api.Config) (api.LocalBackend, error) {
 		return nil, fmt.Errorf("storage/database: failed to create checkpoint restorer: %w", err)
 	}
 
-	return &databaseBackend{
-		ndb:          ndb,
-		checkpointer: checkpoint.NewCreateRestorer(creator, restorer),
-		rootCache:    rootCache,
-		initCh:       initCh,
-		readOnly:     cfg.ReadOnly,
-	}, nil
+	// Start background maintenance if configured.
+	var maintainer *api.Maintainer
+	if cfg.MaintenanceInterval > 0 && !cfg.ReadOnly {
+		maintainer, err = api.NewMaintainer(ndb, cfg.MaintenanceInterval, cfg.MaintenanceKeepLast)
+		if err != nil {
+			ndb.Close()
+			return nil, fmt.Errorf("storage/database: failed to create maintainer: %w", err)
+		}
+		maintainer.Start()
+	}
+
+	ba := &databaseBackend{
+		ndb:            ndb,
+		checkpointer:   checkpoint.NewCreateRestorer(creator, restorer),
+		rootCache:      rootCache,
+		maintainer:     maintainer,
+		initCh:         initCh,
+		readOnly:       cfg.ReadOnly,
+		hotKeys:        hotKeys,
+		syncMode:       cfg.SyncMode,
+		valueValidator: cfg.ValueValidator,
+	}
+
+	// Start periodic hot-key reports if configured.
+	if hotKeys != nil {
+		ba.hotKeysStopCh = make(chan struct{})
+		ba.hotKeysDoneCh = make(chan struct{})
+		go ba.reportHotKeys(cfg.HotKeyReportInterval, cfg.HotKeyTopN)
+	}
+
+	return ba, nil
+}
+
+// reportHotKeys periodically logs the most accessed keys until stopped.
+func (ba *databaseBackend) reportHotKeys(interval time.Duration, topN int) {
+	defer close(ba.hotKeysDoneCh)
+
+	logger := logging.GetLogger("storage/database")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ba.hotKeysStopCh:
+			return
+		case <-ticker.C:
+		}
+
+		hot := ba.hotKeys.Top(topN)
+		if len(hot) == 0 {
+			continue
+		}
+		logger.Info("most accessed storage keys",
+			"hot_keys", hot,
+		)
+	}
 }
 
 func (ba *databaseBackend) Cleanup() {
+	if ba.hotKeysStopCh != nil {
+		close(ba.hotKeysStopCh)
+		<-ba.hotKeysDoneCh
+	}
+	if ba.maintainer != nil {
+		ba.maintainer.Stop()
+	}
 	ba.ndb.Close()
 }
 
@@ -130,6 +228,24 @@ func (ba *databaseBackend) Apply(ctx context.Context, request *api.ApplyRequest)
 	if ba.readOnly {
 		return fmt.Errorf("storage/database: failed to Apply: %w", api.ErrReadOnly)
 	}
+	if err := request.Namespace.Validate(); err != nil {
+		return fmt.Errorf("storage/database: failed to Apply: bad namespace %s: %w", request.Namespace, err)
+	}
+	if request.RejectDuplicateKeys {
+		if dups := request.WriteLog.DuplicateKeys(); len(dups) > 0 {
+			return fmt.Errorf("storage/database: failed to Apply: %w: %X", api.ErrDuplicateKeys, dups)
+		}
+	}
+	if ba.valueValidator != nil {
+		for _, entry := range request.WriteLog {
+			if entry.Value == nil {
+				continue
+			}
+			if err := ba.valueValidator(entry.Key, entry.Value); err != nil {
+				return fmt.Errorf("storage/database: failed to Apply: %w: key %X: %w", api.ErrValueRejected, entry.Key, err)
+			}
+		}
+	}
 
 	oldRoot := api.Root{
 		Namespace: request.Namespace,
@@ -152,6 +268,27 @@ func (ba *databaseBackend) Apply(ctx context.Context, request *api.ApplyRequest)
 	if err != nil {
 		return fmt.Errorf("storage/database: failed to Apply: %w", err)
 	}
+	return ba.maybeSync()
+}
+
+// maybeSync syncs the node database in case enough updates have been applied since the last
+// sync when using the batch sync mode.
+func (ba *databaseBackend) maybeSync() error {
+	if ba.syncMode != api.SyncModeBatch {
+		return nil
+	}
+
+	ba.syncLock.Lock()
+	defer ba.syncLock.Unlock()
+
+	ba.unsyncedApplies++
+	if ba.unsyncedApplies < api.SyncModeBatchSize {
+		return nil
+	}
+	if err := ba.ndb.Sync(); err != nil {
+		return fmt.Errorf("storage/database: failed to sync: %w", err)
+	}
+	ba.unsyncedApplies = 0
 	return nil
 }
 
@@ -1,13 +1,18 @@
 package database
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/oasisprotocol/oasis-core/go/common"
+	"github.com/oasisprotocol/oasis-core/go/common/crypto/hash"
 	genesisTestHelpers "github.com/oasisprotocol/oasis-core/go/genesis/tests"
 	"github.com/oasisprotocol/oasis-core/go/storage/api"
 	"github.com/oasisprotocol/oasis-core/go/storage/tests"
@@ -51,3 +56,234 @@ func doTestImpl(t *testing.T, backend string) {
 	genesisTestHelpers.SetTestChainContext()
 	tests.StorageImplementationTests(t, impl, impl, testNs, 0)
 }
+
+func TestSyncMode(t *testing.T) {
+	require := require.New(t)
+
+	for _, tc := range []struct {
+		mode    api.SyncMode
+		noFsync bool
+	}{
+		{api.SyncModeNone, true},
+		{api.SyncModeBatch, true},
+		{api.SyncModeAlways, false},
+	} {
+		require.NoError(tc.mode.Validate(), "Validate(%s)", tc.mode)
+
+		// The sync mode should override NoFsync.
+		cfg := api.Config{SyncMode: tc.mode, NoFsync: !tc.noFsync}
+		require.Equal(tc.noFsync, cfg.ToNodeDB().NoFsync, "NoFsync for sync mode %s", tc.mode)
+	}
+
+	// Without a sync mode, NoFsync should be used as-is.
+	cfg := api.Config{NoFsync: true}
+	require.NoError(cfg.SyncMode.Validate(), "Validate() with empty sync mode")
+	require.True(cfg.ToNodeDB().NoFsync, "NoFsync without sync mode")
+
+	require.Error(api.SyncMode("sometimes").Validate(), "Validate() with unknown sync mode")
+
+	dir, err := os.MkdirTemp("", "oasis-storage-database-test")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	_, err = New(&api.Config{
+		Backend:  BackendNameBadgerDB,
+		DB:       filepath.Join(dir, DefaultFileName(BackendNameBadgerDB)),
+		SyncMode: api.SyncMode("sometimes"),
+	})
+	require.Error(err, "New() with unknown sync mode")
+
+	// The batch sync mode should sync once enough updates have been applied.
+	impl := newSyncModeTestBackend(t, dir, api.SyncModeBatch)
+	defer impl.Cleanup()
+
+	ba := impl.(*databaseBackend)
+	for i := 0; i < api.SyncModeBatchSize-1; i++ {
+		require.NoError(ba.maybeSync(), "maybeSync()")
+	}
+	require.EqualValues(api.SyncModeBatchSize-1, ba.unsyncedApplies, "updates should not be synced yet")
+	require.NoError(ba.maybeSync(), "maybeSync()")
+	require.EqualValues(0, ba.unsyncedApplies, "updates should be synced")
+}
+
+func newSyncModeTestBackend(tb testing.TB, dir string, mode api.SyncMode) api.LocalBackend {
+	cfg := api.Config{
+		Backend:      BackendNameBadgerDB,
+		DB:           filepath.Join(dir, string(mode), DefaultFileName(BackendNameBadgerDB)),
+		Namespace:    common.NewTestNamespaceFromSeed([]byte("database backend test ns"), 0),
+		MaxCacheSize: 16 * 1024 * 1024,
+		SyncMode:     mode,
+	}
+	impl, err := New(&cfg)
+	require.NoError(tb, err, "New()")
+	return impl
+}
+
+func BenchmarkApplySyncMode(b *testing.B) {
+	ctx := context.Background()
+	testNs := common.NewTestNamespaceFromSeed([]byte("database backend test ns"), 0)
+
+	var wl api.WriteLog
+	for i := 0; i < 100; i++ {
+		wl = append(wl, api.LogEntry{
+			Key:   []byte(fmt.Sprintf("key %d", i)),
+			Value: []byte(fmt.Sprintf("value %d", i)),
+		})
+	}
+	dstRoot := tests.CalculateExpectedNewRoot(b, wl, testNs, 0)
+
+	for _, mode := range []api.SyncMode{
+		api.SyncModeNone,
+		api.SyncModeBatch,
+		api.SyncModeAlways,
+	} {
+		b.Run(string(mode), func(b *testing.B) {
+			dir, err := os.MkdirTemp("", "oasis-storage-database-bench")
+			require.NoError(b, err, "TempDir()")
+			defer os.RemoveAll(dir)
+
+			impl := newSyncModeTestBackend(b, dir, mode)
+			defer impl.Cleanup()
+
+			var emptyRoot hash.Hash
+			emptyRoot.Empty()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err = impl.Apply(ctx, &api.ApplyRequest{
+					Namespace: testNs,
+					RootType:  api.RootTypeState,
+					SrcRound:  uint64(i),
+					SrcRoot:   emptyRoot,
+					DstRound:  uint64(i),
+					DstRoot:   dstRoot,
+					WriteLog:  wl,
+				})
+				require.NoError(b, err, "Apply()")
+			}
+		})
+	}
+}
+
+func TestValueValidator(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	testNs := common.NewTestNamespaceFromSeed([]byte("database backend test ns"), 0)
+	errTooLarge := fmt.Errorf("value too large")
+	cfg := api.Config{
+		Backend:      BackendNameBadgerDB,
+		DB:           filepath.Join(t.TempDir(), DefaultFileName(BackendNameBadgerDB)),
+		Namespace:    testNs,
+		MaxCacheSize: 16 * 1024 * 1024,
+		NoFsync:      true,
+		ValueValidator: func(key, value []byte) error {
+			// Require non-empty values of limited size under the "small/" prefix.
+			if bytes.HasPrefix(key, []byte("small/")) && (len(value) == 0 || len(value) > 4) {
+				return errTooLarge
+			}
+			return nil
+		},
+	}
+	impl, err := New(&cfg)
+	require.NoError(err, "New()")
+	defer impl.Cleanup()
+
+	var emptyRoot hash.Hash
+	emptyRoot.Empty()
+	apply := func(wl api.WriteLog) (api.Root, error) {
+		// Removals of missing keys do not change the root.
+		var inserts api.WriteLog
+		for _, entry := range wl {
+			if entry.Value != nil {
+				inserts = append(inserts, entry)
+			}
+		}
+		dstRoot := tests.CalculateExpectedNewRoot(t, inserts, testNs, 0)
+		root := api.Root{Namespace: testNs, Version: 0, Type: api.RootTypeState, Hash: dstRoot}
+		return root, impl.Apply(ctx, &api.ApplyRequest{
+			Namespace: testNs,
+			RootType:  api.RootTypeState,
+			SrcRound:  0,
+			SrcRoot:   emptyRoot,
+			DstRound:  0,
+			DstRoot:   dstRoot,
+			WriteLog:  wl,
+		})
+	}
+
+	// A single invalid entry should reject the whole write log.
+	root, err := apply(api.WriteLog{
+		{Key: []byte("large/a"), Value: []byte("large value")},
+		{Key: []byte("small/a"), Value: []byte("ok")},
+		{Key: []byte("small/b"), Value: []byte("too large")},
+	})
+	require.ErrorIs(err, api.ErrValueRejected, "Apply() should reject invalid values")
+	require.ErrorIs(err, errTooLarge, "Apply() should report the validator error")
+	require.Contains(err.Error(), fmt.Sprintf("%X", []byte("small/b")), "error should name the rejected key")
+	require.False(impl.NodeDB().HasRoot(root), "nothing should be applied")
+
+	// Valid write logs and removals should be applied.
+	root, err = apply(api.WriteLog{
+		{Key: []byte("large/a"), Value: []byte("large value")},
+		{Key: []byte("small/a"), Value: []byte("ok")},
+		{Key: []byte("small/c"), Value: nil},
+	})
+	require.NoError(err, "Apply()")
+	require.True(impl.NodeDB().HasRoot(root), "valid write log should be applied")
+}
+
+func TestHotKeys(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	testNs := common.NewTestNamespaceFromSeed([]byte("database backend test ns"), 0)
+	cfg := api.Config{
+		Backend:              BackendNameBadgerDB,
+		DB:                   filepath.Join(t.TempDir(), DefaultFileName(BackendNameBadgerDB)),
+		Namespace:            testNs,
+		MaxCacheSize:         16 * 1024 * 1024,
+		NoFsync:              true,
+		HotKeyReportInterval: time.Hour,
+		HotKeyWindow:         time.Hour,
+		HotKeySampleRate:     1,
+		HotKeyCapacity:       16,
+		HotKeyTopN:           10,
+	}
+	impl, err := New(&cfg)
+	require.NoError(err, "New()")
+	defer impl.Cleanup()
+
+	wl := api.WriteLog{
+		{Key: []byte("hot"), Value: []byte("value")},
+		{Key: []byte("cold"), Value: []byte("value")},
+	}
+	var emptyRoot hash.Hash
+	emptyRoot.Empty()
+	dstRoot := tests.CalculateExpectedNewRoot(t, wl, testNs, 0)
+	err = impl.Apply(ctx, &api.ApplyRequest{
+		Namespace: testNs,
+		RootType:  api.RootTypeState,
+		SrcRound:  0,
+		SrcRoot:   emptyRoot,
+		DstRound:  0,
+		DstRoot:   dstRoot,
+		WriteLog:  wl,
+	})
+	require.NoError(err, "Apply()")
+
+	// Each request uses a separate tree, so accesses must be tracked across trees.
+	root := api.Root{Namespace: testNs, Version: 0, Type: api.RootTypeState, Hash: dstRoot}
+	for i, key := range [][]byte{[]byte("hot"), []byte("hot"), []byte("cold")} {
+		_, err = impl.SyncGet(ctx, &api.GetRequest{
+			Tree: api.TreeID{Root: root, Position: dstRoot},
+			Key:  key,
+		})
+		require.NoError(err, "SyncGet(%d)", i)
+	}
+
+	hot := impl.(*databaseBackend).hotKeys.Top(1)
+	require.Len(hot, 1)
+	require.EqualValues([]byte("hot"), hot[0].Key, "most accessed key should be reported")
+	require.EqualValues(2, hot[0].Accesses)
+}
@@ -0,0 +1,72 @@
+package mkvs
+
+import (
+	"context"
+
+	"github.com/oasisprotocol/oasis-core/go/common/crypto/hash"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/syncer"
+)
+
+// ReadAmplification is the cost of a sequence of key lookups in terms of node dereferences.
+type ReadAmplification struct {
+	// Keys is the number of looked up keys.
+	Keys uint64 `json:"keys"`
+	// Derefs is the total number of node dereferences performed by the lookups.
+	Derefs uint64 `json:"derefs"`
+	// UniqueNodes is the number of distinct nodes dereferenced by the lookups.
+	UniqueNodes uint64 `json:"unique_nodes"`
+	// Misses is the number of dereferences that required loading the node from the node
+	// database or the remote syncer.
+	Misses uint64 `json:"misses"`
+}
+
+// Ratio returns the average number of node dereferences per looked up key.
+func (a *ReadAmplification) Ratio() float64 {
+	if a.Keys == 0 {
+		return 0
+	}
+	return float64(a.Derefs) / float64(a.Keys)
+}
+
+// Implements Tree.
+func (t *tree) MeasureReadAmplification(ctx context.Context, root node.Root, keys []node.Key) (*ReadAmplification, error) {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return nil, ErrClosed
+	}
+	if !root.Equal(&t.cache.syncRoot) {
+		return nil, syncer.ErrInvalidRoot
+	}
+	if !t.cache.pendingRoot.IsClean() {
+		return nil, syncer.ErrDirtyRoot
+	}
+
+	amp := ReadAmplification{
+		Keys: uint64(len(keys)),
+	}
+	unique := make(map[hash.Hash]struct{})
+	t.cache.derefObserver = func(ptr *node.Pointer) {
+		amp.Derefs++
+		unique[ptr.Hash] = struct{}{}
+	}
+	defer func() {
+		t.cache.derefObserver = nil
+	}()
+	startMisses := t.cache.misses
+
+	for _, key := range keys {
+		// Remember where the path from root to target node ends (will end).
+		t.cache.markPosition()
+
+		if _, err := t.doGet(ctx, t.cache.pendingRoot, 0, key, doGetOptions{}, false); err != nil {
+			return nil, err
+		}
+	}
+
+	amp.UniqueNodes = uint64(len(unique))
+	amp.Misses = t.cache.misses - startMisses
+	return &amp, nil
+}
@@ -1,11 +1,11 @@
 package mkvs
 
 import (
-	"container/list"
 	"context"
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/oasisprotocol/oasis-core/go/common/crypto/hash"
 	db "github.com/oasisprotocol/oasis-core/go/storage/mkvs/db/api"
@@ -15,6 +15,33 @@ import (
 
 var errRemoveLocked = errors.New("mkvs: tried to remove locked pointer")
 
+// CacheStats are the statistics of the in-memory tree cache.
+type CacheStats struct {
+	// Hits is the number of node dereferences served from memory.
+	Hits uint64 `json:"hits"`
+	// Misses is the number of node dereferences that required loading the node from the
+	// node database or the remote syncer.
+	Misses uint64 `json:"misses"`
+	// RemoteFetches is the number of requests made to the remote syncer.
+	RemoteFetches uint64 `json:"remote_fetches"`
+
+	// InternalNodes is the number of internal nodes currently held in the cache. It is not set
+	// for statistics accumulated while serving a single operation.
+	InternalNodes uint64 `json:"internal_nodes,omitempty"`
+	// ValueSize is the total size of values currently held in the cache. It is not set for
+	// statistics accumulated while serving a single operation.
+	ValueSize uint64 `json:"value_size,omitempty"`
+}
+
+// HitRate returns the fraction of node dereferences served from memory.
+func (s CacheStats) HitRate() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
 // cache handles the in-memory tree cache.
 type cache struct {
 	sync.Mutex
@@ -41,10 +68,38 @@ type cache struct {
 	// Maximum capacity of leaf values.
 	valueCapacity uint64
 
-	lruInternal    *list.List
-	lruInternalPos *list.Element
-	lruLeaf        *list.List
-	lruLeafPos     *list.Element
+	// newEvictionPolicy creates the eviction policies for internal and leaf nodes.
+	newEvictionPolicy EvictionPolicyFactory
+	internalPolicy    EvictionPolicy
+	leafPolicy        EvictionPolicy
+
+	// Number of node dereferences served from memory and from the node
+	// database or the remote syncer.
+	hits          uint64
+	misses        uint64
+	remoteFetches uint64
+
+	// derefObserver is called for each node pointer dereference if set.
+	derefObserver func(ptr *node.Pointer)
+
+	// generation is incremented whenever the pending root changes, invalidating any node
+	// pointers held across operations. Evicted nodes do not change the generation, holders of
+	// pointers need to check whether the pointed-to nodes are still cached instead.
+	generation uint64
+
+	// nodeLoadTimeout is the maximum time a single node load from the node
+	// database or the remote syncer may take. Zero means no limit.
+	nodeLoadTimeout time.Duration
+	// hungLoad is the last node database load which has been given up on while it may still be
+	// in progress.
+	hungLoad *nodeLoad
+
+	// onWriteValue is the optional transform applied to leaf values before
+	// they are stored in the node database.
+	onWriteValue ValueTransformFunc
+	// onReadValue is the optional transform applied to leaf values after
+	// they are fetched from the node database.
+	onReadValue ValueTransformFunc
 }
 
 // MaxPrefetchDepth is the maximum depth of the prefeteched tree.
@@ -52,12 +107,13 @@ const MaxPrefetchDepth = 255
 
 func newCache(ndb db.NodeDB, rs syncer.ReadSyncer, rootType node.RootType) *cache {
 	c := &cache{
-		db:            ndb,
-		rs:            rs,
-		lruInternal:   list.New(),
-		lruLeaf:       list.New(),
-		valueCapacity: 16 * 1024 * 1024,
-		nodeCapacity:  5000,
+		db:                ndb,
+		rs:                rs,
+		newEvictionPolicy: NewLRUPolicy,
+		internalPolicy:    NewLRUPolicy(),
+		leafPolicy:        NewLRUPolicy(),
+		valueCapacity:     16 * 1024 * 1024,
+		nodeCapacity:      5000,
 	}
 	// By default the sync root is an empty root.
 	c.syncRoot.Empty()
@@ -71,10 +127,9 @@ func (c *cache) close() {
 	c.db = nil
 	c.rs = nil
 	c.pendingRoot = nil
-	c.lruInternal = nil
-	c.lruInternalPos = nil
-	c.lruLeaf = nil
-	c.lruLeafPos = nil
+	c.generation++
+	c.internalPolicy = nil
+	c.leafPolicy = nil
 
 	// Reset sync root.
 	c.syncRoot = node.Root{}
@@ -98,6 +153,7 @@ func (c *cache) setSyncRoot(root node.Root) {
 
 func (c *cache) setPendingRoot(ptr *node.Pointer) {
 	c.pendingRoot = ptr
+	c.generation++
 }
 
 func (c *cache) newLeafNodePtr(n *node.LeafNode) *node.Pointer {
@@ -129,28 +185,28 @@ func (c *cache) newInternalNode(label node.Key, labelBitLength node.Depth, leafN
 	})
 }
 
-// useNode moves the node to the front of the LRU list.
+// useNode records an access to the node in the eviction policy.
 func (c *cache) useNode(ptr *node.Pointer) {
 	if ptr.LRU == nil {
 		return
 	}
 	switch ptr.Node.(type) {
 	case *node.InternalNode:
-		c.lruInternal.MoveToFront(ptr.LRU)
+		c.internalPolicy.Use(ptr)
 	case *node.LeafNode:
-		c.lruLeaf.MoveToFront(ptr.LRU)
+		c.leafPolicy.Use(ptr)
 	}
 }
 
-// markPosition marks the current LRU queue positions as the ones before
-// any nodes are visited. Any new nodes committed into the cache after
-// this is called will be inserted after the marked position.
+// markPosition marks the start of an operation in the eviction policies
+// before any nodes are visited. Any nodes committed into the cache or used
+// after this is called will be evicted only after all other nodes.
 //
 // This makes it possible to keep the path from the root to the derefed
 // node in the cache instead of evicting it.
 func (c *cache) markPosition() {
-	c.lruInternalPos = c.lruInternal.Front()
-	c.lruLeafPos = c.lruLeaf.Front()
+	c.internalPolicy.Mark()
+	c.leafPolicy.Mark()
 }
 
 func (c *cache) tryCommitNode(ptr, lockedPtr *node.Pointer) error {
@@ -174,11 +230,7 @@ func (c *cache) tryCommitNode(ptr, lockedPtr *node.Pointer) error {
 			}
 		}
 
-		if c.lruInternalPos != nil {
-			ptr.LRU = c.lruInternal.InsertAfter(ptr, c.lruInternalPos)
-		} else {
-			ptr.LRU = c.lruInternal.PushFront(ptr)
-		}
+		c.internalPolicy.Add(ptr)
 		c.internalNodeCount++
 	case *node.LeafNode:
 		valueSize := n.Size()
@@ -189,11 +241,7 @@ func (c *cache) tryCommitNode(ptr, lockedPtr *node.Pointer) error {
 			}
 		}
 
-		if c.lruLeafPos != nil {
-			ptr.LRU = c.lruLeaf.InsertAfter(ptr, c.lruLeafPos)
-		} else {
-			ptr.LRU = c.lruLeaf.PushFront(ptr)
-		}
+		c.leafPolicy.Add(ptr)
 		c.valueSize += valueSize
 	}
 	return nil
@@ -214,16 +262,10 @@ func (c *cache) rollbackNode(ptr *node.Pointer) {
 
 	switch n := ptr.Node.(type) {
 	case *node.InternalNode:
-		if c.lruInternalPos == ptr.LRU {
-			c.lruInternalPos = nil
-		}
-		c.lruInternal.Remove(ptr.LRU)
+		c.internalPolicy.Remove(ptr)
 		c.internalNodeCount--
 	case *node.LeafNode:
-		if c.lruLeafPos == ptr.LRU {
-			c.lruLeafPos = nil
-		}
-		c.lruLeaf.Remove(ptr.LRU)
+		c.leafPolicy.Remove(ptr)
 		c.valueSize -= n.Size()
 	}
 
@@ -261,16 +303,10 @@ func (c *cache) tryRemoveNode(ptr, lockedPtr *node.Pointer) error {
 			n.Right = nil
 		}
 
-		if c.lruInternalPos == ptr.LRU {
-			c.lruInternalPos = nil
-		}
-		c.lruInternal.Remove(ptr.LRU)
+		c.internalPolicy.Remove(ptr)
 		c.internalNodeCount--
 	case *node.LeafNode:
-		if c.lruLeafPos == ptr.LRU {
-			c.lruLeafPos = nil
-		}
-		c.lruLeaf.Remove(ptr.LRU)
+		c.leafPolicy.Remove(ptr)
 		c.valueSize -= n.Size()
 	}
 
@@ -286,9 +322,8 @@ func (c *cache) removeNode(ptr *node.Pointer) {
 
 // tryEvictLeaf tries to evict leaf nodes from the cache.
 func (c *cache) tryEvictLeaf(targetCapacity uint64, lockedPtr *node.Pointer) error {
-	for c.lruLeaf.Len() > 0 && c.valueSize+targetCapacity > c.valueCapacity {
-		elem := c.lruLeaf.Back()
-		n := elem.Value.(*node.Pointer)
+	for c.leafPolicy.Len() > 0 && c.valueSize+targetCapacity > c.valueCapacity {
+		n := c.leafPolicy.Victim()
 		if !n.Clean {
 			panic(fmt.Errorf("mkvs: tried to evict dirty node %v", n))
 		}
@@ -301,9 +336,8 @@ func (c *cache) tryEvictLeaf(targetCapacity uint64, lockedPtr *node.Pointer) err
 
 // tryEvictInternal tries to evict internal nodes from the cache.
 func (c *cache) tryEvictInternal(targetCapacity uint64, lockedPtr *node.Pointer) error {
-	for c.lruInternal.Len() > 0 && c.internalNodeCount+targetCapacity > c.nodeCapacity {
-		elem := c.lruInternal.Back()
-		n := elem.Value.(*node.Pointer)
+	for c.internalPolicy.Len() > 0 && c.internalNodeCount+targetCapacity > c.nodeCapacity {
+		n := c.internalPolicy.Victim()
 		if !n.Clean {
 			panic(fmt.Errorf("mkvs: tried to evict dirty node %v", n))
 		}
@@ -330,6 +364,9 @@ func (c *cache) derefNodePtr(
 	if ptr == nil {
 		return nil, nil
 	}
+	if c.derefObserver != nil {
+		c.derefObserver(ptr)
+	}
 
 	c.useNode(ptr)
 
@@ -346,6 +383,7 @@ func (c *cache) derefNodePtr(
 		}
 
 		if !refetch {
+			c.hits++
 			return ptr.Node, nil
 		}
 	}
@@ -353,11 +391,15 @@ func (c *cache) derefNodePtr(
 	if !ptr.Clean || ptr.Hash.IsEmpty() {
 		return nil, nil
 	}
+	c.misses++
 
 	// First, attempt to fetch from the local node database.
-	n, err := c.db.GetNode(c.syncRoot, ptr)
+	n, err := c.getNodeFromDb(ctx, ptr)
 	switch err {
 	case nil:
+		if err = c.transformNodeFromDb(ptr, n); err != nil {
+			return nil, err
+		}
 		ptr.Node = n
 		// Commit node to cache.
 		c.commitNode(ptr)
@@ -381,10 +423,91 @@ func (c *cache) derefNodePtr(
 	return ptr.Node, nil
 }
 
+// nodeLoad is a node database load performed with a node load timeout. As a hung node
+// database read cannot be aborted, the load may outlive the operation which started it.
+type nodeLoad struct {
+	hash hash.Hash
+	done chan struct{}
+
+	// ptr is a separate pointer used for the load as the node database may update it.
+	ptr *node.Pointer
+	n   node.Node
+	err error
+}
+
+// result returns the result of a finished load, updating the given pointer.
+func (l *nodeLoad) result(ptr *node.Pointer) (node.Node, error) {
+	if l.err == nil {
+		ptr.DBInternal = l.ptr.DBInternal
+	}
+	return l.n, l.err
+}
+
+// getNodeFromDb fetches the node referenced by the given pointer from the local node database,
+// respecting the configured node load timeout.
+func (c *cache) getNodeFromDb(ctx context.Context, ptr *node.Pointer) (node.Node, error) {
+	if c.nodeLoadTimeout == 0 {
+		return c.db.GetNode(c.syncRoot, ptr)
+	}
+
+	timer := time.NewTimer(c.nodeLoadTimeout)
+	defer timer.Stop()
+
+	// Only allow a single load in flight so that hung node database reads do not pile up. In
+	// case a previous load timed out, wait for it to finish before starting a new one.
+	if load := c.hungLoad; load != nil {
+		select {
+		case <-load.done:
+			c.hungLoad = nil
+			if load.hash.Equal(&ptr.Hash) {
+				// The previous load was for the same node, so its result can be used.
+				return load.result(ptr)
+			}
+		case <-timer.C:
+			return nil, syncer.ErrStorageTimeout
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	ndb, root := c.db, c.syncRoot
+	load := &nodeLoad{
+		hash: ptr.Hash,
+		done: make(chan struct{}),
+		ptr:  &node.Pointer{Clean: true, Hash: ptr.Hash, DBInternal: ptr.DBInternal},
+	}
+	go func() {
+		load.n, load.err = ndb.GetNode(root, load.ptr)
+		close(load.done)
+	}()
+
+	select {
+	case <-load.done:
+		return load.result(ptr)
+	case <-timer.C:
+		c.hungLoad = load
+		return nil, syncer.ErrStorageTimeout
+	case <-ctx.Done():
+		c.hungLoad = load
+		return nil, ctx.Err()
+	}
+}
+
 // remoteSync performs a remote sync with the configured remote syncer.
 func (c *cache) remoteSync(ctx context.Context, ptr *node.Pointer, fetcher readSyncFetcher) error {
-	proof, err := fetcher(ctx, ptr, c.rs)
+	fetchCtx := ctx
+	if c.nodeLoadTimeout > 0 {
+		var cancel context.CancelFunc
+		fetchCtx, cancel = context.WithTimeout(ctx, c.nodeLoadTimeout)
+		defer cancel()
+	}
+
+	c.remoteFetches++
+	proof, err := fetcher(fetchCtx, ptr, c.rs)
 	if err != nil {
+		if ctx.Err() == nil && fetchCtx.Err() == context.DeadlineExceeded {
+			return syncer.ErrStorageTimeout
+		}
 		return err
 	}
 
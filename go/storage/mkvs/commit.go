@@ -1,7 +1,10 @@
 package mkvs
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 
 	"github.com/oasisprotocol/oasis-core/go/common"
 	"github.com/oasisprotocol/oasis-core/go/common/crypto/hash"
@@ -10,6 +13,10 @@ import (
 	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/writelog"
 )
 
+// errPartialCommitWithoutWriteLog is the error returned by CommitPrefix when the tree does
+// not track a write log.
+var errPartialCommitWithoutWriteLog = errors.New("mkvs: partial commit requires a write log")
+
 // CommitOption is an option that can be specified during Commit.
 type CommitOption func(o *commitOptions)
 
@@ -21,8 +28,23 @@ func NoPersist() CommitOption {
 	}
 }
 
+// WithSummary returns a commit option that makes the Commit also store a summary of the new
+// root in the node database, so that RootInfo for the committed root returns without walking
+// the tree.
+//
+// The summary is derived from the summary of the parent root and the nodes created and removed
+// by the pending updates. In case the parent root has no summary, the summary is computed by
+// walking the whole tree once, including any clean subtrees which may need to be fetched from
+// the node database.
+func WithSummary() CommitOption {
+	return func(o *commitOptions) {
+		o.summary = true
+	}
+}
+
 type commitOptions struct {
 	noPersist bool
+	summary   bool
 }
 
 // Implements Tree.
@@ -42,6 +64,46 @@ func (t *tree) Commit(ctx context.Context, namespace common.Namespace, version u
 	return t.commitWithHooks(ctx, namespace, version, nil, options...)
 }
 
+// Implements Tree.
+func (t *tree) PendingRootHash() (hash.Hash, bool) {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.pendingRoot.IsClean() {
+		return t.cache.pendingRoot.GetHash(), true
+	}
+	return updatePendingHash(t.cache.pendingRoot), false
+}
+
+// updatePendingHash recomputes the hashes of all dirty nodes in the subtree rooted at ptr
+// without committing them and returns the resulting hash of the subtree.
+func updatePendingHash(ptr *node.Pointer) hash.Hash {
+	switch {
+	case ptr == nil:
+		var h hash.Hash
+		h.Empty()
+		return h
+	case ptr.Clean:
+		return ptr.Hash
+	}
+
+	switch n := ptr.Node.(type) {
+	case nil:
+		// Dead node.
+		ptr.Hash.Empty()
+	case *node.InternalNode:
+		for _, child := range []*node.Pointer{n.LeafNode, n.Left, n.Right} {
+			updatePendingHash(child)
+		}
+		n.UpdateHash()
+		ptr.Hash = n.Hash
+	case *node.LeafNode:
+		n.UpdateHash()
+		ptr.Hash = n.Hash
+	}
+	return ptr.Hash
+}
+
 func (t *tree) commitWithHooks(
 	ctx context.Context,
 	namespace common.Namespace,
@@ -61,6 +123,19 @@ func (t *tree) commitWithHooks(
 		o(&opts)
 	}
 
+	return t.commitLocked(ctx, namespace, version, beforeDbCommit, &opts)
+}
+
+// commitLocked commits the pending updates and returns the write log and the new root hash.
+//
+// Must be called while holding the cache lock.
+func (t *tree) commitLocked(
+	ctx context.Context,
+	namespace common.Namespace,
+	version uint64,
+	beforeDbCommit func(hash.Hash) error,
+	opts *commitOptions,
+) (writelog.WriteLog, hash.Hash, error) {
 	oldRoot := t.cache.getSyncRoot()
 	if oldRoot.IsEmpty() {
 		oldRoot.Namespace = namespace
@@ -137,6 +212,17 @@ func (t *tree) commitWithHooks(
 		return nil, hash.Hash{}, err
 	}
 
+	// Store the summary of the new root.
+	if opts.summary {
+		summary, err := t.pendingRootSummary(ctx, oldRoot, root)
+		if err != nil {
+			return nil, hash.Hash{}, err
+		}
+		if err = batch.PutRootSummary(summary); err != nil {
+			return nil, hash.Hash{}, err
+		}
+	}
+
 	// And finally commit to the database.
 	if err := batch.Commit(root); err != nil {
 		return nil, hash.Hash{}, err
@@ -144,6 +230,9 @@ func (t *tree) commitWithHooks(
 
 	t.pendingWriteLog = make(map[string]*pendingEntry)
 	t.pendingRemovedNodes = nil
+	t.pendingUndo = nil
+	t.pendingSummary = summaryDelta{}
+	t.committedRoot = t.cache.pendingRoot
 	t.cache.setSyncRoot(root)
 
 	return log, rootHash, nil
@@ -213,7 +302,7 @@ func doCommit(
 		n.UpdateHash()
 
 		// Store the node.
-		if err = subtree.PutNode(depth, ptr); err != nil {
+		if err = cache.putNode(subtree, depth, ptr); err != nil {
 			return
 		}
 
@@ -234,7 +323,7 @@ func doCommit(
 		n.UpdateHash()
 
 		// Store the node.
-		if err = subtree.PutNode(depth, ptr); err != nil {
+		if err = cache.putNode(subtree, depth, ptr); err != nil {
 			return
 		}
 
@@ -252,3 +341,72 @@ func doCommit(
 	h = ptr.Hash
 	return
 }
+
+// Implements Tree.
+func (t *tree) CommitPrefix(ctx context.Context, prefix node.Key, namespace common.Namespace, version uint64) (node.Root, error) {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return node.Root{}, ErrClosed
+	}
+	if t.withoutWriteLog {
+		return node.Root{}, errPartialCommitWithoutWriteLog
+	}
+
+	// Split pending updates into the committed and the remaining ones.
+	var committed, remaining writelog.WriteLog
+	for _, entry := range t.pendingWriteLog {
+		le := writelog.LogEntry{Key: entry.key, Value: entry.value}
+		if bytes.HasPrefix(entry.key, prefix) {
+			committed = append(committed, le)
+		} else {
+			remaining = append(remaining, le)
+		}
+	}
+
+	// Roll back to the last committed root, commit the updates under the prefix and then
+	// re-apply the remaining updates on top of the new root. The deep leaf hook has already been
+	// called for all pending updates, so it is not called again.
+	t.doRollback()
+	rootHash, err := t.commitPrefixLocked(ctx, committed, namespace, version)
+	if err != nil {
+		// Restore all pending updates on top of the last committed root.
+		t.doRollback()
+		if rerr := t.applyLocked(ctx, append(committed, remaining...), false); rerr != nil {
+			t.doRollback()
+			return node.Root{}, fmt.Errorf("%w (failed to restore pending updates: %v)", err, rerr)
+		}
+		return node.Root{}, err
+	}
+	if err = t.applyLocked(ctx, remaining, false); err != nil {
+		// The updates under the prefix have been committed, discard the remaining ones so that
+		// the tree is left at the new root.
+		t.doRollback()
+		return node.Root{}, fmt.Errorf("mkvs: failed to re-apply remaining updates: %w", err)
+	}
+
+	return node.Root{
+		Namespace: namespace,
+		Version:   version,
+		Type:      t.rootType,
+		Hash:      rootHash,
+	}, nil
+}
+
+// commitPrefixLocked applies the given updates on top of the last committed root and commits
+// them.
+//
+// Must be called while holding the cache lock.
+func (t *tree) commitPrefixLocked(
+	ctx context.Context,
+	committed writelog.WriteLog,
+	namespace common.Namespace,
+	version uint64,
+) (hash.Hash, error) {
+	if err := t.applyLocked(ctx, committed, false); err != nil {
+		return hash.Hash{}, err
+	}
+	_, rootHash, err := t.commitLocked(ctx, namespace, version, nil, &commitOptions{})
+	return rootHash, err
+}
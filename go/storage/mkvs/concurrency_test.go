@@ -0,0 +1,482 @@
+package mkvs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/oasisprotocol/oasis-core/go/common"
+	db "github.com/oasisprotocol/oasis-core/go/storage/mkvs/db/api"
+	badgerDb "github.com/oasisprotocol/oasis-core/go/storage/mkvs/db/badger"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/syncer"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/writelog"
+)
+
+const (
+	concurrencyGoroutines = 8
+	concurrencyIterations = 10
+)
+
+// runConcurrently runs each of the given functions in concurrencyGoroutines goroutines, each
+// calling the function concurrencyIterations times, and waits for all of them to finish.
+func runConcurrently(t *testing.T, fns map[string]func() error) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for name, fn := range fns {
+		for i := 0; i < concurrencyGoroutines; i++ {
+			wg.Add(1)
+			go func(name string, fn func() error) {
+				defer wg.Done()
+				for j := 0; j < concurrencyIterations; j++ {
+					if err := fn(); err != nil {
+						t.Errorf("%s: %v", name, err)
+						return
+					}
+				}
+			}(name, fn)
+		}
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Minute):
+		t.Fatal("concurrent operations did not finish (deadlock?)")
+	}
+}
+
+// expectValue returns an error in case the value differs from the expected one.
+func expectValue(key, value, expected []byte) error {
+	if !bytes.Equal(value, expected) {
+		return fmt.Errorf("inconsistent value for key %s: %q (expected %q)", key, value, expected)
+	}
+	return nil
+}
+
+func TestConcurrentReads(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	var ns common.Namespace
+	keys, values := generateKeyValuePairsEx("", 100)
+	source := New(nil, nil, node.RootTypeState, WithHotKeyTracking(time.Minute, 1, 0))
+	defer source.Close()
+	for i, key := range keys {
+		err := source.Insert(ctx, key, values[i])
+		require.NoError(err, "Insert")
+	}
+	_, rootHash, err := source.Commit(ctx, ns, 0)
+	require.NoError(err, "Commit")
+	root := node.Root{Namespace: ns, Version: 0, Type: node.RootTypeState, Hash: rootHash}
+
+	// The remote tree has a small cache, so nodes get evicted and fetched again concurrently.
+	remote := NewWithRoot(source, nil, root, Capacity(50, 1024))
+	defer remote.Close()
+
+	var verifier syncer.ProofVerifier
+	for name, tree := range map[string]Tree{"local": source, "remote": remote} {
+		t.Run(name, func(t *testing.T) {
+			var counter uint64
+			var counterLock sync.Mutex
+			nextKey := func() int {
+				counterLock.Lock()
+				defer counterLock.Unlock()
+				counter++
+				return int(counter % uint64(len(keys)))
+			}
+
+			fns := map[string]func() error{
+				"Get": func() error {
+					i := nextKey()
+					value, err := tree.Get(ctx, keys[i])
+					if err != nil {
+						return err
+					}
+					return expectValue(keys[i], value, values[i])
+				},
+				"GetPreview": func() error {
+					i := nextKey()
+					preview, err := tree.GetPreview(ctx, keys[i], 4)
+					if err != nil {
+						return err
+					}
+					return expectValue(keys[i], preview.Value, values[i][:4])
+				},
+				"KeyDepth": func() error {
+					i := nextKey()
+					_, exists, err := tree.KeyDepth(ctx, root, keys[i])
+					if err != nil {
+						return err
+					}
+					if !exists {
+						return fmt.Errorf("key %s should exist", keys[i])
+					}
+					return nil
+				},
+				"LongestPrefixMatch": func() error {
+					i := nextKey()
+					key := append(append(node.Key{}, keys[i]...), 'x')
+					matched, value, found, err := tree.LongestPrefixMatch(ctx, root, key)
+					if err != nil {
+						return err
+					}
+					if !found || !matched.Equal(keys[i]) {
+						return fmt.Errorf("key %s should be the longest prefix match", keys[i])
+					}
+					return expectValue(keys[i], value, values[i])
+				},
+				"SyncGet": func() error {
+					i := nextKey()
+					rsp, err := tree.SyncGet(ctx, &syncer.GetRequest{
+						Tree: syncer.TreeID{Root: root, Position: rootHash},
+						Key:  keys[i],
+					})
+					if err != nil {
+						return err
+					}
+					return verifier.VerifyMultiproof(ctx, rootHash, map[string][]byte{string(keys[i]): values[i]}, &rsp.Proof)
+				},
+				"SyncGetPrefixes": func() error {
+					_, err := tree.SyncGetPrefixes(ctx, &syncer.GetPrefixesRequest{
+						Tree:     syncer.TreeID{Root: root, Position: rootHash},
+						Prefixes: [][]byte{[]byte("key 1")},
+						Limit:    10,
+					})
+					return err
+				},
+				"SyncIterate": func() error {
+					i := nextKey()
+					_, err := tree.SyncIterate(ctx, &syncer.IterateRequest{
+						Tree:     syncer.TreeID{Root: root, Position: rootHash},
+						Key:      keys[i],
+						Prefetch: 5,
+					})
+					return err
+				},
+				"GetMultiproof": func() error {
+					i, j := nextKey(), nextKey()
+					proof, err := tree.GetMultiproof(ctx, root, [][]byte{keys[i], keys[j]}, 1)
+					if err != nil {
+						return err
+					}
+					return verifier.VerifyMultiproof(ctx, rootHash, map[string][]byte{
+						string(keys[i]): values[i],
+						string(keys[j]): values[j],
+					}, proof)
+				},
+				"GetNodes": func() error {
+					// Keys below 10 are prefixes of other keys, so their identifiers refer to
+					// internal nodes.
+					i := 10 + nextKey()%(len(keys)-10)
+					nodes, errs, err := tree.GetNodes(ctx, root, []SubtreeID{
+						{Path: keys[i], BitDepth: node.Key(keys[i]).BitLength()},
+					})
+					if err != nil {
+						return err
+					}
+					if errs[0] != nil {
+						return errs[0]
+					}
+					leaf, ok := nodes[0].(*node.LeafNode)
+					if !ok {
+						return fmt.Errorf("leaf node expected for key %s", keys[i])
+					}
+					return expectValue(keys[i], leaf.Value, values[i])
+				},
+				"GetLeafWithSiblings": func() error {
+					i := nextKey()
+					kit, err := tree.GetLeafWithSiblings(ctx, root, keys[i])
+					if err != nil {
+						return err
+					}
+					return expectValue(keys[i], kit.Leaf.Value, values[i])
+				},
+				"Iterator": func() error {
+					it := tree.NewIterator(ctx)
+					defer it.Close()
+
+					var count int
+					for it.Rewind(); it.Valid(); it.Next() {
+						count++
+					}
+					if it.Err() != nil {
+						return it.Err()
+					}
+					if count != len(keys) {
+						return fmt.Errorf("iterator returned %d keys (expected %d)", count, len(keys))
+					}
+					return nil
+				},
+				"ExportKV": func() error {
+					return tree.ExportKV(ctx, root, func(key node.Key, value []byte) error {
+						return nil
+					})
+				},
+				"CacheStats": func() error {
+					_ = tree.CacheStats()
+					return nil
+				},
+				"HotKeys": func() error {
+					_ = tree.HotKeys(5)
+					return nil
+				},
+				"PendingRootHash": func() error {
+					pending, ok := tree.PendingRootHash()
+					if !ok || !pending.Equal(&rootHash) {
+						return fmt.Errorf("unexpected pending root hash %s", pending)
+					}
+					return nil
+				},
+				"DumpLocal": func() error {
+					tree.DumpLocal(ctx, io.Discard, 2)
+					return nil
+				},
+			}
+			// Walks of remote trees need enough cache capacity to keep the walked nodes, so
+			// only walk the local tree.
+			if tree == source {
+				fns["SampleKeys"] = func() error {
+					sample, err := tree.SampleKeys(ctx, root, 5, 42)
+					if err != nil {
+						return err
+					}
+					if len(sample) != 5 {
+						return fmt.Errorf("sample contains %d keys (expected 5)", len(sample))
+					}
+					return nil
+				}
+				fns["StreamMultiproof"] = func() error {
+					i, j := nextKey(), nextKey()
+					sv, err := syncer.NewProofStreamVerifier(rootHash, 1)
+					if err != nil {
+						return err
+					}
+					if err = tree.StreamMultiproof(ctx, root, [][]byte{keys[i], keys[j]}, 1, sv.Add); err != nil {
+						return err
+					}
+					proof, err := sv.Proof()
+					if err != nil {
+						return err
+					}
+					return verifier.VerifyMultiproof(ctx, rootHash, map[string][]byte{
+						string(keys[i]): values[i],
+						string(keys[j]): values[j],
+					}, proof)
+				}
+				fns["Verify"] = func() error {
+					progress, err := tree.Verify(ctx, root, nil, 0)
+					if err != nil {
+						return err
+					}
+					if progress.VerifiedLeaves != uint64(len(keys)) {
+						return fmt.Errorf("verified %d leaves (expected %d)", progress.VerifiedLeaves, len(keys))
+					}
+					return nil
+				}
+			}
+			runConcurrently(t, fns)
+		})
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	var ns common.Namespace
+	stableKeys, stableValues := generateKeyValuePairsEx("stable ", 50)
+	tree := New(nil, nil, node.RootTypeState)
+	defer tree.Close()
+	for i, key := range stableKeys {
+		err := tree.Insert(ctx, key, stableValues[i])
+		require.NoError(err, "Insert")
+	}
+	_, _, err := tree.Commit(ctx, ns, 0)
+	require.NoError(err, "Commit")
+
+	// Each writer goroutine inserts and then removes its own set of keys, while readers
+	// concurrently observe the keys which are never modified.
+	var (
+		writerLock sync.Mutex
+		writerID   int
+	)
+	runConcurrently(t, map[string]func() error{
+		"InsertRemove": func() error {
+			writerLock.Lock()
+			writerID++
+			prefix := fmt.Sprintf("writer %d ", writerID)
+			writerLock.Unlock()
+
+			keys, values := generateKeyValuePairsEx(prefix, 10)
+			for i, key := range keys {
+				if err := tree.Insert(ctx, key, values[i]); err != nil {
+					return err
+				}
+			}
+			for i, key := range keys {
+				value, err := tree.Get(ctx, key)
+				if err != nil {
+					return err
+				}
+				if err = expectValue(key, value, values[i]); err != nil {
+					return err
+				}
+			}
+			for i, key := range keys[:5] {
+				value, err := tree.RemoveExisting(ctx, key)
+				if err != nil {
+					return err
+				}
+				if err = expectValue(key, value, values[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		"Get": func() error {
+			for i, key := range stableKeys {
+				value, err := tree.Get(ctx, key)
+				if err != nil {
+					return err
+				}
+				if err = expectValue(key, value, stableValues[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		"Iterator": func() error {
+			it := tree.NewIterator(ctx)
+			defer it.Close()
+
+			var count int
+			for it.Seek(node.Key("stable ")); it.Valid() && bytes.HasPrefix(it.Key(), []byte("stable ")); it.Next() {
+				count++
+			}
+			if it.Err() != nil {
+				return it.Err()
+			}
+			if count != len(stableKeys) {
+				return fmt.Errorf("iterator returned %d stable keys (expected %d)", count, len(stableKeys))
+			}
+			return nil
+		},
+		"Commit": func() error {
+			_, _, err := tree.Commit(ctx, ns, 0)
+			return err
+		},
+		"PendingRootHash": func() error {
+			_, _ = tree.PendingRootHash()
+			return nil
+		},
+	})
+
+	// The final state must match the one obtained by applying the same operations sequentially.
+	_, rootHash, err := tree.Commit(ctx, ns, 0)
+	require.NoError(err, "Commit")
+
+	expected := New(nil, nil, node.RootTypeState)
+	defer expected.Close()
+	for i, key := range stableKeys {
+		err = expected.Insert(ctx, key, stableValues[i])
+		require.NoError(err, "Insert")
+	}
+	for id := 1; id <= concurrencyGoroutines*concurrencyIterations; id++ {
+		keys, values := generateKeyValuePairsEx(fmt.Sprintf("writer %d ", id), 10)
+		for i := 5; i < len(keys); i++ {
+			err = expected.Insert(ctx, keys[i], values[i])
+			require.NoError(err, "Insert")
+		}
+	}
+	_, expectedHash, err := expected.Commit(ctx, ns, 0)
+	require.NoError(err, "Commit")
+	require.Equal(expectedHash, rootHash, "concurrent writes should result in the expected root")
+}
+
+func TestConcurrentApplyIf(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	var ns common.Namespace
+	ndb, err := badgerDb.New(&db.Config{
+		MemoryOnly:   true,
+		Namespace:    ns,
+		MaxCacheSize: 16 * 1024 * 1024,
+	})
+	require.NoError(err, "New")
+	defer ndb.Close()
+
+	counterKey := []byte("counter")
+	tree := New(nil, ndb, node.RootTypeState)
+	defer tree.Close()
+	err = tree.Insert(ctx, counterKey, []byte("0"))
+	require.NoError(err, "Insert")
+	// Also require a set of keys which are never modified to hold their values, so that checking
+	// the conditions takes a while.
+	stableKeys, stableValues := generateKeyValuePairsEx("stable ", 50)
+	conditions := make([]KeyValueCond, 0, len(stableKeys)+1)
+	for i, key := range stableKeys {
+		err = tree.Insert(ctx, key, stableValues[i])
+		require.NoError(err, "Insert")
+		conditions = append(conditions, KeyValueCond{Key: key, Value: stableValues[i]})
+	}
+	_, _, err = tree.Commit(ctx, ns, 0)
+	require.NoError(err, "Commit")
+
+	// Each goroutine increments the counter using compare-and-set, retrying whenever another
+	// goroutine got there first. As every successful update also bumps the version, the version
+	// of the current root always matches the counter.
+	runConcurrently(t, map[string]func() error{
+		"Increment": func() error {
+			for {
+				rootHash, _ := tree.PendingRootHash()
+				value, err := tree.Get(ctx, counterKey)
+				if err != nil {
+					return err
+				}
+				counter, err := strconv.ParseUint(string(value), 10, 64)
+				if err != nil {
+					return err
+				}
+
+				root := node.Root{Namespace: ns, Version: counter, Type: node.RootTypeState, Hash: rootHash}
+				_, err = tree.ApplyIf(ctx, root, counter+1,
+					append([]KeyValueCond{{Key: counterKey, Value: value}}, conditions...),
+					writelog.WriteLog{{Key: counterKey, Value: []byte(strconv.FormatUint(counter+1, 10))}},
+				)
+				switch {
+				case err == nil:
+					return nil
+				case errors.Is(err, syncer.ErrConditionFailed), errors.Is(err, syncer.ErrInvalidRoot):
+					// Lost the race, retry.
+				default:
+					return err
+				}
+			}
+		},
+	})
+
+	// No increment may be lost.
+	expected := uint64(concurrencyGoroutines * concurrencyIterations)
+	value, err := tree.Get(ctx, counterKey)
+	require.NoError(err, "Get")
+	require.EqualValues(strconv.FormatUint(expected, 10), string(value), "no increment should be lost")
+
+	rootHash, clean := tree.PendingRootHash()
+	require.True(clean, "tree should not have any pending updates")
+	root := node.Root{Namespace: ns, Version: expected, Type: node.RootTypeState, Hash: rootHash}
+	_, err = tree.RootInfo(ctx, root)
+	require.NoError(err, "RootInfo")
+}
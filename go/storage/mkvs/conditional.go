@@ -0,0 +1,92 @@
+package mkvs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/syncer"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/writelog"
+)
+
+// KeyValueCond is a condition on the value of a key used in conditional writes.
+type KeyValueCond struct {
+	// Key is the key the condition is for.
+	Key []byte `json:"key"`
+	// Value is the value the key is expected to hold. A nil value means that the key is
+	// expected not to exist, while an empty value requires the key to store an empty value.
+	Value []byte `json:"value"`
+}
+
+// holds returns true iff the condition holds for the given current value of the key.
+func (c *KeyValueCond) holds(value []byte) bool {
+	if (c.Value == nil) != (value == nil) {
+		return false
+	}
+	return bytes.Equal(c.Value, value)
+}
+
+// Implements Tree.
+func (t *tree) ApplyIf(
+	ctx context.Context,
+	oldRoot node.Root,
+	version uint64,
+	conditions []KeyValueCond,
+	wl writelog.WriteLog,
+) (node.Root, error) {
+	// Hold the lock for the whole operation so that no other updates can be made between checking
+	// the conditions and committing the new root.
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return node.Root{}, ErrClosed
+	}
+	if !oldRoot.Equal(&t.cache.syncRoot) {
+		return node.Root{}, syncer.ErrInvalidRoot
+	}
+	if !t.cache.pendingRoot.IsClean() || len(t.pendingWriteLog) > 0 {
+		return node.Root{}, syncer.ErrDirtyRoot
+	}
+	for _, entry := range wl {
+		if err := t.checkKeyWidth(entry.Key); err != nil {
+			return node.Root{}, err
+		}
+	}
+
+	// Remember where the path from root to target node ends (will end).
+	t.cache.markPosition()
+
+	for _, cond := range conditions {
+		if err := t.checkKeyWidth(cond.Key); err != nil {
+			return node.Root{}, err
+		}
+		value, err := t.doGet(ctx, t.cache.pendingRoot, 0, cond.Key, doGetOptions{}, false)
+		if err != nil {
+			return node.Root{}, err
+		}
+		if !cond.holds(value) {
+			return node.Root{}, fmt.Errorf("%w: key %s", syncer.ErrConditionFailed, node.Key(cond.Key))
+		}
+	}
+
+	// Apply and commit the updates, rolling them back on failure so that the tree remains at
+	// the old root.
+	if err := t.applyLocked(ctx, wl, true); err != nil {
+		t.doRollback()
+		return node.Root{}, err
+	}
+	_, rootHash, err := t.commitLocked(ctx, oldRoot.Namespace, version, nil, &commitOptions{})
+	if err != nil {
+		t.doRollback()
+		return node.Root{}, err
+	}
+
+	return node.Root{
+		Namespace: oldRoot.Namespace,
+		Version:   version,
+		Type:      oldRoot.Type,
+		Hash:      rootHash,
+	}, nil
+}
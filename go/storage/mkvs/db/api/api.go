@@ -3,6 +3,7 @@ package api
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/oasisprotocol/oasis-core/go/common"
 	"github.com/oasisprotocol/oasis-core/go/common/errors"
@@ -56,6 +57,8 @@ var (
 	// ErrCannotPruneLatestVersion indicates that the caller attempted to prune the latest finalized
 	// version which would leave the database without any finalized versions.
 	ErrCannotPruneLatestVersion = errors.New(ModuleName, 16, "mkvs: cannot prune latest version")
+	// ErrRootSummaryNotFound indicates that no summary is stored for the given root.
+	ErrRootSummaryNotFound = errors.New(ModuleName, 17, "mkvs: root summary not found")
 )
 
 // Config is the node database backend configuration.
@@ -82,6 +85,42 @@ type Config struct { // nolint: maligned
 	DiscardWriteLogs bool
 }
 
+// SyncMode controls when the storage backend syncs applied updates to disk.
+type SyncMode string
+
+const (
+	// SyncModeNone never explicitly syncs and relies on the operating system to flush writes.
+	// Any updates applied since the last flush may be lost on a crash.
+	SyncModeNone SyncMode = "none"
+	// SyncModeBatch syncs after every batch of applied updates. At most the updates applied
+	// since the last sync may be lost on a crash.
+	SyncModeBatch SyncMode = "batch"
+	// SyncModeAlways syncs on every commit. Applied updates are never lost on a crash.
+	SyncModeAlways SyncMode = "always"
+)
+
+// Validate checks whether the sync mode is valid. An empty sync mode is valid.
+func (m SyncMode) Validate() error {
+	switch m {
+	case "", SyncModeNone, SyncModeBatch, SyncModeAlways:
+		return nil
+	default:
+		return fmt.Errorf("mkvs: unknown sync mode: %s", string(m))
+	}
+}
+
+// RootSummary is a summary of the contents of a root.
+//
+// NOTE: Public fields of this structure are part of the on-disk format.
+type RootSummary struct {
+	// NodeCount is the total number of internal and leaf nodes reachable from the root.
+	NodeCount uint64 `json:"node_count"`
+	// LeafCount is the total number of leaf nodes reachable from the root.
+	LeafCount uint64 `json:"leaf_count"`
+	// ValueBytes is the total size of all values stored under the root.
+	ValueBytes uint64 `json:"value_bytes"`
+}
+
 // Factory is a node database factory interface that can create new databases.
 type Factory interface {
 	// New creates a new node database.
@@ -146,6 +185,12 @@ type NodeDB interface {
 	// GetRootsForVersion returns a list of roots stored under the given version.
 	GetRootsForVersion(version uint64) ([]node.Root, error)
 
+	// GetRootSummary returns the summary stored together with the given root.
+	//
+	// The summary of an empty root is always implicitly present and empty. In case no summary
+	// has been stored for the root, ErrRootSummaryNotFound is returned.
+	GetRootSummary(root node.Root) (*RootSummary, error)
+
 	// StartMultipartInsert prepares the database for a batch insert job from multiple chunks.
 	// Batches from this call onwards will keep track of inserted nodes so that they can be
 	// deleted if the job fails for any reason.
@@ -233,6 +278,10 @@ type Batch interface {
 	// RemoveNodes marks nodes for eventual garbage collection.
 	RemoveNodes(nodes []*node.Pointer) error
 
+	// PutRootSummary stores the summary of the committed root into the batch. The summary is
+	// removed together with the root.
+	PutRootSummary(summary *RootSummary) error
+
 	// Commit commits the batch.
 	Commit(root node.Root) error
 
@@ -286,6 +335,13 @@ func (d *nopNodeDB) GetRootsForVersion(uint64) ([]node.Root, error) {
 	return nil, nil
 }
 
+func (d *nopNodeDB) GetRootSummary(root node.Root) (*RootSummary, error) {
+	if root.Hash.IsEmpty() {
+		return &RootSummary{}, nil
+	}
+	return nil, ErrRootSummaryNotFound
+}
+
 func (d *nopNodeDB) HasRoot(node.Root) bool {
 	return false
 }
@@ -338,6 +394,10 @@ func (b *nopBatch) RemoveNodes([]*node.Pointer) error {
 	return nil
 }
 
+func (b *nopBatch) PutRootSummary(*RootSummary) error {
+	return nil
+}
+
 func (b *nopBatch) Reset() {
 }
 
@@ -5,6 +5,7 @@ import (
 
 	"github.com/oasisprotocol/oasis-core/go/common/crypto/hash"
 	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/syncer"
 	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/writelog"
 )
 
@@ -163,3 +164,65 @@ func doVisit(ctx context.Context, ndb NodeDB, root node.Root, visitor NodeVisito
 
 	return nil
 }
+
+// GetNodeOption is an option for GetNode.
+type GetNodeOption func(o *getNodeOptions)
+
+type getNodeOptions struct {
+	leafOnly bool
+
+	truncateValues bool
+	maxValueBytes  int
+	preview        *node.ValuePreview
+}
+
+// LeafOnly makes GetNode return syncer.ErrNotALeaf when the dereferenced node is an
+// internal node instead of returning it.
+func LeafOnly() GetNodeOption {
+	return func(o *getNodeOptions) {
+		o.leafOnly = true
+	}
+}
+
+// MaxValueBytes makes GetNode return at most the first n bytes of a leaf node's value. In case
+// the value is truncated, a copy of the leaf node is returned which is marked as dirty and has
+// an invalid (zero) hash as it no longer matches the stored node.
+//
+// If preview is non-nil, it is populated with the preview of the leaf node's value, including
+// its total length and whether it was truncated. Internal nodes are returned unchanged.
+func MaxValueBytes(n int, preview *node.ValuePreview) GetNodeOption {
+	return func(o *getNodeOptions) {
+		o.truncateValues = true
+		o.maxValueBytes = n
+		o.preview = preview
+	}
+}
+
+// GetNode looks up a node in the database, applying the given options.
+func GetNode(ndb NodeDB, root node.Root, ptr *node.Pointer, options ...GetNodeOption) (node.Node, error) {
+	var opts getNodeOptions
+	for _, o := range options {
+		o(&opts)
+	}
+
+	nd, err := ndb.GetNode(root, ptr)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := nd.(*node.InternalNode); ok && opts.leafOnly {
+		return nil, syncer.ErrNotALeaf
+	}
+	if leaf, ok := nd.(*node.LeafNode); ok && opts.truncateValues {
+		preview := node.PreviewValue(leaf.Value, opts.maxValueBytes)
+		if opts.preview != nil {
+			*opts.preview = *preview
+		}
+		if preview.Truncated {
+			nd = &node.LeafNode{
+				Key:   leaf.Key,
+				Value: preview.Value,
+			}
+		}
+	}
+	return nd, nil
+}
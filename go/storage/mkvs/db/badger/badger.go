@@ -66,6 +66,10 @@ var (
 	//
 	// Value is empty.
 	rootNodeKeyFmt = keyFormat.New(0x06, &api.TypedHash{})
+	// rootSummaryKeyFmt is the key format for root summaries (version, root).
+	//
+	// Value is CBOR-serialized api.RootSummary.
+	rootSummaryKeyFmt = keyFormat.New(0x07, uint64(0), &api.TypedHash{})
 )
 
 // New creates a new BadgerDB-backed node database.
@@ -504,6 +508,43 @@ func (d *badgerNodeDB) GetRootsForVersion(version uint64) (roots []node.Root, er
 	return
 }
 
+func (d *badgerNodeDB) GetRootSummary(root node.Root) (*api.RootSummary, error) {
+	// An empty root is always implicitly present and empty.
+	if root.Hash.IsEmpty() {
+		return &api.RootSummary{}, nil
+	}
+
+	if err := d.sanityCheckNamespace(root.Namespace); err != nil {
+		return nil, err
+	}
+
+	// If the version is earlier than the earliest version, we don't have the root.
+	if root.Version < d.meta.getEarliestVersion() {
+		return nil, api.ErrRootSummaryNotFound
+	}
+
+	tx := d.db.NewTransactionAt(versionToTs(root.Version), false)
+	defer tx.Discard()
+
+	rootHash := api.TypedHashFromRoot(root)
+	item, err := tx.Get(rootSummaryKeyFmt.Encode(root.Version, &rootHash))
+	switch err {
+	case nil:
+	case badger.ErrKeyNotFound:
+		return nil, api.ErrRootSummaryNotFound
+	default:
+		return nil, fmt.Errorf("mkvs/badger: failed to fetch root summary: %w", err)
+	}
+
+	var summary api.RootSummary
+	if err = item.Value(func(data []byte) error {
+		return cbor.UnmarshalTrusted(data, &summary)
+	}); err != nil {
+		return nil, fmt.Errorf("mkvs/badger: corrupted root summary: %w", err)
+	}
+	return &summary, nil
+}
+
 func (d *badgerNodeDB) HasRoot(root node.Root) bool {
 	if err := d.sanityCheckNamespace(root.Namespace); err != nil {
 		return false
@@ -651,6 +692,11 @@ func (d *badgerNodeDB) Finalize(roots []node.Root) error { // nolint: gocyclo
 			delete(rootsMeta.Roots, rootHash)
 			rootsChanged = true
 
+			// Remove the summary of the non-finalized root.
+			if err = versionBatch.Delete(rootSummaryKeyFmt.Encode(version, &rootHash)); err != nil {
+				return err
+			}
+
 			// Remove write logs for the non-finalized root.
 			if !d.discardWriteLogs {
 				if err = func() error {
@@ -756,6 +802,11 @@ func (d *badgerNodeDB) Prune(version uint64) error {
 	}
 
 	for rootHash, derivedRoots := range rootsMeta.Roots {
+		// Remove the summary of the root.
+		if err = batch.Delete(rootSummaryKeyFmt.Encode(version, &rootHash)); err != nil {
+			return err
+		}
+
 		if len(derivedRoots) > 0 {
 			// Not a lone root.
 			continue
@@ -954,6 +1005,7 @@ type badgerBatch struct {
 	writeLog     writelog.WriteLog
 	annotations  writelog.Annotations
 	updatedNodes []updatedNode
+	summary      *api.RootSummary
 }
 
 func (ba *badgerBatch) MaybeStartSubtree(subtree api.Subtree, _ node.Depth, _ *node.Pointer) api.Subtree {
@@ -990,6 +1042,15 @@ func (ba *badgerBatch) RemoveNodes(nodes []*node.Pointer) error {
 	return nil
 }
 
+func (ba *badgerBatch) PutRootSummary(summary *api.RootSummary) error {
+	if ba.chunk {
+		return fmt.Errorf("mkvs/badger: cannot put root summary in chunk mode")
+	}
+
+	ba.summary = summary
+	return nil
+}
+
 func (ba *badgerBatch) Commit(root node.Root) error {
 	ba.db.metaUpdateLock.Lock()
 	defer ba.db.metaUpdateLock.Unlock()
@@ -1093,6 +1154,14 @@ func (ba *badgerBatch) Commit(root node.Root) error {
 				return fmt.Errorf("mkvs/badger: set new write log returned error: %w", err)
 			}
 		}
+
+		// Store root summary.
+		if ba.summary != nil {
+			key := rootSummaryKeyFmt.Encode(root.Version, &rootHash)
+			if err = ba.bat.Set(key, cbor.Marshal(ba.summary)); err != nil {
+				return fmt.Errorf("mkvs/badger: set root summary returned error: %w", err)
+			}
+		}
 	}
 
 	// Flush node updates.
@@ -1113,6 +1182,7 @@ func (ba *badgerBatch) Commit(root node.Root) error {
 	ba.writeLog = nil
 	ba.annotations = nil
 	ba.updatedNodes = nil
+	ba.summary = nil
 
 	return ba.BaseBatch.Commit(root)
 }
@@ -1126,6 +1196,7 @@ func (ba *badgerBatch) Reset() {
 	ba.writeLog = nil
 	ba.annotations = nil
 	ba.updatedNodes = nil
+	ba.summary = nil
 }
 
 type badgerSubtree struct {
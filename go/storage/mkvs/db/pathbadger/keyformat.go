@@ -53,4 +53,9 @@ var (
 	//
 	// Value is empty.
 	multipartRestoreNodeLogKeyFmt = keyFormat.New(0x06, byte(0), []byte{})
+
+	// rootSummaryKeyFmt is the key format for root summaries: (version, root).
+	//
+	// Value is CBOR-serialized api.RootSummary.
+	rootSummaryKeyFmt = keyFormat.New(0x07, uint64(0), &api.TypedHash{})
 )
@@ -198,6 +198,44 @@ func (d *badgerNodeDB) GetRootsForVersion(version uint64) (roots []node.Root, er
 	return
 }
 
+// Implements api.NodeDB.
+func (d *badgerNodeDB) GetRootSummary(root node.Root) (*api.RootSummary, error) {
+	// An empty root is always implicitly present and empty.
+	if root.Hash.IsEmpty() {
+		return &api.RootSummary{}, nil
+	}
+
+	if err := d.sanityCheckNamespace(&root.Namespace); err != nil {
+		return nil, err
+	}
+
+	// If the version is earlier than the earliest version, we don't have the root.
+	if root.Version < d.meta.getEarliestVersion() {
+		return nil, api.ErrRootSummaryNotFound
+	}
+
+	tx := d.db.NewTransactionAt(tsMetadata, false)
+	defer tx.Discard()
+
+	rootHash := api.TypedHashFromRoot(root)
+	item, err := tx.Get(rootSummaryKeyFmt.Encode(root.Version, &rootHash))
+	switch err {
+	case nil:
+	case badger.ErrKeyNotFound:
+		return nil, api.ErrRootSummaryNotFound
+	default:
+		return nil, fmt.Errorf("mkvs/pathbadger: failed to fetch root summary: %w", err)
+	}
+
+	var summary api.RootSummary
+	if err = item.Value(func(data []byte) error {
+		return cbor.UnmarshalTrusted(data, &summary)
+	}); err != nil {
+		return nil, fmt.Errorf("mkvs/pathbadger: corrupted root summary: %w", err)
+	}
+	return &summary, nil
+}
+
 // Implements api.NodeDB.
 func (d *badgerNodeDB) HasRoot(root node.Root) bool {
 	if err := d.sanityCheckNamespace(&root.Namespace); err != nil {
@@ -378,6 +416,11 @@ func (d *badgerNodeDB) Finalize(roots []node.Root) error { // nolint: gocyclo
 				maybeLoneNodes[rht][string(un.Key)] = struct{}{}
 			}
 
+			// Remove the summary of the non-finalized root.
+			if err = batchMeta.Delete(rootSummaryKeyFmt.Encode(version, &rootHash)); err != nil {
+				return err
+			}
+
 			// Remove write logs for the non-finalized root.
 			if !d.discardWriteLogs {
 				if err = func() error {
@@ -583,6 +626,24 @@ func (d *badgerNodeDB) Prune(version uint64) error {
 		wtx.Discard()
 	}
 
+	// Prune all root summaries in version.
+	if err := func() error {
+		wtx := d.db.NewTransactionAt(tsMetadata, false)
+		defer wtx.Discard()
+
+		it := wtx.NewIterator(badger.IteratorOptions{Prefix: rootSummaryKeyFmt.Encode(version)})
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			if err := batchMeta.Delete(it.Item().KeyCopy(nil)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}(); err != nil {
+		return err
+	}
+
 	// Prune all write logs in version.
 	if !d.discardWriteLogs {
 		wtx := d.db.NewTransactionAt(tsMetadata, false)
@@ -772,6 +833,7 @@ type badgerBatch struct {
 	annotations  writelog.Annotations
 	updatedNodes []updatedNode
 	newRootValue []byte
+	summary      *api.RootSummary
 
 	mpLock *sync.Mutex
 }
@@ -824,6 +886,16 @@ func (ba *badgerBatch) RemoveNodes(nodes []*node.Pointer) error {
 	return nil
 }
 
+// Implements api.Batch.
+func (ba *badgerBatch) PutRootSummary(summary *api.RootSummary) error {
+	if ba.chunk {
+		return fmt.Errorf("mkvs/pathbadger: cannot put root summary in chunk mode")
+	}
+
+	ba.summary = summary
+	return nil
+}
+
 // Implements api.Batch.
 func (ba *badgerBatch) Commit(root node.Root) error {
 	ba.db.metaUpdateLock.Lock()
@@ -909,6 +981,14 @@ func (ba *badgerBatch) Commit(root node.Root) error {
 		if err := storeInternalWriteLog(ba.batMeta, oldRootHash, rootHash, root.Version, ba.writeLog, ba.annotations); err != nil {
 			return err
 		}
+
+		// Store root summary.
+		if ba.summary != nil {
+			key := rootSummaryKeyFmt.Encode(root.Version, &rootHash)
+			if err := ba.batMeta.Set(key, cbor.Marshal(ba.summary)); err != nil {
+				return fmt.Errorf("mkvs/pathbadger: set root summary returned error: %w", err)
+			}
+		}
 	}
 
 	// Make sure root node update happens last so in case anything fails, we can retry.
@@ -942,6 +1022,7 @@ func (ba *badgerBatch) Reset() {
 	ba.annotations = nil
 	ba.updatedNodes = nil
 	ba.newRootValue = nil
+	ba.summary = nil
 
 	if ba.mpLock != nil {
 		ba.mpLock.Unlock()
@@ -6,11 +6,19 @@ import (
 	"io"
 	"strings"
 
+	"github.com/oasisprotocol/oasis-core/go/common/crypto/hash"
 	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/syncer"
 )
 
+// dotKeyBytes is the number of key bytes shown for leaf nodes rendered in DOT format.
+const dotKeyBytes = 8
+
 // Implements Tree.
 func (t *tree) DumpLocal(ctx context.Context, w io.Writer, maxDepth node.Depth) {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
 	t.doDumpLocal(ctx, w, t.cache.pendingRoot, 0, maxDepth)
 }
 
@@ -49,3 +57,117 @@ func (t *tree) doDumpLocal(ctx context.Context, w io.Writer, ptr *node.Pointer,
 		fmt.Fprintf(w, prefix+"<UNKNOWN>")
 	}
 }
+
+// Implements Tree.
+func (t *tree) RenderDOT(ctx context.Context, root node.Root, maxDepth int, w io.Writer) error {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return ErrClosed
+	}
+	if !root.Equal(&t.cache.syncRoot) {
+		return syncer.ErrInvalidRoot
+	}
+	if !t.cache.pendingRoot.IsClean() {
+		return syncer.ErrDirtyRoot
+	}
+
+	// Remember where the path from root to target node ends (will end).
+	t.cache.markPosition()
+
+	r := dotRenderer{
+		t:        t,
+		w:        w,
+		maxDepth: maxDepth,
+	}
+	if _, err := fmt.Fprintln(w, "digraph mkvs {"); err != nil {
+		return err
+	}
+	if _, err := r.render(ctx, t.cache.pendingRoot, 0, node.Key{}, 0); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+type dotRenderer struct {
+	t *tree
+	w io.Writer
+	// maxDepth is the maximum number of node levels below the root to render.
+	maxDepth int
+	nextID   uint64
+}
+
+// render writes the subtree rooted at ptr, located depth node levels below the root, and returns
+// the name of the DOT node for it or an empty name in case the subtree is empty.
+func (r *dotRenderer) render(ctx context.Context, ptr *node.Pointer, bitDepth node.Depth, path node.Key, depth int) (string, error) {
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+
+	nd, err := r.t.cache.derefNodePtr(ctx, ptr, r.t.newFetcherSyncIterate(path, 0))
+	if err != nil {
+		return "", err
+	}
+	if nd == nil {
+		return "", nil
+	}
+
+	name := fmt.Sprintf("n%d", r.nextID)
+	r.nextID++
+
+	if r.maxDepth > 0 && depth > r.maxDepth {
+		_, err = fmt.Fprintf(r.w, "\t%s [label=\"...\", shape=plaintext];\n", name)
+		return name, err
+	}
+
+	switch n := nd.(type) {
+	case *node.InternalNode:
+		var label strings.Builder
+		for i := node.Depth(0); i < n.LabelBitLength; i++ {
+			if n.Label.GetBit(i) {
+				label.WriteByte('1')
+			} else {
+				label.WriteByte('0')
+			}
+		}
+		if _, err = fmt.Fprintf(r.w, "\t%s [label=\"%s\", shape=circle];\n", name, label.String()); err != nil {
+			return "", err
+		}
+
+		bitLength := bitDepth + n.LabelBitLength
+		newPath := path.Merge(bitDepth, n.Label, n.LabelBitLength)
+		for _, child := range []struct {
+			ptr   *node.Pointer
+			label string
+		}{
+			{n.LeafNode, "leaf"},
+			{n.Left, "0"},
+			{n.Right, "1"},
+		} {
+			var childName string
+			if childName, err = r.render(ctx, child.ptr, bitLength, newPath, depth+1); err != nil {
+				return "", err
+			}
+			if childName == "" {
+				continue
+			}
+			if _, err = fmt.Fprintf(r.w, "\t%s -> %s [label=\"%s\"];\n", name, childName, child.label); err != nil {
+				return "", err
+			}
+		}
+	case *node.LeafNode:
+		key := fmt.Sprintf("%x", []byte(n.Key))
+		if len(n.Key) > dotKeyBytes {
+			key = fmt.Sprintf("%x...", []byte(n.Key[:dotKeyBytes]))
+		}
+		valueHash := hash.NewFromBytes(n.Value)
+		if _, err = fmt.Fprintf(r.w, "\t%s [label=\"%s\\n%.16s\", shape=box];\n", name, key, valueHash.String()); err != nil {
+			return "", err
+		}
+	default:
+		panic(fmt.Sprintf("mkvs: unknown node type: %+v", n))
+	}
+	return name, nil
+}
@@ -0,0 +1,163 @@
+package mkvs
+
+import (
+	"bytes"
+	"context"
+	"sort"
+
+	"github.com/oasisprotocol/oasis-core/go/common/crypto/hash"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/syncer"
+)
+
+// DivergenceReport is a summary of the differences between two storage roots, useful for
+// debugging replication divergence.
+type DivergenceReport struct {
+	// Added is the number of keys only present in the second root.
+	Added int `json:"added"`
+	// Removed is the number of keys only present in the first root.
+	Removed int `json:"removed"`
+	// Changed is the number of keys present in both roots with different values.
+	Changed int `json:"changed"`
+
+	// AddedSample contains up to the requested number of added keys in sorted order.
+	AddedSample []node.Key `json:"added_sample,omitempty"`
+	// RemovedSample contains up to the requested number of removed keys in sorted order.
+	RemovedSample []node.Key `json:"removed_sample,omitempty"`
+	// ChangedSample contains up to the requested number of changed keys in sorted order.
+	ChangedSample []node.Key `json:"changed_sample,omitempty"`
+
+	// FirstDivergence is the smallest subtree containing all differing keys. It is nil in case
+	// the roots do not differ.
+	FirstDivergence *SubtreeID `json:"first_divergence,omitempty"`
+}
+
+// IsEmpty returns true iff the report contains no differences.
+func (r *DivergenceReport) IsEmpty() bool {
+	return r.Added == 0 && r.Removed == 0 && r.Changed == 0
+}
+
+// Implements Tree.
+func (t *tree) DivergenceReport(ctx context.Context, rootA, rootB node.Root, sampleSize int) (*DivergenceReport, error) {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return nil, ErrClosed
+	}
+	if rootA.Type != rootB.Type {
+		return nil, syncer.ErrInvalidRoot
+	}
+
+	var report DivergenceReport
+	if rootA.Hash.Equal(&rootB.Hash) {
+		return &report, nil
+	}
+
+	// Collect the leaves of each root that are not shared with the other root.
+	hashesA, err := t.nodeHashes(ctx, rootA)
+	if err != nil {
+		return nil, err
+	}
+	hashesB, err := t.nodeHashes(ctx, rootB)
+	if err != nil {
+		return nil, err
+	}
+	leavesA, err := t.unsharedLeaves(ctx, rootA, hashesB)
+	if err != nil {
+		return nil, err
+	}
+	leavesB, err := t.unsharedLeaves(ctx, rootB, hashesA)
+	if err != nil {
+		return nil, err
+	}
+
+	var added, removed, changed []node.Key
+	for k, valueB := range leavesB {
+		valueA, ok := leavesA[k]
+		switch {
+		case !ok:
+			added = append(added, node.Key(k))
+		case !bytes.Equal(valueA, valueB):
+			changed = append(changed, node.Key(k))
+		}
+	}
+	for k := range leavesA {
+		if _, ok := leavesB[k]; !ok {
+			removed = append(removed, node.Key(k))
+		}
+	}
+
+	report.Added = len(added)
+	report.Removed = len(removed)
+	report.Changed = len(changed)
+	report.AddedSample = sampleKeys(added, sampleSize)
+	report.RemovedSample = sampleKeys(removed, sampleSize)
+	report.ChangedSample = sampleKeys(changed, sampleSize)
+
+	// The first divergence point is the longest common prefix of all differing keys.
+	for _, keys := range [][]node.Key{added, removed, changed} {
+		for _, key := range keys {
+			if report.FirstDivergence == nil {
+				report.FirstDivergence = &SubtreeID{Path: key, BitDepth: key.BitLength()}
+				continue
+			}
+			fd := report.FirstDivergence
+			fd.BitDepth = fd.Path.CommonPrefixLen(fd.BitDepth, key, key.BitLength())
+			fd.Path, _ = fd.Path.Split(fd.BitDepth, fd.Path.BitLength())
+		}
+	}
+	return &report, nil
+}
+
+// nodeHashes returns the hashes of all nodes reachable from the given root.
+//
+// Must be called while holding the cache lock.
+func (t *tree) nodeHashes(ctx context.Context, root node.Root) (map[hash.Hash]struct{}, error) {
+	hashes := make(map[hash.Hash]struct{})
+	err := t.walkRoot(ctx, root, func(_ *node.Pointer, nd node.Node, _ node.Depth, _ node.Key) (bool, error) {
+		hashes[nd.GetHash()] = struct{}{}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// unsharedLeaves returns the keys and values of all leaves reachable from the given root that
+// are not part of any of the shared subtrees.
+//
+// Must be called while holding the cache lock.
+func (t *tree) unsharedLeaves(ctx context.Context, root node.Root, shared map[hash.Hash]struct{}) (map[string][]byte, error) {
+	leaves := make(map[string][]byte)
+	err := t.walkRoot(ctx, root, func(_ *node.Pointer, nd node.Node, _ node.Depth, _ node.Key) (bool, error) {
+		if _, ok := shared[nd.GetHash()]; ok {
+			return false, nil
+		}
+		if leaf, ok := nd.(*node.LeafNode); ok {
+			leaves[string(leaf.Key)] = leaf.Value
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return leaves, nil
+}
+
+func sampleKeys(keys []node.Key, sampleSize int) []node.Key {
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Compare(keys[j]) < 0
+	})
+	if sampleSize < 0 {
+		sampleSize = 0
+	}
+	if len(keys) > sampleSize {
+		keys = keys[:sampleSize]
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return keys
+}
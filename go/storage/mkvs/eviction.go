@@ -0,0 +1,363 @@
+package mkvs
+
+import (
+	"container/list"
+
+	"github.com/oasisprotocol/oasis-core/go/common/crypto/hash"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+)
+
+var (
+	_ EvictionPolicy = (*lruPolicy)(nil)
+	_ EvictionPolicy = (*lfuPolicy)(nil)
+	_ EvictionPolicy = (*arcPolicy)(nil)
+)
+
+// EvictionPolicy decides the order in which nodes are evicted from the in-memory cache.
+//
+// The cache uses separate policy instances for internal and leaf nodes and only calls them
+// while holding the cache lock. While a node is tracked, the policy must keep the node
+// pointer's LRU field set to a non-nil element.
+type EvictionPolicy interface {
+	// Add starts tracking a node that has been committed to the cache.
+	Add(ptr *node.Pointer)
+
+	// Use records an access to a tracked node.
+	Use(ptr *node.Pointer)
+
+	// Remove stops tracking a node.
+	Remove(ptr *node.Pointer)
+
+	// Victim returns the node that should be evicted next or nil if no nodes are tracked.
+	Victim() *node.Pointer
+
+	// Mark marks the start of a tree operation. Nodes added or used after the mark should
+	// only be evicted after all other nodes so that the path from the root to the node being
+	// dereferenced is kept in the cache.
+	Mark()
+
+	// Len returns the number of tracked nodes.
+	Len() int
+}
+
+// EvictionPolicyFactory creates a new eviction policy instance.
+type EvictionPolicyFactory func() EvictionPolicy
+
+type lruPolicy struct {
+	lru *list.List
+	pos *list.Element
+}
+
+// NewLRUPolicy creates an eviction policy that evicts the least recently used nodes first.
+//
+// This is the default eviction policy.
+func NewLRUPolicy() EvictionPolicy {
+	return &lruPolicy{
+		lru: list.New(),
+	}
+}
+
+func (p *lruPolicy) Add(ptr *node.Pointer) {
+	if p.pos != nil {
+		ptr.LRU = p.lru.InsertAfter(ptr, p.pos)
+	} else {
+		ptr.LRU = p.lru.PushFront(ptr)
+	}
+}
+
+func (p *lruPolicy) Use(ptr *node.Pointer) {
+	p.lru.MoveToFront(ptr.LRU)
+}
+
+func (p *lruPolicy) Remove(ptr *node.Pointer) {
+	if p.pos == ptr.LRU {
+		p.pos = nil
+	}
+	p.lru.Remove(ptr.LRU)
+}
+
+func (p *lruPolicy) Victim() *node.Pointer {
+	elem := p.lru.Back()
+	if elem == nil {
+		return nil
+	}
+	return elem.Value.(*node.Pointer)
+}
+
+func (p *lruPolicy) Mark() {
+	p.pos = p.lru.Front()
+}
+
+func (p *lruPolicy) Len() int {
+	return p.lru.Len()
+}
+
+// policyEntry is a node tracked by an access count aware eviction policy.
+type policyEntry struct {
+	ptr *node.Pointer
+	// list is the list the entry is currently in.
+	list *list.List
+	// hits is the number of accesses since the node has been added.
+	hits uint64
+}
+
+func entryOf(ptr *node.Pointer) *policyEntry {
+	return ptr.LRU.Value.(*policyEntry)
+}
+
+func (e *policyEntry) pushTo(l *list.List) {
+	e.list = l
+	e.ptr.LRU = l.PushFront(e)
+}
+
+func (e *policyEntry) detach() {
+	e.list.Remove(e.ptr.LRU)
+}
+
+// markRecent moves all entries from the recent list to the lists selected by dst, preserving
+// their relative order.
+func markRecent(recent *list.List, dst func(*policyEntry) *list.List) {
+	for elem := recent.Back(); elem != nil; {
+		prev := elem.Prev()
+		e := elem.Value.(*policyEntry)
+		e.detach()
+		e.pushTo(dst(e))
+		elem = prev
+	}
+}
+
+func backOf(l *list.List) *node.Pointer {
+	elem := l.Back()
+	if elem == nil {
+		return nil
+	}
+	return elem.Value.(*policyEntry).ptr
+}
+
+type lfuPolicy struct {
+	// buckets are the entries not touched since the last mark, indexed by their access count.
+	// Within a bucket, entries are ordered from the most to the least recently used.
+	buckets map[uint64]*list.List
+	// recent are the entries added or used since the last mark.
+	recent *list.List
+
+	count int
+}
+
+// NewLFUPolicy creates an eviction policy that evicts the least frequently used nodes first.
+// Among nodes with the same access count, the least recently used node is evicted first.
+func NewLFUPolicy() EvictionPolicy {
+	return &lfuPolicy{
+		buckets: make(map[uint64]*list.List),
+		recent:  list.New(),
+	}
+}
+
+func (p *lfuPolicy) detach(e *policyEntry) {
+	e.detach()
+	if e.list != p.recent && e.list.Len() == 0 {
+		delete(p.buckets, e.hits)
+	}
+}
+
+func (p *lfuPolicy) Add(ptr *node.Pointer) {
+	e := &policyEntry{ptr: ptr, hits: 1}
+	e.pushTo(p.recent)
+	p.count++
+}
+
+func (p *lfuPolicy) Use(ptr *node.Pointer) {
+	e := entryOf(ptr)
+	p.detach(e)
+	e.hits++
+	e.pushTo(p.recent)
+}
+
+func (p *lfuPolicy) Remove(ptr *node.Pointer) {
+	p.detach(entryOf(ptr))
+	p.count--
+}
+
+func (p *lfuPolicy) Victim() *node.Pointer {
+	if len(p.buckets) == 0 {
+		return backOf(p.recent)
+	}
+
+	var minHits uint64
+	for hits := range p.buckets {
+		if minHits == 0 || hits < minHits {
+			minHits = hits
+		}
+	}
+	return backOf(p.buckets[minHits])
+}
+
+func (p *lfuPolicy) Mark() {
+	markRecent(p.recent, func(e *policyEntry) *list.List {
+		bucket := p.buckets[e.hits]
+		if bucket == nil {
+			bucket = list.New()
+			p.buckets[e.hits] = bucket
+		}
+		return bucket
+	})
+}
+
+func (p *lfuPolicy) Len() int {
+	return p.count
+}
+
+// ghostList is an ordered set of hashes of recently removed nodes.
+type ghostList struct {
+	order *list.List
+	index map[hash.Hash]*list.Element
+}
+
+func newGhostList() ghostList {
+	return ghostList{
+		order: list.New(),
+		index: make(map[hash.Hash]*list.Element),
+	}
+}
+
+func (g *ghostList) len() int {
+	return g.order.Len()
+}
+
+func (g *ghostList) push(h hash.Hash) {
+	if elem, ok := g.index[h]; ok {
+		g.order.MoveToFront(elem)
+		return
+	}
+	g.index[h] = g.order.PushFront(h)
+}
+
+func (g *ghostList) remove(h hash.Hash) bool {
+	elem, ok := g.index[h]
+	if !ok {
+		return false
+	}
+	g.order.Remove(elem)
+	delete(g.index, h)
+	return true
+}
+
+func (g *ghostList) trim(size int) {
+	for g.order.Len() > size {
+		elem := g.order.Back()
+		g.order.Remove(elem)
+		delete(g.index, elem.Value.(hash.Hash))
+	}
+}
+
+type arcPolicy struct {
+	// t1 are the entries accessed once and t2 are the entries accessed more than once,
+	// excluding entries touched since the last mark. Both are ordered from the most to the
+	// least recently used.
+	t1, t2 *list.List
+	// recent are the entries added or used since the last mark.
+	recent *list.List
+	// b1 and b2 are the ghost entries of nodes recently removed while accessed once and
+	// more than once respectively.
+	b1, b2 ghostList
+
+	// target is the adaptive target size of t1.
+	target int
+	// capacity is the maximum number of nodes tracked at once so far and bounds the size
+	// of the ghost lists.
+	capacity int
+	count    int
+}
+
+// NewARCPolicy creates an adaptive replacement cache eviction policy which balances between
+// evicting least recently and least frequently used nodes based on the observed access
+// pattern.
+func NewARCPolicy() EvictionPolicy {
+	return &arcPolicy{
+		t1:     list.New(),
+		t2:     list.New(),
+		recent: list.New(),
+		b1:     newGhostList(),
+		b2:     newGhostList(),
+	}
+}
+
+func (p *arcPolicy) Add(ptr *node.Pointer) {
+	e := &policyEntry{ptr: ptr, hits: 1}
+	switch {
+	case p.b1.remove(ptr.Hash):
+		// Node was removed too early after a single access, favor recency.
+		delta := 1
+		if p.b1.len() > 0 && p.b2.len() > p.b1.len() {
+			delta = p.b2.len() / p.b1.len()
+		}
+		p.target += delta
+		if p.target > p.capacity {
+			p.target = p.capacity
+		}
+		e.hits++
+	case p.b2.remove(ptr.Hash):
+		// Node was removed too early after repeated accesses, favor frequency.
+		delta := 1
+		if p.b2.len() > 0 && p.b1.len() > p.b2.len() {
+			delta = p.b1.len() / p.b2.len()
+		}
+		p.target -= delta
+		if p.target < 0 {
+			p.target = 0
+		}
+		e.hits++
+	}
+	e.pushTo(p.recent)
+
+	p.count++
+	if p.count > p.capacity {
+		p.capacity = p.count
+	}
+}
+
+func (p *arcPolicy) Use(ptr *node.Pointer) {
+	e := entryOf(ptr)
+	e.detach()
+	e.hits++
+	e.pushTo(p.recent)
+}
+
+func (p *arcPolicy) Remove(ptr *node.Pointer) {
+	e := entryOf(ptr)
+	e.detach()
+	p.count--
+
+	switch e.hits {
+	case 1:
+		p.b1.push(ptr.Hash)
+		p.b1.trim(p.capacity)
+	default:
+		p.b2.push(ptr.Hash)
+		p.b2.trim(p.capacity)
+	}
+}
+
+func (p *arcPolicy) Victim() *node.Pointer {
+	switch {
+	case p.t1.Len() > 0 && (p.t1.Len() > p.target || p.t2.Len() == 0):
+		return backOf(p.t1)
+	case p.t2.Len() > 0:
+		return backOf(p.t2)
+	default:
+		return backOf(p.recent)
+	}
+}
+
+func (p *arcPolicy) Mark() {
+	markRecent(p.recent, func(e *policyEntry) *list.List {
+		if e.hits > 1 {
+			return p.t2
+		}
+		return p.t1
+	})
+}
+
+func (p *arcPolicy) Len() int {
+	return p.count
+}
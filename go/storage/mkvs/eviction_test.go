@@ -0,0 +1,120 @@
+package mkvs
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+)
+
+func newTestPolicyPtrs(n int) []*node.Pointer {
+	ptrs := make([]*node.Pointer, n)
+	for i := range ptrs {
+		ptrs[i] = &node.Pointer{Clean: true}
+		ptrs[i].Hash.FromBytes([]byte(fmt.Sprintf("node %d", i)))
+	}
+	return ptrs
+}
+
+func TestLRUPolicy(t *testing.T) {
+	require := require.New(t)
+
+	p := NewLRUPolicy()
+	require.Nil(p.Victim(), "empty policy should have no victim")
+
+	ptrs := newTestPolicyPtrs(4)
+	a, b, c, d := ptrs[0], ptrs[1], ptrs[2], ptrs[3]
+	p.Add(a)
+	p.Add(b)
+	p.Add(c)
+	require.Equal(3, p.Len())
+	require.Equal(a, p.Victim(), "least recently added node should be evicted first")
+
+	p.Use(a)
+	require.Equal(b, p.Victim(), "used node should not be evicted first")
+
+	p.Remove(b)
+	require.Equal(2, p.Len())
+	require.Equal(c, p.Victim())
+
+	// Nodes added after the mark are placed after the front of the list.
+	p.Mark()
+	p.Add(d)
+	require.Equal(c, p.Victim())
+	p.Remove(c)
+	require.Equal(d, p.Victim(), "node added after the mark should be evicted before the front")
+}
+
+func TestLFUPolicy(t *testing.T) {
+	require := require.New(t)
+
+	p := NewLFUPolicy()
+	require.Nil(p.Victim(), "empty policy should have no victim")
+
+	ptrs := newTestPolicyPtrs(4)
+	a, b, c, d := ptrs[0], ptrs[1], ptrs[2], ptrs[3]
+	p.Add(a)
+	p.Add(b)
+	p.Add(c)
+	p.Mark()
+	p.Use(a)
+	p.Use(a)
+	p.Use(c)
+	p.Mark()
+	require.Equal(3, p.Len())
+
+	require.Equal(b, p.Victim(), "least frequently used node should be evicted first")
+	p.Remove(b)
+	require.Equal(c, p.Victim())
+
+	// Nodes added since the mark are only evicted after all other nodes.
+	p.Add(d)
+	require.Equal(c, p.Victim(), "node added since the mark should not be evicted first")
+	p.Mark()
+	require.Equal(d, p.Victim(), "least frequently used node should be evicted first")
+
+	p.Remove(d)
+	p.Remove(c)
+	require.Equal(a, p.Victim())
+	p.Remove(a)
+	require.Equal(0, p.Len())
+	require.Nil(p.Victim())
+}
+
+func TestARCPolicy(t *testing.T) {
+	require := require.New(t)
+
+	p := NewARCPolicy()
+	require.Nil(p.Victim(), "empty policy should have no victim")
+
+	ptrs := newTestPolicyPtrs(3)
+	a, b, c := ptrs[0], ptrs[1], ptrs[2]
+	p.Add(a)
+	p.Add(b)
+	p.Mark()
+	p.Use(a)
+	p.Mark()
+
+	// Nodes accessed once are evicted before nodes accessed repeatedly.
+	require.Equal(b, p.Victim(), "node accessed once should be evicted first")
+	p.Remove(b)
+
+	// Re-adding a node removed after a single access favors recency and treats the node as
+	// frequently used.
+	p.Add(b)
+	p.Mark()
+	require.Equal(a, p.Victim(), "least recently used frequent node should be evicted")
+	p.Remove(a)
+
+	p.Add(c)
+	p.Mark()
+	require.Equal(b, p.Victim(), "frequent node should be evicted while recency is favored")
+
+	// Re-adding a node removed after repeated accesses favors frequency.
+	p.Add(a)
+	p.Mark()
+	require.Equal(c, p.Victim(), "node accessed once should be evicted while frequency is favored")
+	require.Equal(3, p.Len())
+}
@@ -0,0 +1,78 @@
+package mkvs
+
+import (
+	"context"
+
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/syncer"
+)
+
+// exportKVBatchSize is the maximum number of key/value pairs ExportKV collects while holding the
+// cache lock before passing them to the callback.
+const exportKVBatchSize = 100
+
+// Implements Tree.
+func (t *tree) ExportKV(ctx context.Context, root node.Root, fn func(key node.Key, value []byte) error) error {
+	var (
+		keys   []node.Key
+		values [][]byte
+		next   node.Key
+		err    error
+	)
+	for {
+		// Collect the next batch while holding the lock, but call fn without holding it so that
+		// fn may use the tree and does not block other operations.
+		if keys, values, next, err = t.exportKVBatch(ctx, root, next); err != nil {
+			return err
+		}
+		for i := range keys {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+			if err = fn(keys[i], values[i]); err != nil {
+				return err
+			}
+		}
+		if next == nil {
+			return nil
+		}
+	}
+}
+
+// exportKVBatch returns up to exportKVBatchSize key/value pairs of the given root starting at the
+// given key together with the key at which the next batch starts or
+// nil if there are no more keys.
+func (t *tree) exportKVBatch(ctx context.Context, root node.Root, start node.Key) ([]node.Key, [][]byte, node.Key, error) {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	// The root is checked for each batch as the tree may have been modified in between.
+	if t.cache.isClosed() {
+		return nil, nil, nil, ErrClosed
+	}
+	if !root.Equal(&t.cache.syncRoot) {
+		return nil, nil, nil, syncer.ErrInvalidRoot
+	}
+	if !t.cache.pendingRoot.IsClean() {
+		return nil, nil, nil, syncer.ErrDirtyRoot
+	}
+
+	it := newTreeIterator(ctx, t)
+	defer it.Close()
+
+	var (
+		keys   []node.Key
+		values [][]byte
+	)
+	for it.Seek(start); it.Valid(); it.Next() {
+		if len(keys) == exportKVBatchSize {
+			return keys, values, it.Key(), nil
+		}
+		keys = append(keys, it.Key())
+		values = append(values, it.Value())
+	}
+	if err := it.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+	return keys, values, nil, nil
+}
@@ -0,0 +1,95 @@
+package mkvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	db "github.com/oasisprotocol/oasis-core/go/storage/mkvs/db/api"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/syncer"
+)
+
+// healthCheckTimeout is the maximum time a health check may take in case the tree has no node
+// load timeout configured.
+const healthCheckTimeout = 5 * time.Second
+
+// ErrUnhealthy is the error returned by HealthCheck when the node database is inconsistent.
+var ErrUnhealthy = errors.New("mkvs: node database is unhealthy")
+
+// healthProbe is a read of the root node performed by HealthCheck. As a hung node database
+// read cannot be aborted, the probe may outlive the HealthCheck call which started it.
+type healthProbe struct {
+	done chan struct{}
+	err  error
+}
+
+// Implements Tree.
+func (t *tree) HealthCheck(ctx context.Context) error {
+	t.cache.Lock()
+	if t.cache.isClosed() {
+		t.cache.Unlock()
+		return ErrClosed
+	}
+	ndb, root := t.cache.db, t.cache.syncRoot
+	timeout := t.cache.nodeLoadTimeout
+
+	// There is nothing to read before anything is committed.
+	if root.Hash.IsEmpty() {
+		t.cache.Unlock()
+		return nil
+	}
+
+	// Only allow a single probe in flight so that repeatedly checking a hung node database
+	// does not pile up blocked reads. Calls made while a probe is in flight share its result.
+	probe := t.healthProbe
+	if probe == nil {
+		probe = &healthProbe{done: make(chan struct{})}
+		t.healthProbe = probe
+
+		// Perform the reads without holding the cache lock so that a hung node database does
+		// not block other operations beyond what they would block on anyway.
+		go func() {
+			probe.err = checkRootNode(ndb, root)
+
+			t.cache.Lock()
+			t.healthProbe = nil
+			t.cache.Unlock()
+			close(probe.done)
+		}()
+	}
+	t.cache.Unlock()
+
+	if timeout == 0 {
+		timeout = healthCheckTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-probe.done:
+		return probe.err
+	case <-timer.C:
+		return syncer.ErrStorageTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// checkRootNode checks that the root node of the given root can be loaded from the node
+// database and that it matches the root hash.
+func checkRootNode(ndb db.NodeDB, root node.Root) error {
+	if !ndb.HasRoot(root) {
+		return fmt.Errorf("%w: root not found: %s", ErrUnhealthy, root)
+	}
+
+	nd, err := ndb.GetNode(root, &node.Pointer{Clean: true, Hash: root.Hash})
+	if err != nil {
+		return fmt.Errorf("%w: failed to load root node: %s", ErrUnhealthy, err)
+	}
+	if h := nd.GetHash(); !h.Equal(&root.Hash) {
+		return fmt.Errorf("%w: root node hash mismatch (expected: %s got: %s)", ErrUnhealthy, root.Hash, h)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package mkvs
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/oasisprotocol/oasis-core/go/common/crypto/hash"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/syncer"
+)
+
+// Implements Tree.
+func (t *tree) GetValueHistory(ctx context.Context, key node.Key, roots []node.Root) ([][]byte, error) {
+	if err := t.checkKeyWidth(key); err != nil {
+		return nil, err
+	}
+
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return nil, ErrClosed
+	}
+
+	values := make([][]byte, len(roots))
+	// The nodes visited by the lookup in the previous root, mapped to their bit depth.
+	var prevPath map[hash.Hash]node.Depth
+	for i, root := range roots {
+		if root.Type != t.rootType {
+			return nil, syncer.ErrInvalidRoot
+		}
+
+		path := make(map[hash.Hash]node.Depth)
+		lookup := func(rt *tree) error {
+			var (
+				value    []byte
+				err      error
+				ptr      = rt.cache.pendingRoot
+				bitDepth node.Depth
+			)
+			for ptr != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+
+				// In case the lookup in the previous root visited the same node at the same
+				// depth, the rest of the lookup is the same so its result can be reused.
+				if d, ok := prevPath[ptr.Hash]; ok && d == bitDepth {
+					value = values[i-1]
+					break
+				}
+				path[ptr.Hash] = bitDepth
+
+				// Dereference the node, possibly making a remote request.
+				var nd node.Node
+				if nd, err = rt.cache.derefNodePtr(ctx, ptr, rt.newFetcherSyncGet(key, false)); err != nil {
+					return err
+				}
+
+				ptr = nil
+				switch n := nd.(type) {
+				case nil:
+				case *node.InternalNode:
+					bitLength := bitDepth + n.LabelBitLength
+
+					switch {
+					case key.BitLength() == bitLength:
+						// Lookup key ends here, look into LeafNode.
+						ptr = n.LeafNode
+					case key.BitLength() < bitLength:
+						// Lookup key is too short for the current n.Label. It's not stored.
+					case key.GetBit(bitLength):
+						ptr = n.Right
+					default:
+						ptr = n.Left
+					}
+					bitDepth = bitLength
+				case *node.LeafNode:
+					if n.Key.Equal(key) {
+						value = n.Value
+					}
+				default:
+					panic(fmt.Sprintf("mkvs: unknown node type: %+v", n))
+				}
+			}
+			values[i] = value
+			return nil
+		}
+
+		var err error
+		if root.Equal(&t.cache.syncRoot) && t.cache.pendingRoot.IsClean() {
+			// Look up the root the tree is at in the tree itself, as its nodes may only be
+			// available in memory.
+			t.cache.markPosition()
+			err = lookup(t)
+		} else {
+			err = t.withRoot(root, lookup)
+		}
+		if err != nil {
+			return nil, err
+		}
+		prevPath = path
+	}
+	return values, nil
+}
@@ -0,0 +1,250 @@
+package mkvs
+
+import (
+	"bytes"
+	"container/heap"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+)
+
+// DefaultHotKeyCapacity is the default maximum number of keys tracked per window by a hot-key
+// tracker.
+const DefaultHotKeyCapacity = 1024
+
+// HotKeyStat is the access count of a key reported by the hot-key tracker.
+type HotKeyStat struct {
+	// Key is the accessed key.
+	Key node.Key `json:"key"`
+	// Accesses is the estimated number of accesses of the key within the tracking window.
+	Accesses uint64 `json:"accesses"`
+}
+
+// WithHotKeyTracking enables counting Get and SyncGet accesses per key using a new hot-key
+// tracker, see NewHotKeyTracker. The hottest keys can be obtained using HotKeys.
+func WithHotKeyTracking(window time.Duration, sampleRate uint64, capacity int) Option {
+	return WithHotKeyTracker(NewHotKeyTracker(window, sampleRate, capacity))
+}
+
+// WithHotKeyTracker enables counting Get and SyncGet accesses per key using the given hot-key
+// tracker. The same tracker can be shared by multiple trees to track accesses across all of
+// them.
+func WithHotKeyTracker(tracker *HotKeyTracker) Option {
+	return func(t *tree) {
+		t.hotKeys = tracker
+	}
+}
+
+// HotKeyTracker approximates per-key access counts over a sliding window.
+//
+// Accesses are counted in fixed windows. The count of a key over the sliding window is estimated
+// from the count in the current window and the count in the previous window, weighted by how
+// much of the previous window still overlaps the sliding window.
+//
+// Each window only keeps counters for a bounded number of keys using the space-saving
+// algorithm, so memory use does not depend on the number of distinct keys accessed. When all
+// counters are in use, the key with the lowest count is replaced and its count is inherited by
+// the new key. The counts of keys accessed more often than the lowest count are thus reported
+// accurately, while the counts of rarely accessed keys may be overestimated.
+type HotKeyTracker struct {
+	sync.Mutex
+
+	window     time.Duration
+	sampleRate uint64
+	capacity   int
+	// accesses is the total number of accesses, used for sampling.
+	accesses atomic.Uint64
+
+	current  *spaceSaving
+	previous *spaceSaving
+	// currentStart is the start time of the current window.
+	currentStart time.Time
+
+	now func() time.Time
+}
+
+// NewHotKeyTracker creates a new hot-key tracker counting accesses over a sliding window of
+// the given duration. A zero window counts all accesses since the tracker was created.
+//
+// Only every sampleRate-th access is counted (and weighted accordingly) to reduce overhead. A
+// sampleRate of zero or one counts all accesses.
+//
+// At most capacity keys are tracked per window. A capacity of zero uses DefaultHotKeyCapacity.
+func NewHotKeyTracker(window time.Duration, sampleRate uint64, capacity int) *HotKeyTracker {
+	if sampleRate == 0 {
+		sampleRate = 1
+	}
+	if capacity <= 0 {
+		capacity = DefaultHotKeyCapacity
+	}
+	return &HotKeyTracker{
+		window:       window,
+		sampleRate:   sampleRate,
+		capacity:     capacity,
+		current:      newSpaceSaving(capacity),
+		previous:     newSpaceSaving(capacity),
+		currentStart: time.Now(),
+		now:          time.Now,
+	}
+}
+
+// rotate moves to the window containing the given time.
+//
+// Must be called while holding the tracker lock.
+func (h *HotKeyTracker) rotate(now time.Time) {
+	if h.window <= 0 {
+		return
+	}
+
+	elapsed := now.Sub(h.currentStart)
+	switch {
+	case elapsed < h.window:
+		return
+	case elapsed < 2*h.window:
+		h.previous = h.current
+	default:
+		// No accesses in the previous window.
+		h.previous = newSpaceSaving(h.capacity)
+	}
+	h.current = newSpaceSaving(h.capacity)
+	h.currentStart = now.Add(-(elapsed % h.window))
+}
+
+// record counts an access of the given key, subject to sampling.
+func (h *HotKeyTracker) record(key []byte) {
+	if h.accesses.Add(1)%h.sampleRate != 0 {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.rotate(h.now())
+	h.current.add(key, h.sampleRate)
+}
+
+// Top returns up to n keys with the highest estimated access counts, ordered by decreasing
+// count and then by key.
+func (h *HotKeyTracker) Top(n int) []HotKeyStat {
+	if n <= 0 {
+		return nil
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	now := h.now()
+	h.rotate(now)
+
+	counts := make(map[string]uint64, h.current.Len()+h.previous.Len())
+	for _, c := range h.current.counters {
+		counts[c.key] = c.count
+	}
+	if h.previous.Len() > 0 {
+		// Weight of the previous window, i.e. the part of it still within the sliding window.
+		weight := 1 - float64(now.Sub(h.currentStart))/float64(h.window)
+		for _, c := range h.previous.counters {
+			counts[c.key] += uint64(weight * float64(c.count))
+		}
+	}
+
+	stats := make([]HotKeyStat, 0, len(counts))
+	for key, count := range counts {
+		if count == 0 {
+			continue
+		}
+		stats = append(stats, HotKeyStat{Key: node.Key(key), Accesses: count})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Accesses != stats[j].Accesses {
+			return stats[i].Accesses > stats[j].Accesses
+		}
+		return bytes.Compare(stats[i].Key, stats[j].Key) < 0
+	})
+	if len(stats) > n {
+		stats = stats[:n]
+	}
+	return stats
+}
+
+// spaceSavingCounter is the access counter of a single key.
+type spaceSavingCounter struct {
+	key   string
+	count uint64
+	// index is the index of the counter in the heap.
+	index int
+}
+
+// spaceSaving is a bounded set of per-key access counters maintained using the space-saving
+// algorithm. The counters are kept in a min-heap ordered by count so that the counter with the
+// lowest count can be replaced efficiently.
+type spaceSaving struct {
+	capacity int
+	counters []*spaceSavingCounter
+	keys     map[string]*spaceSavingCounter
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{
+		capacity: capacity,
+		keys:     make(map[string]*spaceSavingCounter),
+	}
+}
+
+// add adds the given number of accesses to the counter of the given key.
+func (s *spaceSaving) add(key []byte, accesses uint64) {
+	if c, ok := s.keys[string(key)]; ok {
+		c.count += accesses
+		heap.Fix(s, c.index)
+		return
+	}
+
+	if len(s.counters) < s.capacity {
+		c := &spaceSavingCounter{key: string(key), count: accesses}
+		s.keys[c.key] = c
+		heap.Push(s, c)
+		return
+	}
+
+	// Replace the key with the lowest count, inheriting its count.
+	c := s.counters[0]
+	delete(s.keys, c.key)
+	c.key = string(key)
+	c.count += accesses
+	s.keys[c.key] = c
+	heap.Fix(s, 0)
+}
+
+func (s *spaceSaving) Len() int           { return len(s.counters) }
+func (s *spaceSaving) Less(i, j int) bool { return s.counters[i].count < s.counters[j].count }
+
+func (s *spaceSaving) Swap(i, j int) {
+	s.counters[i], s.counters[j] = s.counters[j], s.counters[i]
+	s.counters[i].index = i
+	s.counters[j].index = j
+}
+
+func (s *spaceSaving) Push(x interface{}) {
+	c := x.(*spaceSavingCounter)
+	c.index = len(s.counters)
+	s.counters = append(s.counters, c)
+}
+
+func (s *spaceSaving) Pop() interface{} {
+	n := len(s.counters)
+	c := s.counters[n-1]
+	s.counters[n-1] = nil
+	s.counters = s.counters[:n-1]
+	return c
+}
+
+// Implements Tree.
+func (t *tree) HotKeys(topN int) []HotKeyStat {
+	if t.hotKeys == nil {
+		return nil
+	}
+	return t.hotKeys.Top(topN)
+}
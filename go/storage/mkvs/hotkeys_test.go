@@ -0,0 +1,144 @@
+package mkvs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+)
+
+func TestHotKeys(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	tree := New(nil, nil, node.RootTypeState, WithHotKeyTracking(time.Minute, 1, 0))
+	defer tree.Close()
+	for i := 0; i < 10; i++ {
+		err := tree.Insert(ctx, []byte(fmt.Sprintf("key %d", i)), []byte("value"))
+		require.NoError(err, "Insert")
+	}
+
+	// Issue skewed reads concurrently, key i is read 10*(10-i) times.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 10-i; j++ {
+			wg.Add(1)
+			go func(key []byte) {
+				defer wg.Done()
+				for k := 0; k < 10; k++ {
+					if _, err := tree.Get(ctx, key); err != nil {
+						t.Errorf("Get: %v", err)
+					}
+				}
+			}([]byte(fmt.Sprintf("key %d", i)))
+		}
+	}
+	wg.Wait()
+
+	hot := tree.HotKeys(3)
+	require.Equal([]HotKeyStat{
+		{Key: node.Key("key 0"), Accesses: 100},
+		{Key: node.Key("key 1"), Accesses: 90},
+		{Key: node.Key("key 2"), Accesses: 80},
+	}, hot, "hottest keys should be reported")
+	require.Len(tree.HotKeys(100), 10, "all accessed keys should be reported")
+	require.Nil(tree.HotKeys(0))
+
+	// Trees without tracking do not report hot keys.
+	plain := New(nil, nil, node.RootTypeState)
+	defer plain.Close()
+	_, err := plain.Get(ctx, []byte("key 0"))
+	require.NoError(err, "Get")
+	require.Nil(plain.HotKeys(10))
+}
+
+func TestHotKeyTrackerWindow(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Now()
+	h := NewHotKeyTracker(time.Minute, 1, 0)
+	h.currentStart = now
+	h.now = func() time.Time { return now }
+
+	for i := 0; i < 100; i++ {
+		h.record([]byte("old"))
+	}
+	for i := 0; i < 10; i++ {
+		h.record([]byte("other"))
+	}
+
+	// Accesses from the previous window are weighted by their overlap with the sliding window.
+	now = now.Add(time.Minute + 15*time.Second)
+	for i := 0; i < 50; i++ {
+		h.record([]byte("new"))
+	}
+	require.Equal([]HotKeyStat{
+		{Key: node.Key("old"), Accesses: 75},
+		{Key: node.Key("new"), Accesses: 50},
+		{Key: node.Key("other"), Accesses: 7},
+	}, h.Top(10))
+
+	// Accesses older than the sliding window are forgotten.
+	now = now.Add(2 * time.Minute)
+	require.Empty(h.Top(10))
+
+	// Sampled accesses are weighted by the sample rate.
+	h = NewHotKeyTracker(time.Minute, 4, 0)
+	for i := 0; i < 40; i++ {
+		h.record([]byte("sampled"))
+	}
+	require.Equal([]HotKeyStat{{Key: node.Key("sampled"), Accesses: 40}}, h.Top(1))
+}
+
+func TestHotKeyTrackerCapacity(t *testing.T) {
+	require := require.New(t)
+
+	// Access many distinct keys once each, interleaved with a few hot keys. Keys accessed more
+	// than total/capacity times are guaranteed to be tracked.
+	h := NewHotKeyTracker(time.Minute, 1, 8)
+	for i := 0; i < 1000; i++ {
+		h.record([]byte(fmt.Sprintf("cold %d", i)))
+		if i%2 == 0 {
+			h.record([]byte("hot 0"))
+		}
+		if i%4 == 0 {
+			h.record([]byte("hot 1"))
+		}
+	}
+	require.Equal(8, h.current.Len(), "only a bounded number of keys should be tracked")
+	require.Len(h.current.keys, 8, "only a bounded number of keys should be tracked")
+
+	// The hot keys are reported first, with their counts possibly overestimated by at most the
+	// lowest count.
+	top := h.Top(2)
+	require.Len(top, 2)
+	require.EqualValues("hot 0", top[0].Key)
+	require.EqualValues("hot 1", top[1].Key)
+	require.GreaterOrEqual(top[0].Accesses, uint64(500))
+	require.GreaterOrEqual(top[1].Accesses, uint64(250))
+}
+
+func TestHotKeyTrackerShared(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	tracker := NewHotKeyTracker(time.Minute, 1, 0)
+	first := New(nil, nil, node.RootTypeState, WithHotKeyTracker(tracker))
+	defer first.Close()
+	second := New(nil, nil, node.RootTypeState, WithHotKeyTracker(tracker))
+	defer second.Close()
+
+	for _, tree := range []Tree{first, second} {
+		_, err := tree.Get(ctx, []byte("key"))
+		require.NoError(err, "Get")
+	}
+
+	expected := []HotKeyStat{{Key: node.Key("key"), Accesses: 2}}
+	require.Equal(expected, tracker.Top(1), "accesses via all trees should be counted")
+	require.Equal(expected, first.HotKeys(1), "accesses via all trees should be counted")
+}
@@ -0,0 +1,349 @@
+package mkvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"github.com/oasisprotocol/oasis-core/go/common/crypto/hash"
+	db "github.com/oasisprotocol/oasis-core/go/storage/mkvs/db/api"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/syncer"
+)
+
+// NodeKind is the kind of a tree node.
+type NodeKind uint8
+
+const (
+	// NodeKindNil is the kind of a nil (empty) node.
+	NodeKindNil NodeKind = 0
+	// NodeKindInternal is the kind of an internal node.
+	NodeKindInternal NodeKind = 1
+	// NodeKindLeaf is the kind of a leaf node.
+	NodeKindLeaf NodeKind = 2
+)
+
+// String returns the string representation of the node kind.
+func (k NodeKind) String() string {
+	switch k {
+	case NodeKindNil:
+		return "nil"
+	case NodeKindInternal:
+		return "internal"
+	case NodeKindLeaf:
+		return "leaf"
+	default:
+		return fmt.Sprintf("[unknown node kind: %d]", k)
+	}
+}
+
+func nodeKindOf(nd node.Node) NodeKind {
+	switch nd.(type) {
+	case *node.InternalNode:
+		return NodeKindInternal
+	case *node.LeafNode:
+		return NodeKindLeaf
+	default:
+		return NodeKindNil
+	}
+}
+
+// RootInfo is a summary of a storage root.
+type RootInfo struct {
+	// Root is the storage root the summary is for.
+	Root node.Root `json:"root"`
+	// RootNodeKind is the kind of the root node.
+	RootNodeKind NodeKind `json:"root_node_kind"`
+	// NodeCount is the total number of internal and leaf nodes reachable from
+	// the root.
+	NodeCount uint64 `json:"node_count"`
+	// LeafCount is the total number of leaf nodes reachable from the root.
+	LeafCount uint64 `json:"leaf_count"`
+	// ValueBytes is the total size of all values stored under the root.
+	ValueBytes uint64 `json:"value_bytes"`
+}
+
+// Implements Tree.
+func (t *tree) RootInfo(ctx context.Context, root node.Root) (*RootInfo, error) {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return nil, ErrClosed
+	}
+	if !root.Equal(&t.cache.syncRoot) {
+		return nil, syncer.ErrInvalidRoot
+	}
+	if !t.cache.pendingRoot.IsClean() {
+		return nil, syncer.ErrDirtyRoot
+	}
+
+	// Remember where the path from root to target node ends (will end).
+	t.cache.markPosition()
+
+	// Use the summary stored at commit time if available.
+	summary, err := t.cache.db.GetRootSummary(root)
+	switch {
+	case err == nil:
+		nd, err := t.cache.derefNodePtr(ctx, t.cache.pendingRoot, t.newFetcherSyncIterate(node.Key{}, 0))
+		if err != nil {
+			return nil, err
+		}
+		return &RootInfo{
+			Root:         root,
+			RootNodeKind: nodeKindOf(nd),
+			NodeCount:    summary.NodeCount,
+			LeafCount:    summary.LeafCount,
+			ValueBytes:   summary.ValueBytes,
+		}, nil
+	case errors.Is(err, db.ErrRootSummaryNotFound):
+		return t.computeRootInfo(ctx, root)
+	default:
+		return nil, err
+	}
+}
+
+// summaryDelta is the change of a root summary caused by updating the tree.
+type summaryDelta struct {
+	nodes      int64
+	leaves     int64
+	valueBytes int64
+}
+
+// addLeaf records the creation of a leaf node with the given value.
+func (d *summaryDelta) addLeaf(value []byte) {
+	d.nodes++
+	d.leaves++
+	d.valueBytes += int64(len(value))
+}
+
+// removeLeaf records the removal of a leaf node with the given value.
+func (d *summaryDelta) removeLeaf(value []byte) {
+	d.nodes--
+	d.leaves--
+	d.valueBytes -= int64(len(value))
+}
+
+// pendingRootSummary computes the summary of the committed pending root from the summary of
+// the old root and the change caused by the pending updates. In case the old root has no
+// summary, the summary is computed by walking the whole pending tree.
+//
+// Must be called while holding the cache lock.
+func (t *tree) pendingRootSummary(ctx context.Context, oldRoot, root node.Root) (*db.RootSummary, error) {
+	summary, err := t.cache.db.GetRootSummary(oldRoot)
+	switch {
+	case err == nil:
+		return &db.RootSummary{
+			NodeCount:  uint64(int64(summary.NodeCount) + t.pendingSummary.nodes),
+			LeafCount:  uint64(int64(summary.LeafCount) + t.pendingSummary.leaves),
+			ValueBytes: uint64(int64(summary.ValueBytes) + t.pendingSummary.valueBytes),
+		}, nil
+	case errors.Is(err, db.ErrRootSummaryNotFound):
+		info, err := t.computeRootInfo(ctx, root)
+		if err != nil {
+			return nil, err
+		}
+		return &db.RootSummary{
+			NodeCount:  info.NodeCount,
+			LeafCount:  info.LeafCount,
+			ValueBytes: info.ValueBytes,
+		}, nil
+	default:
+		return nil, err
+	}
+}
+
+// computeRootInfo computes the summary of the given root by walking the whole pending tree.
+//
+// Must be called while holding the cache lock.
+func (t *tree) computeRootInfo(ctx context.Context, root node.Root) (*RootInfo, error) {
+	info := RootInfo{
+		Root: root,
+	}
+	err := t.doWalk(ctx, t.cache.pendingRoot, 0, node.Key{}, func(ptr *node.Pointer, nd node.Node, _ node.Depth, _ node.Key) (bool, error) {
+		if ptr == t.cache.pendingRoot {
+			info.RootNodeKind = nodeKindOf(nd)
+		}
+		info.NodeCount++
+		if leaf, ok := nd.(*node.LeafNode); ok {
+			info.LeafCount++
+			info.ValueBytes += uint64(len(leaf.Value))
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Commitment is a succinct commitment to a storage root, useful for comparing state
+// between nodes when debugging divergence.
+type Commitment struct {
+	// RootHash is the root hash.
+	RootHash hash.Hash `json:"root_hash"`
+	// LeafCount is the total number of leaf nodes reachable from the root.
+	LeafCount uint64 `json:"leaf_count"`
+	// LeafHashXor is the XOR of the hashes of all leaf nodes reachable from the root.
+	LeafHashXor hash.Hash `json:"leaf_hash_xor"`
+}
+
+// Implements Tree.
+func (t *tree) Commitment(ctx context.Context, root node.Root) (*Commitment, error) {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return nil, ErrClosed
+	}
+	if !root.Equal(&t.cache.syncRoot) {
+		return nil, syncer.ErrInvalidRoot
+	}
+	if !t.cache.pendingRoot.IsClean() {
+		return nil, syncer.ErrDirtyRoot
+	}
+
+	// Remember where the path from root to target node ends (will end).
+	t.cache.markPosition()
+
+	c := Commitment{
+		RootHash: root.Hash,
+	}
+	err := t.doWalk(ctx, t.cache.pendingRoot, 0, node.Key{}, func(_ *node.Pointer, nd node.Node, _ node.Depth, _ node.Key) (bool, error) {
+		leaf, ok := nd.(*node.LeafNode)
+		if !ok {
+			return true, nil
+		}
+		c.LeafCount++
+		for i := range c.LeafHashXor {
+			c.LeafHashXor[i] ^= leaf.Hash[i]
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Implements Tree.
+func (t *tree) SampleKeys(ctx context.Context, root node.Root, n int, seed int64) ([]node.Key, error) {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return nil, ErrClosed
+	}
+	if !root.Equal(&t.cache.syncRoot) {
+		return nil, syncer.ErrInvalidRoot
+	}
+	if !t.cache.pendingRoot.IsClean() {
+		return nil, syncer.ErrDirtyRoot
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+
+	// Remember where the path from root to target node ends (will end).
+	t.cache.markPosition()
+
+	// Use reservoir sampling so that only the sample is kept in memory. As the walk order is
+	// fixed, the sample only depends on the seed.
+	rng := rand.New(rand.NewSource(seed)) // nolint: gosec
+	var (
+		sample []node.Key
+		seen   int
+	)
+	err := t.doWalk(ctx, t.cache.pendingRoot, 0, node.Key{}, func(_ *node.Pointer, nd node.Node, _ node.Depth, _ node.Key) (bool, error) {
+		leaf, ok := nd.(*node.LeafNode)
+		if !ok {
+			return true, nil
+		}
+		seen++
+		if len(sample) < n {
+			sample = append(sample, leaf.Key)
+		} else if i := rng.Intn(seen); i < n {
+			sample[i] = leaf.Key
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(sample, func(i, j int) bool {
+		return sample[i].Compare(sample[j]) < 0
+	})
+	return sample, nil
+}
+
+// Implements Tree.
+func (t *tree) UniqueFootprint(ctx context.Context, root node.Root, otherRoots []node.Root) (int64, int, error) {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return 0, 0, ErrClosed
+	}
+	if !root.Equal(&t.cache.syncRoot) {
+		return 0, 0, syncer.ErrInvalidRoot
+	}
+	if !t.cache.pendingRoot.IsClean() {
+		return 0, 0, syncer.ErrDirtyRoot
+	}
+
+	// Collect the hashes of all nodes reachable from any of the other roots.
+	shared := make(map[hash.Hash]struct{})
+	for _, otherRoot := range otherRoots {
+		if otherRoot.Type != root.Type {
+			continue
+		}
+
+		err := t.walkRoot(ctx, otherRoot, func(ptr *node.Pointer, _ node.Node, _ node.Depth, _ node.Key) (bool, error) {
+			shared[ptr.Hash] = struct{}{}
+			return true, nil
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	// Remember where the path from root to target node ends (will end).
+	t.cache.markPosition()
+
+	var (
+		size         int64
+		nodes        int
+		embeddedLeaf *node.Pointer
+	)
+	err := t.doWalk(ctx, t.cache.pendingRoot, 0, node.Key{}, func(ptr *node.Pointer, nd node.Node, _ node.Depth, _ node.Key) (bool, error) {
+		if _, ok := shared[ptr.Hash]; ok {
+			// The whole subtree is shared with another root.
+			return false, nil
+		}
+		nodes++
+
+		// A leaf stored on an internal node is serialized as part of that node, which has
+		// already been accounted for.
+		if ptr == embeddedLeaf {
+			return true, nil
+		}
+		if n, ok := nd.(*node.InternalNode); ok {
+			// The leaf (if any) is the first child visited.
+			embeddedLeaf = n.LeafNode
+		}
+
+		data, err := nd.MarshalBinary()
+		if err != nil {
+			return false, err
+		}
+		size += int64(len(data))
+		return true, nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return size, nodes, nil
+}
@@ -10,6 +10,10 @@ import (
 
 // Implements Tree.
 func (t *tree) Insert(ctx context.Context, key, value []byte) error {
+	if err := t.checkKeyWidth(key); err != nil {
+		return err
+	}
+
 	if value == nil {
 		value = []byte{}
 	}
@@ -21,13 +25,24 @@ func (t *tree) Insert(ctx context.Context, key, value []byte) error {
 		return ErrClosed
 	}
 
+	result, err := t.insertLocked(ctx, key, value)
+	if err != nil {
+		return err
+	}
+	t.notifyDeepLeaf(key, result)
+	return nil
+}
+
+// insertLocked inserts a key/value pair into the tree and records it in the pending write log.
+//
+// Must be called while holding the cache lock.
+func (t *tree) insertLocked(ctx context.Context, key, value []byte) (insertResult, error) {
 	// Remember where the path from root to target node ends (will end).
 	t.cache.markPosition()
 
-	var result insertResult
 	result, err := t.doInsert(ctx, t.cache.pendingRoot, 0, key, value)
 	if err != nil {
-		return err
+		return insertResult{}, err
 	}
 
 	// Update the pending write log.
@@ -47,13 +62,22 @@ func (t *tree) Insert(ctx context.Context, key, value []byte) error {
 	}
 
 	t.cache.setPendingRoot(result.newRoot)
-	return nil
+	return result, nil
+}
+
+// notifyDeepLeaf calls the deep leaf hook in case the insert created a new leaf deeper than the
+// configured threshold.
+func (t *tree) notifyDeepLeaf(key []byte, result insertResult) {
+	if t.deepLeafFn != nil && !result.existed && result.insertedLeafDepth > t.deepLeafThreshold {
+		t.deepLeafFn(key, result.insertedLeafDepth)
+	}
 }
 
 type insertResult struct {
-	newRoot      *node.Pointer
-	insertedLeaf *node.Pointer
-	existed      bool
+	newRoot           *node.Pointer
+	insertedLeaf      *node.Pointer
+	insertedLeafDepth node.Depth
+	existed           bool
 }
 
 func (t *tree) doInsert(
@@ -79,10 +103,12 @@ func (t *tree) doInsert(
 	case nil:
 		// Insert into nil node, create a new leaf node.
 		newLeaf := t.cache.newLeafNode(key, val)
+		t.pendingSummary.addLeaf(val)
 		result := insertResult{
-			newRoot:      newLeaf,
-			insertedLeaf: newLeaf,
-			existed:      false,
+			newRoot:           newLeaf,
+			insertedLeaf:      newLeaf,
+			insertedLeafDepth: bitDepth,
+			existed:           false,
 		}
 		return result, nil
 	case *node.InternalNode:
@@ -107,6 +133,10 @@ func (t *tree) doInsert(
 			if err != nil {
 				return insertResult{}, err
 			}
+			if !result.newRoot.IsClean() {
+				// Node will be modified in place, remember its committed state.
+				t.saveNode(ptr)
+			}
 
 			if key.BitLength() == bitLength {
 				n.LeafNode = result.newRoot
@@ -134,6 +164,7 @@ func (t *tree) doInsert(
 
 		// Key mismatches the label at position cpLength. Split the edge and
 		// insert new leaf.
+		t.saveNode(ptr)
 		labelPrefix, labelSuffix := n.Label.Split(cpLength, n.LabelBitLength)
 		n.Label = labelSuffix
 		n.LabelBitLength = n.LabelBitLength - cpLength
@@ -149,6 +180,8 @@ func (t *tree) doInsert(
 		t.cache.rollbackNode(ptr)
 
 		newLeaf := t.cache.newLeafNode(key, val)
+		t.pendingSummary.addLeaf(val)
+		t.pendingSummary.nodes++
 		var leafNode, left, right *node.Pointer
 
 		if key.BitLength()-bitDepth == cpLength {
@@ -169,18 +202,20 @@ func (t *tree) doInsert(
 			right = ptr
 		}
 		return insertResult{
-			newRoot:      t.cache.newInternalNode(labelPrefix, cpLength, leafNode, left, right),
-			insertedLeaf: newLeaf,
-			existed:      false,
+			newRoot:           t.cache.newInternalNode(labelPrefix, cpLength, leafNode, left, right),
+			insertedLeaf:      newLeaf,
+			insertedLeafDepth: bitDepth + cpLength,
+			existed:           false,
 		}, nil
 	case *node.LeafNode:
 		// If the key matches, we can just update the value.
 		if n.Key.Equal(key) {
 			if bytes.Equal(n.Value, val) {
 				return insertResult{
-					newRoot:      ptr,
-					insertedLeaf: ptr,
-					existed:      true,
+					newRoot:           ptr,
+					insertedLeaf:      ptr,
+					insertedLeafDepth: bitDepth,
+					existed:           true,
 				}, nil
 			}
 
@@ -189,15 +224,18 @@ func (t *tree) doInsert(
 				t.pendingRemovedNodes = append(t.pendingRemovedNodes, ptr.ExtractUnchecked())
 			}
 
+			t.saveNode(ptr)
+			t.pendingSummary.valueBytes += int64(len(val)) - int64(len(n.Value))
 			n.Value = val
 			n.Clean = false
 			ptr.SetDirty()
 			// No longer eligible for eviction as it is dirty.
 			t.cache.rollbackNode(ptr)
 			return insertResult{
-				newRoot:      ptr,
-				insertedLeaf: ptr,
-				existed:      true,
+				newRoot:           ptr,
+				insertedLeaf:      ptr,
+				insertedLeafDepth: bitDepth,
+				existed:           true,
 			}, nil
 		}
 
@@ -208,7 +246,10 @@ func (t *tree) doInsert(
 		// Key mismatches the label at position cpLength. Split the edge.
 		labelPrefix, _ := leafKeyRemainder.Split(cpLength, leafKeyRemainder.BitLength())
 		newLeaf := t.cache.newLeafNode(key, val)
+		t.pendingSummary.addLeaf(val)
+		t.pendingSummary.nodes++
 		result.insertedLeaf = newLeaf
+		result.insertedLeafDepth = bitDepth + cpLength
 		var leafNode, left, right *node.Pointer
 
 		if key.BitLength()-bitDepth == cpLength {
@@ -24,6 +24,7 @@ func (t *tree) SyncIterate(ctx context.Context, request *syncer.IterateRequest)
 	if !t.cache.pendingRoot.IsClean() {
 		return nil, syncer.ErrDirtyRoot
 	}
+	defer t.trackRequestStats(ctx)()
 	pb, err := syncer.NewProofBuilderForVersion(request.Tree.Root.Hash, request.Tree.Root.Hash, request.ProofVersion)
 	if err != nil {
 		return nil, err
@@ -32,7 +33,7 @@ func (t *tree) SyncIterate(ctx context.Context, request *syncer.IterateRequest)
 	// Create an iterator which generates proofs. Always anchor the proof at the
 	// root as an iterator may encompass many subtrees. Make sure to propagate
 	// prefetching to any upstream remote syncers.
-	it := t.NewIterator(ctx,
+	it := newTreeIterator(ctx, t,
 		WithProofBuilder(pb),
 		IteratorPrefetch(request.Prefetch),
 	)
@@ -80,7 +81,9 @@ func (t *tree) newFetcherSyncIterate(key node.Key, prefetch uint16) readSyncFetc
 
 // Iterator is a tree iterator.
 //
-// Iterators are not safe for concurrent use.
+// Iterators are not safe for concurrent use. However, an iterator may be used concurrently with
+// other operations on its tree. In case the tree is modified, the iterator continues from its
+// current key in the modified tree.
 type Iterator interface {
 	// Valid checks whether the iterator points to a valid item.
 	Valid() bool
@@ -136,6 +139,13 @@ type treeIterator struct {
 	value    []byte
 
 	proofBuilder *syncer.ProofBuilder
+
+	// locking specifies whether the iterator acquires the cache lock while moving, which is
+	// the case for iterators returned by NewIterator. Iterators used internally while already
+	// holding the cache lock must not acquire it.
+	locking bool
+	// generation is the cache generation after the last move of a locking iterator.
+	generation uint64
 }
 
 // IteratorOption is a configuration option for a tree iterator.
@@ -158,7 +168,10 @@ func WithProofBuilder(pb *syncer.ProofBuilder) IteratorOption {
 	}
 }
 
-func newTreeIterator(ctx context.Context, tree *tree, options ...IteratorOption) Iterator {
+// newTreeIterator creates a new iterator which does not acquire the cache lock.
+//
+// The returned iterator must only be used while holding the cache lock.
+func newTreeIterator(ctx context.Context, tree *tree, options ...IteratorOption) *treeIterator {
 	it := &treeIterator{
 		ctx:  ctx,
 		tree: tree,
@@ -197,7 +210,16 @@ func (it *treeIterator) Seek(key node.Key) {
 	if it.err != nil {
 		return
 	}
+	if it.locking {
+		it.tree.cache.Lock()
+		defer it.tree.cache.Unlock()
+		defer it.updateGeneration()
+	}
+
+	it.seek(key)
+}
 
+func (it *treeIterator) seek(key node.Key) {
 	it.reset()
 	err := it.doNext(it.tree.cache.pendingRoot, 0, node.Key{}, key, visitBefore)
 	if err != nil {
@@ -210,6 +232,23 @@ func (it *treeIterator) Next() {
 	if it.err != nil {
 		return
 	}
+	if it.locking {
+		it.tree.cache.Lock()
+		defer it.tree.cache.Unlock()
+		defer it.updateGeneration()
+
+		// Other operations may have evicted or modified the nodes on the iterator's path since
+		// the last move, so the position needs to be re-established from the root.
+		if it.key != nil && (it.generation != it.tree.cache.generation || !it.pathCached()) {
+			key := it.key
+			it.seek(key)
+			if !it.Valid() || !it.key.Equal(key) {
+				// The current key has been removed, so the iterator already points to the
+				// following key.
+				return
+			}
+		}
+	}
 
 	for len(it.pos) > 0 {
 		// Start where we left off.
@@ -246,6 +285,28 @@ func (it *treeIterator) Next() {
 	it.value = nil
 }
 
+// pathCached returns true iff all nodes on the iterator's path are still cached.
+//
+// Evicting a node also evicts its cached subtree, so in case any node on the path has been
+// evicted, the nodes below it are also no longer cached.
+//
+// Must be called while holding the cache lock.
+func (it *treeIterator) pathCached() bool {
+	for _, atom := range it.pos {
+		if atom.ptr.Node == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// updateGeneration records the current cache generation.
+//
+// Must be called while holding the cache lock.
+func (it *treeIterator) updateGeneration() {
+	it.generation = it.tree.cache.generation
+}
+
 func (it *treeIterator) doNext(ptr *node.Pointer, bitDepth node.Depth, path, key node.Key, state visitState) error { // nolint: gocyclo
 	// Dereference the node, possibly making a remote request.
 	nd, err := it.tree.cache.derefNodePtr(it.ctx, ptr, it.tree.newFetcherSyncIterate(key, it.prefetch))
@@ -3,6 +3,7 @@ package mkvs
 import (
 	"context"
 	"encoding/hex"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -221,6 +222,83 @@ func TestIteratorEviction(t *testing.T) {
 	require.EqualValues(t, 2, stats.SyncIterateCount, "SyncIterateCount")
 }
 
+func TestIteratorLeafEviction(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	source := New(nil, nil, 0, Capacity(0, 0))
+	defer source.Close()
+
+	// Use keys of the same length so that no leaf nodes are embedded in internal nodes, as
+	// evicting those also evicts the internal node.
+	var keys [][]byte
+	expected := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key %03d", i))
+		value := []byte(fmt.Sprintf("value %03d", i))
+		err := source.Insert(ctx, key, value)
+		require.NoError(err, "Insert")
+		keys = append(keys, key)
+		expected[string(key)] = value
+	}
+
+	var root node.Root
+	_, rootHash, err := source.Commit(ctx, root.Namespace, root.Version)
+	require.NoError(err, "Commit")
+	root.Hash = rootHash
+
+	// Create a remote tree which caches all internal nodes but only a few values so that
+	// leaf nodes are evicted by other operations while iterating.
+	remote := NewWithRoot(source, nil, root, Capacity(0, 64))
+	defer remote.Close()
+	rt := remote.(*tree)
+
+	// Count how many times the root is visited while moving the iterator.
+	var (
+		moving     bool
+		rootDerefs int
+	)
+	rt.cache.Lock()
+	rt.cache.derefObserver = func(ptr *node.Pointer) {
+		if moving && ptr == rt.cache.pendingRoot {
+			rootDerefs++
+		}
+	}
+	rt.cache.Unlock()
+
+	iterate := func(evict bool) int {
+		it := remote.NewIterator(ctx)
+		defer it.Close()
+
+		rootDerefs = 0
+		var (
+			count   int
+			lastKey node.Key
+		)
+		for it.Rewind(); it.Valid(); {
+			require.True(lastKey == nil || lastKey.Compare(it.Key()) < 0, "iterator should return keys in order")
+			require.EqualValues(expected[string(it.Key())], it.Value(), "iterator should return correct values")
+			lastKey = it.Key()
+			count++
+
+			if evict {
+				// Fetching other keys evicts leaf nodes but leaves the iterator's path intact.
+				_, err = remote.Get(ctx, keys[(count+50)%len(keys)])
+				require.NoError(err, "Get")
+			}
+
+			moving = true
+			it.Next()
+			moving = false
+		}
+		require.NoError(it.Err(), "iterator should not fail")
+		require.Equal(len(keys), count, "iterator should visit all keys")
+		return rootDerefs
+	}
+
+	expectedDerefs := iterate(false)
+	require.Equal(expectedDerefs, iterate(true), "evicting leaf nodes should not force the iterator to seek again")
+}
+
 type testCase struct {
 	seek node.Key
 	pos  int
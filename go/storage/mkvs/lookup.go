@@ -1,6 +1,7 @@
 package mkvs
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 
@@ -13,6 +14,13 @@ const syncProofsVersion uint16 = 0
 
 // Implements Tree.
 func (t *tree) Get(ctx context.Context, key []byte) ([]byte, error) {
+	if err := t.checkKeyWidth(key); err != nil {
+		return nil, err
+	}
+	if t.hotKeys != nil {
+		t.hotKeys.record(key)
+	}
+
 	t.cache.Lock()
 	defer t.cache.Unlock()
 
@@ -33,43 +41,451 @@ func (t *tree) Get(ctx context.Context, key []byte) ([]byte, error) {
 	return t.doGet(ctx, t.cache.pendingRoot, 0, key, doGetOptions{}, false)
 }
 
+// Implements Tree.
+func (t *tree) GetPreview(ctx context.Context, key []byte, maxValueBytes int) (*node.ValuePreview, error) {
+	if maxValueBytes < 0 {
+		return nil, fmt.Errorf("mkvs: invalid maximum value size: %d", maxValueBytes)
+	}
+
+	value, err := t.Get(ctx, key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return node.PreviewValue(value, maxValueBytes), nil
+}
+
 // Implements syncer.ReadSyncer.
 func (t *tree) SyncGet(ctx context.Context, request *syncer.GetRequest) (*syncer.ProofResponse, error) {
+	rsp, _, err := t.SyncGetWithExistence(ctx, request)
+	return rsp, err
+}
+
+// Implements Tree.
+func (t *tree) SyncGetWithExistence(ctx context.Context, request *syncer.GetRequest) (*syncer.ProofResponse, bool, error) {
+	if t.hotKeys != nil {
+		t.hotKeys.record(request.Key)
+	}
+
 	t.cache.Lock()
 	defer t.cache.Unlock()
 
 	if t.cache.isClosed() {
-		return nil, ErrClosed
+		return nil, false, ErrClosed
 	}
 	if !request.Tree.Root.Equal(&t.cache.syncRoot) {
-		return nil, syncer.ErrInvalidRoot
+		return nil, false, syncer.ErrInvalidRoot
 	}
 	if !t.cache.pendingRoot.IsClean() {
-		return nil, syncer.ErrDirtyRoot
+		return nil, false, syncer.ErrDirtyRoot
 	}
+	defer t.trackRequestStats(ctx)()
 
 	// Remember where the path from root to target node ends (will end).
 	t.cache.markPosition()
 
 	pb, err := syncer.NewProofBuilderForVersion(request.Tree.Root.Hash, request.Tree.Position, request.ProofVersion)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	opts := doGetOptions{
 		proofBuilder:    pb,
 		includeSiblings: request.IncludeSiblings,
 	}
-	if _, err = t.doGet(ctx, t.cache.pendingRoot, 0, request.Key, opts, false); err != nil {
-		return nil, err
+	value, err := t.doGet(ctx, t.cache.pendingRoot, 0, request.Key, opts, false)
+	if err != nil {
+		return nil, false, err
+	}
+	if request.IncludeWitness {
+		if err = t.includeSuccessorPath(ctx, request.Key, pb); err != nil {
+			return nil, false, err
+		}
 	}
 	proof, err := pb.Build(ctx)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	return &syncer.ProofResponse{
 		Proof: *proof,
-	}, nil
+	}, value != nil, nil
+}
+
+// includeSuccessorPath includes the path to the first key following the given key into the
+// proof. Together with the path to the key itself, this makes the proof cover all keys between
+// the two, as any such key would have to be stored in a subtree along the two paths.
+//
+// Must be called while holding the cache lock.
+func (t *tree) includeSuccessorPath(ctx context.Context, key node.Key, pb *syncer.ProofBuilder) error {
+	it := newTreeIterator(ctx, t, WithProofBuilder(pb))
+	defer it.Close()
+
+	it.Seek(key)
+	if it.Valid() && it.Key().Equal(key) {
+		it.Next()
+	}
+	return it.Err()
+}
+
+// Implements Tree.
+func (t *tree) GetMultiproof(ctx context.Context, root node.Root, keys [][]byte, proofVersion uint16) (*syncer.Proof, error) {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return nil, ErrClosed
+	}
+	if !root.Equal(&t.cache.syncRoot) {
+		return nil, syncer.ErrInvalidRoot
+	}
+	if !t.cache.pendingRoot.IsClean() {
+		return nil, syncer.ErrDirtyRoot
+	}
+
+	pb, err := syncer.NewProofBuilderForVersion(root.Hash, root.Hash, proofVersion)
+	if err != nil {
+		return nil, err
+	}
+	opts := doGetOptions{
+		proofBuilder: pb,
+	}
+	for _, key := range keys {
+		// Remember where the path from root to target node ends (will end).
+		t.cache.markPosition()
+
+		if _, err = t.doGet(ctx, t.cache.pendingRoot, 0, key, opts, false); err != nil {
+			return nil, err
+		}
+	}
+	return pb.Build(ctx)
+}
+
+// streamMultiproofBatchSize is the maximum number of proof entries StreamMultiproof prepares
+// while holding the cache lock before passing them to the callback.
+const streamMultiproofBatchSize = 64
+
+// multiproofFrame is a subtree whose proof entries still need to be streamed by
+// StreamMultiproof.
+type multiproofFrame struct {
+	ptr      *node.Pointer
+	bitDepth node.Depth
+	keys     []node.Key
+}
+
+// Implements Tree.
+func (t *tree) StreamMultiproof(
+	ctx context.Context,
+	root node.Root,
+	keys [][]byte,
+	proofVersion uint16,
+	fn func(entry []byte) error,
+) error {
+	t.cache.Lock()
+	if err := t.checkStreamRoot(root); err != nil {
+		t.cache.Unlock()
+		return err
+	}
+	if proofVersion < syncer.MinimumProofVersion || proofVersion > syncer.LatestProofVersion {
+		t.cache.Unlock()
+		return fmt.Errorf("%w: %d", syncer.ErrUnsupportedProofVersion, proofVersion)
+	}
+
+	nodeKeys := make([]node.Key, 0, len(keys))
+	for _, key := range keys {
+		nodeKeys = append(nodeKeys, key)
+	}
+	stack := []multiproofFrame{{ptr: t.cache.pendingRoot, keys: nodeKeys}}
+	t.cache.Unlock()
+
+	// Prepare the entries in batches while holding the lock, but call fn without holding it so
+	// that a slow receiver does not block other operations.
+	for len(stack) > 0 {
+		var (
+			entries [][]byte
+			err     error
+		)
+		if entries, stack, err = t.streamMultiproofBatch(ctx, root, stack, proofVersion); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err = fn(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkStreamRoot checks that a multiproof for the given root can be streamed.
+//
+// Must be called while holding the cache lock.
+func (t *tree) checkStreamRoot(root node.Root) error {
+	if t.cache.isClosed() {
+		return ErrClosed
+	}
+	if !root.Equal(&t.cache.syncRoot) {
+		return syncer.ErrInvalidRoot
+	}
+	if !t.cache.pendingRoot.IsClean() {
+		return syncer.ErrDirtyRoot
+	}
+	return nil
+}
+
+// streamMultiproofBatch returns up to streamMultiproofBatchSize proof entries for the subtrees
+// on the given stack in pre-order traversal together with the stack of remaining subtrees.
+//
+// Nodes on the paths to the given keys are included in full, all other nodes are only included
+// by hash. The visited nodes are the same as the ones included by doGet, so the entries match
+// the ones of a proof built by GetMultiproof.
+func (t *tree) streamMultiproofBatch(
+	ctx context.Context,
+	root node.Root,
+	stack []multiproofFrame,
+	proofVersion uint16,
+) ([][]byte, []multiproofFrame, error) {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	// The tree may have been modified since the previous batch.
+	if err := t.checkStreamRoot(root); err != nil {
+		return nil, nil, err
+	}
+
+	// Remember where the path from root to target node ends (will end).
+	t.cache.markPosition()
+
+	var entries [][]byte
+	for len(stack) > 0 && len(entries) < streamMultiproofBatchSize {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+
+		frame := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		entry, nd, err := t.multiproofEntry(ctx, frame.ptr, frame.keys, proofVersion)
+		if err != nil {
+			return nil, nil, err
+		}
+		entries = append(entries, entry)
+
+		n, ok := nd.(*node.InternalNode)
+		if !ok {
+			continue
+		}
+		bitLength := frame.bitDepth + n.LabelBitLength
+
+		var leafKeys, leftKeys, rightKeys []node.Key
+		for _, key := range frame.keys {
+			switch {
+			case key.BitLength() == bitLength:
+				// Lookup key ends here, look into LeafNode.
+				leafKeys = append(leafKeys, key)
+			case key.BitLength() < bitLength:
+				// Lookup key is too short for the current n.Label. It's not stored.
+			case key.GetBit(bitLength):
+				rightKeys = append(rightKeys, key)
+			default:
+				leftKeys = append(leftKeys, key)
+			}
+		}
+
+		if proofVersion > 0 {
+			// In version 1, the leaf node is added separately, as a child. Add it right away as
+			// it cannot be loaded on its own in case this node is evicted before the next batch.
+			if entry, _, err = t.multiproofEntry(ctx, n.LeafNode, leafKeys, proofVersion); err != nil {
+				return nil, nil, err
+			}
+			entries = append(entries, entry)
+		}
+
+		// Push children in reverse order so that they are visited in pre-order.
+		stack = append(stack,
+			multiproofFrame{ptr: n.Right, bitDepth: bitLength, keys: rightKeys},
+			multiproofFrame{ptr: n.Left, bitDepth: bitLength, keys: leftKeys},
+		)
+	}
+	return entries, stack, nil
+}
+
+// multiproofEntry returns the proof entry for the node referenced by the given pointer. In case
+// the node is on the path to any of the given keys, it is included in full and also returned.
+//
+// Must be called while holding the cache lock.
+func (t *tree) multiproofEntry(
+	ctx context.Context,
+	ptr *node.Pointer,
+	keys []node.Key,
+	proofVersion uint16,
+) ([]byte, node.Node, error) {
+	var nd node.Node
+	if len(keys) > 0 {
+		// Dereference the node, possibly making a remote request.
+		var err error
+		nd, err = t.cache.derefNodePtr(ctx, ptr, t.newFetcherSyncGet(keys[0], false))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if nd == nil {
+		// Node is not on the path to any of the keys, just add hash of subtree.
+		entry, err := syncer.HashProofEntry(ptr.GetHash())
+		return entry, nil, err
+	}
+
+	entry, err := syncer.FullProofEntry(nd, proofVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	return entry, nd, nil
+}
+
+// Implements Tree.
+func (t *tree) KeyDepth(ctx context.Context, root node.Root, key node.Key) (node.Depth, bool, error) {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return 0, false, ErrClosed
+	}
+	if !root.Equal(&t.cache.syncRoot) {
+		return 0, false, syncer.ErrInvalidRoot
+	}
+	if !t.cache.pendingRoot.IsClean() {
+		return 0, false, syncer.ErrDirtyRoot
+	}
+
+	// Remember where the path from root to target node ends (will end).
+	t.cache.markPosition()
+
+	ptr := t.cache.pendingRoot
+	var bitDepth node.Depth
+	for {
+		if ctx.Err() != nil {
+			return 0, false, ctx.Err()
+		}
+
+		// Dereference the node, possibly making a remote request.
+		nd, err := t.cache.derefNodePtr(ctx, ptr, t.newFetcherSyncGet(key, false))
+		if err != nil {
+			return 0, false, err
+		}
+
+		switch n := nd.(type) {
+		case nil:
+			// Reached a nil node, there is nothing here.
+			return bitDepth, false, nil
+		case *node.InternalNode:
+			bitLength := bitDepth + n.LabelBitLength
+
+			switch {
+			case key.BitLength() == bitLength:
+				// Lookup key ends here, look into LeafNode.
+				ptr = n.LeafNode
+			case key.BitLength() < bitLength:
+				// Lookup key is too short for the current n.Label. It's not stored.
+				return bitDepth, false, nil
+			case key.GetBit(bitLength):
+				ptr = n.Right
+			default:
+				ptr = n.Left
+			}
+			bitDepth = bitLength
+		case *node.LeafNode:
+			return bitDepth, n.Key.Equal(key), nil
+		default:
+			panic(fmt.Sprintf("mkvs: unknown node type: %+v", n))
+		}
+	}
+}
+
+// Implements Tree.
+func (t *tree) LongestPrefixMatch(ctx context.Context, root node.Root, key node.Key) (node.Key, []byte, bool, error) {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return nil, nil, false, ErrClosed
+	}
+	if !root.Equal(&t.cache.syncRoot) {
+		return nil, nil, false, syncer.ErrInvalidRoot
+	}
+	if !t.cache.pendingRoot.IsClean() {
+		return nil, nil, false, syncer.ErrDirtyRoot
+	}
+
+	// Remember where the path from root to target node ends (will end).
+	t.cache.markPosition()
+
+	var (
+		match *node.LeafNode
+		ptr   = t.cache.pendingRoot
+	)
+	// checkLeaf records the given leaf node as the best match so far in case its key is a
+	// prefix of the lookup key. Leaves are visited in order of increasing key length.
+	checkLeaf := func(ptr *node.Pointer) error {
+		nd, err := t.cache.derefNodePtr(ctx, ptr, t.newFetcherSyncGet(key, false))
+		if err != nil {
+			return err
+		}
+		if n, ok := nd.(*node.LeafNode); ok && bytes.HasPrefix(key, n.Key) {
+			match = n
+		}
+		return nil
+	}
+
+	var bitDepth node.Depth
+	for {
+		if ctx.Err() != nil {
+			return nil, nil, false, ctx.Err()
+		}
+
+		// Dereference the node, possibly making a remote request.
+		nd, err := t.cache.derefNodePtr(ctx, ptr, t.newFetcherSyncGet(key, false))
+		if err != nil {
+			return nil, nil, false, err
+		}
+
+		switch n := nd.(type) {
+		case nil:
+		case *node.InternalNode:
+			bitLength := bitDepth + n.LabelBitLength
+			if key.BitLength() < bitLength {
+				// All keys below this node are longer than the lookup key.
+				break
+			}
+
+			// A key stored at this node is shorter than or equal to the lookup key.
+			if n.LeafNode != nil {
+				if err = checkLeaf(n.LeafNode); err != nil {
+					return nil, nil, false, err
+				}
+			}
+			if key.BitLength() == bitLength {
+				break
+			}
+
+			if key.GetBit(bitLength) {
+				ptr = n.Right
+			} else {
+				ptr = n.Left
+			}
+			bitDepth = bitLength
+			continue
+		case *node.LeafNode:
+			if bytes.HasPrefix(key, n.Key) {
+				match = n
+			}
+		default:
+			panic(fmt.Sprintf("mkvs: unknown node type: %+v", n))
+		}
+		break
+	}
+
+	if match == nil {
+		return nil, nil, false, nil
+	}
+	return match.Key, match.Value, true, nil
 }
 
 func (t *tree) newFetcherSyncGet(key node.Key, includeSiblings bool) readSyncFetcher {
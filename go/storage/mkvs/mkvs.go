@@ -20,11 +20,34 @@ var (
 	// ErrKnownRootMismatch is the error returned by CommitKnown when the known
 	// root mismatches.
 	ErrKnownRootMismatch = errors.New("mkvs: known root mismatch")
+
+	// ErrInvalidKeyRange is the error returned when the start key of a key range
+	// is greater than its end key.
+	ErrInvalidKeyRange = errors.New("mkvs: invalid key range")
+
+	// ErrKeyWidthMismatch is the error returned when a key does not match the fixed key width
+	// configured via WithFixedKeyWidth.
+	ErrKeyWidthMismatch = errors.New("mkvs: key does not match fixed key width")
+
+	// ErrSubtreeMismatch is the error returned when a received subtree does not match the
+	// corresponding subtree of the local tree.
+	ErrSubtreeMismatch = errors.New("mkvs: subtree mismatch")
+
+	// ErrInvalidSubtreeID is the error returned when the path of a subtree identifier does not
+	// match its bit depth.
+	ErrInvalidSubtreeID = errors.New("mkvs: invalid subtree identifier")
+
+	// ErrNodeHashMismatch is the error returned by Verify when the hash of a node does not match
+	// the hash it is referenced by.
+	ErrNodeHashMismatch = errors.New("mkvs: node hash mismatch")
 )
 
 // ImmutableKeyValueTree is the immutable key-value store tree interface.
 type ImmutableKeyValueTree interface {
 	// Get looks up an existing key.
+	//
+	// Returns nil if the key does not exist. A key storing a zero-length value is returned as
+	// a non-nil empty slice.
 	Get(ctx context.Context, key []byte) ([]byte, error)
 
 	// NewIterator returns a new iterator over the tree.
@@ -36,6 +59,8 @@ type KeyValueTree interface {
 	ImmutableKeyValueTree
 
 	// Insert inserts a key/value pair into the tree.
+	//
+	// A nil value is stored as a zero-length value; use Remove to remove a key.
 	Insert(ctx context.Context, key, value []byte) error
 
 	// RemoveExisting removes a key from the tree and returns the previous value.
@@ -81,6 +106,101 @@ type Tree interface {
 	ClosableTree
 	syncer.ReadSyncer
 
+	// SyncGetWithExistence is like SyncGet but additionally returns whether the requested key
+	// exists in the tree, so callers do not need to inspect the proof to tell inclusion from
+	// exclusion.
+	SyncGetWithExistence(ctx context.Context, request *syncer.GetRequest) (*syncer.ProofResponse, bool, error)
+
+	// Snapshot returns a read-only snapshot of the given root, which must be the root the tree
+	// was created with. The snapshot is isolated from subsequent commits and pruning and pins
+	// all of its nodes in memory until it is released.
+	//
+	// In case the root does not fit into the snapshot capacity configured via SnapshotCapacity,
+	// ErrSnapshotTooLarge is returned.
+	Snapshot(ctx context.Context, root node.Root) (*Snapshot, error)
+
+	// GetPreview looks up an existing key and returns a preview of its value containing at
+	// most maxValueBytes bytes, together with the total value length.
+	//
+	// Returns nil if the key does not exist.
+	GetPreview(ctx context.Context, key []byte, maxValueBytes int) (*node.ValuePreview, error)
+
+	// KeyDepth returns the bit depth at which the leaf node for the given key is located in the
+	// given root, which must be the root the tree was created with, and whether the key exists.
+	//
+	// In case the key does not exist, the returned depth is the depth at which the lookup
+	// terminated.
+	KeyDepth(ctx context.Context, root node.Root, key node.Key) (node.Depth, bool, error)
+
+	// GetValueHistory returns the value of the given key in each of the given roots, or nil
+	// where the key does not exist. The roots need not include the root the tree was created
+	// with.
+	//
+	// Consecutive roots are expected to be related (e.g., successive versions) as the lookup in
+	// each root stops as soon as it reaches a node that the lookup in the previous root visited,
+	// reusing its result. This makes the method much cheaper than independent lookups in case
+	// the key rarely changes.
+	GetValueHistory(ctx context.Context, key node.Key, roots []node.Root) ([][]byte, error)
+
+	// LongestPrefixMatch returns the longest key stored in the given root, which must be the
+	// root the tree was created with, that is a prefix of the given key, together with its
+	// value. A key is a prefix of itself, so an exact match is returned in case the key exists.
+	//
+	// In case no stored key is a prefix of the given key, found is false.
+	LongestPrefixMatch(ctx context.Context, root node.Root, key node.Key) (matchedPrefix node.Key, value []byte, found bool, err error)
+
+	// MeasureReadAmplification looks up the given keys in the given root, which must be the
+	// root the tree was created with, and reports the number of node dereferences the lookups
+	// cost. On a tree with a cold cache, each miss is a node database or remote syncer read.
+	MeasureReadAmplification(ctx context.Context, root node.Root, keys []node.Key) (*ReadAmplification, error)
+
+	// SampleKeys returns up to n pseudo-random keys present in the given root, which must be
+	// the root the tree was created with, in sorted order. The sample is deterministic for a
+	// given seed. In case the root contains at most n keys, all keys are returned.
+	//
+	// The whole tree is walked, so calling this method on large trees is expensive.
+	SampleKeys(ctx context.Context, root node.Root, n int, seed int64) ([]node.Key, error)
+
+	// GetLeafWithSiblings returns the leaf node for the given key in the given root, which must
+	// be the root the tree was created with, together with the sibling hashes along its path.
+	// The returned kit can be used to recompute the root hash after changing the key's value
+	// and its steps form a flat inclusion proof which can be checked using VerifyLeafProof.
+	//
+	// In case the key does not exist, nil is returned.
+	GetLeafWithSiblings(ctx context.Context, root node.Root, key node.Key) (*LeafProofKit, error)
+
+	// GetMultiproof returns a single proof for the existence or non-existence of all the given
+	// keys in the given root which must be the root the tree was created with. Nodes shared by
+	// the paths to multiple keys are only included once.
+	//
+	// The proof can be verified using syncer.ProofVerifier.VerifyMultiproof.
+	GetMultiproof(ctx context.Context, root node.Root, keys [][]byte, proofVersion uint16) (*syncer.Proof, error)
+
+	// StreamMultiproof is like GetMultiproof but instead of building the proof in memory, it
+	// passes each proof entry to fn as soon as it is produced, in the order of the proof
+	// entries. This keeps memory use flat when proving many keys, e.g., when forwarding the
+	// proof over the network.
+	//
+	// The entries are prepared in small batches and fn is called without holding the tree lock,
+	// so fn may use the tree. In case the tree is modified while streaming, streaming fails with
+	// syncer.ErrInvalidRoot or syncer.ErrDirtyRoot.
+	//
+	// Streaming stops at the first error returned by fn or when the context is canceled. The
+	// streamed proof can be incrementally verified using syncer.ProofStreamVerifier.
+	StreamMultiproof(ctx context.Context, root node.Root, keys [][]byte, proofVersion uint16, fn func(entry []byte) error) error
+
+	// PushMissing pushes all nodes of the given root, which must be the root the tree was created
+	// with, that the target does not have yet into the target and returns the number of pushed
+	// nodes. Nodes are pushed in pre-order, so parents are pushed before their children.
+	//
+	// The hasNode function reports whether the target already has the node with the given hash.
+	// As a node's hash commits to its whole subtree, the target is assumed to have the whole
+	// subtree of such nodes, which is skipped without being loaded.
+	//
+	// Both hasNode and the target are called without holding the tree lock. In case the tree is
+	// modified while pushing, pushing fails with syncer.ErrInvalidRoot or syncer.ErrDirtyRoot.
+	PushMissing(ctx context.Context, root node.Root, target NodeSink, hasNode func(hash.Hash) bool) (int, error)
+
 	// PrefetchPrefixes populates the in-memory tree with nodes for keys
 	// starting with given prefixes.
 	PrefetchPrefixes(ctx context.Context, prefixes [][]byte, limit uint16) error
@@ -88,7 +208,17 @@ type Tree interface {
 	// ApplyWriteLog applies the operations from a write log to the current tree.
 	//
 	// The caller is responsible for calling Commit.
-	ApplyWriteLog(ctx context.Context, wl writelog.Iterator) error
+	ApplyWriteLog(ctx context.Context, wl writelog.Iterator, options ...ApplyOption) error
+
+	// ApplyIf applies the given write log to the given root, which must be the root the tree
+	// was created with, and commits the result as the given version, but only in case all
+	// conditions hold in the given root.
+	//
+	// In case a condition does not hold, nothing is applied and syncer.ErrConditionFailed is
+	// returned, naming the key of the failed condition. In case applying or committing the
+	// write log fails, the tree is rolled back to the given root. The tree must not have any
+	// pending updates.
+	ApplyIf(ctx context.Context, oldRoot node.Root, version uint64, conditions []KeyValueCond, wl writelog.WriteLog) (node.Root, error)
 
 	// CommitKnown checks that the computed root matches a known root and
 	// if so, commits tree updates to the underlying database and returns
@@ -102,9 +232,167 @@ type Tree interface {
 	// the write log and new merkle root.
 	Commit(ctx context.Context, namespace common.Namespace, version uint64, options ...CommitOption) (writelog.WriteLog, hash.Hash, error)
 
+	// PendingRootHash returns the hash the root would have if the pending updates were committed
+	// now and whether there are no pending updates. This can be used to compare the pending
+	// state against an expected root before committing.
+	//
+	// The hashes of all nodes changed by pending updates are recomputed on each call.
+	PendingRootHash() (hash.Hash, bool)
+
+	// Rollback discards all pending updates and resets the tree to the last committed root.
+	//
+	// Nodes modified by the pending updates are restored in memory, without reloading them from
+	// the node database.
+	Rollback() error
+
+	// CommitPrefix commits only the pending updates to keys starting with the given prefix
+	// and returns the new root. All other pending updates remain uncommitted and are applied
+	// on top of the new root.
+	//
+	// All pending updates are re-applied in the process, so this is more expensive than Commit.
+	// The tree must not have been created with the WithoutWriteLog option.
+	CommitPrefix(ctx context.Context, prefix node.Key, namespace common.Namespace, version uint64) (node.Root, error)
+
 	// DumpLocal dumps the tree in the local memory into the given writer.
 	DumpLocal(ctx context.Context, w io.Writer, maxDepth node.Depth)
 
+	// RenderDOT writes a Graphviz DOT representation of the given root, which must be the root
+	// the tree was created with, into the given writer. Internal nodes are labeled with their
+	// label bits and leaf nodes with their truncated key and value hash.
+	//
+	// The maxDepth is counted in node levels (not key bits), with the root node at level zero.
+	// Nodes deeper than maxDepth are collapsed into a single placeholder node. A maxDepth of
+	// zero renders the whole tree.
+	RenderDOT(ctx context.Context, root node.Root, maxDepth int, w io.Writer) error
+
+	// HotKeys returns up to topN keys with the most Get and SyncGet accesses within the window
+	// configured using the WithHotKeyTracking or WithHotKeyTracker options, ordered by
+	// decreasing access count. In case the tracker is shared, accesses via all trees sharing it
+	// are included.
+	//
+	// Returns nil in case hot-key tracking is not enabled.
+	HotKeys(topN int) []HotKeyStat
+
+	// CacheStats returns the statistics of the in-memory cache.
+	CacheStats() CacheStats
+
 	// RootType returns the storage root type.
 	RootType() node.RootType
+
+	// HealthCheck performs a lightweight read of the root node of the last committed root from
+	// the node database and returns an error in case the node database is unresponsive or
+	// inconsistent. Trees without a committed root are always considered healthy.
+	//
+	// The check is bounded by the node load timeout if configured and a short default timeout
+	// otherwise. It does not go through the in-memory cache and is safe to call frequently, as
+	// at most one read is in flight at any time and concurrent calls share its result.
+	HealthCheck(ctx context.Context) error
+
+	// RootInfo returns a summary of the given root which must be the root
+	// the tree was created with.
+	//
+	// The summary is computed lazily by walking the whole tree, so calling
+	// this method on large trees is expensive unless the root was committed
+	// with the WithSummary option, which stores the summary in the node
+	// database.
+	RootInfo(ctx context.Context, root node.Root) (*RootInfo, error)
+
+	// ListRootsUnder returns all roots retained in the node database whose namespace matches
+	// the first prefixBits bits of the given namespace prefix, ordered by version. A zero
+	// prefixBits matches all namespaces.
+	//
+	// Each node database only stores roots of a single namespace, so querying roots across
+	// namespaces requires calling this method on a tree for each of them.
+	ListRootsUnder(ctx context.Context, nsPrefix common.Namespace, prefixBits int) ([]node.Root, error)
+
+	// UniqueFootprint returns the total serialized size and the number of nodes reachable from
+	// the given root, which must be the root the tree was created with, but not from any of the
+	// other roots. This is the amount of storage that would be freed if only the given root was
+	// removed.
+	//
+	// All other roots are loaded from the node database and walked in full, so calling this
+	// method on large trees is expensive.
+	UniqueFootprint(ctx context.Context, root node.Root, otherRoots []node.Root) (int64, int, error)
+
+	// Commitment returns a succinct commitment to the given root which must be the root the
+	// tree was created with. Besides the root hash it contains the number of leaves and an
+	// aggregate of leaf hashes, so a mismatch can be narrowed down to either the structure or
+	// the values.
+	//
+	// Computing the commitment requires walking the whole tree.
+	Commitment(ctx context.Context, root node.Root) (*Commitment, error)
+
+	// GetRangeProof returns a proof for all keys in the inclusive range [startKey, endKey] of
+	// the given root which must be the root the tree was created with.
+	//
+	// The proof also includes the first key following the range (if any) so that its boundary
+	// is covered by the proof.
+	GetRangeProof(ctx context.Context, root node.Root, startKey, endKey node.Key, proofVersion uint16) (*syncer.Proof, error)
+
+	// ExportKV calls fn for each key/value pair of the given root, which must be the root the
+	// tree was created with, in sorted key order.
+	//
+	// Exporting stops at the first error returned by fn or when the context is canceled.
+	//
+	// The function is called without holding the tree lock, so it may use the tree. In case the
+	// tree is modified while exporting, the export fails with syncer.ErrInvalidRoot or
+	// syncer.ErrDirtyRoot.
+	ExportKV(ctx context.Context, root node.Root, fn func(key node.Key, value []byte) error) error
+
+	// ExportRegion writes the part of the given root, which must be the root the tree was
+	// created with, containing all keys starting with the given prefix into the given writer.
+	// Nodes outside the region are only included by hash so that the region can be verified
+	// against the root hash.
+	//
+	// The region can be imported as a partial tree using ImportRegion.
+	ExportRegion(ctx context.Context, root node.Root, prefix node.Key, w io.Writer) error
+
+	// ChangedSubtrees returns the identifiers of the subtrees starting at the given bit depth
+	// whose hashes differ between the old and the new root. Leaves located above the given
+	// depth are treated as subtrees of their own.
+	//
+	// Only nodes above the given depth are walked, so the cost is bounded by the depth rather
+	// than by the size of the trees.
+	ChangedSubtrees(ctx context.Context, oldRoot, newRoot node.Root, depth node.Depth) ([]SubtreeID, error)
+
+	// DivergenceReport returns a summary of the keys added, removed and changed between the
+	// two given roots, including up to sampleSize keys of each kind and the smallest subtree
+	// containing all differences. The report is empty in case the roots are equal.
+	//
+	// Both roots are walked in full, so calling this method on large trees is expensive.
+	DivergenceReport(ctx context.Context, rootA, rootB node.Root, sampleSize int) (*DivergenceReport, error)
+
+	// NodeCountDelta returns the number of nodes (internal and leaf) in the new root minus the
+	// number of nodes in the old root. Subtrees shared by both roots are skipped, so the cost is
+	// proportional to the size of the difference rather than the size of the trees, making it
+	// much cheaper than computing a full diff.
+	NodeCountDelta(ctx context.Context, oldRoot, newRoot node.Root) (int, error)
+
+	// VerifySubtreeAgainstLocal compares the subtree contained in the given proof node by node
+	// against the subtree of the given local root identified by id, and returns an error
+	// wrapping ErrSubtreeMismatch describing the first mismatch. Nodes that the proof only
+	// includes by hash are compared by hash.
+	//
+	// In case the identifier is not well-formed, ErrInvalidSubtreeID is returned.
+	VerifySubtreeAgainstLocal(ctx context.Context, root node.Root, id SubtreeID, proof *syncer.Proof) error
+
+	// GetNodes returns the nodes identified by the given subtree identifiers in the given root,
+	// which must be the root the tree was created with, in the same order. All nodes are fetched
+	// under a single acquisition of the tree lock.
+	//
+	// Failures to fetch individual nodes do not abort the batch and are instead reported in the
+	// corresponding slot of the returned error slice, e.g., db.ErrNodeNotFound in case there is no
+	// such node or ErrInvalidSubtreeID in case the identifier is not well-formed.
+	GetNodes(ctx context.Context, root node.Root, ids []SubtreeID) ([]node.Node, []error, error)
+
+	// Verify checks the integrity of the given root, which must be the root the tree was created
+	// with, by recomputing the hash of every node and comparing it to the hash the node is
+	// referenced by. Leaves are verified in key order and at most maxLeaves leaves are verified
+	// per call (zero means no limit).
+	//
+	// The returned progress can be persisted and passed to a later call to resume verification
+	// where it stopped, without verifying the already verified leaves again. Verification is
+	// finished once the returned progress is complete. In case verification is interrupted by an
+	// error, the returned progress (if any) reflects the leaves verified before the error.
+	Verify(ctx context.Context, root node.Root, progress *VerifyProgress, maxLeaves int) (*VerifyProgress, error)
 }
@@ -0,0 +1,128 @@
+// Package mkvstest provides helpers for generating MKVS tree contents in tests and benchmarks.
+//
+// The package does not depend on the mkvs package, so it can also be used by its tests.
+package mkvstest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/writelog"
+)
+
+// Shape is the shape of a generated tree.
+type Shape uint8
+
+const (
+	// ShapeBalanced generates uniformly random keys, resulting in a tree with leaves at a
+	// depth of about log2 of the number of keys.
+	ShapeBalanced Shape = iota
+	// ShapeSkewed generates keys starting with an increasing number of zero bits followed by
+	// a one bit, resulting in a tree with a long left spine and a leaf branching off each of
+	// its internal nodes.
+	ShapeSkewed
+	// ShapeWide generates keys that share a random common prefix and only differ in a
+	// sequential suffix, resulting in a complete subtree below a single long label.
+	ShapeWide
+)
+
+// String returns the string representation of the tree shape.
+func (s Shape) String() string {
+	switch s {
+	case ShapeBalanced:
+		return "balanced"
+	case ShapeSkewed:
+		return "skewed"
+	case ShapeWide:
+		return "wide"
+	default:
+		return fmt.Sprintf("[unknown shape: %d]", s)
+	}
+}
+
+// TreeParams are the parameters of a generated tree.
+type TreeParams struct {
+	// Shape is the shape of the tree.
+	Shape Shape
+	// Seed is the seed of the random generator. The same parameters always produce the
+	// same tree.
+	Seed int64
+	// KeyCount is the number of keys in the tree.
+	KeyCount int
+	// KeySize is the size of each key in bytes.
+	KeySize int
+	// ValueSize is the size of each value in bytes.
+	ValueSize int
+}
+
+// maxKeys returns the number of distinct keys that can be generated for the given shape.
+func (p *TreeParams) maxKeys() uint64 {
+	bits := 8 * p.KeySize
+	switch p.Shape {
+	case ShapeSkewed:
+		return uint64(bits)
+	case ShapeWide:
+		// Half of the key is the common prefix.
+		bits -= 8 * (p.KeySize / 2)
+	}
+	if bits >= 63 {
+		return 1 << 63
+	}
+	return 1 << bits
+}
+
+// GenerateWriteLog generates the key-value pairs of a tree with the given parameters, sorted
+// by key.
+func GenerateWriteLog(p TreeParams) (writelog.WriteLog, error) {
+	if p.KeyCount < 0 || p.KeySize <= 0 || p.ValueSize < 0 {
+		return nil, fmt.Errorf("mkvstest: invalid tree parameters")
+	}
+	if uint64(p.KeyCount) > p.maxKeys() {
+		return nil, fmt.Errorf("mkvstest: %d keys do not fit into %d-byte keys of a %s tree", p.KeyCount, p.KeySize, p.Shape)
+	}
+
+	rng := rand.New(rand.NewSource(p.Seed)) // nolint: gosec
+	prefix := make([]byte, p.KeySize/2)
+	_, _ = rng.Read(prefix)
+
+	seen := make(map[string]bool, p.KeyCount)
+	wl := make(writelog.WriteLog, 0, p.KeyCount)
+	for i := 0; len(wl) < p.KeyCount; i++ {
+		key := make(node.Key, p.KeySize)
+		switch p.Shape {
+		case ShapeBalanced:
+			_, _ = rng.Read(key)
+		case ShapeSkewed:
+			_, _ = rng.Read(key)
+			for b := 0; b < i/8; b++ {
+				key[b] = 0
+			}
+			key[i/8] = key[i/8]&(0xff>>(i%8+1)) | 0x80>>(i%8)
+		case ShapeWide:
+			var suffix [8]byte
+			binary.BigEndian.PutUint64(suffix[:], uint64(i))
+			n := min(len(suffix), p.KeySize-len(prefix))
+			copy(key, prefix)
+			copy(key[p.KeySize-n:], suffix[len(suffix)-n:])
+		default:
+			return nil, fmt.Errorf("mkvstest: unknown tree shape: %s", p.Shape)
+		}
+		if seen[string(key)] {
+			continue
+		}
+		seen[string(key)] = true
+
+		value := make([]byte, p.ValueSize)
+		_, _ = rng.Read(value)
+		wl = append(wl, writelog.LogEntry{Key: key, Value: value})
+	}
+
+	sort.Slice(wl, func(i, j int) bool {
+		return bytes.Compare(wl[i].Key, wl[j].Key) < 0
+	})
+	return wl, nil
+}
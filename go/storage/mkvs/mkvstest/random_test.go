@@ -0,0 +1,81 @@
+package mkvstest
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateWriteLog(t *testing.T) {
+	for _, shape := range []Shape{ShapeBalanced, ShapeSkewed, ShapeWide} {
+		t.Run(shape.String(), func(t *testing.T) {
+			require := require.New(t)
+
+			p := TreeParams{
+				Shape:     shape,
+				Seed:      42,
+				KeyCount:  100,
+				KeySize:   16,
+				ValueSize: 32,
+			}
+			wl, err := GenerateWriteLog(p)
+			require.NoError(err, "GenerateWriteLog")
+			require.Len(wl, p.KeyCount)
+			for i, entry := range wl {
+				require.Len(entry.Key, p.KeySize)
+				require.Len(entry.Value, p.ValueSize)
+				if i > 0 {
+					require.Equal(-1, bytes.Compare(wl[i-1].Key, entry.Key), "keys should be sorted and unique")
+				}
+			}
+
+			// The same parameters should always produce the same write log.
+			wl2, err := GenerateWriteLog(p)
+			require.NoError(err, "GenerateWriteLog")
+			require.Equal(wl, wl2, "write log should be reproducible given the seed")
+
+			// A different seed should produce a different write log.
+			p.Seed++
+			wl3, err := GenerateWriteLog(p)
+			require.NoError(err, "GenerateWriteLog")
+			require.NotEqual(wl, wl3, "different seeds should produce different write logs")
+
+			switch shape {
+			case ShapeSkewed:
+				// Each key has a different number of leading zero bits, so sorted keys have a
+				// decreasing number of leading zero bits.
+				for i, entry := range wl {
+					zeros := p.KeyCount - 1 - i
+					require.Equal(8*p.KeySize-zeros, new(big.Int).SetBytes(entry.Key).BitLen())
+				}
+			case ShapeWide:
+				// All keys should share the common prefix.
+				for _, entry := range wl {
+					require.Equal(wl[0].Key[:p.KeySize/2], entry.Key[:p.KeySize/2])
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateWriteLogErrors(t *testing.T) {
+	for _, p := range []TreeParams{
+		{KeyCount: -1, KeySize: 1},
+		{KeyCount: 1, KeySize: 0},
+		{KeyCount: 1, KeySize: 1, ValueSize: -1},
+		{Shape: ShapeBalanced, KeyCount: 257, KeySize: 1},
+		{Shape: ShapeSkewed, KeyCount: 9, KeySize: 1},
+		{Shape: ShapeWide, KeyCount: 257, KeySize: 2},
+		{Shape: Shape(42), KeyCount: 1, KeySize: 1},
+	} {
+		_, err := GenerateWriteLog(p)
+		require.Error(t, err, "GenerateWriteLog(%+v) should fail", p)
+	}
+
+	// All possible keys can be generated.
+	wl, err := GenerateWriteLog(TreeParams{Shape: ShapeBalanced, KeyCount: 256, KeySize: 1})
+	require.NoError(t, err, "GenerateWriteLog")
+	require.Len(t, wl, 256)
+}
@@ -90,6 +90,19 @@ type Root struct {
 	Hash hash.Hash `json:"hash"`
 }
 
+// NewRoot creates a new storage root after checking that its namespace is well-formed.
+func NewRoot(namespace common.Namespace, version uint64, rootType RootType, rootHash hash.Hash) (Root, error) {
+	if err := namespace.Validate(); err != nil {
+		return Root{}, fmt.Errorf("mkvs: bad root namespace %s: %w", namespace, err)
+	}
+	return Root{
+		Namespace: namespace,
+		Version:   version,
+		Type:      rootType,
+		Hash:      rootHash,
+	}, nil
+}
+
 // String returns the string representation of a storage root.
 func (r Root) String() string {
 	return fmt.Sprintf("<Root ns=%s version=%d type=%v hash=%s>", r.Namespace, r.Version, r.Type, r.Hash)
@@ -711,6 +724,34 @@ func (n *LeafNode) Equal(other Node) bool {
 	return false
 }
 
+// ValuePreview is a preview of a value which contains at most a given number of bytes.
+type ValuePreview struct {
+	// Value is the value, truncated in case it is too large.
+	Value []byte
+	// Length is the total length of the value in bytes.
+	Length int
+	// Truncated is true in case Value only contains the first bytes of the value.
+	Truncated bool
+}
+
+// PreviewValue returns a preview of the given value containing at most maxValueBytes bytes.
+func PreviewValue(value []byte, maxValueBytes int) *ValuePreview {
+	if maxValueBytes < 0 {
+		maxValueBytes = 0
+	}
+	if len(value) <= maxValueBytes {
+		return &ValuePreview{
+			Value:  value,
+			Length: len(value),
+		}
+	}
+	return &ValuePreview{
+		Value:     append([]byte{}, value[:maxValueBytes]...),
+		Length:    len(value),
+		Truncated: true,
+	}
+}
+
 // UnmarshalBinary unmarshals a node of arbitrary type.
 func UnmarshalBinary(bytes []byte) (Node, error) {
 	// Nodes can be either Internal or Leaf nodes.
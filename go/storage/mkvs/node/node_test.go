@@ -5,6 +5,7 @@ import (
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/oasisprotocol/oasis-core/go/common"
 	"github.com/oasisprotocol/oasis-core/go/common/crypto/hash"
 )
 
@@ -203,3 +204,25 @@ func FuzzNode(f *testing.F) {
 		}
 	})
 }
+
+func TestNewRoot(t *testing.T) {
+	rootHash := hash.NewFromBytes([]byte("root"))
+
+	// Valid namespace.
+	ns := common.NewTestNamespaceFromSeed([]byte("node test ns"), 0)
+	root, err := NewRoot(ns, 1, RootTypeState, rootHash)
+	require.NoError(t, err, "NewRoot")
+	require.EqualValues(t, Root{Namespace: ns, Version: 1, Type: RootTypeState, Hash: rootHash}, root)
+
+	// Zero namespace.
+	var zeroNs common.Namespace
+	root, err = NewRoot(zeroNs, 0, RootTypeIO, rootHash)
+	require.NoError(t, err, "NewRoot with zero namespace")
+	require.EqualValues(t, zeroNs, root.Namespace)
+
+	// Malformed namespace with reserved flags set.
+	var badNs common.Namespace
+	badNs[7] = 0x01
+	_, err = NewRoot(badNs, 0, RootTypeState, rootHash)
+	require.ErrorIs(t, err, common.ErrMalformedNamespace, "NewRoot with malformed namespace")
+}
@@ -0,0 +1,128 @@
+package mkvs
+
+import (
+	"context"
+
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/syncer"
+)
+
+// nodeCountCursor is a position in one of the trees compared by NodeCountDelta.
+type nodeCountCursor struct {
+	t        *tree
+	ptr      *node.Pointer
+	bitDepth node.Depth
+	path     node.Key
+}
+
+// Implements Tree.
+func (t *tree) NodeCountDelta(ctx context.Context, oldRoot, newRoot node.Root) (int, error) {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return 0, ErrClosed
+	}
+	if oldRoot.Type != newRoot.Type {
+		return 0, syncer.ErrInvalidRoot
+	}
+	if oldRoot.Hash.Equal(&newRoot.Hash) {
+		return 0, nil
+	}
+
+	var delta int
+	err := t.withRoot(oldRoot, func(ot *tree) error {
+		return t.withRoot(newRoot, func(nt *tree) error {
+			var err error
+			delta, err = nodeCountDelta(
+				ctx,
+				nodeCountCursor{t: ot, ptr: ot.cache.pendingRoot},
+				nodeCountCursor{t: nt, ptr: nt.cache.pendingRoot},
+			)
+			return err
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return delta, nil
+}
+
+// nodeCountDelta returns the difference between the number of nodes in the subtree at the new
+// cursor and the number of nodes in the subtree at the old cursor.
+//
+// Must be called while holding the cache locks of both trees.
+func nodeCountDelta(ctx context.Context, oldCur, newCur nodeCountCursor) (int, error) {
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+
+	// Equal hashes mean equal subtrees, so there is no need to descend.
+	if oldCur.ptr != nil && newCur.ptr != nil && oldCur.ptr.Hash.Equal(&newCur.ptr.Hash) {
+		return 0, nil
+	}
+
+	oldNd, err := oldCur.t.cache.derefNodePtr(ctx, oldCur.ptr, oldCur.t.newFetcherSyncIterate(oldCur.path, 0))
+	if err != nil {
+		return 0, err
+	}
+	newNd, err := newCur.t.cache.derefNodePtr(ctx, newCur.ptr, newCur.t.newFetcherSyncIterate(newCur.path, 0))
+	if err != nil {
+		return 0, err
+	}
+
+	oldInternal, oldOk := oldNd.(*node.InternalNode)
+	newInternal, newOk := newNd.(*node.InternalNode)
+	if !oldOk || !newOk {
+		// At most one side has children, so count both subtrees in full.
+		oldCount, err := oldCur.count(ctx)
+		if err != nil {
+			return 0, err
+		}
+		newCount, err := newCur.count(ctx)
+		if err != nil {
+			return 0, err
+		}
+		return newCount - oldCount, nil
+	}
+
+	// Both sides are internal nodes, which cancel out. Counts are additive, so the children can
+	// be compared pairwise even if the nodes have different labels. Child pointers are captured
+	// before descending as visiting a large subtree may cause the nodes to be evicted.
+	oldChildren := oldCur.children(oldInternal)
+	newChildren := newCur.children(newInternal)
+	var delta int
+	for i := range oldChildren {
+		childDelta, err := nodeCountDelta(ctx, oldChildren[i], newChildren[i])
+		if err != nil {
+			return 0, err
+		}
+		delta += childDelta
+	}
+	return delta, nil
+}
+
+// count returns the number of nodes in the subtree at the cursor.
+//
+// Must be called while holding the cache lock of the cursor's tree.
+func (c nodeCountCursor) count(ctx context.Context) (int, error) {
+	var count int
+	err := c.t.doWalk(ctx, c.ptr, c.bitDepth, c.path, func(*node.Pointer, node.Node, node.Depth, node.Key) (bool, error) {
+		count++
+		return true, nil
+	})
+	return count, err
+}
+
+// children returns cursors for the leaf node, left and right children of the given internal
+// node at the cursor.
+func (c nodeCountCursor) children(n *node.InternalNode) []nodeCountCursor {
+	bitLength := c.bitDepth + n.LabelBitLength
+	path := c.path.Merge(c.bitDepth, n.Label, n.LabelBitLength)
+
+	children := make([]nodeCountCursor, 0, 3)
+	for _, child := range []*node.Pointer{n.LeafNode, n.Left, n.Right} {
+		children = append(children, nodeCountCursor{t: c.t, ptr: child, bitDepth: bitLength, path: path})
+	}
+	return children
+}
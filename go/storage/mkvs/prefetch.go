@@ -62,6 +62,7 @@ func (t *tree) SyncGetPrefixes(ctx context.Context, request *syncer.GetPrefixesR
 	if !t.cache.pendingRoot.IsClean() {
 		return nil, syncer.ErrDirtyRoot
 	}
+	defer t.trackRequestStats(ctx)()
 
 	// First, trigger same prefetching locally if a remote read syncer
 	// is available. This is needed to ensure that the same optimization
@@ -77,7 +78,7 @@ func (t *tree) SyncGetPrefixes(ctx context.Context, request *syncer.GetPrefixesR
 	if err != nil {
 		return nil, err
 	}
-	it := t.NewIterator(ctx, WithProofBuilder(pb))
+	it := newTreeIterator(ctx, t, WithProofBuilder(pb))
 	defer it.Close()
 
 	var total int
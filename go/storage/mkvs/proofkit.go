@@ -0,0 +1,218 @@
+package mkvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/oasisprotocol/oasis-core/go/common/crypto/hash"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/syncer"
+)
+
+// ErrInvalidLeafProof is the error returned when a leaf proof fails to verify.
+var ErrInvalidLeafProof = errors.New("mkvs: invalid leaf proof")
+
+// ChildPosition is the position of a child node within an internal node.
+type ChildPosition uint8
+
+const (
+	// ChildLeafNode is the position of the internal node's leaf node.
+	ChildLeafNode ChildPosition = 0
+	// ChildLeft is the position of the internal node's left child.
+	ChildLeft ChildPosition = 1
+	// ChildRight is the position of the internal node's right child.
+	ChildRight ChildPosition = 2
+)
+
+// LeafProofStep is an internal node on the path from a leaf to the root, containing everything
+// needed to recompute its hash from the hash of the child on the path.
+type LeafProofStep struct {
+	// Label is the internal node's label.
+	Label node.Key `json:"label"`
+	// LabelBitLength is the length of the label in bits.
+	LabelBitLength node.Depth `json:"label_bit_length"`
+	// Position is the position of the child on the path.
+	Position ChildPosition `json:"position"`
+	// ChildHashes are the hashes of the internal node's leaf node, left and right children. The
+	// hash at the position of the child on the path is ignored.
+	ChildHashes [3]hash.Hash `json:"child_hashes"`
+}
+
+// LeafProofKit is the leaf node for a key together with the siblings along its path, which is
+// enough to recompute the root hash after the leaf's value changes.
+type LeafProofKit struct {
+	// Root is the root the kit was obtained from.
+	Root node.Root `json:"root"`
+	// Leaf is the leaf node for the key.
+	Leaf *node.LeafNode `json:"leaf"`
+	// Steps are the internal nodes on the path ordered from the leaf to the root.
+	Steps []LeafProofStep `json:"steps"`
+}
+
+// ComputeRootHash computes the root hash that results from storing the given value in the
+// kit's leaf, keeping the rest of the tree unchanged.
+func (k *LeafProofKit) ComputeRootHash(value []byte) hash.Hash {
+	return computeLeafProofRootHash(k.Leaf.Key, value, k.Steps)
+}
+
+// Verify verifies that the kit proves the kit's leaf to be stored under the given root hash.
+func (k *LeafProofKit) Verify(rootHash hash.Hash) error {
+	return VerifyLeafProof(rootHash, k.Leaf.Key, k.Leaf.Value, k.Steps)
+}
+
+// VerifyLeafProof verifies that the given steps, ordered from the leaf to the root, prove that
+// the given key is stored with the given value under the given root hash.
+//
+// Unlike syncer proofs, which encode a subtree, the steps are a flat array with one entry per
+// internal node on the path, so they are simple to verify in other implementations.
+func VerifyLeafProof(rootHash hash.Hash, key node.Key, value []byte, steps []LeafProofStep) error {
+	// Check that the path described by the steps leads to the key, starting from the root.
+	var (
+		path     node.Key
+		bitDepth node.Depth
+	)
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := steps[i]
+		if len(step.Label) != step.LabelBitLength.ToBytes() {
+			return fmt.Errorf("%w: malformed label in step %d", ErrInvalidLeafProof, i)
+		}
+
+		bitLength := bitDepth + step.LabelBitLength
+		path = path.Merge(bitDepth, step.Label, step.LabelBitLength)
+		if key.BitLength() < bitLength || key.CommonPrefixLen(key.BitLength(), path, bitLength) != bitLength {
+			return fmt.Errorf("%w: label in step %d does not match key", ErrInvalidLeafProof, i)
+		}
+
+		var position ChildPosition
+		switch {
+		case key.BitLength() == bitLength:
+			position = ChildLeafNode
+		case key.GetBit(bitLength):
+			position = ChildRight
+		default:
+			position = ChildLeft
+		}
+		if step.Position != position {
+			return fmt.Errorf("%w: position in step %d does not match key", ErrInvalidLeafProof, i)
+		}
+		bitDepth = bitLength
+	}
+
+	if h := computeLeafProofRootHash(key, value, steps); !h.Equal(&rootHash) {
+		return fmt.Errorf("%w: root hash mismatch (expected: %s got: %s)", ErrInvalidLeafProof, rootHash, h)
+	}
+	return nil
+}
+
+// computeLeafProofRootHash computes the root hash from a leaf and the steps from the leaf to the
+// root. The step positions must be valid.
+func computeLeafProofRootHash(key node.Key, value []byte, steps []LeafProofStep) hash.Hash {
+	leaf := node.LeafNode{
+		Key:   key,
+		Value: value,
+	}
+	leaf.UpdateHash()
+
+	h := leaf.Hash
+	for _, step := range steps {
+		children := step.ChildHashes
+		children[step.Position] = h
+
+		internal := node.InternalNode{
+			Label:          step.Label,
+			LabelBitLength: step.LabelBitLength,
+			LeafNode:       &node.Pointer{Hash: children[ChildLeafNode]},
+			Left:           &node.Pointer{Hash: children[ChildLeft]},
+			Right:          &node.Pointer{Hash: children[ChildRight]},
+		}
+		internal.UpdateHash()
+		h = internal.Hash
+	}
+	return h
+}
+
+// Implements Tree.
+func (t *tree) GetLeafWithSiblings(ctx context.Context, root node.Root, key node.Key) (*LeafProofKit, error) {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return nil, ErrClosed
+	}
+	if !root.Equal(&t.cache.syncRoot) {
+		return nil, syncer.ErrInvalidRoot
+	}
+	if !t.cache.pendingRoot.IsClean() {
+		return nil, syncer.ErrDirtyRoot
+	}
+
+	// Remember where the path from root to target node ends (will end).
+	t.cache.markPosition()
+
+	var steps []LeafProofStep
+	ptr := t.cache.pendingRoot
+	var bitDepth node.Depth
+	for {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		// Dereference the node, possibly making a remote request.
+		nd, err := t.cache.derefNodePtr(ctx, ptr, t.newFetcherSyncGet(key, false))
+		if err != nil {
+			return nil, err
+		}
+
+		switch n := nd.(type) {
+		case nil:
+			// Reached a nil node, there is nothing here.
+			return nil, nil
+		case *node.InternalNode:
+			bitLength := bitDepth + n.LabelBitLength
+
+			step := LeafProofStep{
+				Label:          n.Label,
+				LabelBitLength: n.LabelBitLength,
+				ChildHashes: [3]hash.Hash{
+					n.LeafNode.GetHash(),
+					n.Left.GetHash(),
+					n.Right.GetHash(),
+				},
+			}
+			switch {
+			case key.BitLength() == bitLength:
+				// Lookup key ends here, look into LeafNode.
+				ptr = n.LeafNode
+				step.Position = ChildLeafNode
+			case key.BitLength() < bitLength:
+				// Lookup key is too short for the current n.Label. It's not stored.
+				return nil, nil
+			case key.GetBit(bitLength):
+				ptr = n.Right
+				step.Position = ChildRight
+			default:
+				ptr = n.Left
+				step.Position = ChildLeft
+			}
+			steps = append(steps, step)
+			bitDepth = bitLength
+		case *node.LeafNode:
+			if !n.Key.Equal(key) {
+				return nil, nil
+			}
+
+			// Order the steps from the leaf to the root.
+			for i, j := 0, len(steps)-1; i < j; i, j = i+1, j-1 {
+				steps[i], steps[j] = steps[j], steps[i]
+			}
+			return &LeafProofKit{
+				Root:  root,
+				Leaf:  n.ExtractUnchecked().(*node.LeafNode),
+				Steps: steps,
+			}, nil
+		default:
+			panic(fmt.Sprintf("mkvs: unknown node type: %+v", n))
+		}
+	}
+}
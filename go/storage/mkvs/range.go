@@ -0,0 +1,53 @@
+package mkvs
+
+import (
+	"context"
+
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/syncer"
+)
+
+// Implements Tree.
+func (t *tree) GetRangeProof(
+	ctx context.Context,
+	root node.Root,
+	startKey, endKey node.Key,
+	proofVersion uint16,
+) (*syncer.Proof, error) {
+	if startKey.Compare(endKey) > 0 {
+		return nil, ErrInvalidKeyRange
+	}
+
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return nil, ErrClosed
+	}
+	if !root.Equal(&t.cache.syncRoot) {
+		return nil, syncer.ErrInvalidRoot
+	}
+	if !t.cache.pendingRoot.IsClean() {
+		return nil, syncer.ErrDirtyRoot
+	}
+	pb, err := syncer.NewProofBuilderForVersion(root.Hash, root.Hash, proofVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	// Iterate over the range, stopping at the first key past its end. All visited nodes,
+	// including the path to the boundary key, are included in the proof.
+	it := newTreeIterator(ctx, t, WithProofBuilder(pb))
+	defer it.Close()
+
+	for it.Seek(startKey); it.Valid(); it.Next() {
+		if it.Key().Compare(endKey) > 0 {
+			break
+		}
+	}
+	if it.Err() != nil {
+		return nil, it.Err()
+	}
+
+	return it.GetProof()
+}
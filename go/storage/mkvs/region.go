@@ -0,0 +1,99 @@
+package mkvs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/oasisprotocol/oasis-core/go/common/cbor"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/syncer"
+)
+
+// Implements Tree.
+func (t *tree) ExportRegion(ctx context.Context, root node.Root, prefix node.Key, w io.Writer) error {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return ErrClosed
+	}
+	if !root.Equal(&t.cache.syncRoot) {
+		return syncer.ErrInvalidRoot
+	}
+	if !t.cache.pendingRoot.IsClean() {
+		return syncer.ErrDirtyRoot
+	}
+
+	// Use version 0 proofs so that leaf nodes of internal nodes on the path to the region are
+	// always included, as otherwise the internal nodes could not be used by the partial tree.
+	pb, err := syncer.NewProofBuilderForVersion(root.Hash, root.Hash, 0)
+	if err != nil {
+		return err
+	}
+
+	// Iterate over the region, stopping at the first key past its end. All visited nodes,
+	// including the path to the boundary key, are included in the proof while all other nodes
+	// are only included by hash.
+	it := newTreeIterator(ctx, t, WithProofBuilder(pb))
+	defer it.Close()
+
+	for it.Seek(prefix); it.Valid(); it.Next() {
+		if !bytes.HasPrefix(it.Key(), prefix) {
+			break
+		}
+	}
+	if it.Err() != nil {
+		return it.Err()
+	}
+
+	proof, err := it.GetProof()
+	if err != nil {
+		return err
+	}
+	if err = cbor.NewEncoder(w).Encode(proof); err != nil {
+		return fmt.Errorf("mkvs: failed to encode region: %w", err)
+	}
+	return nil
+}
+
+// ImportRegion creates a partial tree for the given root from a region exported by ExportRegion.
+// The region is verified against the root hash before it is imported.
+//
+// The partial tree serves reads of keys within the exported region, while reads requiring nodes
+// outside the region fail with db.ErrNodeNotFound. All imported nodes are kept in memory and the
+// tree is not backed by a node database.
+func ImportRegion(ctx context.Context, root node.Root, r io.Reader) (Tree, error) {
+	var proof syncer.Proof
+	if err := cbor.NewDecoder(r).Decode(&proof); err != nil {
+		return nil, fmt.Errorf("mkvs: failed to decode region: %w", err)
+	}
+
+	var pv syncer.ProofVerifier
+	ptr, err := pv.VerifyProof(ctx, root.Hash, &proof)
+	if err != nil {
+		return nil, err
+	}
+
+	// Imported nodes cannot be reloaded, so they must never be evicted.
+	t := NewWithRoot(nil, nil, root, Capacity(0, 0)).(*tree)
+	t.committedRoot = ptr
+	t.cache.setPendingRoot(ptr)
+
+	var commitNode func(*node.Pointer)
+	commitNode = func(p *node.Pointer) {
+		if p == nil || p.Node == nil {
+			return
+		}
+		t.cache.commitNode(p)
+
+		if n, ok := p.Node.(*node.InternalNode); ok {
+			commitNode(n.Left)
+			commitNode(n.Right)
+		}
+	}
+	commitNode(ptr)
+
+	return t, nil
+}
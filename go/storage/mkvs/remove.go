@@ -9,6 +9,10 @@ import (
 
 // Implements Tree.
 func (t *tree) RemoveExisting(ctx context.Context, key []byte) ([]byte, error) {
+	if err := t.checkKeyWidth(key); err != nil {
+		return nil, err
+	}
+
 	t.cache.Lock()
 	defer t.cache.Unlock()
 
@@ -16,6 +20,14 @@ func (t *tree) RemoveExisting(ctx context.Context, key []byte) ([]byte, error) {
 		return nil, ErrClosed
 	}
 
+	return t.removeExistingLocked(ctx, key)
+}
+
+// removeExistingLocked removes a key from the tree, records the removal in the pending write log
+// and returns the value the key had.
+//
+// Must be called while holding the cache lock.
+func (t *tree) removeExistingLocked(ctx context.Context, key []byte) ([]byte, error) {
 	// If the key has already been removed locally, don't try to remove it again.
 	var entry *pendingEntry
 	if !t.withoutWriteLog {
@@ -77,21 +89,34 @@ func (t *tree) doRemove(
 		// needed.
 		bitLength := bitDepth + n.LabelBitLength
 
-		var changed bool
-		var existing []byte
+		var child *node.Pointer
 		if key.BitLength() < bitLength {
 			// Lookup key is too short for the current n.Label, so it doesn't exist.
 			return ptr, false, nil, nil
 		} else if key.BitLength() == bitLength {
-			n.LeafNode, changed, existing, err = t.doRemove(ctx, n.LeafNode, bitLength, key)
+			child = n.LeafNode
 		} else if key.GetBit(bitLength) {
-			n.Right, changed, existing, err = t.doRemove(ctx, n.Right, bitLength, key)
+			child = n.Right
 		} else {
-			n.Left, changed, existing, err = t.doRemove(ctx, n.Left, bitLength, key)
+			child = n.Left
 		}
+
+		newChild, changed, existing, err := t.doRemove(ctx, child, bitLength, key)
 		if err != nil {
 			return nil, false, existing, err
 		}
+		if changed {
+			// Node will be modified in place, remember its committed state.
+			t.saveNode(ptr)
+		}
+
+		if key.BitLength() == bitLength {
+			n.LeafNode = newChild
+		} else if key.GetBit(bitLength) {
+			n.Right = newChild
+		} else {
+			n.Left = newChild
+		}
 
 		// Fetch and check the remaining children.
 		var remainingLeaf node.Node
@@ -113,6 +138,7 @@ func (t *tree) doRemove(
 			ndLeaf := n.LeafNode
 			n.LeafNode = nil
 			t.pendingRemovedNodes = append(t.pendingRemovedNodes, ptr)
+			t.pendingSummary.nodes--
 			t.cache.removeNode(ptr)
 			return ndLeaf, true, existing, nil
 		} else if remainingLeaf == nil && (remainingLeft == nil || remainingRight == nil) {
@@ -131,6 +157,7 @@ func (t *tree) doRemove(
 			// If child is an internal node, also fix the label.
 			switch inode := ndChild.(type) {
 			case *node.InternalNode:
+				t.saveNode(nodePtr)
 				inode.Label = n.Label.Merge(n.LabelBitLength, inode.Label, inode.LabelBitLength)
 				inode.LabelBitLength += n.LabelBitLength
 				if inode.Clean {
@@ -144,6 +171,7 @@ func (t *tree) doRemove(
 			}
 
 			t.pendingRemovedNodes = append(t.pendingRemovedNodes, ptr)
+			t.pendingSummary.nodes--
 			t.cache.removeNode(ptr)
 			return nodePtr, true, existing, nil
 		}
@@ -165,7 +193,9 @@ func (t *tree) doRemove(
 	case *node.LeafNode:
 		// Remove from leaf node.
 		if n.Key.Equal(key) {
+			t.saveNode(ptr)
 			t.pendingRemovedNodes = append(t.pendingRemovedNodes, ptr)
+			t.pendingSummary.removeLeaf(n.Value)
 			t.cache.removeNode(ptr)
 			return nil, true, n.Value, nil
 		}
@@ -0,0 +1,127 @@
+package mkvs
+
+import (
+	"context"
+
+	"github.com/oasisprotocol/oasis-core/go/common/crypto/hash"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/syncer"
+)
+
+// NodeSink is the replication target receiving nodes pushed by PushMissing.
+type NodeSink interface {
+	// PutNode stores the given node. Children of internal nodes are only included by hash.
+	PutNode(ctx context.Context, nd node.Node) error
+}
+
+// pushFrame is a subtree that still needs to be pushed by PushMissing.
+type pushFrame struct {
+	ptr      *node.Pointer
+	bitDepth node.Depth
+	path     node.Key
+
+	// leaf is the already extracted leaf node in case the frame is for an internal node's leaf.
+	// Such leaves are loaded together with their internal node as they cannot be loaded on
+	// their own in case they are evicted in the meantime.
+	leaf node.Node
+}
+
+// Implements Tree.
+func (t *tree) PushMissing(ctx context.Context, root node.Root, target NodeSink, hasNode func(hash.Hash) bool) (int, error) {
+	t.cache.Lock()
+	if err := t.checkPushRoot(root); err != nil {
+		t.cache.Unlock()
+		return 0, err
+	}
+	stack := []pushFrame{{ptr: t.cache.pendingRoot, path: node.Key{}}}
+	t.cache.Unlock()
+
+	// Both hasNode and the target may be slow (e.g., make network requests), so only hold the
+	// lock while loading each node.
+	var pushed int
+	for len(stack) > 0 {
+		if err := ctx.Err(); err != nil {
+			return pushed, err
+		}
+
+		frame := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		// The target already has the whole subtree rooted at this node, skip it without
+		// loading the node.
+		if frame.ptr == nil || frame.ptr.Hash.IsEmpty() || hasNode(frame.ptr.Hash) {
+			continue
+		}
+
+		nd, children := frame.leaf, []pushFrame(nil)
+		if nd == nil {
+			var err error
+			if nd, children, err = t.loadPushNode(ctx, root, frame); err != nil {
+				return pushed, err
+			}
+			if nd == nil {
+				continue
+			}
+		}
+		if err := target.PutNode(ctx, nd); err != nil {
+			return pushed, err
+		}
+		pushed++
+
+		// Push children in reverse order so that nodes are visited in pre-order.
+		for i := len(children) - 1; i >= 0; i-- {
+			stack = append(stack, children[i])
+		}
+	}
+	return pushed, nil
+}
+
+// checkPushRoot checks that the given root can be pushed.
+//
+// Must be called while holding the cache lock.
+func (t *tree) checkPushRoot(root node.Root) error {
+	if t.cache.isClosed() {
+		return ErrClosed
+	}
+	if !root.Equal(&t.cache.syncRoot) {
+		return syncer.ErrInvalidRoot
+	}
+	if !t.cache.pendingRoot.IsClean() {
+		return syncer.ErrDirtyRoot
+	}
+	return nil
+}
+
+// loadPushNode loads the node of the given frame and returns its extracted copy together with
+// the frames of its children.
+func (t *tree) loadPushNode(ctx context.Context, root node.Root, frame pushFrame) (node.Node, []pushFrame, error) {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	// The tree may have been modified since the previous node was loaded.
+	if err := t.checkPushRoot(root); err != nil {
+		return nil, nil, err
+	}
+
+	nd, err := t.cache.derefNodePtr(ctx, frame.ptr, t.newFetcherSyncIterate(frame.path, 0))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var children []pushFrame
+	switch n := nd.(type) {
+	case nil:
+		return nil, nil, nil
+	case *node.InternalNode:
+		bitLength := frame.bitDepth + n.LabelBitLength
+		newPath := frame.path.Merge(frame.bitDepth, n.Label, n.LabelBitLength)
+		// Dereferencing the internal node ensures that its leaf node is available.
+		if n.LeafNode != nil && n.LeafNode.Node != nil {
+			children = append(children, pushFrame{ptr: n.LeafNode, leaf: n.LeafNode.Node.Extract()})
+		}
+		for _, child := range []*node.Pointer{n.Left, n.Right} {
+			children = append(children, pushFrame{ptr: child, bitDepth: bitLength, path: newPath})
+		}
+	}
+	return nd.Extract(), children, nil
+}
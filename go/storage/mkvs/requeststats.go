@@ -0,0 +1,63 @@
+package mkvs
+
+import (
+	"context"
+
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+)
+
+type requestStatsKey struct{}
+
+// RequestStats are the statistics of serving a single read sync request.
+type RequestStats struct {
+	// Nodes is the number of node dereferences performed while serving the request.
+	Nodes uint64 `json:"nodes"`
+	// Bytes is the total in-memory size of the dereferenced nodes.
+	Bytes uint64 `json:"bytes"`
+	// Cache are the cache statistics accumulated while serving the request.
+	Cache CacheStats `json:"cache"`
+}
+
+// WithRequestStats returns a context which makes read sync requests (SyncGet, SyncGetPrefixes
+// and SyncIterate) served by a tree populate the given statistics once the request has been
+// served. The statistics must not be shared by concurrent requests.
+func WithRequestStats(ctx context.Context, stats *RequestStats) context.Context {
+	return context.WithValue(ctx, requestStatsKey{}, stats)
+}
+
+// trackRequestStats starts collecting statistics for the request served with the given context
+// in case they were requested using WithRequestStats. The returned function must be called once
+// the request has been served.
+//
+// Must be called while holding the cache lock.
+func (t *tree) trackRequestStats(ctx context.Context) func() {
+	stats, _ := ctx.Value(requestStatsKey{}).(*RequestStats)
+	if stats == nil {
+		return func() {}
+	}
+
+	var ptrs []*node.Pointer
+	t.cache.derefObserver = func(ptr *node.Pointer) {
+		ptrs = append(ptrs, ptr)
+	}
+	startHits, startMisses, startRemoteFetches := t.cache.hits, t.cache.misses, t.cache.remoteFetches
+
+	return func() {
+		t.cache.derefObserver = nil
+
+		*stats = RequestStats{
+			Nodes: uint64(len(ptrs)),
+			Cache: CacheStats{
+				Hits:          t.cache.hits - startHits,
+				Misses:        t.cache.misses - startMisses,
+				RemoteFetches: t.cache.remoteFetches - startRemoteFetches,
+			},
+		}
+		for _, ptr := range ptrs {
+			// Nodes may have been evicted in the meantime, in which case they are not counted.
+			if ptr.Node != nil {
+				stats.Bytes += ptr.Node.Size()
+			}
+		}
+	}
+}
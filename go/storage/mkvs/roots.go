@@ -0,0 +1,55 @@
+package mkvs
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/oasisprotocol/oasis-core/go/common"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+)
+
+// namespaceHasPrefix returns true iff the first prefixBits bits of the namespace match the
+// given prefix.
+func namespaceHasPrefix(ns, prefix common.Namespace, prefixBits int) bool {
+	if prefixBits == 0 {
+		return true
+	}
+	bits := node.Depth(prefixBits)
+	return node.Key(ns[:]).CommonPrefixLen(bits, node.Key(prefix[:]), bits) == bits
+}
+
+// Implements Tree.
+func (t *tree) ListRootsUnder(ctx context.Context, nsPrefix common.Namespace, prefixBits int) ([]node.Root, error) {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return nil, ErrClosed
+	}
+	if prefixBits < 0 || prefixBits > 8*common.NamespaceSize {
+		return nil, fmt.Errorf("mkvs: invalid namespace prefix length: %d", prefixBits)
+	}
+
+	latest, ok := t.cache.db.GetLatestVersion()
+	if !ok {
+		return nil, nil
+	}
+
+	var roots []node.Root
+	for version := t.cache.db.GetEarliestVersion(); version <= latest; version++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		versionRoots, err := t.cache.db.GetRootsForVersion(version)
+		if err != nil {
+			return nil, err
+		}
+		for _, root := range versionRoots {
+			if namespaceHasPrefix(root.Namespace, nsPrefix, prefixBits) {
+				roots = append(roots, root)
+			}
+		}
+	}
+	return roots, nil
+}
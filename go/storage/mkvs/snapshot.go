@@ -0,0 +1,150 @@
+package mkvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	db "github.com/oasisprotocol/oasis-core/go/storage/mkvs/db/api"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/syncer"
+)
+
+const (
+	// defaultSnapshotNodeCapacity is the default maximum number of internal nodes pinned by
+	// a snapshot.
+	defaultSnapshotNodeCapacity = 100_000
+	// defaultSnapshotValueCapacity is the default maximum size of values pinned by a snapshot.
+	defaultSnapshotValueCapacity = 128 * 1024 * 1024
+)
+
+// ErrSnapshotTooLarge is the error returned by Snapshot when the root does not fit into the
+// configured snapshot capacity.
+var ErrSnapshotTooLarge = errors.New("mkvs: snapshot exceeds the snapshot capacity")
+
+// SnapshotCapacity sets the maximum number of internal nodes and the maximum size of values
+// that a snapshot may pin in memory. Taking a snapshot of a larger root fails with
+// ErrSnapshotTooLarge.
+//
+// If no capacity is specified, snapshots are limited to 100000 internal nodes and 128MB of
+// values. If a capacity of 0 is specified, the respective size is not limited.
+func SnapshotCapacity(nodeCapacity, valueCapacityBytes uint64) Option {
+	return func(t *tree) {
+		t.snapshotNodeCapacity = nodeCapacity
+		t.snapshotValueCapacity = valueCapacityBytes
+	}
+}
+
+// Snapshot is a read-only view of a storage root which is isolated from any subsequent
+// operations on the tree and the underlying node database.
+//
+// All nodes reachable from the snapshot root are pinned in memory until the snapshot is
+// released, so reads remain consistent even if newer roots are committed and the snapshot
+// root is pruned from the node database.
+type Snapshot struct {
+	tree *tree
+}
+
+// Root returns the root the snapshot was taken at.
+func (s *Snapshot) Root() node.Root {
+	return s.tree.cache.getSyncRoot()
+}
+
+// Get looks up an existing key in the snapshot.
+//
+// Returns nil if the key does not exist.
+func (s *Snapshot) Get(ctx context.Context, key []byte) ([]byte, error) {
+	return s.tree.Get(ctx, key)
+}
+
+// NewIterator returns a new iterator over the snapshot.
+func (s *Snapshot) NewIterator(ctx context.Context, options ...IteratorOption) Iterator {
+	return s.tree.NewIterator(ctx, options...)
+}
+
+// Release releases all nodes pinned by the snapshot. The snapshot must not be used after
+// it has been released.
+func (s *Snapshot) Release() {
+	s.tree.Close()
+}
+
+// Implements Tree.
+func (t *tree) Snapshot(ctx context.Context, root node.Root) (*Snapshot, error) {
+	t.cache.Lock()
+	if t.cache.isClosed() {
+		t.cache.Unlock()
+		return nil, ErrClosed
+	}
+	if !root.Equal(&t.cache.syncRoot) {
+		t.cache.Unlock()
+		return nil, syncer.ErrInvalidRoot
+	}
+	if !t.cache.pendingRoot.IsClean() {
+		t.cache.Unlock()
+		return nil, syncer.ErrDirtyRoot
+	}
+
+	// Load all nodes reachable from the root into a separate tree with an unbounded cache so
+	// nothing can be evicted. The size is limited by the snapshot capacity instead. The nodes
+	// already cached by the tree are copied, so only the remaining ones need to be loaded.
+	st := t.newWithRoot(root)
+	st.cache.nodeCapacity, st.cache.valueCapacity = 0, 0
+	st.committedRoot = copyCachedNodes(st.cache, t.cache.pendingRoot)
+	st.cache.setPendingRoot(st.committedRoot)
+	nodeCapacity, valueCapacity := t.snapshotNodeCapacity, t.snapshotValueCapacity
+
+	// The snapshot does not share the tree's cache, so the tree lock can be released while
+	// loading it.
+	t.cache.Unlock()
+
+	st.cache.Lock()
+	defer st.cache.Unlock()
+
+	err := st.doWalk(ctx, st.cache.pendingRoot, 0, nil, func(*node.Pointer, node.Node, node.Depth, node.Key) (bool, error) {
+		if nodeCapacity > 0 && st.cache.internalNodeCount > nodeCapacity {
+			return false, fmt.Errorf("%w: more than %d internal nodes", ErrSnapshotTooLarge, nodeCapacity)
+		}
+		if valueCapacity > 0 && st.cache.valueSize > valueCapacity {
+			return false, fmt.Errorf("%w: more than %d bytes of values", ErrSnapshotTooLarge, valueCapacity)
+		}
+		return true, nil
+	})
+	if err != nil {
+		st.cache.close()
+		return nil, err
+	}
+
+	// Detach the snapshot from the node database and the remote syncer so that it never
+	// observes any later changes.
+	st.cache.db, _ = db.NewNopNodeDB()
+	st.cache.rs = syncer.NopReadSyncer
+
+	return &Snapshot{tree: st}, nil
+}
+
+// copyCachedNodes returns a copy of the clean subtree rooted at ptr which contains copies of all
+// nodes held in memory, while all other nodes are only referenced by their hashes. The copied
+// nodes are committed into the given cache.
+func copyCachedNodes(c *cache, ptr *node.Pointer) *node.Pointer {
+	if ptr == nil {
+		return nil
+	}
+
+	cp := ptr.Extract()
+	switch n := ptr.Node.(type) {
+	case *node.InternalNode:
+		cp.Node = &node.InternalNode{
+			Clean:          true,
+			Hash:           n.Hash,
+			Label:          n.Label,
+			LabelBitLength: n.LabelBitLength,
+			LeafNode:       copyCachedNodes(c, n.LeafNode),
+			Left:           copyCachedNodes(c, n.Left),
+			Right:          copyCachedNodes(c, n.Right),
+		}
+	case *node.LeafNode:
+		cp.Node = n.Extract()
+	}
+	c.commitNode(cp)
+	return cp
+}
@@ -0,0 +1,355 @@
+package mkvs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/oasisprotocol/oasis-core/go/common/crypto/hash"
+	db "github.com/oasisprotocol/oasis-core/go/storage/mkvs/db/api"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/syncer"
+)
+
+// SubtreeID identifies a subtree by the key prefix shared by all keys in the subtree.
+type SubtreeID struct {
+	// Path is the key prefix shared by all keys in the subtree.
+	Path node.Key `json:"path"`
+	// BitDepth is the length of the prefix in bits.
+	BitDepth node.Depth `json:"bit_depth"`
+}
+
+// Validate checks that the subtree identifier is well-formed, i.e. that the path consists of
+// exactly the bytes needed to hold BitDepth bits. In particular, a non-empty path with a zero
+// bit depth is rejected as it most likely is a key passed without setting the bit depth.
+func (id SubtreeID) Validate() error {
+	if len(id.Path) != id.BitDepth.ToBytes() {
+		return fmt.Errorf("%w: path of %d bytes at bit depth %d", ErrInvalidSubtreeID, len(id.Path), id.BitDepth)
+	}
+	return nil
+}
+
+// Implements Tree.
+func (t *tree) ChangedSubtrees(ctx context.Context, oldRoot, newRoot node.Root, depth node.Depth) ([]SubtreeID, error) {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return nil, ErrClosed
+	}
+	if oldRoot.Type != newRoot.Type {
+		return nil, syncer.ErrInvalidRoot
+	}
+
+	oldSubtrees, err := t.subtreesAtDepth(ctx, oldRoot, depth)
+	if err != nil {
+		return nil, err
+	}
+	newSubtrees, err := t.subtreesAtDepth(ctx, newRoot, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []SubtreeID
+	for k, st := range newSubtrees {
+		if old, ok := oldSubtrees[k]; ok && old.hash.Equal(&st.hash) {
+			continue
+		}
+		changed = append(changed, st.id)
+	}
+	for k, st := range oldSubtrees {
+		if _, ok := newSubtrees[k]; !ok {
+			changed = append(changed, st.id)
+		}
+	}
+
+	sort.Slice(changed, func(i, j int) bool {
+		if cmp := changed[i].Path.Compare(changed[j].Path); cmp != 0 {
+			return cmp < 0
+		}
+		return changed[i].BitDepth < changed[j].BitDepth
+	})
+	return changed, nil
+}
+
+type subtreeKey struct {
+	path     string
+	bitDepth node.Depth
+}
+
+type subtreeInfo struct {
+	id   SubtreeID
+	hash hash.Hash
+}
+
+// subtreesAtDepth returns the subtrees of the given root that start at or below the given bit
+// depth together with any leaves located above it.
+//
+// Must be called while holding the cache lock.
+func (t *tree) subtreesAtDepth(ctx context.Context, root node.Root, depth node.Depth) (map[subtreeKey]subtreeInfo, error) {
+	subtrees := make(map[subtreeKey]subtreeInfo)
+	err := t.walkRoot(ctx, root, func(_ *node.Pointer, nd node.Node, bitDepth node.Depth, path node.Key) (bool, error) {
+		var id SubtreeID
+		switch n := nd.(type) {
+		case *node.InternalNode:
+			if bitDepth < depth {
+				return true, nil
+			}
+			id.Path = path.Merge(bitDepth, n.Label, n.LabelBitLength)
+			id.BitDepth = bitDepth + n.LabelBitLength
+		case *node.LeafNode:
+			id.Path = n.Key
+			id.BitDepth = n.Key.BitLength()
+		}
+
+		subtrees[subtreeKey{string(id.Path), id.BitDepth}] = subtreeInfo{
+			id:   id,
+			hash: nd.GetHash(),
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subtrees, nil
+}
+
+// Implements Tree.
+func (t *tree) VerifySubtreeAgainstLocal(ctx context.Context, root node.Root, id SubtreeID, proof *syncer.Proof) error {
+	if err := id.Validate(); err != nil {
+		return err
+	}
+
+	// Reconstruct the received subtree. The proof is checked against the hash of its own
+	// root so that tampered subtrees can be compared node by node.
+	remoteHash, err := proof.RootHash()
+	if err != nil {
+		return err
+	}
+	remoteProof := *proof
+	remoteProof.UntrustedRoot = remoteHash
+	var pv syncer.ProofVerifier
+	remote, err := pv.VerifyProof(ctx, remoteHash, &remoteProof)
+	if err != nil {
+		return err
+	}
+
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return ErrClosed
+	}
+
+	return t.withRoot(root, func(rt *tree) error {
+		local, bitDepth, path, ferr := rt.findSubtree(ctx, id)
+		if ferr != nil {
+			return ferr
+		}
+		return rt.compareSubtree(ctx, local, remote, bitDepth, path)
+	})
+}
+
+// Implements Tree.
+func (t *tree) GetNodes(ctx context.Context, root node.Root, ids []SubtreeID) ([]node.Node, []error, error) {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return nil, nil, ErrClosed
+	}
+	if !root.Equal(&t.cache.syncRoot) {
+		return nil, nil, syncer.ErrInvalidRoot
+	}
+	if !t.cache.pendingRoot.IsClean() {
+		return nil, nil, syncer.ErrDirtyRoot
+	}
+
+	nodes := make([]node.Node, len(ids))
+	errs := make([]error, len(ids))
+	for i, id := range ids {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		if errs[i] = id.Validate(); errs[i] != nil {
+			continue
+		}
+
+		nd, err := t.findNode(ctx, id)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		nodes[i] = nd.Extract()
+	}
+	return nodes, errs, nil
+}
+
+// findNode looks up the node identified by id by descending along its path, so that only the
+// nodes on the path need to be fetched. In case an internal node and its leaf node share the
+// identifier, the internal node is returned. Returns db.ErrNodeNotFound in case there is no
+// such node.
+//
+// Must be called while holding the cache lock.
+func (t *tree) findNode(ctx context.Context, id SubtreeID) (node.Node, error) {
+	ptr := t.cache.pendingRoot
+	path := node.Key{}
+	var bitDepth node.Depth
+	for {
+		nd, err := t.cache.derefNodePtr(ctx, ptr, t.newFetcherSyncGet(id.Path, false))
+		if err != nil {
+			return nil, err
+		}
+
+		switch n := nd.(type) {
+		case nil:
+			return nil, db.ErrNodeNotFound
+		case *node.InternalNode:
+			bitLength := bitDepth + n.LabelBitLength
+			path = path.Merge(bitDepth, n.Label, n.LabelBitLength)
+
+			switch {
+			case bitLength > id.BitDepth:
+				return nil, db.ErrNodeNotFound
+			case path.CommonPrefixLen(bitLength, id.Path, id.BitDepth) != bitLength:
+				return nil, db.ErrNodeNotFound
+			case bitLength == id.BitDepth:
+				return n, nil
+			case id.Path.GetBit(bitLength):
+				ptr = n.Right
+			default:
+				ptr = n.Left
+			}
+			bitDepth = bitLength
+		case *node.LeafNode:
+			if n.Key.BitLength() != id.BitDepth || !n.Key.Equal(id.Path) {
+				return nil, db.ErrNodeNotFound
+			}
+			return n, nil
+		default:
+			return nil, fmt.Errorf("mkvs: unknown node type: %T", n)
+		}
+	}
+}
+
+// findSubtree returns the pointer to the root node of the subtree identified by id together
+// with the bit depth and key prefix at which the node is located. A nil pointer is returned
+// in case there is no such subtree.
+//
+// Must be called while holding the cache lock.
+func (t *tree) findSubtree(ctx context.Context, id SubtreeID) (*node.Pointer, node.Depth, node.Key, error) {
+	var (
+		found         *node.Pointer
+		foundBitDepth node.Depth
+		foundPath     node.Key
+	)
+	err := t.doWalk(ctx, t.cache.pendingRoot, 0, node.Key{}, func(ptr *node.Pointer, nd node.Node, bitDepth node.Depth, path node.Key) (bool, error) {
+		if found != nil {
+			return false, nil
+		}
+
+		var (
+			subtreePath     node.Key
+			subtreeBitDepth node.Depth
+		)
+		switch n := nd.(type) {
+		case *node.InternalNode:
+			subtreePath = path.Merge(bitDepth, n.Label, n.LabelBitLength)
+			subtreeBitDepth = bitDepth + n.LabelBitLength
+		case *node.LeafNode:
+			subtreePath = n.Key
+			subtreeBitDepth = n.Key.BitLength()
+		}
+
+		if subtreeBitDepth == id.BitDepth && subtreePath.Equal(id.Path) {
+			found, foundBitDepth, foundPath = ptr, bitDepth, path
+			return false, nil
+		}
+		// Only descend into subtrees that may contain the requested one.
+		if subtreeBitDepth >= id.BitDepth {
+			return false, nil
+		}
+		return subtreePath.CommonPrefixLen(subtreeBitDepth, id.Path, id.BitDepth) == subtreeBitDepth, nil
+	})
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return found, foundBitDepth, foundPath, nil
+}
+
+// compareSubtree compares the local subtree rooted at local with the in-memory subtree rooted
+// at remote and returns an error describing the first mismatch.
+//
+// Must be called while holding the cache lock.
+func (t *tree) compareSubtree(
+	ctx context.Context,
+	local *node.Pointer,
+	remote *node.Pointer,
+	bitDepth node.Depth,
+	path node.Key,
+) error {
+	mismatch := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s (bit depth: %d, path: %s)", ErrSubtreeMismatch, fmt.Sprintf(format, args...), bitDepth, path)
+	}
+
+	// Nodes only included by hash can only be compared by hash.
+	if remote != nil && remote.Node == nil {
+		localHash, remoteHash := local.GetHash(), remote.GetHash()
+		if !localHash.Equal(&remoteHash) {
+			return mismatch("node hash %s, expected %s", remoteHash, localHash)
+		}
+		return nil
+	}
+
+	nd, err := t.cache.derefNodePtr(ctx, local, t.newFetcherSyncIterate(path, 0))
+	if err != nil {
+		return err
+	}
+	switch {
+	case nd == nil && remote == nil:
+		return nil
+	case nd == nil:
+		return mismatch("unexpected node %s", remote.Hash)
+	case remote == nil:
+		return mismatch("missing node %s", nd.GetHash())
+	}
+
+	switch r := remote.Node.(type) {
+	case *node.InternalNode:
+		n, ok := nd.(*node.InternalNode)
+		if !ok {
+			return mismatch("internal node, expected leaf node")
+		}
+		if n.LabelBitLength != r.LabelBitLength || !n.Label.Equal(r.Label) {
+			return mismatch("label %s (%d bits), expected %s (%d bits)", r.Label, r.LabelBitLength, n.Label, n.LabelBitLength)
+		}
+
+		bitLength := bitDepth + n.LabelBitLength
+		newPath := path.Merge(bitDepth, n.Label, n.LabelBitLength)
+
+		// Capture child pointers before descending as comparing a large subtree may cause
+		// this node to be evicted from the cache.
+		localChildren := []*node.Pointer{n.LeafNode, n.Left, n.Right}
+		remoteChildren := []*node.Pointer{r.LeafNode, r.Left, r.Right}
+		for i := range localChildren {
+			if err = t.compareSubtree(ctx, localChildren[i], remoteChildren[i], bitLength, newPath); err != nil {
+				return err
+			}
+		}
+	case *node.LeafNode:
+		n, ok := nd.(*node.LeafNode)
+		if !ok {
+			return mismatch("leaf node, expected internal node")
+		}
+		if !n.Key.Equal(r.Key) {
+			return mismatch("leaf key %s, expected %s", r.Key, n.Key)
+		}
+		if !bytes.Equal(n.Value, r.Value) {
+			return mismatch("value %X for key %s, expected %X", r.Value, n.Key, n.Value)
+		}
+	default:
+		panic(fmt.Sprintf("mkvs: unknown node type: %+v", r))
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package syncer
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -50,6 +51,33 @@ type Proof struct {
 	Entries [][]byte `json:"entries"`
 }
 
+// RootHash reconstructs the root node of the (sub)tree contained in the proof and returns its
+// hash. The proof is not checked against the untrusted root, so the returned hash can be used
+// to cross-check a subtree root claimed by the prover before integrating the proof.
+//
+// For a proof of an empty tree, the empty hash is returned.
+func (p *Proof) RootHash() (hash.Hash, error) {
+	if p.V < MinimumProofVersion || p.V > LatestProofVersion {
+		return hash.Hash{}, fmt.Errorf("verifier: unsupported proof version: %d", p.V)
+	}
+	if len(p.Entries) == 0 {
+		return hash.Hash{}, errors.New("verifier: empty proof")
+	}
+
+	var (
+		pv  ProofVerifier
+		res verifyResult
+	)
+	idx, rootPtr, err := pv.verifyProof(context.Background(), p, 0, &verifyOpts{}, &res)
+	if err != nil {
+		return hash.Hash{}, err
+	}
+	if idx != len(p.Entries) {
+		return hash.Hash{}, fmt.Errorf("verifier: unused entries in proof")
+	}
+	return rootPtr.GetHash(), nil
+}
+
 type proofNode struct {
 	serialized []byte
 	children   []hash.Hash
@@ -121,16 +149,7 @@ func (b *ProofBuilder) Include(n node.Node) {
 	// Node is available, serialize it.
 	var err error
 	var pn proofNode
-	switch b.proofVersion {
-	case 0:
-		// In version 0, the leaf is included in the internal node.
-		pn.serialized, err = n.CompactMarshalBinaryV0()
-	case 1:
-		// In version 1, the leaf node is added separately, as a child.
-		pn.serialized, err = n.CompactMarshalBinaryV1()
-	default:
-		panic("proof: unexpected proof version")
-	}
+	pn.serialized, err = marshalProofNode(n, b.proofVersion)
 	if err != nil {
 		panic(err)
 	}
@@ -188,6 +207,42 @@ func (b *ProofBuilder) Size() uint64 {
 	return b.size
 }
 
+// Validate checks that all included nodes are reachable from the proof root and will thus be
+// part of the built proof.
+//
+// This is useful when assembling proofs node by node (e.g., in tests or tools) as Build silently
+// omits any nodes that are not reachable.
+func (b *ProofBuilder) Validate() error {
+	proofRoot := b.root
+	if b.HasSubtreeRoot() {
+		proofRoot = b.subtree
+	}
+
+	reachable := make(map[hash.Hash]struct{}, len(b.included))
+	b.markReachable(proofRoot, reachable)
+	for h := range b.included {
+		if _, ok := reachable[h]; !ok {
+			return fmt.Errorf("%w: %s", ErrDanglingProofNode, h)
+		}
+	}
+	return nil
+}
+
+func (b *ProofBuilder) markReachable(h hash.Hash, reachable map[hash.Hash]struct{}) {
+	n := b.included[h]
+	if n == nil {
+		return
+	}
+	if _, ok := reachable[h]; ok {
+		return
+	}
+	reachable[h] = struct{}{}
+
+	for _, childHash := range n.children {
+		b.markReachable(childHash, reachable)
+	}
+}
+
 // Build tries to build the proof.
 func (b *ProofBuilder) Build(ctx context.Context) (*Proof, error) {
 	proof := Proof{
@@ -222,11 +277,11 @@ func (b *ProofBuilder) build(ctx context.Context, proof *Proof, h hash.Hash) err
 	n := b.included[h]
 	if n == nil {
 		// Node is not included in this proof, just add hash of subtree.
-		data, err := h.MarshalBinary()
+		entry, err := HashProofEntry(h)
 		if err != nil {
 			return err
 		}
-		proof.Entries = append(proof.Entries, append([]byte{proofEntryHash}, data...))
+		proof.Entries = append(proof.Entries, entry)
 		return nil
 	}
 
@@ -243,6 +298,54 @@ func (b *ProofBuilder) build(ctx context.Context, proof *Proof, h hash.Hash) err
 	return nil
 }
 
+// marshalProofNode serializes the given node for inclusion in a proof of the given version.
+func marshalProofNode(n node.Node, proofVersion uint16) ([]byte, error) {
+	switch proofVersion {
+	case 0:
+		// In version 0, the leaf is included in the internal node.
+		return n.CompactMarshalBinaryV0()
+	case 1:
+		// In version 1, the leaf node is added separately, as a child.
+		return n.CompactMarshalBinaryV1()
+	default:
+		panic("proof: unexpected proof version")
+	}
+}
+
+// FullProofEntry returns the proof entry including the given clean node in full, in the format
+// of the given proof version.
+//
+// This is useful for producing proof entries on the fly (e.g., when streaming a proof) instead of
+// using a ProofBuilder.
+func FullProofEntry(n node.Node, proofVersion uint16) ([]byte, error) {
+	if proofVersion < MinimumProofVersion || proofVersion > LatestProofVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedProofVersion, proofVersion)
+	}
+	if !n.IsClean() {
+		return nil, errors.New("proof: attempted to add a dirty node")
+	}
+
+	serialized, err := marshalProofNode(n, proofVersion)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{proofEntryFull}, serialized...), nil
+}
+
+// HashProofEntry returns the proof entry including a node only by its hash. For the empty hash,
+// the nil entry representing an empty node is returned.
+func HashProofEntry(h hash.Hash) ([]byte, error) {
+	if h.IsEmpty() {
+		return nil, nil
+	}
+
+	data, err := h.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{proofEntryHash}, data...), nil
+}
+
 // ProofVerifier enables verifying proofs returned by the ReadSyncer API.
 type ProofVerifier struct{}
 
@@ -288,6 +391,135 @@ func (pv *ProofVerifier) VerifyProofToWriteLog(ctx context.Context, root hash.Ha
 	return res.writeLog, nil
 }
 
+// VerifyMultiproof verifies a proof for multiple keys (e.g., as returned by GetMultiproof) and
+// checks that it proves all of the given key/value pairs. A nil value means that the key must
+// not exist in the tree.
+//
+// An error is returned if the proof does not contain enough nodes to prove any of the keys.
+func (pv *ProofVerifier) VerifyMultiproof(ctx context.Context, root hash.Hash, keyValues map[string][]byte, proof *Proof) error {
+	res, err := pv.verifyProofOpts(ctx, root, proof, &verifyOpts{})
+	if err != nil {
+		return err
+	}
+
+	for key, expected := range keyValues {
+		value, err := lookupVerified(res.rootPtr, 0, node.Key(key))
+		if err != nil {
+			return fmt.Errorf("verifier: failed to look up key %X: %w", key, err)
+		}
+
+		switch {
+		case expected == nil && value != nil:
+			return fmt.Errorf("verifier: key %X exists but it should not", key)
+		case expected != nil && value == nil:
+			return fmt.Errorf("verifier: key %X does not exist", key)
+		case !bytes.Equal(expected, value):
+			return fmt.Errorf("verifier: value mismatch for key %X", key)
+		}
+	}
+	return nil
+}
+
+// CoversKeys verifies a proof and checks whether it contains the full path for each of the given
+// keys, so that the existence (or absence) of each key can be proven using only the proof.
+//
+// The keys whose paths are incomplete are returned in the order they were given. An error is
+// only returned if the proof itself fails verification.
+func (pv *ProofVerifier) CoversKeys(ctx context.Context, root hash.Hash, proof *Proof, keys []node.Key) ([]node.Key, error) {
+	res, err := pv.verifyProofOpts(ctx, root, proof, &verifyOpts{})
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []node.Key
+	for _, key := range keys {
+		_, err = lookupVerified(res.rootPtr, 0, key)
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrIncompleteProof):
+			missing = append(missing, key)
+		default:
+			return nil, err
+		}
+	}
+	return missing, nil
+}
+
+// Witness is a verified proof which can be used to look up keys locally, e.g., to answer
+// lookups of keys near a key previously fetched using a GetRequest with IncludeWitness set.
+//
+// Answers are exact rather than probabilistic, as they are derived from nodes verified against
+// the root hash. The witness is sound for the root it was verified against only and must not be
+// used to answer lookups for any other root. Lookups of keys whose paths are not fully contained
+// in the witness fail with ErrIncompleteProof and must be answered remotely.
+type Witness struct {
+	rootPtr *node.Pointer
+}
+
+// VerifyWitness verifies a proof and returns a witness for answering lookups using the proof.
+func (pv *ProofVerifier) VerifyWitness(ctx context.Context, root hash.Hash, proof *Proof) (*Witness, error) {
+	res, err := pv.verifyProofOpts(ctx, root, proof, &verifyOpts{})
+	if err != nil {
+		return nil, err
+	}
+	return &Witness{rootPtr: res.rootPtr}, nil
+}
+
+// Lookup returns the value of the given key or nil in case the key does not exist.
+//
+// In case the witness does not cover the key, ErrIncompleteProof is returned.
+func (w *Witness) Lookup(key node.Key) ([]byte, error) {
+	return lookupVerified(w.rootPtr, 0, key)
+}
+
+// lookupVerified looks up a key in a verified in-memory subtree.
+func lookupVerified(ptr *node.Pointer, bitDepth node.Depth, key node.Key) ([]byte, error) {
+	if ptr == nil {
+		return nil, nil
+	}
+	if ptr.Node == nil {
+		if ptr.Hash.IsEmpty() {
+			return nil, nil
+		}
+		return nil, ErrIncompleteProof
+	}
+
+	switch n := ptr.Node.(type) {
+	case *node.InternalNode:
+		bitLength := bitDepth + n.LabelBitLength
+
+		// In case the lookup key diverges from the label, it is not stored and there is no need
+		// to descend into (possibly incomplete) subtrees.
+		if key.BitLength() >= bitLength {
+			for i := node.Depth(0); i < n.LabelBitLength; i++ {
+				if key.GetBit(bitDepth+i) != n.Label.GetBit(i) {
+					return nil, nil
+				}
+			}
+		}
+
+		switch {
+		case key.BitLength() == bitLength:
+			// Lookup key ends here, look into LeafNode.
+			return lookupVerified(n.LeafNode, bitLength, key)
+		case key.BitLength() < bitLength:
+			// Lookup key is too short for the current label. It's not stored.
+			return nil, nil
+		case key.GetBit(bitLength):
+			return lookupVerified(n.Right, bitLength, key)
+		default:
+			return lookupVerified(n.Left, bitLength, key)
+		}
+	case *node.LeafNode:
+		if n.Key.Equal(key) {
+			return n.Value, nil
+		}
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("verifier: unknown node type: %T", n)
+	}
+}
+
 func (pv *ProofVerifier) verifyProofOpts(ctx context.Context, root hash.Hash, proof *Proof, opts *verifyOpts) (*verifyResult, error) {
 	if proof.V < MinimumProofVersion || proof.V > LatestProofVersion {
 		return nil, fmt.Errorf("verifier: unsupported proof version: %d", proof.V)
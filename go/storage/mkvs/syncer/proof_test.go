@@ -9,6 +9,8 @@ import (
 
 	"github.com/oasisprotocol/oasis-core/go/common/cbor"
 	"github.com/oasisprotocol/oasis-core/go/common/crypto/hash"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/writelog"
 )
 
 func TestProofExtraNodes(t *testing.T) {
@@ -57,6 +59,53 @@ func TestProofExtraNodes(t *testing.T) {
 	require.Error(err, "proof with extra data should fail to validate")
 }
 
+func TestProofBuilderManual(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	newLeaf := func(key, value string) *node.LeafNode {
+		leaf := &node.LeafNode{Clean: true, Key: node.Key(key), Value: []byte(value)}
+		leaf.UpdateHash()
+		return leaf
+	}
+	leafFoo := newLeaf("foo", "bar")
+	leafMoo := newLeaf("moo", "goo")
+	root := &node.InternalNode{
+		Clean:          true,
+		Label:          node.Key{0x60},
+		LabelBitLength: 4,
+		Left:           &node.Pointer{Clean: true, Hash: leafFoo.Hash, Node: leafFoo},
+		Right:          &node.Pointer{Clean: true, Hash: leafMoo.Hash, Node: leafMoo},
+	}
+	root.UpdateHash()
+
+	for _, version := range []uint16{0, 1} {
+		pb, err := NewProofBuilderForVersion(root.Hash, root.Hash, version)
+		require.NoError(err, "NewProofBuilderForVersion")
+		pb.Include(root)
+		pb.Include(leafFoo)
+		require.NoError(pb.Validate(), "Validate")
+
+		proof, err := pb.Build(ctx)
+		require.NoError(err, "Build")
+
+		// Building again should produce identical output.
+		proof2, err := pb.Build(ctx)
+		require.NoError(err, "Build")
+		require.EqualValues(proof, proof2, "proof building should be deterministic")
+
+		var verifier ProofVerifier
+		wl, err := verifier.VerifyProofToWriteLog(ctx, root.Hash, proof)
+		require.NoError(err, "VerifyProofToWriteLog")
+		require.EqualValues(writelog.WriteLog{{Key: leafFoo.Key, Value: leafFoo.Value}}, wl)
+
+		// Including a node that is not reachable from the root should fail validation.
+		pb.Include(newLeaf("dangling", "node"))
+		err = pb.Validate()
+		require.ErrorIs(err, ErrDanglingProofNode, "Validate should reject dangling nodes")
+	}
+}
+
 func FuzzProof(f *testing.F) {
 	// Seed corpus.
 	rawProofV0, _ := base64.StdEncoding.DecodeString("omdlbnRyaWVzhUoBASQAa2V5IDACRgEBAQAAAlghAsFltYRhD4dAwHOdOmEigY1r02pJH6InhiibKlh9neYlWCECpsJnkjOnIgc4+yfvpsqCcIYHh5eld1hNMWTT7arAfHFYIQLhNTLWRbks1RBf52ulnlOTO+7D5EZNMYFzTx8U46sCnm51bnRydXN0ZWRfcm9vdFggWeZ8L9wIuOEN0Iu2uO/mFPzJZey4liX5fxf4fwcQRhM=")
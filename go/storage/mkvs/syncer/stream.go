@@ -0,0 +1,135 @@
+package syncer
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/oasisprotocol/oasis-core/go/common/crypto/hash"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+)
+
+// streamFrame is an internal node of a streamed proof whose children have not yet been received.
+type streamFrame struct {
+	node     *node.InternalNode
+	children int
+}
+
+// ProofStreamVerifier incrementally verifies a proof received as a stream of proof entries in
+// pre-order traversal and reassembles it.
+//
+// The hash of each subtree is computed as soon as all of its entries have been received, so
+// only the path to the current entry needs to be kept around, in addition to the reassembled
+// entries.
+type ProofStreamVerifier struct {
+	root         hash.Hash
+	proofVersion uint16
+
+	entries  [][]byte
+	stack    []*streamFrame
+	complete bool
+}
+
+// NewProofStreamVerifier creates a new verifier for a streamed proof of the given version for
+// the given root.
+func NewProofStreamVerifier(root hash.Hash, proofVersion uint16) (*ProofStreamVerifier, error) {
+	if proofVersion < MinimumProofVersion || proofVersion > LatestProofVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedProofVersion, proofVersion)
+	}
+	return &ProofStreamVerifier{
+		root:         root,
+		proofVersion: proofVersion,
+	}, nil
+}
+
+// Add processes the next proof entry.
+//
+// An error is returned in case the entry is malformed, in case it is received after the proof
+// has been completed or in case it completes the proof and the proof does not match the root.
+func (v *ProofStreamVerifier) Add(entry []byte) error {
+	if v.complete {
+		return fmt.Errorf("verifier: unused entries in proof")
+	}
+
+	var ptr *node.Pointer
+	switch {
+	case entry == nil:
+	case len(entry) == 0:
+		return errors.New("verifier: malformed proof")
+	case entry[0] == proofEntryFull:
+		n, err := node.UnmarshalBinary(entry[1:])
+		if err != nil {
+			return err
+		}
+		if nd, ok := n.(*node.InternalNode); ok {
+			// The hash of internal nodes can only be computed once all children are received.
+			v.entries = append(v.entries, entry)
+			v.stack = append(v.stack, &streamFrame{node: nd})
+			return nil
+		}
+		ptr = &node.Pointer{Clean: true, Hash: n.GetHash(), Node: n}
+	case entry[0] == proofEntryHash:
+		var h hash.Hash
+		if err := h.UnmarshalBinary(entry[1:]); err != nil {
+			return err
+		}
+		ptr = &node.Pointer{Clean: true, Hash: h}
+	default:
+		return fmt.Errorf("verifier: unexpected entry in proof (%x)", entry[0])
+	}
+	v.entries = append(v.entries, entry)
+
+	return v.completeSubtree(ptr)
+}
+
+// completeSubtree attaches the given completed subtree to its parent, completing any internal
+// nodes which have received all of their children.
+func (v *ProofStreamVerifier) completeSubtree(ptr *node.Pointer) error {
+	for len(v.stack) > 0 {
+		frame := v.stack[len(v.stack)-1]
+
+		// In version 0, the leaf node is included in the internal node, otherwise it is added
+		// separately, as a child.
+		slot := frame.children
+		if v.proofVersion == 0 {
+			slot++
+		}
+		switch slot {
+		case 0:
+			frame.node.LeafNode = ptr
+		case 1:
+			frame.node.Left = ptr
+		case 2:
+			frame.node.Right = ptr
+		}
+		frame.children++
+		if slot < 2 {
+			return nil
+		}
+
+		// All children have been received, recompute hash as hashes were not recomputed for
+		// compact encoding.
+		frame.node.UpdateHash()
+		ptr = &node.Pointer{Clean: true, Hash: frame.node.GetHash()}
+		v.stack = v.stack[:len(v.stack)-1]
+	}
+
+	// The root has been completed.
+	v.complete = true
+	rootHash := ptr.GetHash()
+	if !rootHash.Equal(&v.root) {
+		return fmt.Errorf("verifier: bad root (expected: %s got: %s)", v.root, rootHash)
+	}
+	return nil
+}
+
+// Proof returns the reassembled proof once all of its entries have been received and verified.
+func (v *ProofStreamVerifier) Proof() (*Proof, error) {
+	if !v.complete {
+		return nil, fmt.Errorf("verifier: incomplete proof stream")
+	}
+	return &Proof{
+		V:             v.proofVersion,
+		UntrustedRoot: v.root,
+		Entries:       v.entries,
+	}, nil
+}
@@ -20,6 +20,21 @@ var (
 	ErrUnsupported = errors.New("mkvs: method not supported")
 	// ErrUnsupportedProofVersion is the error returned when a ReadSyncer requests an unsuported proof version.
 	ErrUnsupportedProofVersion = errors.New("mkvs: unsupported proof version")
+	// ErrStorageTimeout is the error returned when loading a node from storage takes
+	// too long.
+	ErrStorageTimeout = errors.New("mkvs: storage timeout")
+	// ErrIncompleteProof is the error returned when a proof does not contain the nodes
+	// required to prove a key.
+	ErrIncompleteProof = errors.New("mkvs: incomplete proof")
+	// ErrDanglingProofNode is the error returned when a proof builder contains nodes that are
+	// not reachable from the proof root.
+	ErrDanglingProofNode = errors.New("mkvs: dangling proof node")
+	// ErrNotALeaf is the error returned when a leaf node was requested but the dereferenced
+	// node is an internal node.
+	ErrNotALeaf = errors.New("mkvs: not a leaf node")
+	// ErrConditionFailed is the error returned when a condition of a conditional write does
+	// not hold.
+	ErrConditionFailed = errors.New("mkvs: condition failed")
 )
 
 // TreeID identifies a specific tree and a position within that tree.
@@ -37,6 +52,11 @@ type GetRequest struct {
 	Key             []byte `json:"key"`
 	IncludeSiblings bool   `json:"include_siblings,omitempty"`
 
+	// IncludeWitness specifies whether the proof should additionally include the path to the
+	// first key following the requested key. The proof can then be used as a witness which
+	// answers lookups of all keys in between locally (see ProofVerifier.VerifyWitness).
+	IncludeWitness bool `json:"include_witness,omitempty"`
+
 	// ProofVersion specifies the proof version to use. If not specified,
 	// the default (0) version is used for backwards compatibility.
 	ProofVersion uint16 `json:"proof_version,omitempty"`
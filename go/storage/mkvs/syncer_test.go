@@ -3,6 +3,7 @@ package mkvs
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -427,6 +428,495 @@ func copyProof(p *syncer.Proof) *syncer.Proof {
 	return &result
 }
 
+func TestProofBuilderMatchesTree(t *testing.T) {
+	require := require.New(t)
+
+	ctx := context.Background()
+	var ns common.Namespace
+
+	tree := New(nil, nil, node.RootTypeState)
+	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
+	require.NoError(err, "Insert")
+	err = tree.Insert(ctx, []byte("moo"), []byte("goo"))
+	require.NoError(err, "Insert")
+	_, rootHash, err := tree.Commit(ctx, ns, 0)
+	require.NoError(err, "Commit")
+
+	// Assemble the same tree manually. The keys first differ in the fifth bit.
+	leafFoo := &node.LeafNode{Clean: true, Key: node.Key("foo"), Value: []byte("bar")}
+	leafFoo.UpdateHash()
+	leafMoo := &node.LeafNode{Clean: true, Key: node.Key("moo"), Value: []byte("goo")}
+	leafMoo.UpdateHash()
+	rootNode := &node.InternalNode{
+		Clean:          true,
+		Label:          node.Key{0x60},
+		LabelBitLength: 4,
+		Left:           &node.Pointer{Clean: true, Hash: leafFoo.Hash, Node: leafFoo},
+		Right:          &node.Pointer{Clean: true, Hash: leafMoo.Hash, Node: leafMoo},
+	}
+	rootNode.UpdateHash()
+	require.EqualValues(rootHash, rootNode.Hash, "manually assembled tree should have the same root")
+
+	for _, proofVersion := range []uint16{0, 1} {
+		rsp, err := tree.SyncGet(ctx, &syncer.GetRequest{
+			Tree: syncer.TreeID{
+				Root:     node.Root{Namespace: ns, Version: 0, Type: node.RootTypeState, Hash: rootHash},
+				Position: rootHash,
+			},
+			Key:          []byte("foo"),
+			ProofVersion: proofVersion,
+		})
+		require.NoError(err, "SyncGet")
+
+		builder, err := syncer.NewProofBuilderForVersion(rootHash, rootHash, proofVersion)
+		require.NoError(err, "NewProofBuilderForVersion")
+		builder.Include(rootNode)
+		builder.Include(leafFoo)
+		require.NoError(builder.Validate(), "Validate")
+		proof, err := builder.Build(ctx)
+		require.NoError(err, "Build")
+		require.EqualValues(&rsp.Proof, proof, "manually built proof should match the tree-produced proof")
+	}
+}
+
+func TestRangeProof(t *testing.T) {
+	require := require.New(t)
+
+	ctx := context.Background()
+	keys, values := generateKeyValuePairsEx("", 20)
+	var ns common.Namespace
+
+	tree := New(nil, nil, node.RootTypeState)
+	for i, key := range keys {
+		err := tree.Insert(ctx, key, values[i])
+		require.NoError(err, "Insert")
+	}
+	_, rootHash, err := tree.Commit(ctx, ns, 0)
+	require.NoError(err, "Commit")
+	root := node.Root{Namespace: ns, Version: 0, Type: node.RootTypeState, Hash: rootHash}
+
+	var verifier syncer.ProofVerifier
+	for _, tc := range []struct {
+		name     string
+		startKey node.Key
+		endKey   node.Key
+	}{
+		{"Partial", node.Key("key 10"), node.Key("key 15")},
+		{"Single", node.Key("key 3"), node.Key("key 3")},
+		{"Empty", node.Key("zzz"), node.Key("zzzz")},
+		{"Whole", node.Key{}, node.Key{0xff}},
+	} {
+		proof, err := tree.GetRangeProof(ctx, root, tc.startKey, tc.endKey, 1)
+		require.NoError(err, "GetRangeProof(%s)", tc.name)
+
+		wl, err := verifier.VerifyProofToWriteLog(ctx, rootHash, proof)
+		require.NoError(err, "VerifyProofToWriteLog(%s)", tc.name)
+		proven := make(map[string][]byte)
+		for _, entry := range wl {
+			proven[string(entry.Key)] = entry.Value
+		}
+
+		for i, key := range keys {
+			if node.Key(key).Compare(tc.startKey) < 0 || node.Key(key).Compare(tc.endKey) > 0 {
+				continue
+			}
+			require.EqualValues(values[i], proven[string(key)], "key %s should be provable from the range proof (%s)", key, tc.name)
+		}
+	}
+
+	_, err = tree.GetRangeProof(ctx, root, node.Key("key 2"), node.Key("key 1"), 1)
+	require.ErrorIs(err, ErrInvalidKeyRange, "GetRangeProof should fail when start is after end")
+}
+
+func TestSyncGetWithExistence(t *testing.T) {
+	require := require.New(t)
+
+	ctx := context.Background()
+	keys, values := generateKeyValuePairsEx("", 10)
+	var ns common.Namespace
+
+	tree := New(nil, nil, node.RootTypeState)
+	for i, key := range keys {
+		err := tree.Insert(ctx, key, values[i])
+		require.NoError(err, "Insert")
+	}
+	err := tree.Insert(ctx, []byte("empty"), []byte{})
+	require.NoError(err, "Insert")
+	_, rootHash, err := tree.Commit(ctx, ns, 0)
+	require.NoError(err, "Commit")
+
+	var verifier syncer.ProofVerifier
+	for _, tc := range []struct {
+		key    []byte
+		exists bool
+	}{
+		{keys[0], true},
+		{keys[9], true},
+		{[]byte("empty"), true},
+		{[]byte("key"), false},
+		{[]byte("key 10"), false},
+		{[]byte("missing"), false},
+	} {
+		request := &syncer.GetRequest{
+			Tree: syncer.TreeID{
+				Root:     node.Root{Namespace: ns, Version: 0, Type: node.RootTypeState, Hash: rootHash},
+				Position: rootHash,
+			},
+			Key:          tc.key,
+			ProofVersion: 1,
+		}
+		rsp, exists, err := tree.SyncGetWithExistence(ctx, request)
+		require.NoError(err, "SyncGetWithExistence")
+		require.Equal(tc.exists, exists, "existence flag should be correct for key %s", tc.key)
+
+		// The proof should be the same as the one returned by SyncGet.
+		expected, err := tree.SyncGet(ctx, request)
+		require.NoError(err, "SyncGet")
+		require.EqualValues(expected, rsp, "proof should match SyncGet")
+
+		_, err = verifier.VerifyProof(ctx, rootHash, &rsp.Proof)
+		require.NoError(err, "VerifyProof")
+	}
+}
+
+func TestMultiproof(t *testing.T) {
+	require := require.New(t)
+
+	ctx := context.Background()
+	keys, values := generateKeyValuePairsEx("", 50)
+	var ns common.Namespace
+
+	tree := New(nil, nil, node.RootTypeState)
+	for i, key := range keys {
+		err := tree.Insert(ctx, key, values[i])
+		require.NoError(err, "Insert")
+	}
+	_, rootHash, err := tree.Commit(ctx, ns, 0)
+	require.NoError(err, "Commit")
+	root := node.Root{Namespace: ns, Version: 0, Type: node.RootTypeState, Hash: rootHash}
+
+	keyValues := map[string][]byte{
+		string(keys[0]):  values[0],
+		string(keys[17]): values[17],
+		string(keys[42]): values[42],
+		"key":            nil,
+		"key 100":        nil,
+		"missing":        nil,
+	}
+	var proofKeys [][]byte
+	for key := range keyValues {
+		proofKeys = append(proofKeys, []byte(key))
+	}
+
+	var verifier syncer.ProofVerifier
+	for _, proofVersion := range []uint16{0, 1} {
+		proof, err := tree.GetMultiproof(ctx, root, proofKeys, proofVersion)
+		require.NoError(err, "GetMultiproof")
+
+		err = verifier.VerifyMultiproof(ctx, rootHash, keyValues, proof)
+		require.NoError(err, "VerifyMultiproof")
+
+		// Shared nodes should only be included once.
+		var totalEntries int
+		for _, key := range proofKeys {
+			var single *syncer.Proof
+			single, err = tree.GetMultiproof(ctx, root, [][]byte{key}, proofVersion)
+			require.NoError(err, "GetMultiproof")
+			totalEntries += len(single.Entries)
+		}
+		require.Less(len(proof.Entries), totalEntries, "multiproof should be smaller than individual proofs")
+
+		// Wrong values should fail verification.
+		err = verifier.VerifyMultiproof(ctx, rootHash, map[string][]byte{string(keys[0]): values[1]}, proof)
+		require.Error(err, "VerifyMultiproof should fail for wrong value")
+		err = verifier.VerifyMultiproof(ctx, rootHash, map[string][]byte{string(keys[17]): nil}, proof)
+		require.Error(err, "VerifyMultiproof should fail for existing key claimed absent")
+		err = verifier.VerifyMultiproof(ctx, rootHash, map[string][]byte{"missing": []byte("value")}, proof)
+		require.Error(err, "VerifyMultiproof should fail for absent key claimed present")
+	}
+
+	// Keys not covered by the proof should not be provable.
+	proof, err := tree.GetMultiproof(ctx, root, [][]byte{keys[0]}, 1)
+	require.NoError(err, "GetMultiproof")
+	err = verifier.VerifyMultiproof(ctx, rootHash, map[string][]byte{string(keys[42]): values[42]}, proof)
+	require.ErrorIs(err, syncer.ErrIncompleteProof, "VerifyMultiproof should fail for keys not covered by the proof")
+}
+
+func TestStreamMultiproof(t *testing.T) {
+	require := require.New(t)
+
+	ctx := context.Background()
+	keys, values := generateKeyValuePairsEx("", 200)
+	var ns common.Namespace
+
+	tree := New(nil, nil, node.RootTypeState)
+	for i, key := range keys {
+		err := tree.Insert(ctx, key, values[i])
+		require.NoError(err, "Insert")
+	}
+	_, rootHash, err := tree.Commit(ctx, ns, 0)
+	require.NoError(err, "Commit")
+	root := node.Root{Namespace: ns, Version: 0, Type: node.RootTypeState, Hash: rootHash}
+
+	// Prove every other key together with some missing keys.
+	keyValues := map[string][]byte{
+		"key":     nil,
+		"key 999": nil,
+		"missing": nil,
+	}
+	for i := 0; i < len(keys); i += 2 {
+		keyValues[string(keys[i])] = values[i]
+	}
+	var proofKeys [][]byte
+	for key := range keyValues {
+		proofKeys = append(proofKeys, []byte(key))
+	}
+
+	// Streaming from a remote tree should fetch the nodes as needed.
+	remote := NewWithRoot(tree, nil, root)
+	defer remote.Close()
+
+	var verifier syncer.ProofVerifier
+	for _, proofVersion := range []uint16{0, 1} {
+		expected, err := tree.GetMultiproof(ctx, root, proofKeys, proofVersion)
+		require.NoError(err, "GetMultiproof")
+
+		for _, source := range []Tree{tree, remote} {
+			sv, err := syncer.NewProofStreamVerifier(rootHash, proofVersion)
+			require.NoError(err, "NewProofStreamVerifier")
+			err = source.StreamMultiproof(ctx, root, proofKeys, proofVersion, sv.Add)
+			require.NoError(err, "StreamMultiproof")
+
+			proof, err := sv.Proof()
+			require.NoError(err, "Proof")
+			require.EqualValues(expected, proof, "streamed proof should match GetMultiproof")
+			err = verifier.VerifyMultiproof(ctx, rootHash, keyValues, proof)
+			require.NoError(err, "VerifyMultiproof")
+		}
+	}
+
+	// The receiver should be able to use the tree while entries are streamed.
+	sv, err := syncer.NewProofStreamVerifier(rootHash, 1)
+	require.NoError(err, "NewProofStreamVerifier")
+	err = tree.StreamMultiproof(ctx, root, proofKeys, 1, func(entry []byte) error {
+		if _, gErr := tree.Get(ctx, keys[0]); gErr != nil {
+			return gErr
+		}
+		return sv.Add(entry)
+	})
+	require.NoError(err, "StreamMultiproof")
+	_, err = sv.Proof()
+	require.NoError(err, "Proof")
+
+	// A proof for no keys only contains the root hash.
+	sv, err = syncer.NewProofStreamVerifier(rootHash, 1)
+	require.NoError(err, "NewProofStreamVerifier")
+	err = tree.StreamMultiproof(ctx, root, nil, 1, sv.Add)
+	require.NoError(err, "StreamMultiproof")
+	proof, err := sv.Proof()
+	require.NoError(err, "Proof")
+	require.Len(proof.Entries, 1, "proof should only contain the root hash")
+
+	// Tampered entries should fail verification.
+	var entries [][]byte
+	err = tree.StreamMultiproof(ctx, root, proofKeys, 1, func(entry []byte) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	require.NoError(err, "StreamMultiproof")
+	sv, err = syncer.NewProofStreamVerifier(rootHash, 1)
+	require.NoError(err, "NewProofStreamVerifier")
+	tampered := len(entries) - 1
+	for entries[tampered] == nil {
+		tampered--
+	}
+	for i, entry := range entries {
+		if i == tampered {
+			entry = append([]byte{}, entry...)
+			entry[len(entry)-1] ^= 0xff
+		}
+		if err = sv.Add(entry); err != nil {
+			break
+		}
+	}
+	require.Error(err, "tampered proof should fail verification")
+
+	// Incomplete streams should not produce a proof and extra entries should be rejected.
+	sv, err = syncer.NewProofStreamVerifier(rootHash, 1)
+	require.NoError(err, "NewProofStreamVerifier")
+	for _, entry := range entries[:len(entries)-1] {
+		err = sv.Add(entry)
+		require.NoError(err, "Add")
+	}
+	_, err = sv.Proof()
+	require.Error(err, "incomplete proof stream should fail")
+	err = sv.Add(entries[len(entries)-1])
+	require.NoError(err, "Add")
+	err = sv.Add(entries[0])
+	require.Error(err, "extra entries should be rejected")
+
+	// The first error should stop streaming.
+	errStop := errors.New("stop")
+	var count int
+	err = tree.StreamMultiproof(ctx, root, proofKeys, 1, func([]byte) error {
+		count++
+		if count == 3 {
+			return errStop
+		}
+		return nil
+	})
+	require.ErrorIs(err, errStop, "StreamMultiproof should return the first error")
+	require.Equal(3, count, "streaming should stop at the first error")
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	err = tree.StreamMultiproof(cancelCtx, root, proofKeys, 1, func([]byte) error {
+		return nil
+	})
+	require.ErrorIs(err, context.Canceled, "StreamMultiproof should respect the context")
+
+	err = tree.StreamMultiproof(ctx, root, proofKeys, syncer.LatestProofVersion+1, func([]byte) error {
+		return nil
+	})
+	require.ErrorIs(err, syncer.ErrUnsupportedProofVersion)
+
+	// Modifying the tree while streaming should fail the stream.
+	err = tree.StreamMultiproof(ctx, root, proofKeys, 1, func([]byte) error {
+		return tree.Insert(ctx, keys[0], []byte("modified"))
+	})
+	require.ErrorIs(err, syncer.ErrDirtyRoot, "StreamMultiproof should fail when the tree is modified")
+}
+
+func TestProofCoversKeys(t *testing.T) {
+	require := require.New(t)
+
+	ctx := context.Background()
+	keys, values := generateKeyValuePairsEx("", 50)
+	var ns common.Namespace
+
+	tree := New(nil, nil, node.RootTypeState)
+	for i, key := range keys {
+		err := tree.Insert(ctx, key, values[i])
+		require.NoError(err, "Insert")
+	}
+	_, rootHash, err := tree.Commit(ctx, ns, 0)
+	require.NoError(err, "Commit")
+	root := node.Root{Namespace: ns, Version: 0, Type: node.RootTypeState, Hash: rootHash}
+
+	proof, err := tree.GetMultiproof(ctx, root, [][]byte{keys[0], keys[17], []byte("missing")}, 1)
+	require.NoError(err, "GetMultiproof")
+
+	var verifier syncer.ProofVerifier
+
+	// Keys the proof was built for are fully covered, including absent ones.
+	missing, err := verifier.CoversKeys(ctx, rootHash, proof, []node.Key{keys[0], keys[17], node.Key("missing")})
+	require.NoError(err, "CoversKeys")
+	require.Empty(missing)
+
+	// Keys whose paths leave the proof are reported.
+	missing, err = verifier.CoversKeys(ctx, rootHash, proof, []node.Key{keys[42], keys[0], keys[23]})
+	require.NoError(err, "CoversKeys")
+	require.EqualValues([]node.Key{keys[42], keys[23]}, missing)
+
+	// Proofs for a different root fail verification.
+	var otherRoot hash.Hash
+	otherRoot.FromBytes([]byte("other root"))
+	_, err = verifier.CoversKeys(ctx, otherRoot, proof, []node.Key{keys[0]})
+	require.Error(err, "CoversKeys should fail for a different root")
+}
+
+func TestSyncGetWitness(t *testing.T) {
+	require := require.New(t)
+
+	ctx := context.Background()
+	keys, values := generateKeyValuePairsEx("", 50)
+	var ns common.Namespace
+
+	tree := New(nil, nil, node.RootTypeState)
+	for i, key := range keys {
+		err := tree.Insert(ctx, key, values[i])
+		require.NoError(err, "Insert")
+	}
+	_, rootHash, err := tree.Commit(ctx, ns, 0)
+	require.NoError(err, "Commit")
+
+	var verifier syncer.ProofVerifier
+	for _, proofVersion := range []uint16{0, 1} {
+		request := &syncer.GetRequest{
+			Tree: syncer.TreeID{
+				Root:     node.Root{Namespace: ns, Version: 0, Type: node.RootTypeState, Hash: rootHash},
+				Position: rootHash,
+			},
+			Key:          keys[1],
+			ProofVersion: proofVersion,
+		}
+
+		// Without a witness, keys following the requested key are not covered.
+		rsp, err := tree.SyncGet(ctx, request)
+		require.NoError(err, "SyncGet")
+		witness, err := verifier.VerifyWitness(ctx, rootHash, &rsp.Proof)
+		require.NoError(err, "VerifyWitness")
+		_, err = witness.Lookup(node.Key("key 1/"))
+		require.ErrorIs(err, syncer.ErrIncompleteProof)
+
+		// The exact proof is still included with the witness.
+		request.IncludeWitness = true
+		rsp, err = tree.SyncGet(ctx, request)
+		require.NoError(err, "SyncGet")
+		err = verifier.VerifyMultiproof(ctx, rootHash, map[string][]byte{string(keys[1]): values[1]}, &rsp.Proof)
+		require.NoError(err, "VerifyMultiproof")
+
+		// Keys up to the following key ("key 10") are answered locally.
+		witness, err = verifier.VerifyWitness(ctx, rootHash, &rsp.Proof)
+		require.NoError(err, "VerifyWitness")
+		for _, tc := range []struct {
+			key   string
+			value []byte
+		}{
+			{"key 1", values[1]},
+			{"key 1\x00", nil},
+			{"key 1/", nil},
+			{"key 10", values[10]},
+		} {
+			value, err := witness.Lookup(node.Key(tc.key))
+			require.NoError(err, "Lookup(%q) should be covered by the witness", tc.key)
+			require.Equal(tc.value, value, "Lookup(%q) should return the correct value", tc.key)
+		}
+		_, err = witness.Lookup(keys[42])
+		require.ErrorIs(err, syncer.ErrIncompleteProof, "far keys should not be covered")
+
+		// Witnesses for missing keys cover the gap to the following key.
+		request.Key = []byte("key 1!")
+		rsp, err = tree.SyncGet(ctx, request)
+		require.NoError(err, "SyncGet")
+		witness, err = verifier.VerifyWitness(ctx, rootHash, &rsp.Proof)
+		require.NoError(err, "VerifyWitness")
+		for _, key := range []string{"key 1!", "key 1#", "key 1/"} {
+			value, err := witness.Lookup(node.Key(key))
+			require.NoError(err, "Lookup(%q) should be covered by the witness", key)
+			require.Nil(value, "Lookup(%q) should report a missing key", key)
+		}
+		value, err := witness.Lookup(keys[10])
+		require.NoError(err, "Lookup")
+		require.Equal(values[10], value)
+	}
+
+	// Witnesses fail verification against a different root.
+	rsp, err := tree.SyncGet(ctx, &syncer.GetRequest{
+		Tree: syncer.TreeID{
+			Root:     node.Root{Namespace: ns, Version: 0, Type: node.RootTypeState, Hash: rootHash},
+			Position: rootHash,
+		},
+		Key:            keys[1],
+		IncludeWitness: true,
+	})
+	require.NoError(err, "SyncGet")
+	var otherRoot hash.Hash
+	otherRoot.FromBytes([]byte("other root"))
+	_, err = verifier.VerifyWitness(ctx, otherRoot, &rsp.Proof)
+	require.Error(err, "VerifyWitness should fail for a different root")
+}
+
 func TestTreeProofs(t *testing.T) {
 	// NOTE: Ensure this matches the test in runtime/src/storage/mkvs/sync/proof.rs.
 	require := require.New(t)
@@ -540,3 +1030,92 @@ func TestTreeProofs(t *testing.T) {
 		}
 	}
 }
+
+func TestProofRootHash(t *testing.T) {
+	require := require.New(t)
+
+	ctx := context.Background()
+	keys, values := generateKeyValuePairsEx("", 20)
+	var ns common.Namespace
+
+	tree := New(nil, nil, node.RootTypeState).(*tree)
+	for i, key := range keys {
+		err := tree.Insert(ctx, key, values[i])
+		require.NoError(err, "Insert")
+	}
+	_, rootHash, err := tree.Commit(ctx, ns, 0)
+	require.NoError(err, "Commit")
+
+	// includeAll includes all nodes of the in-memory subtree in the proof.
+	var includeAll func(b *syncer.ProofBuilder, ptr *node.Pointer)
+	includeAll = func(b *syncer.ProofBuilder, ptr *node.Pointer) {
+		if ptr == nil {
+			return
+		}
+		b.Include(ptr.Node)
+		if n, ok := ptr.Node.(*node.InternalNode); ok {
+			includeAll(b, n.LeafNode)
+			includeAll(b, n.Left)
+			includeAll(b, n.Right)
+		}
+	}
+
+	rootNode := tree.cache.pendingRoot.Node.(*node.InternalNode)
+	leafPtr := rootNode.Left
+	for {
+		n, ok := leafPtr.Node.(*node.InternalNode)
+		if !ok {
+			break
+		}
+		leafPtr = n.Left
+	}
+	for _, tc := range []struct {
+		name string
+		ptr  *node.Pointer
+	}{
+		{"Root", tree.cache.pendingRoot},
+		{"Subtree", rootNode.Left},
+		{"SingleLeaf", leafPtr},
+	} {
+		require.NotNil(tc.ptr, "%s should exist in the source tree", tc.name)
+		for _, proofVersion := range []uint16{0, 1} {
+			builder, err := syncer.NewProofBuilderForVersion(rootHash, tc.ptr.Hash, proofVersion)
+			require.NoError(err, "NewProofBuilderForVersion")
+			includeAll(builder, tc.ptr)
+			proof, err := builder.Build(ctx)
+			require.NoError(err, "Build")
+
+			h, err := proof.RootHash()
+			require.NoError(err, "RootHash")
+			require.EqualValues(tc.ptr.Hash, h, "%s root hash should match the source tree", tc.name)
+		}
+	}
+
+	// Partial proofs reconstruct the same hash as the hashes of omitted nodes are included.
+	builder := syncer.NewProofBuilder(rootHash, rootNode.Left.Hash)
+	builder.Include(rootNode.Left.Node)
+	proof, err := builder.Build(ctx)
+	require.NoError(err, "Build")
+	h, err := proof.RootHash()
+	require.NoError(err, "RootHash")
+	require.EqualValues(rootNode.Left.Hash, h)
+
+	// Empty subtree.
+	var emptyHash hash.Hash
+	emptyHash.Empty()
+	builder = syncer.NewProofBuilder(emptyHash, emptyHash)
+	proof, err = builder.Build(ctx)
+	require.NoError(err, "Build")
+	h, err = proof.RootHash()
+	require.NoError(err, "RootHash")
+	require.True(h.IsEmpty(), "empty subtree should have the empty hash")
+
+	// Corrupted proofs are rejected.
+	var emptyProof syncer.Proof
+	_, err = emptyProof.RootHash()
+	require.Error(err, "RootHash should fail with an empty proof")
+	corrupted := copyProof(proof)
+	corrupted.Entries = append(corrupted.Entries, nil)
+	_, err = corrupted.RootHash()
+	require.Error(err, "RootHash should fail with unused entries")
+}
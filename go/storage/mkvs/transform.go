@@ -0,0 +1,122 @@
+package mkvs
+
+import (
+	"fmt"
+
+	db "github.com/oasisprotocol/oasis-core/go/storage/mkvs/db/api"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/writelog"
+)
+
+// ValueTransformFunc is a function that transforms a leaf value stored under the given key.
+//
+// The function must not modify the passed value in place.
+type ValueTransformFunc func(key, value []byte) ([]byte, error)
+
+type transformIterator struct {
+	it     writelog.Iterator
+	onRead ValueTransformFunc
+}
+
+func (ti *transformIterator) Next() (bool, error) {
+	return ti.it.Next()
+}
+
+func (ti *transformIterator) Value() (writelog.LogEntry, error) {
+	entry, err := ti.it.Value()
+	if err != nil || entry.Value == nil {
+		return entry, err
+	}
+
+	value, err := ti.onRead(entry.Key, entry.Value)
+	if err != nil {
+		return writelog.LogEntry{}, fmt.Errorf("mkvs: failed to transform value on read: %w", err)
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	return writelog.LogEntry{Key: entry.Key, Value: value}, nil
+}
+
+// TransformWriteLog returns a write log iterator which reverses the given read value transform
+// on all inserted values of the given iterator.
+//
+// Write logs stored in the node database reference the stored leaf nodes, so write logs returned
+// by NodeDB.GetWriteLog for a tree configured using WithValueTransform contain transformed values.
+func TransformWriteLog(it writelog.Iterator, onRead ValueTransformFunc) writelog.Iterator {
+	if onRead == nil {
+		return it
+	}
+	return &transformIterator{it: it, onRead: onRead}
+}
+
+// leafNodeOf returns the leaf node stored in the given node, if any.
+func leafNodeOf(nd node.Node) *node.LeafNode {
+	switch n := nd.(type) {
+	case *node.InternalNode:
+		if n.LeafNode == nil {
+			return nil
+		}
+		leaf, _ := n.LeafNode.Node.(*node.LeafNode)
+		return leaf
+	case *node.LeafNode:
+		return n
+	default:
+		return nil
+	}
+}
+
+// putNode stores the node referenced by the given pointer into the node database, transforming
+// any leaf value using the configured write value transform.
+func (c *cache) putNode(subtree db.Subtree, depth node.Depth, ptr *node.Pointer) error {
+	leaf := leafNodeOf(ptr.Node)
+	if c.onWriteValue == nil || leaf == nil {
+		return subtree.PutNode(depth, ptr)
+	}
+
+	value := leaf.Value
+	transformed, err := c.onWriteValue(leaf.Key, value)
+	if err != nil {
+		return fmt.Errorf("mkvs: failed to transform value on write: %w", err)
+	}
+
+	// Temporarily replace the value while the node is being stored. The node hash remains
+	// computed over the original value.
+	leaf.Value = transformed
+	defer func() {
+		leaf.Value = value
+	}()
+
+	return subtree.PutNode(depth, ptr)
+}
+
+// transformNodeFromDb reverses the write value transform on a node fetched from the node
+// database and verifies that the node hash matches the expected hash.
+func (c *cache) transformNodeFromDb(ptr *node.Pointer, nd node.Node) error {
+	leaf := leafNodeOf(nd)
+	if c.onReadValue == nil || leaf == nil {
+		return nil
+	}
+
+	value, err := c.onReadValue(leaf.Key, leaf.Value)
+	if err != nil {
+		return fmt.Errorf("mkvs: failed to transform value on read: %w", err)
+	}
+	if value == nil {
+		// Leaves always store a value, make sure zero-length values are not mistaken for
+		// missing keys.
+		value = []byte{}
+	}
+	leaf.Value = value
+	leaf.UpdateHash()
+
+	if n, ok := nd.(*node.InternalNode); ok {
+		n.LeafNode.Hash = leaf.Hash
+		n.UpdateHash()
+	}
+
+	if h := nd.GetHash(); !h.Equal(&ptr.Hash) {
+		return fmt.Errorf("mkvs: node hash mismatch after value transform (expected: %s got: %s)", ptr.Hash, h)
+	}
+	return nil
+}
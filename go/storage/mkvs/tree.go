@@ -2,6 +2,8 @@ package mkvs
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	db "github.com/oasisprotocol/oasis-core/go/storage/mkvs/db/api"
 	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
@@ -19,10 +21,35 @@ type tree struct { // nolint: maligned
 	// NOTE: This can be a map as updates are commutative.
 	pendingWriteLog map[string]*pendingEntry
 	withoutWriteLog bool
+	// fixedKeyWidth is the width of all keys in bytes or zero if keys have variable width.
+	fixedKeyWidth int
+	// deepLeafThreshold is the bit depth beyond which newly inserted leaves are reported to
+	// deepLeafFn.
+	deepLeafThreshold node.Depth
+	// deepLeafFn is the hook called for leaves inserted deeper than deepLeafThreshold.
+	deepLeafFn DeepLeafFunc
 	// pendingRemovedNodes are the nodes that have been removed from the
 	// in-memory tree and should be marked for garbage collection if this
 	// tree is committed to the node database.
 	pendingRemovedNodes []*node.Pointer
+	// committedRoot is the root pointer as of the last commit, which the pending root is reset
+	// to on Rollback.
+	committedRoot *node.Pointer
+	// pendingUndo are the committed states of the clean nodes that have been modified in place
+	// by the pending updates, in modification order.
+	pendingUndo []undoEntry
+	// pendingSummary is the change of the root summary caused by the pending updates.
+	pendingSummary summaryDelta
+	// hotKeys is the hot-key tracker enabled with the WithHotKeyTracking or WithHotKeyTracker
+	// options.
+	hotKeys *HotKeyTracker
+	// snapshotNodeCapacity is the maximum number of internal nodes pinned by a snapshot.
+	snapshotNodeCapacity uint64
+	// snapshotValueCapacity is the maximum size of values pinned by a snapshot.
+	snapshotValueCapacity uint64
+	// healthProbe is the health check probe currently in flight, if any. Protected by the cache
+	// lock.
+	healthProbe *healthProbe
 }
 
 type pendingEntry struct {
@@ -33,6 +60,12 @@ type pendingEntry struct {
 	insertedLeaf *node.Pointer
 }
 
+// undoEntry is the committed state of a node pointer that has been modified in place.
+type undoEntry struct {
+	ptr   *node.Pointer
+	saved *node.Pointer
+}
+
 // Option is a configuration option used when instantiating the tree.
 type Option func(t *tree)
 
@@ -63,6 +96,74 @@ func WithoutWriteLog() Option {
 	}
 }
 
+// NodeLoadTimeout sets the maximum time loading a single node from the node database or the
+// remote syncer may take. Loads taking longer fail with syncer.ErrStorageTimeout.
+//
+// If no timeout is specified, node loads are only bounded by the passed context.
+func NodeLoadTimeout(timeout time.Duration) Option {
+	return func(t *tree) {
+		t.cache.nodeLoadTimeout = timeout
+	}
+}
+
+// WithValueTransform configures transforms applied to leaf values when they are stored in
+// and fetched from the node database (e.g., for at-rest encryption or compression).
+//
+// The onRead transform must reverse the onWrite transform. Node hashes and therefore roots are
+// always computed over the original (untransformed) values, so using a transform does not change
+// the resulting roots.
+//
+// The node database itself is not aware of the transform. Write logs stored in the node database
+// reference the stored leaf nodes, so values returned by NodeDB.GetWriteLog are transformed; use
+// TransformWriteLog to reverse the transform. Checkpoints are created from and restored into the
+// node database without the transform and are therefore not supported for transformed trees.
+func WithValueTransform(onWrite, onRead ValueTransformFunc) Option {
+	return func(t *tree) {
+		t.cache.onWriteValue = onWrite
+		t.cache.onReadValue = onRead
+	}
+}
+
+// WithEvictionPolicy sets the policy used to decide which nodes are evicted from the in-memory
+// cache when it is full.
+//
+// If no policy is specified, the least recently used nodes are evicted first.
+func WithEvictionPolicy(factory EvictionPolicyFactory) Option {
+	return func(t *tree) {
+		t.cache.newEvictionPolicy = factory
+		t.cache.internalPolicy = factory()
+		t.cache.leafPolicy = factory()
+	}
+}
+
+// WithFixedKeyWidth declares that all keys in the tree have the given width in bytes (e.g., 32
+// for trees keyed by hashes). Operations on keys of any other width fail with
+// ErrKeyWidthMismatch.
+//
+// As no key can be a prefix of another key in such a tree, this catches keys that would
+// otherwise silently end up stored on internal nodes.
+//
+// The option only validates keys, tree operations are not specialized for fixed-width keys.
+func WithFixedKeyWidth(width int) Option {
+	return func(t *tree) {
+		t.fixedKeyWidth = width
+	}
+}
+
+// DeepLeafFunc is the function called when a newly inserted leaf is located deeper than the
+// configured threshold.
+type DeepLeafFunc func(key node.Key, bitDepth node.Depth)
+
+// WithDeepLeafHook configures the tree to call fn whenever Insert creates a new leaf at a bit
+// depth greater than the given threshold. This can be used to detect key distributions that
+// result in unbalanced trees.
+func WithDeepLeafHook(threshold node.Depth, fn DeepLeafFunc) Option {
+	return func(t *tree) {
+		t.deepLeafThreshold = threshold
+		t.deepLeafFn = fn
+	}
+}
+
 // New creates a new empty MKVS tree backed by the given node database.
 func New(rs syncer.ReadSyncer, ndb db.NodeDB, rootType node.RootType, options ...Option) Tree {
 	if rs == nil {
@@ -77,6 +178,9 @@ func New(rs syncer.ReadSyncer, ndb db.NodeDB, rootType node.RootType, options ..
 		rootType:        rootType,
 		pendingWriteLog: make(map[string]*pendingEntry),
 		withoutWriteLog: false,
+
+		snapshotNodeCapacity:  defaultSnapshotNodeCapacity,
+		snapshotValueCapacity: defaultSnapshotValueCapacity,
 	}
 
 	for _, v := range options {
@@ -90,21 +194,108 @@ func New(rs syncer.ReadSyncer, ndb db.NodeDB, rootType node.RootType, options ..
 // the given node database.
 func NewWithRoot(rs syncer.ReadSyncer, ndb db.NodeDB, root node.Root, options ...Option) Tree {
 	t := New(rs, ndb, root.Type, options...).(*tree)
-	t.cache.setPendingRoot(&node.Pointer{
+	t.committedRoot = &node.Pointer{
 		Clean: true,
 		Hash:  root.Hash,
-	})
+	}
+	t.cache.setPendingRoot(t.committedRoot)
 	t.cache.setSyncRoot(root)
 	return t
 }
 
+// checkKeyWidth checks whether the key matches the fixed key width (if any).
+func (t *tree) checkKeyWidth(key []byte) error {
+	if t.fixedKeyWidth > 0 && len(key) != t.fixedKeyWidth {
+		return fmt.Errorf("%w: expected %d bytes, got %d", ErrKeyWidthMismatch, t.fixedKeyWidth, len(key))
+	}
+	return nil
+}
+
+// newWithRoot creates a new tree with the same configuration as this tree, sharing its node
+// database and read syncer, rooted at the given root.
+func (t *tree) newWithRoot(root node.Root) *tree {
+	nt := NewWithRoot(
+		t.cache.rs,
+		t.cache.db,
+		root,
+		Capacity(t.cache.nodeCapacity, t.cache.valueCapacity),
+		NodeLoadTimeout(t.cache.nodeLoadTimeout),
+		WithValueTransform(t.cache.onWriteValue, t.cache.onReadValue),
+		WithEvictionPolicy(t.cache.newEvictionPolicy),
+	).(*tree)
+	nt.withoutWriteLog = t.withoutWriteLog
+	nt.fixedKeyWidth = t.fixedKeyWidth
+	nt.deepLeafThreshold = t.deepLeafThreshold
+	nt.deepLeafFn = t.deepLeafFn
+	nt.hotKeys = t.hotKeys
+	nt.snapshotNodeCapacity = t.snapshotNodeCapacity
+	nt.snapshotValueCapacity = t.snapshotValueCapacity
+	return nt
+}
+
 // Implements Tree.
 func (t *tree) NewIterator(ctx context.Context, options ...IteratorOption) Iterator {
-	return newTreeIterator(ctx, t, options...)
+	it := newTreeIterator(ctx, t, options...)
+	it.locking = true
+	return it
+}
+
+// ApplyOption is an option that can be specified during ApplyWriteLog.
+type ApplyOption func(o *applyOptions)
+
+// ApplyProgressFunc is the function called to report write log application progress.
+//
+// The applied argument is the number of entries applied so far and remaining is the number of
+// entries still left to apply or -1 in case the write log iterator cannot tell.
+type ApplyProgressFunc func(applied uint64, remaining int64)
+
+// WithApplyProgress returns an apply option that calls fn after every interval applied entries
+// and once more after the whole write log has been applied.
+func WithApplyProgress(interval uint64, fn ApplyProgressFunc) ApplyOption {
+	return func(o *applyOptions) {
+		o.progressInterval = interval
+		o.progressFn = fn
+	}
+}
+
+// ApplyStats are the statistics of a single write log application.
+type ApplyStats struct {
+	// Entries is the number of applied write log entries.
+	Entries uint64
+	// Cache are the cache statistics accumulated while applying the write log. For trees backed
+	// by a remote syncer, the number of remote fetches shows how many of the touched nodes were
+	// not yet cached.
+	Cache CacheStats
+}
+
+// WithApplyStats returns an apply option that calls fn with the statistics of the write log
+// application once the whole write log has been applied.
+func WithApplyStats(fn func(*ApplyStats)) ApplyOption {
+	return func(o *applyOptions) {
+		o.statsFn = fn
+	}
+}
+
+type applyOptions struct {
+	statsFn func(*ApplyStats)
+
+	progressInterval uint64
+	progressFn       ApplyProgressFunc
 }
 
 // Implements Tree.
-func (t *tree) ApplyWriteLog(ctx context.Context, wl writelog.Iterator) error {
+func (t *tree) ApplyWriteLog(ctx context.Context, wl writelog.Iterator, options ...ApplyOption) error {
+	var opts applyOptions
+	for _, o := range options {
+		o(&opts)
+	}
+
+	var startStats CacheStats
+	if opts.statsFn != nil {
+		startStats = t.CacheStats()
+	}
+
+	var applied uint64
 	for {
 		// Fetch next entry from write log iterator.
 		more, err := wl.Next()
@@ -119,6 +310,16 @@ func (t *tree) ApplyWriteLog(ctx context.Context, wl writelog.Iterator) error {
 			return err
 		}
 
+		// Report progress before applying the next entry so that the final count is only
+		// reported once the whole write log has been applied.
+		if opts.progressFn != nil && opts.progressInterval > 0 && applied > 0 && applied%opts.progressInterval == 0 {
+			remaining := int64(-1)
+			if sized, ok := wl.(writelog.SizedIterator); ok {
+				remaining = int64(sized.Remaining()) + 1
+			}
+			opts.progressFn(applied, remaining)
+		}
+
 		// Apply operation.
 		if entry.Value == nil {
 			err = t.Remove(ctx, entry.Key)
@@ -128,10 +329,118 @@ func (t *tree) ApplyWriteLog(ctx context.Context, wl writelog.Iterator) error {
 		if err != nil {
 			return err
 		}
+
+		applied++
+	}
+	if opts.progressFn != nil {
+		opts.progressFn(applied, 0)
+	}
+	if opts.statsFn != nil {
+		endStats := t.CacheStats()
+		opts.statsFn(&ApplyStats{
+			Entries: applied,
+			Cache: CacheStats{
+				Hits:          endStats.Hits - startStats.Hits,
+				Misses:        endStats.Misses - startStats.Misses,
+				RemoteFetches: endStats.RemoteFetches - startStats.RemoteFetches,
+			},
+		})
 	}
 	return nil
 }
 
+// applyLocked applies the given write log to the tree. The deep leaf hook is only called in case
+// notify is set, so that it is not called again when re-applying pending updates.
+//
+// Must be called while holding the cache lock.
+func (t *tree) applyLocked(ctx context.Context, wl writelog.WriteLog, notify bool) error {
+	for _, entry := range wl {
+		if entry.Value == nil {
+			if _, err := t.removeExistingLocked(ctx, entry.Key); err != nil {
+				return err
+			}
+			continue
+		}
+
+		result, err := t.insertLocked(ctx, entry.Key, entry.Value)
+		if err != nil {
+			return err
+		}
+		if notify {
+			t.notifyDeepLeaf(entry.Key, result)
+		}
+	}
+	return nil
+}
+
+// Implements Tree.
+func (t *tree) Rollback() error {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return ErrClosed
+	}
+
+	t.doRollback()
+	return nil
+}
+
+// saveNode remembers the committed state of a clean node before it is modified in place so
+// that it can be restored on rollback. Dirty nodes are not saved as they either have been
+// saved before or have been created by the pending updates.
+func (t *tree) saveNode(ptr *node.Pointer) {
+	if ptr == nil || !ptr.Clean {
+		return
+	}
+
+	saved := ptr.ExtractUnchecked()
+	switch n := ptr.Node.(type) {
+	case *node.InternalNode:
+		nd := *n
+		saved.Node = &nd
+	case *node.LeafNode:
+		nd := *n
+		saved.Node = &nd
+	}
+	t.pendingUndo = append(t.pendingUndo, undoEntry{ptr: ptr, saved: saved})
+}
+
+// doRollback discards all pending updates by restoring the committed state of all modified
+// nodes and resetting the pending root to the committed root. Nodes created by the pending
+// updates are dropped as they are no longer referenced.
+//
+// Must be called while holding the cache lock.
+func (t *tree) doRollback() {
+	// Restore in reverse order so that each node ends up in the state before it was first
+	// modified. Modified nodes are no longer in the cache, so they are committed to it again.
+	for i := len(t.pendingUndo) - 1; i >= 0; i-- {
+		entry := t.pendingUndo[i]
+		*entry.ptr = *entry.saved
+		t.cache.commitNode(entry.ptr)
+	}
+
+	t.cache.setPendingRoot(t.committedRoot)
+	t.pendingUndo = nil
+	t.pendingWriteLog = make(map[string]*pendingEntry)
+	t.pendingRemovedNodes = nil
+	t.pendingSummary = summaryDelta{}
+}
+
+// Implements Tree.
+func (t *tree) CacheStats() CacheStats {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	return CacheStats{
+		Hits:          t.cache.hits,
+		Misses:        t.cache.misses,
+		RemoteFetches: t.cache.remoteFetches,
+		InternalNodes: t.cache.internalNodeCount,
+		ValueSize:     t.cache.valueSize,
+	}
+}
+
 // Implements Tree.
 func (t *tree) RootType() node.RootType {
 	return t.rootType
@@ -8,7 +8,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -18,6 +21,7 @@ import (
 	db "github.com/oasisprotocol/oasis-core/go/storage/mkvs/db/api"
 	badgerDb "github.com/oasisprotocol/oasis-core/go/storage/mkvs/db/badger"
 	pathBadgerDb "github.com/oasisprotocol/oasis-core/go/storage/mkvs/db/pathbadger"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/mkvstest"
 	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
 	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/syncer"
 	mkvsTests "github.com/oasisprotocol/oasis-core/go/storage/mkvs/tests"
@@ -628,7 +632,7 @@ func testRemove(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 
 func testSyncerBasic(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	ctx := context.Background()
-	keys, values, r, tree := generatePopulatedTree(t, ndb)
+	keys, values, r, tree := generateRandomTree(t, ndb, randomTreeParams(insertItems), Capacity(0, 0))
 
 	// Create a "remote" tree that talks to the original tree via the
 	// syncer interface.
@@ -647,6 +651,61 @@ func testSyncerBasic(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	require.Equal(t, 0, stats.SyncIterateCount, "SyncIterate count")
 }
 
+func testSyncerApplyCached(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+	keys, _, r, tree := generateRandomTree(t, ndb, randomTreeParams(insertItems), Capacity(0, 0))
+
+	// Create a "remote" tree that talks to the original tree via the syncer interface and
+	// caches all fetched nodes.
+	stats := syncer.NewStatsCollector(tree)
+	remoteTree := NewWithRoot(stats, nil, r, Capacity(0, 0))
+	defer remoteTree.Close()
+
+	localTree := NewWithRoot(nil, ndb, r)
+	defer localTree.Close()
+
+	// applyBoth applies the write log to both the remote and the local tree and checks that
+	// the resulting roots match, returning the statistics of the remote apply.
+	applyBoth := func(wl writelog.WriteLog) *ApplyStats {
+		var applyStats *ApplyStats
+		err := remoteTree.ApplyWriteLog(ctx, writelog.NewStaticIterator(wl), WithApplyStats(func(s *ApplyStats) {
+			applyStats = s
+		}))
+		require.NoError(t, err, "ApplyWriteLog")
+		require.NotNil(t, applyStats, "apply stats should be reported")
+		require.EqualValues(t, len(wl), applyStats.Entries)
+
+		err = localTree.ApplyWriteLog(ctx, writelog.NewStaticIterator(wl))
+		require.NoError(t, err, "ApplyWriteLog")
+
+		_, remoteRootHash, err := remoteTree.Commit(ctx, testNs, r.Version+1, NoPersist())
+		require.NoError(t, err, "Commit")
+		_, localRootHash, err := localTree.Commit(ctx, testNs, r.Version+1, NoPersist())
+		require.NoError(t, err, "Commit")
+		require.Equal(t, localRootHash, remoteRootHash, "remote apply should produce the same root as a local apply")
+		return applyStats
+	}
+
+	// Update a region of keys.
+	var wl writelog.WriteLog
+	for _, key := range keys[10:20] {
+		wl = append(wl, writelog.LogEntry{Key: key, Value: []byte("first update")})
+	}
+	wl = append(wl, writelog.LogEntry{Key: keys[20], Value: nil})
+	first := applyBoth(wl)
+	require.NotZero(t, first.Cache.RemoteFetches, "first apply should fetch nodes")
+	require.EqualValues(t, stats.SyncGetCount, first.Cache.RemoteFetches)
+
+	// Updating the same region again should use the cached nodes.
+	for i := range wl {
+		wl[i].Value = []byte("second update")
+	}
+	second := applyBoth(wl)
+	require.Less(t, second.Cache.RemoteFetches, first.Cache.RemoteFetches, "second apply should fetch fewer nodes")
+	require.EqualValues(t, stats.SyncGetCount, first.Cache.RemoteFetches+second.Cache.RemoteFetches)
+	require.NotZero(t, second.Cache.Hits)
+}
+
 func testSyncerRootEmptyLabelNeedsDeref(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	ctx := context.Background()
 	tree := New(nil, ndb, node.RootTypeState)
@@ -825,13 +884,17 @@ func testSyncerNilNodes(t *testing.T, _ db.NodeDB, _ NodeDBFactory) {
 
 func testSyncerPrefetchPrefixes(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	ctx := context.Background()
-	keys, values, root, tree := generatePopulatedTree(t, ndb)
+	// All keys of a wide tree share a common prefix.
+	p := randomTreeParams(insertItems)
+	p.Shape = mkvstest.ShapeWide
+	keys, values, root, tree := generateRandomTree(t, ndb, p, Capacity(0, 0))
+	prefix := keys[0][:p.KeySize/2]
 
 	stats := syncer.NewStatsCollector(tree)
 	remoteTree := NewWithRoot(stats, nil, root, Capacity(0, 0))
 
-	// Prefetch keys starting with prefix "key".
-	err := remoteTree.PrefetchPrefixes(ctx, [][]byte{[]byte("key")}, 1000)
+	// Prefetch keys starting with the common prefix.
+	err := remoteTree.PrefetchPrefixes(ctx, [][]byte{prefix}, insertItems)
 	require.NoError(t, err, "PrefetchPrefixes")
 	require.EqualValues(t, 1, stats.SyncGetPrefixesCount, "SyncGetPrefixes should be called exactly once")
 
@@ -932,6 +995,60 @@ func testDebugDumpLocal(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	require.True(t, len(buffer.Bytes()) > 0)
 }
 
+func testRenderDOT(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+	tree := New(nil, ndb, node.RootTypeState)
+	defer tree.Close()
+
+	for _, key := range []string{"foo 1", "foo 2", "foo 3", "foo"} {
+		err := tree.Insert(ctx, []byte(key), []byte("bar"))
+		require.NoError(t, err, "Insert")
+	}
+	_, rootHash, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+	root := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash}
+
+	info, err := tree.RootInfo(ctx, root)
+	require.NoError(t, err, "RootInfo")
+
+	countNodesEdges := func(dot string) (int, int) {
+		var nodes, edges int
+		for _, line := range strings.Split(dot, "\n") {
+			switch {
+			case strings.Contains(line, "->"):
+				edges++
+			case strings.Contains(line, "[label="):
+				nodes++
+			}
+		}
+		return nodes, edges
+	}
+
+	// Render the whole tree.
+	var buf bytes.Buffer
+	err = tree.RenderDOT(ctx, root, 0, &buf)
+	require.NoError(t, err, "RenderDOT")
+	dot := buf.String()
+	require.True(t, strings.HasPrefix(dot, "digraph mkvs {\n"))
+	require.True(t, strings.HasSuffix(dot, "}\n"))
+	nodes, edges := countNodesEdges(dot)
+	require.EqualValues(t, info.NodeCount, nodes, "all nodes should be rendered")
+	require.Equal(t, nodes-1, edges, "every node except the root should have an incoming edge")
+	require.Equal(t, 4, strings.Count(dot, "shape=box"), "every leaf should be rendered")
+
+	// Render only the root and its children.
+	buf.Reset()
+	err = tree.RenderDOT(ctx, root, 1, &buf)
+	require.NoError(t, err, "RenderDOT")
+	nodes, edges = countNodesEdges(buf.String())
+	require.Less(t, nodes, int(info.NodeCount), "deep nodes should be collapsed")
+	require.Equal(t, nodes-1, edges)
+	require.Contains(t, buf.String(), "shape=plaintext", "collapsed nodes should be marked")
+
+	err = tree.RenderDOT(ctx, node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHash}, 0, &buf)
+	require.ErrorIs(t, err, syncer.ErrInvalidRoot, "RenderDOT should fail for a different root")
+}
+
 func testApplyWriteLog(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	keys, values := generateKeyValuePairsEx("", 100)
 
@@ -969,6 +1086,81 @@ func testApplyWriteLog(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	require.True(t, rootHash.IsEmpty(), "root hash must be empty after removal of all items")
 }
 
+func testApplyWriteLogProgress(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	keys, values := generateKeyValuePairsEx("", 10_000)
+
+	var writeLog writelog.WriteLog
+	for i := range keys {
+		writeLog = append(writeLog, writelog.LogEntry{Key: keys[i], Value: values[i]})
+	}
+
+	type progress struct {
+		applied   uint64
+		remaining int64
+	}
+	var reports []progress
+
+	ctx := context.Background()
+	tree := New(nil, ndb, node.RootTypeState)
+	defer tree.Close()
+	err := tree.ApplyWriteLog(ctx, writelog.NewStaticIterator(writeLog), WithApplyProgress(1000, func(applied uint64, remaining int64) {
+		reports = append(reports, progress{applied, remaining})
+	}))
+	require.NoError(t, err, "ApplyWriteLog")
+
+	require.Len(t, reports, 10, "progress should be reported every 1000 entries")
+	for i, p := range reports {
+		if i > 0 {
+			require.Greater(t, p.applied, reports[i-1].applied, "applied count should increase")
+		}
+		require.EqualValues(t, len(writeLog), int64(p.applied)+p.remaining, "remaining estimate should be exact")
+	}
+	require.EqualValues(t, len(writeLog), reports[len(reports)-1].applied, "final report should cover all entries")
+	require.EqualValues(t, 0, reports[len(reports)-1].remaining)
+}
+
+func testCanonicalWriteLog(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+	keys, values := generateKeyValuePairsEx("", 50)
+
+	var writeLog writelog.WriteLog
+	for i := range keys {
+		writeLog = append(writeLog, writelog.LogEntry{Key: keys[i], Value: values[i]})
+	}
+	// Add some duplicate keys with updates and removals.
+	writeLog = append(writeLog,
+		writelog.LogEntry{Key: keys[0], Value: []byte("updated")},
+		writelog.LogEntry{Key: keys[1]},
+		writelog.LogEntry{Key: keys[2]},
+		writelog.LogEntry{Key: keys[2], Value: []byte("reinserted")},
+	)
+
+	computeRoot := func(wl writelog.WriteLog) hash.Hash {
+		tree := New(nil, ndb, node.RootTypeState)
+		defer tree.Close()
+
+		err := tree.ApplyWriteLog(ctx, writelog.NewStaticIterator(wl))
+		require.NoError(t, err, "ApplyWriteLog")
+		_, rootHash, err := tree.Commit(ctx, testNs, 0, NoPersist())
+		require.NoError(t, err, "Commit")
+		return rootHash
+	}
+
+	expectedRoot := computeRoot(writeLog)
+	canonical := writeLog.Canonical()
+	require.Len(t, canonical, len(keys), "canonical write log should not contain duplicates")
+	require.EqualValues(t, expectedRoot, computeRoot(canonical), "canonical write log should result in the same root")
+
+	// Reverse the order of the initial entries, keeping the relative order of duplicates.
+	reordered := make(writelog.WriteLog, 0, len(writeLog))
+	for i := len(keys) - 1; i >= 0; i-- {
+		reordered = append(reordered, writeLog[i])
+	}
+	reordered = append(reordered, writeLog[len(keys):]...)
+	require.True(t, canonical.Equal(reordered.Canonical()), "canonical write log should not depend on input order")
+	require.EqualValues(t, expectedRoot, computeRoot(reordered.Canonical()), "canonical write log should result in the same root")
+}
+
 func testOnCommitHooks(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	var emptyRoot hash.Hash
 	emptyRoot.Empty()
@@ -1002,1345 +1194,3508 @@ func testOnCommitHooks(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	require.EqualValues(t, calls, []int{1, 2, 3}, "OnCommit hooks should fire in order")
 }
 
-func testCommitNoPersist(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+func testValueTransform(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	ctx := context.Background()
-	tree := New(nil, ndb, node.RootTypeState)
+	keys, values := generateKeyValuePairsEx("", 50)
 
-	err := tree.Insert(ctx, []byte("this key"), []byte("should not be persisted"))
-	require.NoError(t, err, "Insert")
+	xor := func(_, value []byte) ([]byte, error) {
+		transformed := make([]byte, len(value))
+		for i := range value {
+			transformed[i] = value[i] ^ 0xaa
+		}
+		return transformed, nil
+	}
 
-	log, root, err := tree.Commit(ctx, testNs, 0, NoPersist())
+	// Compute the expected root without any transform.
+	plainTree := New(nil, nil, node.RootTypeState)
+	defer plainTree.Close()
+	for i := range keys {
+		err := plainTree.Insert(ctx, keys[i], values[i])
+		require.NoError(t, err, "Insert")
+	}
+	_, expectedRoot, err := plainTree.Commit(ctx, testNs, 0, NoPersist())
 	require.NoError(t, err, "Commit")
-	require.Equal(t, "46141a682ada455db80763c17c4e76535adaafaa2508d4fdae8a5ee5c0166629", root.String(), "computed root should be correct")
-	require.Len(t, log, 1, "write log should contain one item")
-
-	// Make sure we can still commit and finalize something at an arbitrary higher round.
 
-	err = tree.Insert(ctx, []byte("but now"), []byte("we will persist everything"))
-	require.NoError(t, err, "Insert")
-
-	log, root, err = tree.Commit(ctx, testNs, 42)
+	tree := New(nil, ndb, node.RootTypeState, WithValueTransform(xor, xor))
+	defer tree.Close()
+	for i := range keys {
+		err = tree.Insert(ctx, keys[i], values[i])
+		require.NoError(t, err, "Insert")
+	}
+	_, rootHash, err := tree.Commit(ctx, testNs, 0)
 	require.NoError(t, err, "Commit")
-	require.Equal(t, "d9b2effdff5a22145cef58c7c84c8040ee441e65a30e75d13e7490939299a4f4", root.String(), "computed root should be correct")
-	require.Len(t, log, 2, "write log should contain two items")
+	require.EqualValues(t, expectedRoot, rootHash, "value transform should not change the root")
 
-	nodeRoot := node.Root{
+	root := node.Root{
 		Namespace: testNs,
-		Version:   42,
+		Version:   0,
 		Type:      node.RootTypeState,
-		Hash:      root,
+		Hash:      rootHash,
 	}
-	err = ndb.Finalize([]node.Root{nodeRoot})
-	require.NoError(t, err, "Finalize")
 
-	roots, err := ndb.GetRootsForVersion(42)
-	require.NoError(t, err, "GetRootsForVersion")
-	require.Len(t, roots, 1, "there should only be one root")
-	require.Equal(t, nodeRoot, roots[0], "the root hash should be correct")
+	// Values should round-trip when read back through a tree with the same transform.
+	tree = NewWithRoot(nil, ndb, root, WithValueTransform(xor, xor))
+	defer tree.Close()
+	for i := range keys {
+		var value []byte
+		value, err = tree.Get(ctx, keys[i])
+		require.NoError(t, err, "Get")
+		require.EqualValues(t, values[i], value, "value should round-trip through the transform")
+	}
 
-	// Make sure everything has been persisted now.
-	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 42, Type: node.RootTypeState, Hash: root})
+	// Reads of other roots should use the same transform.
+	history, err := tree.GetValueHistory(ctx, keys[0], []node.Root{root})
+	require.NoError(t, err, "GetValueHistory")
+	require.EqualValues(t, [][]byte{values[0]}, history, "GetValueHistory should reverse the transform")
 
-	value, err := tree.Get(ctx, []byte("this key"))
+	// Values should be stored in transformed form.
+	tree = NewWithRoot(nil, ndb, root)
+	defer tree.Close()
+	value, err := tree.Get(ctx, keys[0])
 	require.NoError(t, err, "Get")
-	require.EqualValues(t, []byte("should not be persisted"), value)
+	require.NotEqualValues(t, values[0], value, "stored value should be transformed")
 
-	value, err = tree.Get(ctx, []byte("but now"))
-	require.NoError(t, err, "Get")
-	require.EqualValues(t, []byte("we will persist everything"), value)
-}
+	// Stored write logs should contain transformed values which can be reversed.
+	var emptyRoot node.Root
+	emptyRoot.Empty()
+	emptyRoot.Namespace = testNs
+	emptyRoot.Type = node.RootTypeState
+	it, err := ndb.GetWriteLog(ctx, emptyRoot, root)
+	require.NoError(t, err, "GetWriteLog")
+	expected := make(map[string][]byte)
+	for i := range keys {
+		expected[string(keys[i])] = values[i]
+	}
+	stored := foldWriteLogIterator(t, it)
+	require.Len(t, stored, len(keys), "write log should contain all inserted keys")
+	for _, entry := range stored {
+		require.NotEqualValues(t, expected[string(entry.Key)], entry.Value, "stored write log value should be transformed")
+	}
+	it, err = ndb.GetWriteLog(ctx, emptyRoot, root)
+	require.NoError(t, err, "GetWriteLog")
+	for _, entry := range foldWriteLogIterator(t, TransformWriteLog(it, xor)) {
+		require.EqualValues(t, expected[string(entry.Key)], entry.Value, "TransformWriteLog should reverse the transform")
+	}
 
-func testHasRoot(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
-	// Test that an empty root is always implicitly present.
-	root := node.Root{
-		Namespace: testNs,
-		Version:   0,
-		Type:      node.RootTypeState,
+	// A transform that does not reverse the write transform should be detected.
+	identity := func(_, value []byte) ([]byte, error) {
+		return value, nil
 	}
-	root.Hash.Empty()
-	require.True(t, ndb.HasRoot(root), "HasRoot should return true on empty root")
+	tree = NewWithRoot(nil, ndb, root, WithValueTransform(xor, identity))
+	defer tree.Close()
+	_, err = tree.Get(ctx, keys[0])
+	require.Error(t, err, "Get should fail with a mismatched transform")
+}
 
-	// Create a root in version 0.
+func testRollback(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	ctx := context.Background()
-	tree := New(nil, ndb, node.RootTypeState)
-	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
+
+	tr := New(nil, ndb, node.RootTypeState).(*tree)
+	defer tr.Close()
+	err := tr.Insert(ctx, []byte("foo"), []byte("bar"))
 	require.NoError(t, err, "Insert")
-	_, rootHash1, err := tree.Commit(ctx, testNs, 0)
+	_, rootHash, err := tr.Commit(ctx, testNs, 0)
 	require.NoError(t, err, "Commit")
+	root := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash}
 
-	root = node.Root{
-		Namespace: testNs,
-		Version:   0,
-		Type:      node.RootTypeState,
-		Hash:      rootHash1,
+	keys, values := generateKeyValuePairsEx("", 100)
+	for i := range keys {
+		err = tr.Insert(ctx, keys[i], values[i])
+		require.NoError(t, err, "Insert")
 	}
+	err = tr.Remove(ctx, []byte("foo"))
+	require.NoError(t, err, "Remove")
 
-	// Finalize version 0.
-	err = ndb.Finalize([]node.Root{root})
-	require.NoError(t, err, "Finalize")
-
-	// Make sure that HasRoot returns true.
-	require.True(t, ndb.HasRoot(root), "HasRoot should return true for existing root")
-	root.Hash.FromBytes([]byte("invalid root"))
-	require.False(t, ndb.HasRoot(root), "HasRoot should return false for non-existing root")
-
-	// Create a different root in version 1.
-	tree = New(nil, ndb, node.RootTypeState)
-	err = tree.Insert(ctx, []byte("goo"), []byte("bar"))
-	require.NoError(t, err, "Insert")
-	_, rootHash2, err := tree.Commit(ctx, testNs, 1)
-	require.NoError(t, err, "Commit")
-	// Finalize version 1.
-	root2 := node.Root{
-		Namespace: testNs,
-		Version:   1,
-		Type:      node.RootTypeState,
-		Hash:      rootHash2,
-	}
-	err = ndb.Finalize([]node.Root{root2})
-	require.NoError(t, err, "Finalize")
+	err = tr.Rollback()
+	require.NoError(t, err, "Rollback")
 
-	// Make sure that HasRoot for root hash from version 0 but with
-	// version 1 passed returns false.
-	root = node.Root{
-		Namespace: testNs,
-		Version:   1,
-		Type:      node.RootTypeState,
-		Hash:      rootHash1,
-	}
-	require.False(t, ndb.HasRoot(root), "HasRoot should return false for non-existing root")
-	root.Hash = rootHash2
-	require.True(t, ndb.HasRoot(root), "HasRoot should return true for existing root")
-}
+	// Reads should reflect only the committed state.
+	value, err := tr.Get(ctx, []byte("foo"))
+	require.NoError(t, err, "Get")
+	require.EqualValues(t, []byte("bar"), value)
+	value, err = tr.Get(ctx, keys[0])
+	require.NoError(t, err, "Get")
+	require.Nil(t, value, "rolled back key should not exist")
 
-func testGetRootsForVersion(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
-	ctx := context.Background()
+	info, err := tr.RootInfo(ctx, root)
+	require.NoError(t, err, "RootInfo")
+	require.EqualValues(t, 1, info.NodeCount, "tree should only contain committed nodes")
+	leaf := node.LeafNode{Key: []byte("foo"), Value: []byte("bar")}
+	require.EqualValues(t, leaf.Size(), tr.cache.valueSize, "only committed values should be cached")
+	require.Empty(t, tr.pendingWriteLog, "pending write log should be released")
 
-	// Create two roots in version 10.
-	tree := New(nil, ndb, node.RootTypeState)
-	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
+	// The tree should remain usable after rollback.
+	err = tr.Insert(ctx, []byte("moo"), []byte("goo"))
 	require.NoError(t, err, "Insert")
-	_, rootHash1, err := tree.Commit(ctx, testNs, 10)
+	writeLog, _, err := tr.Commit(ctx, testNs, 1)
 	require.NoError(t, err, "Commit")
+	require.Len(t, writeLog, 1, "write log should only contain updates after rollback")
 
-	tree = New(nil, ndb, node.RootTypeIO)
-	err = tree.Insert(ctx, []byte("bar"), []byte("foo"))
+	// Trees without a node database only have the committed state in memory.
+	mem := New(nil, nil, node.RootTypeState)
+	defer mem.Close()
+	half := len(keys) / 2
+	err = mem.Insert(ctx, []byte("foo"), []byte("bar"))
 	require.NoError(t, err, "Insert")
-	_, rootHash2, err := tree.Commit(ctx, testNs, 10)
+	for i := 0; i < half; i++ {
+		err = mem.Insert(ctx, keys[i], values[i])
+		require.NoError(t, err, "Insert")
+	}
+	_, memRootHash, err := mem.Commit(ctx, testNs, 0)
 	require.NoError(t, err, "Commit")
 
-	// Finalize version 10.
-	root1 := node.Root{
-		Namespace: testNs,
-		Version:   10,
-		Type:      node.RootTypeState,
-		Hash:      rootHash1,
+	for i := half; i < len(keys); i++ {
+		err = mem.Insert(ctx, keys[i], values[i])
+		require.NoError(t, err, "Insert")
 	}
-	root2 := node.Root{
-		Namespace: testNs,
-		Version:   10,
-		Type:      node.RootTypeIO,
-		Hash:      rootHash2,
+	err = mem.Insert(ctx, []byte("foo"), []byte("baz"))
+	require.NoError(t, err, "Insert")
+	_, _, err = mem.Commit(ctx, testNs, 1, NoPersist())
+	require.NoError(t, err, "Commit")
+	for i := 0; i < half; i += 2 {
+		err = mem.Remove(ctx, keys[i])
+		require.NoError(t, err, "Remove")
 	}
-	err = ndb.Finalize([]node.Root{root1, root2})
-	require.NoError(t, err, "Finalize")
 
-	roots, err := ndb.GetRootsForVersion(10)
-	require.NoError(t, err, "GetRootsForVersion")
-	require.Len(t, roots, 2, "GetRootsForVersion should return the correct number of roots")
-	require.Contains(t, roots, root1, "GetRootsForVersion should return the correct roots")
-	require.Contains(t, roots, root2, "GetRootsForVersion should return the correct roots")
+	err = mem.Rollback()
+	require.NoError(t, err, "Rollback")
 
-	roots, err = ndb.GetRootsForVersion(1)
-	require.NoError(t, err, "GetRootsForVersion")
-	require.Len(t, roots, 0, "GetRootsForVersion should return no roots for eaerlier versions")
+	value, err = mem.Get(ctx, []byte("foo"))
+	require.NoError(t, err, "Get")
+	require.EqualValues(t, []byte("bar"), value, "rollback should restore the committed value")
+	for i := range keys {
+		value, err = mem.Get(ctx, keys[i])
+		require.NoError(t, err, "Get")
+		if i < half {
+			require.EqualValues(t, values[i], value, "rollback should restore removed keys")
+		} else {
+			require.Nil(t, value, "rolled back key should not exist")
+		}
+	}
 
-	roots, err = ndb.GetRootsForVersion(11)
-	require.NoError(t, err, "GetRootsForVersion")
-	require.Len(t, roots, 0, "GetRootsForVersion should return no roots for later versions")
+	// Dirtying the restored nodes should result in the committed root again.
+	err = mem.Insert(ctx, keys[half], values[half])
+	require.NoError(t, err, "Insert")
+	err = mem.Remove(ctx, keys[half])
+	require.NoError(t, err, "Remove")
+	pendingHash, _ := mem.PendingRootHash()
+	require.EqualValues(t, memRootHash, pendingHash, "restored nodes should match the committed root")
 }
 
-func testSize(t *testing.T, ndb db.NodeDB, factory NodeDBFactory) {
+func testCommitPrefix(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	ctx := context.Background()
 
-	size, err := ndb.Size()
-	require.NoError(t, err, "Size")
+	computeRoot := func(keys ...string) hash.Hash {
+		tree := New(nil, nil, node.RootTypeState)
+		defer tree.Close()
+		for _, key := range keys {
+			err := tree.Insert(ctx, []byte(key), []byte("value "+key))
+			require.NoError(t, err, "Insert")
+		}
+		_, rootHash, err := tree.Commit(ctx, testNs, 0, NoPersist())
+		require.NoError(t, err, "Commit")
+		return rootHash
+	}
 
-	// Put something in the database.
 	tree := New(nil, ndb, node.RootTypeState)
-	err = tree.Insert(ctx, []byte("foo"), []byte("bar"))
-	require.NoError(t, err, "Insert")
-	_, rootHash1, err := tree.Commit(ctx, testNs, 0)
-	require.NoError(t, err, "Commit")
-	root1 := node.Root{
-		Namespace: testNs,
-		Version:   0,
-		Type:      node.RootTypeState,
-		Hash:      rootHash1,
+	defer tree.Close()
+	for _, key := range []string{"a/1", "a/2", "b/1"} {
+		err := tree.Insert(ctx, []byte(key), []byte("value "+key))
+		require.NoError(t, err, "Insert")
 	}
-	err = ndb.Finalize([]node.Root{root1})
-	require.NoError(t, err, "Finalize")
 
-	// Reopen database to force flush.
-	ndb.Close()
-	ndb, err = factory(testNs)
-	require.NoError(t, err, "ndb.New")
-	defer ndb.Close()
+	root, err := tree.CommitPrefix(ctx, node.Key("a/"), testNs, 1)
+	require.NoError(t, err, "CommitPrefix")
+	require.EqualValues(t, computeRoot("a/1", "a/2"), root.Hash, "committed root should only contain the prefix")
+	require.EqualValues(t, 1, root.Version)
 
-	// Make sure size reports something that makes sense.
-	newSize, err := ndb.Size()
-	require.NoError(t, err, "Size")
-	require.True(t, newSize > size, "Size should be greater than before")
-}
+	// The committed root should be readable from the node database.
+	committed := NewWithRoot(nil, ndb, root)
+	defer committed.Close()
+	value, err := committed.Get(ctx, []byte("a/1"))
+	require.NoError(t, err, "Get")
+	require.EqualValues(t, []byte("value a/1"), value)
+	value, err = committed.Get(ctx, []byte("b/1"))
+	require.NoError(t, err, "Get")
+	require.Nil(t, value, "uncommitted key should not be part of the committed root")
 
-func testEmptyValueWriteLog(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
-	ctx := context.Background()
+	// Remaining updates should still be pending.
+	value, err = tree.Get(ctx, []byte("b/1"))
+	require.NoError(t, err, "Get")
+	require.EqualValues(t, []byte("value b/1"), value)
+	_, err = tree.RootInfo(ctx, root)
+	require.ErrorIs(t, err, syncer.ErrDirtyRoot, "tree should remain dirty")
 
-	// Populate the tree.
-	tree := New(nil, ndb, node.RootTypeState)
-	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
+	err = tree.Insert(ctx, []byte("a/3"), []byte("value a/3"))
 	require.NoError(t, err, "Insert")
-	err = tree.Insert(ctx, []byte("bar"), []byte(""))
-	require.NoError(t, err, "Insert")
-	writeLog, rootHash, err := tree.Commit(ctx, testNs, 0)
+	writeLog, rootHash, err := tree.Commit(ctx, testNs, 2)
 	require.NoError(t, err, "Commit")
-
-	// Ensure no nil entries returned.
-	for _, entry := range writeLog {
-		require.NotNil(t, entry.Value)
+	require.EqualValues(t, computeRoot("a/1", "a/2", "a/3", "b/1"), rootHash, "final root should contain all updates")
+	require.Len(t, writeLog, 2, "write log should only contain the remaining updates")
+
+	// Trees without a node database should commit on top of their committed state and should
+	// not report deep leaves again.
+	var deepLeaves int
+	mem := New(nil, nil, node.RootTypeState, WithDeepLeafHook(0, func(node.Key, node.Depth) {
+		deepLeaves++
+	}))
+	defer mem.Close()
+	for _, key := range []string{"a/1", "b/1"} {
+		err = mem.Insert(ctx, []byte(key), []byte("value "+key))
+		require.NoError(t, err, "Insert")
 	}
-
-	startRoot := node.Root{
-		Namespace: testNs,
-		Version:   0,
-		Type:      node.RootTypeState,
+	_, _, err = mem.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+	for _, key := range []string{"a/2", "b/2", "b/3"} {
+		err = mem.Insert(ctx, []byte(key), []byte("value "+key))
+		require.NoError(t, err, "Insert")
 	}
-	startRoot.Hash.Empty()
+	err = mem.Remove(ctx, []byte("b/1"))
+	require.NoError(t, err, "Remove")
+	reported := deepLeaves
 
-	endRoot := node.Root{
-		Namespace: testNs,
-		Hash:      rootHash,
-		Version:   0,
-		Type:      node.RootTypeState,
+	root, err = mem.CommitPrefix(ctx, node.Key("a/"), testNs, 1)
+	require.NoError(t, err, "CommitPrefix")
+	require.EqualValues(t, computeRoot("a/1", "a/2", "b/1"), root.Hash, "committed root should only contain the prefix")
+	require.Equal(t, reported, deepLeaves, "deep leaves should not be reported again")
+
+	_, rootHash, err = mem.Commit(ctx, testNs, 2)
+	require.NoError(t, err, "Commit")
+	require.EqualValues(t, computeRoot("a/1", "a/2", "b/2", "b/3"), rootHash, "final root should contain all updates")
+}
+
+func testSideTreeOptions(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	tree := New(nil, ndb, node.RootTypeState,
+		Capacity(10, 1024),
+		NodeLoadTimeout(time.Second),
+		WithFixedKeyWidth(8),
+		WithDeepLeafHook(1, func(node.Key, node.Depth) {}),
+		WithHotKeyTracking(time.Minute, 1, 0),
+		SnapshotCapacity(20, 2048),
+	).(*tree)
+	defer tree.Close()
+
+	st := tree.newWithRoot(tree.cache.syncRoot)
+	defer st.Close()
+	require.EqualValues(t, tree.cache.nodeCapacity, st.cache.nodeCapacity, "side tree should keep the node capacity")
+	require.EqualValues(t, tree.cache.valueCapacity, st.cache.valueCapacity, "side tree should keep the value capacity")
+	require.EqualValues(t, tree.cache.nodeLoadTimeout, st.cache.nodeLoadTimeout, "side tree should keep the node load timeout")
+	require.EqualValues(t, tree.fixedKeyWidth, st.fixedKeyWidth, "side tree should keep the fixed key width")
+	require.EqualValues(t, tree.deepLeafThreshold, st.deepLeafThreshold, "side tree should keep the deep leaf threshold")
+	require.NotNil(t, st.deepLeafFn, "side tree should keep the deep leaf hook")
+	require.True(t, tree.hotKeys == st.hotKeys, "side tree should share the hot-key tracker")
+	require.EqualValues(t, tree.snapshotNodeCapacity, st.snapshotNodeCapacity, "side tree should keep the snapshot capacity")
+	require.EqualValues(t, tree.snapshotValueCapacity, st.snapshotValueCapacity, "side tree should keep the snapshot capacity")
+}
+
+// blockingNodeDB is a node database which blocks node loads until released.
+type blockingNodeDB struct {
+	db.NodeDB
+
+	release chan struct{}
+
+	l        sync.Mutex
+	wg       sync.WaitGroup
+	released bool
+	blocked  int
+}
+
+// enter registers an in-flight access and blocks until the database is released. It returns
+// false in case the database has already been released and must no longer be accessed.
+func (b *blockingNodeDB) enter() bool {
+	b.l.Lock()
+	if b.released {
+		b.l.Unlock()
+		return false
 	}
+	b.wg.Add(1)
+	b.blocked++
+	b.l.Unlock()
 
-	// Fetch write log from database.
-	wli, err := ndb.GetWriteLog(ctx, startRoot, endRoot)
-	require.NoError(t, err, "GetWriteLog")
-	writeLog = foldWriteLogIterator(t, wli)
+	<-b.release
+	return true
+}
 
-	for _, entry := range writeLog {
-		require.NotNil(t, entry.Value)
+// blockedCount returns the number of accesses which blocked.
+func (b *blockingNodeDB) blockedCount() int {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	return b.blocked
+}
+
+// releaseAndWait releases all blocked accesses and waits for them to finish. Accesses made
+// afterwards fail without touching the underlying database, so it can be safely closed.
+func (b *blockingNodeDB) releaseAndWait() {
+	b.l.Lock()
+	if !b.released {
+		b.released = true
+		close(b.release)
 	}
+	b.l.Unlock()
+
+	b.wg.Wait()
 }
 
-func testBasicWriteLog(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
-	ctx := context.Background()
+func (b *blockingNodeDB) HasRoot(root node.Root) bool {
+	if !b.enter() {
+		return false
+	}
+	defer b.wg.Done()
 
-	keyZero := []byte("foo")
-	valueZero := []byte("bar")
-	keyOne := []byte("baz")
-	valueOne := []byte("quux")
+	return b.NodeDB.HasRoot(root)
+}
 
-	emptyRoot := node.Root{
-		Namespace: testNs,
-		Version:   0,
-		Type:      node.RootTypeState,
+func (b *blockingNodeDB) GetNode(root node.Root, ptr *node.Pointer) (node.Node, error) {
+	if !b.enter() {
+		return nil, db.ErrNodeNotFound
 	}
-	emptyRoot.Hash.Empty()
+	defer b.wg.Done()
+
+	return b.NodeDB.GetNode(root, ptr)
+}
+
+func testNodeLoadTimeout(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
 
-	// Put some stuff in the tree.
 	tree := New(nil, ndb, node.RootTypeState)
-	err := tree.Insert(ctx, keyZero, valueZero)
+	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
 	require.NoError(t, err, "Insert")
-	_, rootHash1, err := tree.Commit(ctx, testNs, 0)
+	_, rootHash, err := tree.Commit(ctx, testNs, 0)
 	require.NoError(t, err, "Commit")
+	tree.Close()
+	root := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash}
 
-	root1 := node.Root{
-		Namespace: testNs,
-		Version:   0,
-		Type:      node.RootTypeState,
-		Hash:      rootHash1,
+	// Normal loads should not time out.
+	tree = NewWithRoot(nil, ndb, root, NodeLoadTimeout(time.Second))
+	value, err := tree.Get(ctx, []byte("foo"))
+	require.NoError(t, err, "Get")
+	require.EqualValues(t, []byte("bar"), value)
+	tree.Close()
+
+	// A hung load should time out.
+	bdb := &blockingNodeDB{NodeDB: ndb, release: make(chan struct{})}
+	defer bdb.releaseAndWait()
+
+	tree = NewWithRoot(nil, bdb, root, NodeLoadTimeout(50*time.Millisecond))
+	defer tree.Close()
+	_, err = tree.Get(ctx, []byte("foo"))
+	require.ErrorIs(t, err, syncer.ErrStorageTimeout, "Get should time out")
+
+	// Loading again while the database is still hung should not start new loads.
+	for i := 0; i < 10; i++ {
+		_, err = tree.Get(ctx, []byte("foo"))
+		require.ErrorIs(t, err, syncer.ErrStorageTimeout, "Get should time out")
 	}
+	require.Equal(t, 1, bdb.blockedCount(), "only a single node load should be in flight")
 
-	wli, err := ndb.GetWriteLog(ctx, emptyRoot, root1)
-	require.NoError(t, err, "GetWriteLog")
+	// Once the hung load finishes, its result should be used. Loads made after releasing the
+	// database fail, so the value can only come from the previous load.
+	bdb.releaseAndWait()
+	value, err = tree.Get(ctx, []byte("foo"))
+	require.NoError(t, err, "Get")
+	require.EqualValues(t, []byte("bar"), value)
+}
 
-	wl := writeLogToMap(foldWriteLogIterator(t, wli))
-	require.Equal(t, writeLogToMap(writelog.WriteLog{writelog.LogEntry{Key: keyZero, Value: valueZero}}), wl)
+// corruptNodeDB is a node database which returns the wrong node for the given hash.
+type corruptNodeDB struct {
+	db.NodeDB
 
-	// Continue adding to this same tree.
-	err = tree.Insert(ctx, keyOne, valueOne)
+	hash hash.Hash
+}
+
+func (c *corruptNodeDB) GetNode(root node.Root, ptr *node.Pointer) (node.Node, error) {
+	if ptr.Hash.Equal(&c.hash) {
+		leaf := &node.LeafNode{Key: []byte("corrupt"), Value: []byte("node")}
+		leaf.UpdateHash()
+		return leaf, nil
+	}
+	return c.NodeDB.GetNode(root, ptr)
+}
+
+func testHealthCheck(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+
+	tree := New(nil, ndb, node.RootTypeState)
+	require.NoError(t, tree.HealthCheck(ctx), "HealthCheck should pass without a committed root")
+
+	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
 	require.NoError(t, err, "Insert")
-	_, rootHash2, err := tree.Commit(ctx, testNs, 1)
+	err = tree.Insert(ctx, []byte("moo"), []byte("goo"))
+	require.NoError(t, err, "Insert")
+	_, rootHash, err := tree.Commit(ctx, testNs, 0)
 	require.NoError(t, err, "Commit")
+	root := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash}
+	require.NoError(t, tree.HealthCheck(ctx), "HealthCheck should pass on a healthy tree")
+	tree.Close()
+	require.ErrorIs(t, tree.HealthCheck(ctx), ErrClosed, "HealthCheck should fail on a closed tree")
 
-	root2 := node.Root{
-		Namespace: testNs,
-		Version:   1,
-		Type:      node.RootTypeState,
-		Hash:      rootHash2,
-	}
+	tree = NewWithRoot(nil, ndb, root)
+	require.NoError(t, tree.HealthCheck(ctx), "HealthCheck should pass on a healthy tree")
+	tree.Close()
 
-	// We can still get write logs to intermediate roots.
-	wli, err = ndb.GetWriteLog(ctx, emptyRoot, root1)
-	require.NoError(t, err, "GetWriteLog")
-	_ = writelog.DrainIterator(wli)
-	wli, err = ndb.GetWriteLog(ctx, root1, root2)
-	require.NoError(t, err, "GetWriteLog")
-	_ = writelog.DrainIterator(wli)
+	// A node database returning inconsistent nodes should fail the check.
+	tree = NewWithRoot(nil, &corruptNodeDB{NodeDB: ndb, hash: rootHash}, root)
+	require.ErrorIs(t, tree.HealthCheck(ctx), ErrUnhealthy, "HealthCheck should fail on a corrupt node database")
+	tree.Close()
 
-	// Make sure that we fail with more than one hop.
-	keys, values := generateKeyValuePairs()
-	for i, key := range keys {
-		err = tree.Insert(ctx, key, values[i])
-		require.NoError(t, err, "Insert(%d)", i)
+	// A node database missing the root should fail the check.
+	missingRoot := root
+	missingRoot.Hash.FromBytes([]byte("missing root"))
+	tree = NewWithRoot(nil, ndb, missingRoot)
+	require.ErrorIs(t, tree.HealthCheck(ctx), ErrUnhealthy, "HealthCheck should fail on a missing root")
+	tree.Close()
+
+	// An unresponsive node database should fail the check.
+	bdb := &blockingNodeDB{NodeDB: ndb, release: make(chan struct{})}
+	defer bdb.releaseAndWait()
+	tree = NewWithRoot(nil, bdb, root, NodeLoadTimeout(50*time.Millisecond))
+	defer tree.Close()
+	require.ErrorIs(t, tree.HealthCheck(ctx), syncer.ErrStorageTimeout, "HealthCheck should time out")
+
+	// Checking again while the database is still hung should not start new reads.
+	for i := 0; i < 10; i++ {
+		require.ErrorIs(t, tree.HealthCheck(ctx), syncer.ErrStorageTimeout, "HealthCheck should time out")
 	}
-	_, rootHash3, err := tree.Commit(ctx, testNs, 2)
+	require.Equal(t, 1, bdb.blockedCount(), "only a single health check read should be in flight")
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	tree = NewWithRoot(nil, bdb, root)
+	defer tree.Close()
+	require.ErrorIs(t, tree.HealthCheck(cancelCtx), context.Canceled, "HealthCheck should respect the context")
+}
+
+func testApplyIf(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+
+	tree := New(nil, ndb, node.RootTypeState)
+	defer tree.Close()
+	err := tree.Insert(ctx, []byte("balance/alice"), []byte("10"))
+	require.NoError(t, err, "Insert")
+	err = tree.Insert(ctx, []byte("balance/bob"), []byte("5"))
+	require.NoError(t, err, "Insert")
+	err = tree.Insert(ctx, []byte("empty"), []byte{})
+	require.NoError(t, err, "Insert")
+	_, rootHash, err := tree.Commit(ctx, testNs, 0)
 	require.NoError(t, err, "Commit")
+	root := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash}
 
-	root3 := node.Root{
-		Namespace: testNs,
-		Version:   2,
-		Type:      node.RootTypeState,
-		Hash:      rootHash3,
+	transfer := writelog.WriteLog{
+		{Key: []byte("balance/alice"), Value: []byte("7")},
+		{Key: []byte("balance/bob"), Value: []byte("8")},
+		{Key: []byte("balance/carol"), Value: []byte("0")},
 	}
 
-	_, err = ndb.GetWriteLog(ctx, emptyRoot, root2)
-	require.Error(t, err, "GetWriteLog")
-	_, err = ndb.GetWriteLog(ctx, emptyRoot, root3)
-	require.Error(t, err, "GetWriteLog")
+	// A failing condition should reject the whole write log.
+	for _, conds := range [][]KeyValueCond{
+		{{Key: []byte("balance/alice"), Value: []byte("10")}, {Key: []byte("balance/bob"), Value: []byte("6")}},
+		{{Key: []byte("balance/carol"), Value: []byte("0")}},
+		{{Key: []byte("balance/alice"), Value: nil}},
+		{{Key: []byte("empty"), Value: nil}},
+	} {
+		_, err = tree.ApplyIf(ctx, root, 1, conds, transfer)
+		require.ErrorIs(t, err, syncer.ErrConditionFailed, "ApplyIf should fail when a condition does not hold")
 
-	// Make sure all the items are there.
-	wli, err = ndb.GetWriteLog(ctx, root2, root3)
-	require.NoError(t, err, "GetWriteLog")
-	wl = writeLogToMap(foldWriteLogIterator(t, wli))
-	for i, key := range keys {
-		require.EqualValues(t, wl[string(key)], values[i])
+		var value []byte
+		value, err = tree.Get(ctx, []byte("balance/alice"))
+		require.NoError(t, err, "Get")
+		require.EqualValues(t, "10", value, "state should be unchanged after a failed condition")
+		value, err = tree.Get(ctx, []byte("balance/carol"))
+		require.NoError(t, err, "Get")
+		require.Nil(t, value, "state should be unchanged after a failed condition")
 	}
-}
+	_, err = tree.ApplyIf(ctx, root, 1, []KeyValueCond{{Key: []byte("balance/bob"), Value: []byte("6")}}, transfer)
+	require.ErrorContains(t, err, node.Key("balance/bob").String(), "error should name the failing key")
 
-func testFinalizeEmpty(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
-	root := node.Root{
-		Namespace: testNs,
-		Version:   0,
-		Type:      node.RootTypeState,
+	// Conditions on the wrong root should be rejected.
+	var emptyRoot node.Root
+	emptyRoot.Empty()
+	_, err = tree.ApplyIf(ctx, emptyRoot, 1, nil, transfer)
+	require.ErrorIs(t, err, syncer.ErrInvalidRoot, "ApplyIf should fail on a different root")
+
+	// If all conditions hold, the write log should be applied and committed.
+	newRoot, err := tree.ApplyIf(ctx, root, 1, []KeyValueCond{
+		{Key: []byte("balance/alice"), Value: []byte("10")},
+		{Key: []byte("balance/bob"), Value: []byte("5")},
+		{Key: []byte("balance/carol"), Value: nil},
+		{Key: []byte("empty"), Value: []byte{}},
+	}, transfer)
+	require.NoError(t, err, "ApplyIf")
+	require.Equal(t, testNs, newRoot.Namespace)
+	require.EqualValues(t, 1, newRoot.Version)
+	require.Equal(t, node.RootTypeState, newRoot.Type)
+
+	expected := NewWithRoot(nil, ndb, root)
+	defer expected.Close()
+	err = expected.ApplyWriteLog(ctx, writelog.NewStaticIterator(transfer))
+	require.NoError(t, err, "ApplyWriteLog")
+	_, expectedHash, err := expected.Commit(ctx, testNs, 1, NoPersist())
+	require.NoError(t, err, "Commit")
+	require.Equal(t, expectedHash, newRoot.Hash)
+
+	committed := NewWithRoot(nil, ndb, newRoot)
+	defer committed.Close()
+	for _, entry := range transfer {
+		value, gerr := committed.Get(ctx, entry.Key)
+		require.NoError(t, gerr, "Get")
+		require.Equal(t, entry.Value, value)
 	}
-	root.Hash.Empty()
 
-	err := ndb.Finalize([]node.Root{root})
-	require.NoError(t, err, "Finalize")
+	// The tree should have moved on to the new root.
+	_, err = tree.ApplyIf(ctx, root, 2, nil, transfer)
+	require.ErrorIs(t, err, syncer.ErrInvalidRoot, "ApplyIf should fail on a stale root")
 
-	// Create an empty root, but with an actual commit.
-	ctx := context.Background()
-	tree := NewWithRoot(nil, ndb, root)
-	_, rootHash, err := tree.Commit(ctx, testNs, 1)
+	// A failed commit should leave the tree at the old root.
+	_, err = tree.ApplyIf(ctx, newRoot, 3, nil, writelog.WriteLog{
+		{Key: []byte("balance/alice"), Value: nil},
+		{Key: []byte("balance/dave"), Value: []byte("1")},
+	})
+	require.ErrorIs(t, err, db.ErrRootMustFollowOld, "ApplyIf should fail on a non-following version")
+	pendingHash, clean := tree.PendingRootHash()
+	require.True(t, clean, "tree should not have any pending updates after a failed commit")
+	require.Equal(t, newRoot.Hash, pendingHash, "tree should remain at the old root after a failed commit")
+	value, err := tree.Get(ctx, []byte("balance/alice"))
+	require.NoError(t, err, "Get")
+	require.EqualValues(t, "7", value, "state should be unchanged after a failed commit")
+
+	// Trees without a node database should apply updates to their committed state.
+	mem := New(nil, nil, node.RootTypeState)
+	defer mem.Close()
+	err = mem.Insert(ctx, []byte("balance/alice"), []byte("10"))
+	require.NoError(t, err, "Insert")
+	_, memRootHash, err := mem.Commit(ctx, testNs, 5)
 	require.NoError(t, err, "Commit")
-	require.True(t, rootHash.IsEmpty())
+	memRoot := node.Root{Namespace: testNs, Version: 5, Type: node.RootTypeState, Hash: memRootHash}
+	memNewRoot, err := mem.ApplyIf(ctx, memRoot, 6, []KeyValueCond{
+		{Key: []byte("balance/alice"), Value: []byte("10")},
+	}, transfer)
+	require.NoError(t, err, "ApplyIf")
+	require.EqualValues(t, 6, memNewRoot.Version)
+	for _, entry := range transfer {
+		value, err = mem.Get(ctx, entry.Key)
+		require.NoError(t, err, "Get")
+		require.Equal(t, entry.Value, value)
+	}
 
-	root.Version = 1
-	err = ndb.Finalize([]node.Root{root})
-	require.NoError(t, err, "Finalize")
+	// Pending updates should be rejected.
+	err = tree.Insert(ctx, []byte("pending"), []byte("update"))
+	require.NoError(t, err, "Insert")
+	_, err = tree.ApplyIf(ctx, newRoot, 2, nil, transfer)
+	require.ErrorIs(t, err, syncer.ErrDirtyRoot, "ApplyIf should fail with pending updates")
 }
 
-func testPruneBasic(t *testing.T, ndb db.NodeDB, factory NodeDBFactory) {
+func testCommitNoPersist(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	ctx := context.Background()
 	tree := New(nil, ndb, node.RootTypeState)
 
-	// Create some keys in version 0.
-	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
-	require.NoError(t, err, "Insert")
-	err = tree.Insert(ctx, []byte("moo"), []byte("bar"))
+	err := tree.Insert(ctx, []byte("this key"), []byte("should not be persisted"))
 	require.NoError(t, err, "Insert")
-	_, rootHash1, err := tree.Commit(ctx, testNs, 0)
+
+	log, root, err := tree.Commit(ctx, testNs, 0, NoPersist())
 	require.NoError(t, err, "Commit")
-	// Test that we cannot prune non-finalized versions.
-	err = ndb.Prune(0)
-	require.Error(t, err, "Prune should fail for non-finalized versions")
-	require.Equal(t, db.ErrNotFinalized, err)
-	// Finalize version 0.
-	root1 := node.Root{
-		Namespace: testNs,
-		Version:   0,
-		Type:      node.RootTypeState,
-		Hash:      rootHash1,
-	}
-	err = ndb.Finalize([]node.Root{root1})
-	require.NoError(t, err, "Finalize")
+	require.Equal(t, "46141a682ada455db80763c17c4e76535adaafaa2508d4fdae8a5ee5c0166629", root.String(), "computed root should be correct")
+	require.Len(t, log, 1, "write log should contain one item")
 
-	// Remove key in version 1.
-	err = tree.Remove(ctx, []byte("foo"))
-	require.NoError(t, err, "Remove")
-	err = tree.Insert(ctx, []byte("another"), []byte("value"))
+	// Make sure we can still commit and finalize something at an arbitrary higher round.
+
+	err = tree.Insert(ctx, []byte("but now"), []byte("we will persist everything"))
 	require.NoError(t, err, "Insert")
-	_, rootHash2, err := tree.Commit(ctx, testNs, 1)
+
+	log, root, err = tree.Commit(ctx, testNs, 42)
 	require.NoError(t, err, "Commit")
-	// Test that we cannot prune non-finalized versions.
-	err = ndb.Prune(1)
-	require.Error(t, err, "Prune should fail for non-finalized versions")
-	require.Equal(t, db.ErrNotFinalized, err)
-	// Finalize version 1.
-	root2 := node.Root{
+	require.Equal(t, "d9b2effdff5a22145cef58c7c84c8040ee441e65a30e75d13e7490939299a4f4", root.String(), "computed root should be correct")
+	require.Len(t, log, 2, "write log should contain two items")
+
+	nodeRoot := node.Root{
 		Namespace: testNs,
-		Version:   1,
+		Version:   42,
 		Type:      node.RootTypeState,
-		Hash:      rootHash2,
+		Hash:      root,
+	}
+	err = ndb.Finalize([]node.Root{nodeRoot})
+	require.NoError(t, err, "Finalize")
+
+	roots, err := ndb.GetRootsForVersion(42)
+	require.NoError(t, err, "GetRootsForVersion")
+	require.Len(t, roots, 1, "there should only be one root")
+	require.Equal(t, nodeRoot, roots[0], "the root hash should be correct")
+
+	// Make sure everything has been persisted now.
+	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 42, Type: node.RootTypeState, Hash: root})
+
+	value, err := tree.Get(ctx, []byte("this key"))
+	require.NoError(t, err, "Get")
+	require.EqualValues(t, []byte("should not be persisted"), value)
+
+	value, err = tree.Get(ctx, []byte("but now"))
+	require.NoError(t, err, "Get")
+	require.EqualValues(t, []byte("we will persist everything"), value)
+}
+
+func testHasRoot(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	// Test that an empty root is always implicitly present.
+	root := node.Root{
+		Namespace: testNs,
+		Version:   0,
+		Type:      node.RootTypeState,
+	}
+	root.Hash.Empty()
+	require.True(t, ndb.HasRoot(root), "HasRoot should return true on empty root")
+
+	// Create a root in version 0.
+	ctx := context.Background()
+	tree := New(nil, ndb, node.RootTypeState)
+	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
+	require.NoError(t, err, "Insert")
+	_, rootHash1, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+
+	root = node.Root{
+		Namespace: testNs,
+		Version:   0,
+		Type:      node.RootTypeState,
+		Hash:      rootHash1,
+	}
+
+	// Finalize version 0.
+	err = ndb.Finalize([]node.Root{root})
+	require.NoError(t, err, "Finalize")
+
+	// Make sure that HasRoot returns true.
+	require.True(t, ndb.HasRoot(root), "HasRoot should return true for existing root")
+	root.Hash.FromBytes([]byte("invalid root"))
+	require.False(t, ndb.HasRoot(root), "HasRoot should return false for non-existing root")
+
+	// Create a different root in version 1.
+	tree = New(nil, ndb, node.RootTypeState)
+	err = tree.Insert(ctx, []byte("goo"), []byte("bar"))
+	require.NoError(t, err, "Insert")
+	_, rootHash2, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+	// Finalize version 1.
+	root2 := node.Root{
+		Namespace: testNs,
+		Version:   1,
+		Type:      node.RootTypeState,
+		Hash:      rootHash2,
 	}
 	err = ndb.Finalize([]node.Root{root2})
 	require.NoError(t, err, "Finalize")
 
-	// Add some keys in version 2.
-	err = tree.Insert(ctx, []byte("blah"), []byte("ugh"))
-	require.NoError(t, err, "Insert")
-	_, rootHash3, err := tree.Commit(ctx, testNs, 2)
-	require.NoError(t, err, "Commit")
-	// Test that we cannot prune non-finalized versions.
-	err = ndb.Prune(2)
-	require.Error(t, err, "Prune should fail for non-finalized versions")
-	require.Equal(t, db.ErrNotFinalized, err)
-	// Finalize version 2.
-	root3 := node.Root{
-		Namespace: testNs,
-		Version:   2,
-		Type:      node.RootTypeState,
-		Hash:      rootHash3,
+	// Make sure that HasRoot for root hash from version 0 but with
+	// version 1 passed returns false.
+	root = node.Root{
+		Namespace: testNs,
+		Version:   1,
+		Type:      node.RootTypeState,
+		Hash:      rootHash1,
+	}
+	require.False(t, ndb.HasRoot(root), "HasRoot should return false for non-existing root")
+	root.Hash = rootHash2
+	require.True(t, ndb.HasRoot(root), "HasRoot should return true for existing root")
+}
+
+func testGetRootsForVersion(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+
+	// Create two roots in version 10.
+	tree := New(nil, ndb, node.RootTypeState)
+	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
+	require.NoError(t, err, "Insert")
+	_, rootHash1, err := tree.Commit(ctx, testNs, 10)
+	require.NoError(t, err, "Commit")
+
+	tree = New(nil, ndb, node.RootTypeIO)
+	err = tree.Insert(ctx, []byte("bar"), []byte("foo"))
+	require.NoError(t, err, "Insert")
+	_, rootHash2, err := tree.Commit(ctx, testNs, 10)
+	require.NoError(t, err, "Commit")
+
+	// Finalize version 10.
+	root1 := node.Root{
+		Namespace: testNs,
+		Version:   10,
+		Type:      node.RootTypeState,
+		Hash:      rootHash1,
+	}
+	root2 := node.Root{
+		Namespace: testNs,
+		Version:   10,
+		Type:      node.RootTypeIO,
+		Hash:      rootHash2,
+	}
+	err = ndb.Finalize([]node.Root{root1, root2})
+	require.NoError(t, err, "Finalize")
+
+	roots, err := ndb.GetRootsForVersion(10)
+	require.NoError(t, err, "GetRootsForVersion")
+	require.Len(t, roots, 2, "GetRootsForVersion should return the correct number of roots")
+	require.Contains(t, roots, root1, "GetRootsForVersion should return the correct roots")
+	require.Contains(t, roots, root2, "GetRootsForVersion should return the correct roots")
+
+	roots, err = ndb.GetRootsForVersion(1)
+	require.NoError(t, err, "GetRootsForVersion")
+	require.Len(t, roots, 0, "GetRootsForVersion should return no roots for eaerlier versions")
+
+	roots, err = ndb.GetRootsForVersion(11)
+	require.NoError(t, err, "GetRootsForVersion")
+	require.Len(t, roots, 0, "GetRootsForVersion should return no roots for later versions")
+}
+
+func testSize(t *testing.T, ndb db.NodeDB, factory NodeDBFactory) {
+	ctx := context.Background()
+
+	size, err := ndb.Size()
+	require.NoError(t, err, "Size")
+
+	// Put something in the database.
+	tree := New(nil, ndb, node.RootTypeState)
+	err = tree.Insert(ctx, []byte("foo"), []byte("bar"))
+	require.NoError(t, err, "Insert")
+	_, rootHash1, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+	root1 := node.Root{
+		Namespace: testNs,
+		Version:   0,
+		Type:      node.RootTypeState,
+		Hash:      rootHash1,
+	}
+	err = ndb.Finalize([]node.Root{root1})
+	require.NoError(t, err, "Finalize")
+
+	// Reopen database to force flush.
+	ndb.Close()
+	ndb, err = factory(testNs)
+	require.NoError(t, err, "ndb.New")
+	defer ndb.Close()
+
+	// Make sure size reports something that makes sense.
+	newSize, err := ndb.Size()
+	require.NoError(t, err, "Size")
+	require.True(t, newSize > size, "Size should be greater than before")
+}
+
+func testEmptyValueWriteLog(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+
+	// Populate the tree.
+	tree := New(nil, ndb, node.RootTypeState)
+	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
+	require.NoError(t, err, "Insert")
+	err = tree.Insert(ctx, []byte("bar"), []byte(""))
+	require.NoError(t, err, "Insert")
+	writeLog, rootHash, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+
+	// Ensure no nil entries returned.
+	for _, entry := range writeLog {
+		require.NotNil(t, entry.Value)
+	}
+
+	startRoot := node.Root{
+		Namespace: testNs,
+		Version:   0,
+		Type:      node.RootTypeState,
+	}
+	startRoot.Hash.Empty()
+
+	endRoot := node.Root{
+		Namespace: testNs,
+		Hash:      rootHash,
+		Version:   0,
+		Type:      node.RootTypeState,
+	}
+
+	// Fetch write log from database.
+	wli, err := ndb.GetWriteLog(ctx, startRoot, endRoot)
+	require.NoError(t, err, "GetWriteLog")
+	writeLog = foldWriteLogIterator(t, wli)
+
+	for _, entry := range writeLog {
+		require.NotNil(t, entry.Value)
+	}
+}
+
+func testBasicWriteLog(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+
+	keyZero := []byte("foo")
+	valueZero := []byte("bar")
+	keyOne := []byte("baz")
+	valueOne := []byte("quux")
+
+	emptyRoot := node.Root{
+		Namespace: testNs,
+		Version:   0,
+		Type:      node.RootTypeState,
+	}
+	emptyRoot.Hash.Empty()
+
+	// Put some stuff in the tree.
+	tree := New(nil, ndb, node.RootTypeState)
+	err := tree.Insert(ctx, keyZero, valueZero)
+	require.NoError(t, err, "Insert")
+	_, rootHash1, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+
+	root1 := node.Root{
+		Namespace: testNs,
+		Version:   0,
+		Type:      node.RootTypeState,
+		Hash:      rootHash1,
+	}
+
+	wli, err := ndb.GetWriteLog(ctx, emptyRoot, root1)
+	require.NoError(t, err, "GetWriteLog")
+
+	wl := writeLogToMap(foldWriteLogIterator(t, wli))
+	require.Equal(t, writeLogToMap(writelog.WriteLog{writelog.LogEntry{Key: keyZero, Value: valueZero}}), wl)
+
+	// Continue adding to this same tree.
+	err = tree.Insert(ctx, keyOne, valueOne)
+	require.NoError(t, err, "Insert")
+	_, rootHash2, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+
+	root2 := node.Root{
+		Namespace: testNs,
+		Version:   1,
+		Type:      node.RootTypeState,
+		Hash:      rootHash2,
+	}
+
+	// We can still get write logs to intermediate roots.
+	wli, err = ndb.GetWriteLog(ctx, emptyRoot, root1)
+	require.NoError(t, err, "GetWriteLog")
+	_ = writelog.DrainIterator(wli)
+	wli, err = ndb.GetWriteLog(ctx, root1, root2)
+	require.NoError(t, err, "GetWriteLog")
+	_ = writelog.DrainIterator(wli)
+
+	// Make sure that we fail with more than one hop.
+	keys, values := generateKeyValuePairs()
+	for i, key := range keys {
+		err = tree.Insert(ctx, key, values[i])
+		require.NoError(t, err, "Insert(%d)", i)
+	}
+	_, rootHash3, err := tree.Commit(ctx, testNs, 2)
+	require.NoError(t, err, "Commit")
+
+	root3 := node.Root{
+		Namespace: testNs,
+		Version:   2,
+		Type:      node.RootTypeState,
+		Hash:      rootHash3,
+	}
+
+	_, err = ndb.GetWriteLog(ctx, emptyRoot, root2)
+	require.Error(t, err, "GetWriteLog")
+	_, err = ndb.GetWriteLog(ctx, emptyRoot, root3)
+	require.Error(t, err, "GetWriteLog")
+
+	// Make sure all the items are there.
+	wli, err = ndb.GetWriteLog(ctx, root2, root3)
+	require.NoError(t, err, "GetWriteLog")
+	wl = writeLogToMap(foldWriteLogIterator(t, wli))
+	for i, key := range keys {
+		require.EqualValues(t, wl[string(key)], values[i])
+	}
+}
+
+func testFinalizeEmpty(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	root := node.Root{
+		Namespace: testNs,
+		Version:   0,
+		Type:      node.RootTypeState,
+	}
+	root.Hash.Empty()
+
+	err := ndb.Finalize([]node.Root{root})
+	require.NoError(t, err, "Finalize")
+
+	// Create an empty root, but with an actual commit.
+	ctx := context.Background()
+	tree := NewWithRoot(nil, ndb, root)
+	_, rootHash, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+	require.True(t, rootHash.IsEmpty())
+
+	root.Version = 1
+	err = ndb.Finalize([]node.Root{root})
+	require.NoError(t, err, "Finalize")
+}
+
+func testPruneBasic(t *testing.T, ndb db.NodeDB, factory NodeDBFactory) {
+	ctx := context.Background()
+	tree := New(nil, ndb, node.RootTypeState)
+
+	// Create some keys in version 0.
+	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
+	require.NoError(t, err, "Insert")
+	err = tree.Insert(ctx, []byte("moo"), []byte("bar"))
+	require.NoError(t, err, "Insert")
+	_, rootHash1, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+	// Test that we cannot prune non-finalized versions.
+	err = ndb.Prune(0)
+	require.Error(t, err, "Prune should fail for non-finalized versions")
+	require.Equal(t, db.ErrNotFinalized, err)
+	// Finalize version 0.
+	root1 := node.Root{
+		Namespace: testNs,
+		Version:   0,
+		Type:      node.RootTypeState,
+		Hash:      rootHash1,
+	}
+	err = ndb.Finalize([]node.Root{root1})
+	require.NoError(t, err, "Finalize")
+
+	// Remove key in version 1.
+	err = tree.Remove(ctx, []byte("foo"))
+	require.NoError(t, err, "Remove")
+	err = tree.Insert(ctx, []byte("another"), []byte("value"))
+	require.NoError(t, err, "Insert")
+	_, rootHash2, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+	// Test that we cannot prune non-finalized versions.
+	err = ndb.Prune(1)
+	require.Error(t, err, "Prune should fail for non-finalized versions")
+	require.Equal(t, db.ErrNotFinalized, err)
+	// Finalize version 1.
+	root2 := node.Root{
+		Namespace: testNs,
+		Version:   1,
+		Type:      node.RootTypeState,
+		Hash:      rootHash2,
+	}
+	err = ndb.Finalize([]node.Root{root2})
+	require.NoError(t, err, "Finalize")
+
+	// Add some keys in version 2.
+	err = tree.Insert(ctx, []byte("blah"), []byte("ugh"))
+	require.NoError(t, err, "Insert")
+	_, rootHash3, err := tree.Commit(ctx, testNs, 2)
+	require.NoError(t, err, "Commit")
+	// Test that we cannot prune non-finalized versions.
+	err = ndb.Prune(2)
+	require.Error(t, err, "Prune should fail for non-finalized versions")
+	require.Equal(t, db.ErrNotFinalized, err)
+	// Finalize version 2.
+	root3 := node.Root{
+		Namespace: testNs,
+		Version:   2,
+		Type:      node.RootTypeState,
+		Hash:      rootHash3,
+	}
+	err = ndb.Finalize([]node.Root{root3})
+	require.NoError(t, err, "Finalize")
+
+	earliestVersion := ndb.GetEarliestVersion()
+	require.EqualValues(t, 0, earliestVersion, "earliest version should be correct")
+	latestVersion, exists := ndb.GetLatestVersion()
+	require.EqualValues(t, 2, latestVersion, "latest version should be correct")
+	require.True(t, exists, "latest version should exist")
+
+	// Prune version 0.
+	err = ndb.Prune(0)
+	require.NoError(t, err, "Prune")
+
+	// Reopen database to force compaction.
+	ndb.Close()
+	ndb, err = factory(testNs)
+	require.NoError(t, err, "ndb.New")
+	defer ndb.Close()
+
+	earliestVersion = ndb.GetEarliestVersion()
+	require.EqualValues(t, 1, earliestVersion, "earliest version should be correct")
+	latestVersion, exists = ndb.GetLatestVersion()
+	require.EqualValues(t, 2, latestVersion, "latest version should be correct")
+	require.True(t, exists, "latest version should exist")
+
+	// Keys must still be available in version 2.
+	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 2, Type: node.RootTypeState, Hash: rootHash3})
+	value, err := tree.Get(ctx, []byte("blah"))
+	require.NoError(t, err, "Get")
+	require.EqualValues(t, []byte("ugh"), value)
+	value, err = tree.Get(ctx, []byte("moo"))
+	require.NoError(t, err, "Get")
+	require.EqualValues(t, []byte("bar"), value)
+	value, err = tree.Get(ctx, []byte("another"))
+	require.NoError(t, err, "Get")
+	require.EqualValues(t, []byte("value"), value)
+	// Removed key must be gone.
+	value, err = tree.Get(ctx, []byte("foo"))
+	require.NoError(t, err, "Get")
+	require.Nil(t, value, "removed key must be gone")
+
+	// Version 0 must be gone.
+	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash1})
+	_, err = tree.Get(ctx, []byte("foo"))
+	require.Error(t, err, "Get")
+}
+
+func testPruneManyVersions(t *testing.T, ndb db.NodeDB, factory NodeDBFactory) {
+	ctx := context.Background()
+	tree := New(nil, ndb, node.RootTypeState)
+
+	const numVersions = 50
+	const numPairsPerVersion = 50
+
+	for r := 0; r < numVersions; r++ {
+		for p := 0; p < numPairsPerVersion; p++ {
+			key := []byte(fmt.Sprintf("key %d/%d", r, p))
+			value := []byte(fmt.Sprintf("value %d/%d", r, p))
+			err := tree.Insert(ctx, key, value)
+			require.NoError(t, err, "Insert")
+		}
+
+		_, rootHash, err := tree.Commit(ctx, testNs, uint64(r))
+		require.NoError(t, err, "Commit")
+		root := node.Root{
+			Namespace: testNs,
+			Version:   uint64(r),
+			Type:      node.RootTypeState,
+			Hash:      rootHash,
+		}
+		err = ndb.Finalize([]node.Root{root})
+		require.NoError(t, err, "Finalize")
+	}
+
+	// Prune all versions except the last one.
+	for r := 0; r < numVersions-1; r++ {
+		err := ndb.Prune(uint64(r))
+		require.NoError(t, err, "Prune")
+	}
+
+	// Reopen database to force compaction.
+	ndb.Close()
+	ndb, err := factory(testNs)
+	require.NoError(t, err, "ndb.New")
+	defer ndb.Close()
+
+	// Check that the latest version has all the keys.
+	for r := 0; r < numVersions; r++ {
+		for p := 0; p < numPairsPerVersion; p++ {
+			key := []byte(fmt.Sprintf("key %d/%d", r, p))
+			value, err := tree.Get(ctx, key)
+			require.NoError(t, err, "Get")
+			require.EqualValues(t, value, fmt.Sprintf("value %d/%d", r, p))
+		}
+	}
+}
+
+func testPruneForkedRoots(t *testing.T, ndb db.NodeDB, factory NodeDBFactory) {
+	ctx := context.Background()
+
+	// Create a root in version 0.
+	tree := New(nil, ndb, node.RootTypeState)
+	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
+	require.NoError(t, err, "Insert")
+	err = tree.Insert(ctx, []byte("moo"), []byte("goo"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR0_1, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+	// Finalize version 0.
+	err = ndb.Finalize([]node.Root{{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashR0_1}})
+	require.NoError(t, err, "Finalize")
+
+	// Create a derived root A in version 1.
+	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashR0_1})
+	err = tree.Insert(ctx, []byte("dr"), []byte("A"))
+	require.NoError(t, err, "Insert")
+	err = tree.Remove(ctx, []byte("moo"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR1_1, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+
+	// Create a derived root B in version 1.
+	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashR0_1})
+	err = tree.Insert(ctx, []byte("dr"), []byte("B"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR1_2, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+
+	// Finalize version 1. Only derived root B was finalized, so derived root A
+	// should be discarded.
+	err = ndb.Finalize([]node.Root{{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_2}})
+	require.NoError(t, err, "Finalize")
+
+	// Make sure that the write log for the discarded root is gone.
+	rootR0_1 := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashR0_1}
+	rootR1_1 := node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_1}
+	rootR1_2 := node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_2}
+	_, err = ndb.GetWriteLog(ctx, rootR0_1, rootR1_1)
+	require.Error(t, err, "GetWriteLog")
+	// Make sure that the write log for the non-discarded root exists.
+	_, err = ndb.GetWriteLog(ctx, rootR0_1, rootR1_2)
+	require.NoError(t, err, "GetWriteLog")
+
+	// Create a derived root C from derived root B in version 2.
+	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_2})
+	err = tree.Insert(ctx, []byte("yet"), []byte("another"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR2_1, err := tree.Commit(ctx, testNs, 2)
+	require.NoError(t, err, "Commit")
+	// Finalize version 2.
+	err = ndb.Finalize([]node.Root{{Namespace: testNs, Version: 2, Type: node.RootTypeState, Hash: rootHashR2_1}})
+	require.NoError(t, err, "Finalize")
+
+	// Prune version 1 (should fail as it is not the earliest version).
+	err = ndb.Prune(1)
+	require.Error(t, err, "Prune")
+	require.Equal(t, db.ErrNotEarliest, err)
+
+	// Prune versions 0 and 1.
+	err = ndb.Prune(0)
+	require.NoError(t, err, "Prune")
+	err = ndb.Prune(1)
+	require.NoError(t, err, "Prune")
+
+	// Reopen database to force compaction.
+	ndb.Close()
+	ndb, err = factory(testNs)
+	require.NoError(t, err, "ndb.New")
+	defer ndb.Close()
+
+	// Make sure all the keys are there.
+	for _, root := range []struct {
+		Version uint64
+		Hash    hash.Hash
+		Keys    []string
+	}{
+		{2, rootHashR2_1, []string{"foo", "moo", "dr", "yet"}},
+	} {
+		tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: root.Version, Type: node.RootTypeState, Hash: root.Hash})
+
+		for _, key := range root.Keys {
+			value, err := tree.Get(ctx, []byte(key))
+			require.NoError(t, err, "Get(%d, %s)", root.Version, key)
+			require.NotNil(t, value, "value should exist (%d, %s)", root.Version, key)
+		}
+	}
+}
+
+func testPruneLoneRootsShared(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+
+	// Create a lone root (e.g., not included among the finalized roots)
+	// that shares some nodes with a root that is among the finalized
+	// roots. Make sure that the shared nodes aren't pruned.
+
+	tree := New(nil, ndb, node.RootTypeState)
+	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
+	require.NoError(t, err, "Insert")
+	err = tree.Insert(ctx, []byte("foo 2"), []byte("bar2"))
+	require.NoError(t, err, "Insert")
+	err = tree.Insert(ctx, []byte("foo 3"), []byte("bar3"))
+	require.NoError(t, err, "Insert")
+	_, rootHash1, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+
+	tree = New(nil, ndb, node.RootTypeState)
+	err = tree.Insert(ctx, []byte("foo"), []byte("bar"))
+	require.NoError(t, err, "Insert")
+	err = tree.Insert(ctx, []byte("foo 2"), []byte("bar2"))
+	require.NoError(t, err, "Insert")
+	err = tree.Insert(ctx, []byte("foo 3"), []byte("bar3"))
+	require.NoError(t, err, "Insert")
+	err = tree.Insert(ctx, []byte("__extra__"), []byte("extra"))
+	require.NoError(t, err, "Insert")
+	_, _, err = tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+
+	err = ndb.Finalize([]node.Root{{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash1}})
+	require.NoError(t, err, "Finalize")
+
+	// Check that the shared nodes are still there.
+	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash1})
+	value, err := tree.Get(ctx, []byte("foo"))
+	require.NoError(t, err, "Get")
+	require.EqualValues(t, []byte("bar"), value)
+	value, err = tree.Get(ctx, []byte("foo 2"))
+	require.NoError(t, err, "Get")
+	require.EqualValues(t, []byte("bar2"), value)
+	value, err = tree.Get(ctx, []byte("foo 3"))
+	require.NoError(t, err, "Get")
+	require.EqualValues(t, []byte("bar3"), value)
+}
+
+func testPruneLoneRootsShared2(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+
+	type item struct {
+		Key   string
+		Value string
+	}
+	batches := []struct {
+		Namespace  common.Namespace
+		SrcVersion uint64
+		DstVersion uint64
+		SrcRoot    string
+		DstRoot    string
+		Finalized  bool
+		Items      []item
+	}{
+		{
+			Namespace:  testNs,
+			SrcVersion: 3,
+			DstVersion: 3,
+			SrcRoot:    "xnK40e9W7Sirh8NiLFEUBpvdOte4+XN0mNDAHs7wlno=", // Empty hash.
+			DstRoot:    "HDRPGZxGtdYTxcEwY8xMEQb5glc5rzc30q27u2CceVU=",
+			Finalized:  true,
+			Items: []item{
+				{
+					Key: "VFxlQ0wtW+UFzn4ojduOXMqLVlgtTzk5tN+eysKJiu7nAA==",
+					Value: "glkBGqNkYXJnc6Jja2V5eEpVbmxvY2sgdGhlIHBvdGVudGlhbCBvZiB5b3VyIGRhdGEgd2l0aG91" +
+						"dCBjb21wcm9taXNpbmcgc2VjdXJpdHkgb3IgcHJpdmFjeWV2YWx1ZXh5VGhlIHBsYXRmb3JtIHRo" +
+						"YXQgcHV0cyBkYXRhIHByaXZhY3kgZmlyc3QuIEZyb20gc2hhcmluZyBtZWRpY2FsIHJlY29yZHMs" +
+						"IHRvIGFuYWx5emluZyBwZXJzb25hbCBmaW5hbmNpYWwgaW5mb3JtYXRpb24gZXRjLmZtZXRob2Rm" +
+						"aW5zZXJ0cHByZWRpY3RlZF9yd19zZXSjaHJlYWRfc2V0gGl3cml0ZV9zZXSAa2dyYW51bGFyaXR5" +
+						"AAA=",
+				},
+			},
+		},
+		{
+			Namespace:  testNs,
+			SrcVersion: 3,
+			DstVersion: 4,
+			SrcRoot:    "HDRPGZxGtdYTxcEwY8xMEQb5glc5rzc30q27u2CceVU=",
+			DstRoot:    "1mhju3gCBswUklbJuiifvVJDY6QeNiqRx2F1MDdxcys=",
+			Finalized:  true,
+			Items: []item{
+				{
+					Key: "RWt2X2tleVxlQ0wtW+UFzn4ojduOXMqLVlgtTzk5tN+eysKJiu7n",
+					Value: "VW5sb2NrIHRoZSBwb3RlbnRpYWwgb2YgeW91ciBkYXRhIHdpdGhvdXQgY29tcHJvbWlzaW5nIHNl" +
+						"Y3VyaXR5IG9yIHByaXZhY3k=",
+				},
+				{
+					Key:   "RWt2X29wXGVDTC1b5QXOfiiN245cyotWWC1POTm0357KwomK7uc=",
+					Value: "aW5zZXJ0",
+				},
+				{
+					Key:   "VFxlQ0wtW+UFzn4ojduOXMqLVlgtTzk5tN+eysKJiu7nAQ==",
+					Value: "gUqhZ1N1Y2Nlc3P2",
+				},
+			},
+		},
+		{
+			Namespace:  testNs,
+			SrcVersion: 3,
+			DstVersion: 4,
+			SrcRoot:    "HDRPGZxGtdYTxcEwY8xMEQb5glc5rzc30q27u2CceVU=",
+			DstRoot:    "+h6pzinXfRJY1tnL7jXoGcbUfG0lFCYTX1TaDngycso=",
+			Items: []item{
+				{
+					Key: "RWt2X2tleVxlQ0wtW+UFzn4ojduOXMqLVlgtTzk5tN+eysKJiu7n",
+					Value: "VW5sb2NrIHRoZSBwb3RlbnRpYWwgb2YgeW91ciBkYXRhIHdpdGhvdXQgY29tcHJvbWlzaW5nIHNl" +
+						"Y3VyaXR5IG9yIHByaXZhY3k=",
+				},
+				{
+					Key:   "RWt2X29wXGVDTC1b5QXOfiiN245cyotWWC1POTm0357KwomK7uc=",
+					Value: "aW5zZXJ0",
+				},
+				{
+					Key:   "VFxlQ0wtW+UFzn4ojduOXMqLVlgtTzk5tN+eysKJiu7nAQ==",
+					Value: "gUqhZ1N1Y2Nlc3P2",
+				},
+				{
+					Key:   "X19ib29tX18=",
+					Value: "cG9vZg==",
+				},
+			},
+		},
+	}
+
+	var finalizedRoots []node.Root
+	for _, batch := range batches {
+		if len(finalizedRoots) > 0 && finalizedRoots[0].Version != batch.DstVersion {
+			err := ndb.Finalize(finalizedRoots)
+			require.NoError(t, err, "Finalize")
+			finalizedRoots = nil
+		}
+
+		srcRootHashRaw, err := base64.StdEncoding.DecodeString(batch.SrcRoot)
+		require.NoError(t, err, "base64.DecodeString")
+		var srcRootHash hash.Hash
+		err = srcRootHash.UnmarshalBinary(srcRootHashRaw)
+		require.NoError(t, err, "hash.UnmarshalBinary")
+
+		tree := NewWithRoot(nil, ndb, node.Root{
+			Namespace: batch.Namespace,
+			Version:   batch.SrcVersion,
+			Type:      node.RootTypeState,
+			Hash:      srcRootHash,
+		})
+		defer tree.Close()
+
+		for _, item := range batch.Items {
+			var key, value []byte
+			key, err = base64.StdEncoding.DecodeString(item.Key)
+			require.NoError(t, err, "base64.DecodeString")
+			value, err = base64.StdEncoding.DecodeString(item.Value)
+			require.NoError(t, err, "base64.DecodeString")
+			err = tree.Insert(ctx, key, value)
+			require.NoError(t, err, "Insert")
+		}
+
+		_, rootHash, err := tree.Commit(ctx, batch.Namespace, batch.DstVersion)
+		require.NoError(t, err, "Commit")
+
+		dstRootHashRaw, err := base64.StdEncoding.DecodeString(batch.DstRoot)
+		require.NoError(t, err, "base64.DecodeString")
+		var dstRootHash hash.Hash
+		err = dstRootHash.UnmarshalBinary(dstRootHashRaw)
+		require.NoError(t, err, "hash.UnmarshalBinary")
+		require.EqualValues(t, dstRootHash, rootHash, "computed root hash must be as expected")
+
+		if batch.Finalized {
+			finalizedRoots = append(finalizedRoots, node.Root{
+				Namespace: batches[0].Namespace,
+				Version:   batch.DstVersion,
+				Type:      node.RootTypeState,
+				Hash:      rootHash,
+			})
+		}
+	}
+
+	err := ndb.Finalize(finalizedRoots)
+	require.NoError(t, err, "Finalize")
+
+	tree := NewWithRoot(nil, ndb, finalizedRoots[0])
+	defer tree.Close()
+
+	it := tree.NewIterator(ctx)
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() { //nolint:revive
+		// Just iterate over the whole tree. If the tree is not consistent
+		// this iteration will throw an error that a node is missing.
+	}
+	require.NoError(t, it.Err(), "tree should still be consistent")
+}
+
+func testPruneLoneRootsShared3(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	// Create a root in version 0.
+	tree := New(nil, ndb, node.RootTypeState)
+	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
+	require.NoError(err, "Insert")
+	_, _, err = tree.Commit(ctx, testNs, 0)
+	require.NoError(err, "Commit")
+
+	// Create another root in version 0.
+	tree = New(nil, ndb, node.RootTypeState)
+	err = tree.Insert(ctx, []byte("moo"), []byte("goo"))
+	require.NoError(err, "Insert")
+	_, rootHashR0_2, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(err, "Commit")
+
+	// Create the same root as the first root in version 1.
+	tree = New(nil, ndb, node.RootTypeState)
+	err = tree.Insert(ctx, []byte("foo"), []byte("bar"))
+	require.NoError(err, "Insert")
+	_, rootHashR1_1, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(err, "Commit")
+
+	// Finalize version 0 with the second root.
+	err = ndb.Finalize([]node.Root{{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashR0_2}})
+	require.NoError(err, "Finalize")
+
+	// Make sure that the first root in version 1 is still valid.
+	tree = NewWithRoot(nil, ndb, node.Root{
+		Namespace: testNs,
+		Version:   1,
+		Type:      node.RootTypeState,
+		Hash:      rootHashR1_1,
+	})
+	value, err := tree.Get(ctx, []byte("foo"))
+	require.NoError(err, "Get")
+	require.EqualValues([]byte("bar"), value)
+}
+
+func testPruneLoneRootsShared4(t *testing.T, ndb db.NodeDB, factory NodeDBFactory) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	// Create a root in version 0.
+	tree := New(nil, ndb, node.RootTypeState)
+	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
+	require.NoError(err, "Insert")
+	_, rootHashR0_1, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(err, "Commit")
+
+	// Create the same root as the first root in version 1.
+	tree = New(nil, ndb, node.RootTypeState)
+	err = tree.Insert(ctx, []byte("foo"), []byte("bar"))
+	require.NoError(err, "Insert")
+	_, rootHashR1_1, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(err, "Commit")
+
+	// Finalize version 0.
+	err = ndb.Finalize([]node.Root{{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashR0_1}})
+	require.NoError(err, "Finalize")
+	// Finalize version 1.
+	err = ndb.Finalize([]node.Root{{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_1}})
+	require.NoError(err, "Finalize")
+	// Prune version 0.
+	err = ndb.Prune(0)
+	require.NoError(err, "Prune")
+
+	// Reopen database to force compaction.
+	ndb.Close()
+	ndb, err = factory(testNs)
+	require.NoError(err, "ndb.New")
+	defer ndb.Close()
+
+	// Make sure that the first root in version 1 is still valid.
+	tree = NewWithRoot(nil, ndb, node.Root{
+		Namespace: testNs,
+		Version:   1,
+		Type:      node.RootTypeState,
+		Hash:      rootHashR1_1,
+	})
+	value, err := tree.Get(ctx, []byte("foo"))
+	require.NoError(err, "Get")
+	require.EqualValues([]byte("bar"), value)
+}
+
+func testPruneLoneRoots(t *testing.T, ndb db.NodeDB, factory NodeDBFactory) {
+	ctx := context.Background()
+
+	// Create a root in version 0.
+	tree := New(nil, ndb, node.RootTypeState)
+	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
+	require.NoError(t, err, "Insert")
+	err = tree.Insert(ctx, []byte("moo"), []byte("goo"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR0_1, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+
+	// Create another root in version 0.
+	tree = New(nil, ndb, node.RootTypeState)
+	err = tree.Insert(ctx, []byte("goo"), []byte("blah"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR0_2, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+
+	// Create yet another root in version 0.
+	tree = New(nil, ndb, node.RootTypeState)
+	err = tree.Insert(ctx, []byte("yet"), []byte("another"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR0_3, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+
+	// Create yet another root in version 0.
+	tree = New(nil, ndb, node.RootTypeState)
+	err = tree.Insert(ctx, []byte("yet2"), []byte("another2"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR0_4, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+
+	// Finalize version 0.
+	var finalRoots []node.Root
+	for _, hash := range []hash.Hash{rootHashR0_1, rootHashR0_2, rootHashR0_3, rootHashR0_4} {
+		finalRoots = append(finalRoots, node.Root{
+			Namespace: testNs,
+			Version:   0,
+			Type:      node.RootTypeState,
+			Hash:      hash,
+		})
+	}
+	err = ndb.Finalize(finalRoots)
+	require.NoError(t, err, "Finalize")
+
+	// Create a distinct root in version 1.
+	tree = New(nil, ndb, node.RootTypeState)
+	err = tree.Insert(ctx, []byte("different"), []byte("boo"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR1_1, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+
+	// Create a derived root in version 1.
+	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashR0_2})
+	err = tree.Insert(ctx, []byte("different2"), []byte("boo"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR1_2, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+
+	// Create two linked roots inside version 1 which will not be referenced
+	// in subsequent versions and so should be garbage collected.
+	tree = New(nil, ndb, node.RootTypeState)
+	err = tree.Insert(ctx, []byte("first"), []byte("am i"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR1_3, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+
+	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_3})
+	err = tree.Insert(ctx, []byte("second"), []byte("i am"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR1_4, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+
+	// Create three linked roots inside version 1 where the first root is
+	// derived from a root in version 0, the second root is derived from
+	// the first root and the third root is derived from the second root
+	// (both in the same version). All three should be garbage collected
+	// as they are not referenced in subsequent versions.
+	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashR0_3})
+	err = tree.Insert(ctx, []byte("first"), []byte("am i"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR1_5, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_5})
+	err = tree.Insert(ctx, []byte("second"), []byte("i am"))
+	require.NoError(t, err, "Insert")
+	err = tree.Remove(ctx, []byte("yet"))
+	require.NoError(t, err, "Remove")
+	_, rootHashR1_6, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_6})
+	err = tree.Insert(ctx, []byte("third"), []byte("i am not"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR1_7, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+
+	// Create three linked roots inside version 1 where the first root is
+	// derived from a root in version 0, the second root is derived from
+	// the first root and the third root is derived from the second root
+	// (both in the same version). The third root is then referenced in version
+	// 2 so only intermediate nodes should be garbage collected.
+	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashR0_4})
+	err = tree.Insert(ctx, []byte("first2"), []byte("am i"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR1_8, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_8})
+	err = tree.Insert(ctx, []byte("second2"), []byte("i am"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR1_9, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_9})
+	err = tree.Insert(ctx, []byte("third2"), []byte("i am not"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR1_10, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+	// After these commits, 3 nodes are only referenced in intermediate roots
+	// and should be garbage collected.
+
+	// Finalize version 1.
+	finalRoots = nil
+	for _, hash := range []hash.Hash{rootHashR1_1, rootHashR1_2, rootHashR1_4, rootHashR1_7, rootHashR1_10} {
+		finalRoots = append(finalRoots, node.Root{
+			Namespace: testNs,
+			Version:   1,
+			Type:      node.RootTypeState,
+			Hash:      hash,
+		})
+	}
+	err = ndb.Finalize(finalRoots)
+	require.NoError(t, err, "Finalize")
+
+	// Create a distinct root in version 2.
+	tree = New(nil, ndb, node.RootTypeState)
+	err = tree.Insert(ctx, []byte("blah"), []byte("brah"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR2_1, err := tree.Commit(ctx, testNs, 2)
+	require.NoError(t, err, "Commit")
+
+	// Create a derived root in version 2.
+	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_2})
+	err = tree.Insert(ctx, []byte("foo"), []byte("boo"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR2_2, err := tree.Commit(ctx, testNs, 2)
+	require.NoError(t, err, "Commit")
+
+	// Create another derived root in version 2.
+	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_10})
+	err = tree.Insert(ctx, []byte("foo2"), []byte("boo"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR2_3, err := tree.Commit(ctx, testNs, 2)
+	require.NoError(t, err, "Commit")
+
+	// Finalize version 2.
+	finalRoots = nil
+	for _, hash := range []hash.Hash{rootHashR2_1, rootHashR2_2, rootHashR2_3} {
+		finalRoots = append(finalRoots, node.Root{
+			Namespace: testNs,
+			Version:   2,
+			Type:      node.RootTypeState,
+			Hash:      hash,
+		})
+	}
+	err = ndb.Finalize(finalRoots)
+	require.NoError(t, err, "Finalize")
+
+	// Prune versions 0 and 1, all of the lone root's node should have been removed.
+	err = ndb.Prune(0)
+	require.NoError(t, err, "Prune")
+	err = ndb.Prune(1)
+	require.NoError(t, err, "Prune")
+
+	// Reopen database to force compaction.
+	ndb.Close()
+	ndb, err = factory(testNs)
+	require.NoError(t, err, "ndb.New")
+	defer ndb.Close()
+
+	// Check that roots in version 0 and 2 are still there.
+	for _, root := range []struct {
+		Version uint64
+		Hash    hash.Hash
+		Keys    []string
+	}{
+		{2, rootHashR2_1, []string{"blah"}},
+		{2, rootHashR2_2, []string{"goo", "different2", "foo"}},
+		{2, rootHashR2_3, []string{"yet2", "first2", "second2", "third2", "foo2"}},
+	} {
+		tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: root.Version, Type: node.RootTypeState, Hash: root.Hash})
+
+		for _, key := range root.Keys {
+			value, err := tree.Get(ctx, []byte(key))
+			require.NoError(t, err, "Get(%d, %s)", root.Version, key)
+			require.NotNil(t, value, "value should exist (%d, %s)", root.Version, key)
+		}
+	}
+}
+
+func testPruneLatest(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+	tree := New(nil, ndb, node.RootTypeState)
+
+	// Create and finalize a root in version 0.
+	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
+	require.NoError(t, err, "Insert")
+	_, rootHash, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+
+	root := node.Root{
+		Namespace: testNs,
+		Version:   0,
+		Type:      node.RootTypeState,
+		Hash:      rootHash,
+	}
+	err = ndb.Finalize([]node.Root{root})
+	require.NoError(t, err, "Finalize")
+
+	// Attempt to prune the only finalized version.
+	err = ndb.Prune(0)
+	require.Error(t, err, "Prune should fail for the only finalized version")
+}
+
+func testErrors(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+
+	// Commit root for version 0.
+	tree := New(nil, ndb, node.RootTypeState)
+	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR0_1, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+
+	// Commit root for version 1.
+	tree = New(nil, ndb, node.RootTypeState)
+	err = tree.Insert(ctx, []byte("another"), []byte("bar"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR1_1, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+
+	// Commit root for version 2.
+	tree = New(nil, ndb, node.RootTypeState)
+	err = tree.Insert(ctx, []byte("another2"), []byte("bar"))
+	require.NoError(t, err, "Insert")
+	_, rootHashR2_1, err := tree.Commit(ctx, testNs, 2)
+	require.NoError(t, err, "Commit")
+
+	// Commit for non-following version should fail.
+	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 2, Type: node.RootTypeState, Hash: rootHashR2_1})
+	err = tree.Insert(ctx, []byte("moo"), []byte("moo"))
+	require.NoError(t, err, "Insert")
+	_, _, err = tree.Commit(ctx, testNs, 100)
+	require.Error(t, err, "Commit should fail for non-following version")
+	require.Equal(t, db.ErrRootMustFollowOld, err)
+
+	// Commit with mismatched old root should fail.
+	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 99, Type: node.RootTypeState, Hash: rootHashR1_1})
+	_ = tree.Insert(ctx, []byte("moo"), []byte("moo"))
+	_, _, err = tree.Commit(ctx, testNs, 100)
+	require.Error(t, err, "Commit should fail for mismatched version")
+	require.Equal(t, db.ErrRootNotFound, err)
+
+	// Commit with non-existent old root should fail.
+	bogusRoot := hash.NewFromBytes([]byte("bogus root"))
+	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: bogusRoot})
+	_, _, err = tree.Commit(ctx, testNs, 1)
+	require.Error(t, err, "Commit should fail for invalid root")
+	require.Equal(t, db.ErrRootNotFound, err)
+
+	// Finalizing a version twice should fail.
+	err = ndb.Finalize([]node.Root{{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashR0_1}})
+	require.NoError(t, err, "Finalize")
+	err = ndb.Finalize([]node.Root{{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashR0_1}})
+	require.Error(t, err, "Finalize should fail as version is already finalized")
+	require.Equal(t, db.ErrAlreadyFinalized, err)
+
+	// Finalize of version 2 should fail as version 1 is not finalized.
+	err = ndb.Finalize([]node.Root{{Namespace: testNs, Version: 2, Type: node.RootTypeState, Hash: rootHashR2_1}})
+	require.Error(t, err, "Finalize should fail as previous version not finalized")
+	require.Equal(t, db.ErrNotFinalized, err)
+
+	// Commit into an already finalized version should fail.
+	tree = New(nil, ndb, node.RootTypeState)
+	err = tree.Insert(ctx, []byte("already finalized"), []byte("woohoo"))
+	require.NoError(t, err, "Insert")
+	_, _, err = tree.Commit(ctx, testNs, 0)
+	require.Error(t, err, "Commit should fail for already finalized version")
+	require.Equal(t, db.ErrAlreadyFinalized, err)
+
+	// Commit for a different namespace should fail.
+	var badNs common.Namespace
+	_ = badNs.UnmarshalText([]byte("badbadbadbadbadbadbadbadbadbadbadbadbadbadbadbadbadbadbadbadbadb"))
+
+	tree = New(nil, ndb, node.RootTypeState)
+	err = tree.Insert(ctx, []byte("bad namespace"), []byte("woohoo"))
+	require.NoError(t, err, "Insert")
+	_, _, err = tree.Commit(ctx, badNs, 0)
+	require.Error(t, err, "Commit should fail for bad namespace")
+	require.Equal(t, db.ErrBadNamespace, err)
+
+	// Using the WithoutWriteLog option together with a remote read syncer should panic.
+	require.Panics(t, func() { New(tree, nil, node.RootTypeState, WithoutWriteLog()) })
+}
+
+func testIncompatibleDB(t *testing.T, ndb db.NodeDB, factory NodeDBFactory) {
+	// Database has been created with namespace testNs.
+	ndb.Close()
+
+	// Try to open the same database with a different namespace.
+	testNs2 := common.NewTestNamespaceFromSeed([]byte("oasis mkvs test ns 2"), 0)
+	_, err := factory(testNs2)
+	require.Error(t, err, "using a different namespace should fail")
+}
+
+func testSpecialCaseFromJSON(t *testing.T, ndb db.NodeDB, fixture string) {
+	data, err := os.ReadFile(filepath.Join("testdata", fixture))
+	require.NoError(t, err, "failed to read the fixture file")
+
+	var ops mkvsTests.TestVector
+	err = json.Unmarshal(data, &ops)
+	require.NoError(t, err, "failed to unmarshal fixture")
+
+	ctx := context.Background()
+	tree := New(nil, ndb, node.RootTypeState)
+
+	// Also test all operations against a "remote" tree to test sync operations.
+	var (
+		root       node.Root
+		remoteTree Tree
+		value      []byte
+		version    uint64
+	)
+
+	commitRemote := func() {
+		// Commit everything and create a new remote tree at the root.
+		var rootHash hash.Hash
+		_, rootHash, err = tree.Commit(ctx, testNs, version)
+		require.NoError(t, err, "Commit")
+
+		root = node.Root{Namespace: testNs, Type: node.RootTypeState, Hash: rootHash, Version: version}
+		tree = NewWithRoot(nil, ndb, root)
+		remoteTree = NewWithRoot(tree, nil, root, Capacity(0, 0))
+
+		version++
+	}
+
+	for _, o := range ops {
+		switch o.Op {
+		case mkvsTests.OpInsert:
+			if remoteTree != nil {
+				err = remoteTree.Insert(ctx, o.Key, o.Value)
+				require.NoError(t, err, "Insert")
+			}
+
+			err = tree.Insert(ctx, o.Key, o.Value)
+			require.NoError(t, err, "Insert")
+
+			commitRemote()
+		case mkvsTests.OpRemove:
+			if remoteTree != nil {
+				err = remoteTree.Remove(ctx, o.Key)
+				require.NoError(t, err, "Remove")
+				value, err = remoteTree.Get(ctx, o.Key)
+				require.NoError(t, err, "Get (after Remove)")
+				require.Nil(t, value, "Get (after Remove) should return nil")
+			}
+
+			err = tree.Remove(ctx, o.Key)
+			require.NoError(t, err, "Remove")
+			value, err = tree.Get(ctx, o.Key)
+			require.NoError(t, err, "Get (after Remove)")
+			require.Nil(t, value, "Get (after Remove) should return nil")
+
+			commitRemote()
+		case mkvsTests.OpGet:
+			if remoteTree != nil {
+				value, err = remoteTree.Get(ctx, o.Key)
+				require.NoError(t, err, "Get")
+				require.EqualValues(t, o.Value, value, "Get should return the correct value")
+			}
+
+			value, err = tree.Get(ctx, o.Key)
+			require.NoError(t, err, "Get")
+			require.EqualValues(t, o.Value, value, "Get should return the correct value")
+		case mkvsTests.OpIteratorSeek:
+			if remoteTree != nil {
+				it := remoteTree.NewIterator(ctx)
+				it.Seek(o.Key)
+				require.NoError(t, it.Err(), "Seek")
+				require.EqualValues(t, o.ExpectedKey, it.Key(), "iterator should be at correct key")
+				require.EqualValues(t, o.Value, it.Value(), "iterator should be at correct value")
+				it.Close()
+			}
+
+			it := tree.NewIterator(ctx)
+			it.Seek(o.Key)
+			require.NoError(t, it.Err(), "Seek")
+			require.EqualValues(t, o.ExpectedKey, it.Key(), "iterator should be at correct key")
+			require.EqualValues(t, o.Value, it.Value(), "iterator should be at correct value")
+			it.Close()
+		default:
+			require.Fail(t, "unknown operation: %s", o.Op)
+		}
+	}
+
+	// Ensure overall tree consistency.
+	tree = NewWithRoot(nil, ndb, root)
+	it := tree.NewIterator(ctx)
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() { //nolint:revive
+		// Just iterate over the whole tree. If the tree is not consistent
+		// this iteration will throw an error that a node is missing.
 	}
-	err = ndb.Finalize([]node.Root{root3})
-	require.NoError(t, err, "Finalize")
+	require.NoError(t, it.Err())
+}
 
-	earliestVersion := ndb.GetEarliestVersion()
-	require.EqualValues(t, 0, earliestVersion, "earliest version should be correct")
-	latestVersion, exists := ndb.GetLatestVersion()
-	require.EqualValues(t, 2, latestVersion, "latest version should be correct")
-	require.True(t, exists, "latest version should exist")
+func testSpecialCase1(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	testSpecialCaseFromJSON(t, ndb, "case-1.json")
+}
 
-	// Prune version 0.
-	err = ndb.Prune(0)
-	require.NoError(t, err, "Prune")
+func testSpecialCase2(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	testSpecialCaseFromJSON(t, ndb, "case-2.json")
+}
 
-	// Reopen database to force compaction.
-	ndb.Close()
-	ndb, err = factory(testNs)
-	require.NoError(t, err, "ndb.New")
-	defer ndb.Close()
+func testSpecialCase3(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	testSpecialCaseFromJSON(t, ndb, "case-3.json")
+}
 
-	earliestVersion = ndb.GetEarliestVersion()
-	require.EqualValues(t, 1, earliestVersion, "earliest version should be correct")
-	latestVersion, exists = ndb.GetLatestVersion()
-	require.EqualValues(t, 2, latestVersion, "latest version should be correct")
-	require.True(t, exists, "latest version should exist")
+func testSpecialCase4(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	testSpecialCaseFromJSON(t, ndb, "case-4.json")
+}
 
-	// Keys must still be available in version 2.
-	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 2, Type: node.RootTypeState, Hash: rootHash3})
-	value, err := tree.Get(ctx, []byte("blah"))
-	require.NoError(t, err, "Get")
-	require.EqualValues(t, []byte("ugh"), value)
-	value, err = tree.Get(ctx, []byte("moo"))
-	require.NoError(t, err, "Get")
-	require.EqualValues(t, []byte("bar"), value)
-	value, err = tree.Get(ctx, []byte("another"))
-	require.NoError(t, err, "Get")
-	require.EqualValues(t, []byte("value"), value)
-	// Removed key must be gone.
-	value, err = tree.Get(ctx, []byte("foo"))
-	require.NoError(t, err, "Get")
-	require.Nil(t, value, "removed key must be gone")
+func testSpecialCase5(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	testSpecialCaseFromJSON(t, ndb, "case-5.json")
+}
 
-	// Version 0 must be gone.
-	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash1})
-	_, err = tree.Get(ctx, []byte("foo"))
-	require.Error(t, err, "Get")
+func testSpecialCase6(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	testSpecialCaseFromJSON(t, ndb, "case-6.json")
 }
 
-func testPruneManyVersions(t *testing.T, ndb db.NodeDB, factory NodeDBFactory) {
+func testLargeUpdates(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	ctx := context.Background()
 	tree := New(nil, ndb, node.RootTypeState)
 
-	const numVersions = 50
-	const numPairsPerVersion = 50
-
-	for r := 0; r < numVersions; r++ {
-		for p := 0; p < numPairsPerVersion; p++ {
-			key := []byte(fmt.Sprintf("key %d/%d", r, p))
-			value := []byte(fmt.Sprintf("value %d/%d", r, p))
-			err := tree.Insert(ctx, key, value)
-			require.NoError(t, err, "Insert")
-		}
-
-		_, rootHash, err := tree.Commit(ctx, testNs, uint64(r))
-		require.NoError(t, err, "Commit")
-		root := node.Root{
-			Namespace: testNs,
-			Version:   uint64(r),
-			Type:      node.RootTypeState,
-			Hash:      rootHash,
-		}
-		err = ndb.Finalize([]node.Root{root})
-		require.NoError(t, err, "Finalize")
-	}
-
-	// Prune all versions except the last one.
-	for r := 0; r < numVersions-1; r++ {
-		err := ndb.Prune(uint64(r))
-		require.NoError(t, err, "Prune")
+	// The number of elements is such that it would overflow the maximum number of allowed array
+	// elements in the default (untrusted) CBOR decoder.
+	for i := 0; i < 132_000; i++ {
+		err := tree.Insert(ctx, []byte(fmt.Sprintf("%d", i)), []byte(fmt.Sprintf("%d", i)))
+		require.NoError(t, err, "Insert")
 	}
 
-	// Reopen database to force compaction.
-	ndb.Close()
-	ndb, err := factory(testNs)
-	require.NoError(t, err, "ndb.New")
-	defer ndb.Close()
-
-	// Check that the latest version has all the keys.
-	for r := 0; r < numVersions; r++ {
-		for p := 0; p < numPairsPerVersion; p++ {
-			key := []byte(fmt.Sprintf("key %d/%d", r, p))
-			value, err := tree.Get(ctx, key)
-			require.NoError(t, err, "Get")
-			require.EqualValues(t, value, fmt.Sprintf("value %d/%d", r, p))
-		}
+	_, rootHash, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+	root := node.Root{
+		Namespace: testNs,
+		Version:   0,
+		Type:      node.RootTypeState,
+		Hash:      rootHash,
 	}
+	err = ndb.Finalize([]node.Root{root})
+	require.NoError(t, err, "Finalize")
 }
 
-func testPruneForkedRoots(t *testing.T, ndb db.NodeDB, factory NodeDBFactory) {
+func testRootInfo(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	ctx := context.Background()
-
-	// Create a root in version 0.
 	tree := New(nil, ndb, node.RootTypeState)
-	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
-	require.NoError(t, err, "Insert")
-	err = tree.Insert(ctx, []byte("moo"), []byte("goo"))
+
+	// Empty root.
+	var emptyRoot node.Root
+	emptyRoot.Empty()
+	emptyRoot.Type = node.RootTypeState
+	info, err := tree.RootInfo(ctx, emptyRoot)
+	require.NoError(t, err, "RootInfo")
+	require.Equal(t, NodeKindNil, info.RootNodeKind)
+	require.EqualValues(t, 0, info.NodeCount)
+
+	// Single leaf.
+	err = tree.Insert(ctx, []byte("foo"), []byte("bar"))
 	require.NoError(t, err, "Insert")
-	_, rootHashR0_1, err := tree.Commit(ctx, testNs, 0)
+	_, err = tree.RootInfo(ctx, emptyRoot)
+	require.ErrorIs(t, err, syncer.ErrDirtyRoot, "RootInfo should fail on dirty root")
+
+	_, rootHash, err := tree.Commit(ctx, testNs, 1)
 	require.NoError(t, err, "Commit")
-	// Finalize version 0.
-	err = ndb.Finalize([]node.Root{{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashR0_1}})
-	require.NoError(t, err, "Finalize")
+	root := node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHash}
+	info, err = tree.RootInfo(ctx, root)
+	require.NoError(t, err, "RootInfo")
+	require.Equal(t, root, info.Root)
+	require.Equal(t, NodeKindLeaf, info.RootNodeKind)
+	require.EqualValues(t, 1, info.NodeCount)
 
-	// Create a derived root A in version 1.
-	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashR0_1})
-	err = tree.Insert(ctx, []byte("dr"), []byte("A"))
+	_, err = tree.RootInfo(ctx, emptyRoot)
+	require.ErrorIs(t, err, syncer.ErrInvalidRoot, "RootInfo should fail on a different root")
+
+	// An internal node with two leaves and an internal leaf node.
+	err = tree.Insert(ctx, []byte("moo"), []byte("goo"))
 	require.NoError(t, err, "Insert")
-	err = tree.Remove(ctx, []byte("moo"))
+	err = tree.Insert(ctx, []byte("fo"), []byte("bar"))
 	require.NoError(t, err, "Insert")
-	_, rootHashR1_1, err := tree.Commit(ctx, testNs, 1)
+	_, rootHash, err = tree.Commit(ctx, testNs, 2)
 	require.NoError(t, err, "Commit")
+	root = node.Root{Namespace: testNs, Version: 2, Type: node.RootTypeState, Hash: rootHash}
 
-	// Create a derived root B in version 1.
-	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashR0_1})
-	err = tree.Insert(ctx, []byte("dr"), []byte("B"))
-	require.NoError(t, err, "Insert")
-	_, rootHashR1_2, err := tree.Commit(ctx, testNs, 1)
-	require.NoError(t, err, "Commit")
+	// Use a fresh tree so that all nodes need to be fetched from the node database.
+	tree = NewWithRoot(nil, ndb, root)
+	info, err = tree.RootInfo(ctx, root)
+	require.NoError(t, err, "RootInfo")
+	require.Equal(t, testNs, info.Root.Namespace)
+	require.EqualValues(t, 2, info.Root.Version)
+	require.Equal(t, NodeKindInternal, info.RootNodeKind)
+	// Root internal node, left internal node with leaves "fo" and "foo" and the "moo" leaf.
+	require.EqualValues(t, 5, info.NodeCount)
+}
 
-	// Finalize version 1. Only derived root B was finalized, so derived root A
-	// should be discarded.
-	err = ndb.Finalize([]node.Root{{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_2}})
-	require.NoError(t, err, "Finalize")
+func testRootInfoSummary(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+	keys, values := generateKeyValuePairsEx("", 100)
 
-	// Make sure that the write log for the discarded root is gone.
-	rootR0_1 := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashR0_1}
-	rootR1_1 := node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_1}
-	rootR1_2 := node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_2}
-	_, err = ndb.GetWriteLog(ctx, rootR0_1, rootR1_1)
-	require.Error(t, err, "GetWriteLog")
-	// Make sure that the write log for the non-discarded root exists.
-	_, err = ndb.GetWriteLog(ctx, rootR0_1, rootR1_2)
-	require.NoError(t, err, "GetWriteLog")
+	// walkRootInfo computes the summary of the given root by walking the whole tree.
+	walkRootInfo := func(root node.Root) *RootInfo {
+		fresh := NewWithRoot(nil, ndb, root).(*tree)
+		defer fresh.Close()
 
-	// Create a derived root C from derived root B in version 2.
-	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_2})
-	err = tree.Insert(ctx, []byte("yet"), []byte("another"))
+		fresh.cache.Lock()
+		defer fresh.cache.Unlock()
+		info, err := fresh.computeRootInfo(ctx, root)
+		require.NoError(t, err, "computeRootInfo")
+		return info
+	}
+
+	tree := New(nil, ndb, node.RootTypeState)
+	defer tree.Close()
+
+	var roots []node.Root
+	for version := uint64(1); version <= 5; version++ {
+		// Update some values, remove some keys and insert new ones.
+		for i := range keys {
+			var err error
+			switch {
+			case version == 1:
+				err = tree.Insert(ctx, keys[i], values[i])
+			case i%5 == int(version)%5:
+				err = tree.Remove(ctx, keys[i])
+			case i%3 == int(version)%3:
+				err = tree.Insert(ctx, keys[i], []byte(fmt.Sprintf("%s updated %d", values[i], version)))
+			case i%7 == int(version)%7:
+				err = tree.Insert(ctx, []byte(fmt.Sprintf("%s %d", keys[i], version)), values[i])
+			}
+			require.NoError(t, err, "Insert/Remove")
+		}
+
+		// Commit the third version without a summary so that the next summary cannot be derived
+		// from the summary of its parent.
+		var options []CommitOption
+		if version != 3 {
+			options = append(options, WithSummary())
+		}
+		_, rootHash, err := tree.Commit(ctx, testNs, version, options...)
+		require.NoError(t, err, "Commit")
+		root := node.Root{Namespace: testNs, Version: version, Type: node.RootTypeState, Hash: rootHash}
+		roots = append(roots, root)
+
+		expected := walkRootInfo(root)
+		require.NotZero(t, expected.LeafCount)
+		require.NotZero(t, expected.ValueBytes)
+
+		var leafCount, valueBytes uint64
+		it := tree.NewIterator(ctx)
+		for it.Rewind(); it.Valid(); it.Next() {
+			leafCount++
+			valueBytes += uint64(len(it.Value()))
+		}
+		require.NoError(t, it.Err(), "iterator")
+		it.Close()
+		require.Equal(t, leafCount, expected.LeafCount)
+		require.Equal(t, valueBytes, expected.ValueBytes)
+
+		summary, err := ndb.GetRootSummary(root)
+		if version == 3 {
+			require.ErrorIs(t, err, db.ErrRootSummaryNotFound, "summary should not be stored without the option")
+		} else {
+			require.NoError(t, err, "GetRootSummary")
+			require.Equal(t, &db.RootSummary{
+				NodeCount:  expected.NodeCount,
+				LeafCount:  expected.LeafCount,
+				ValueBytes: expected.ValueBytes,
+			}, summary, "stored summary should match a full walk")
+		}
+
+		// The summary should be used by any tree for the root, and otherwise computed.
+		for _, tr := range []Tree{tree, NewWithRoot(nil, ndb, root)} {
+			info, err := tr.RootInfo(ctx, root)
+			require.NoError(t, err, "RootInfo")
+			require.Equal(t, expected, info, "summary should match a full walk")
+		}
+	}
+
+	// Summaries of roots that are not finalized or pruned should be removed.
+	err := ndb.Finalize(roots[:1])
+	require.NoError(t, err, "Finalize")
+	forked := NewWithRoot(nil, ndb, roots[0])
+	defer forked.Close()
+	err = forked.Insert(ctx, []byte("another key"), []byte("another value"))
 	require.NoError(t, err, "Insert")
-	_, rootHashR2_1, err := tree.Commit(ctx, testNs, 2)
+	_, rootHash, err := forked.Commit(ctx, testNs, 2, WithSummary())
 	require.NoError(t, err, "Commit")
-	// Finalize version 2.
-	err = ndb.Finalize([]node.Root{{Namespace: testNs, Version: 2, Type: node.RootTypeState, Hash: rootHashR2_1}})
-	require.NoError(t, err, "Finalize")
+	fork := node.Root{Namespace: testNs, Version: 2, Type: node.RootTypeState, Hash: rootHash}
+	require.NotEqual(t, roots[1], fork)
+	_, err = ndb.GetRootSummary(fork)
+	require.NoError(t, err, "GetRootSummary")
 
-	// Prune version 1 (should fail as it is not the earliest version).
-	err = ndb.Prune(1)
-	require.Error(t, err, "Prune")
-	require.Equal(t, db.ErrNotEarliest, err)
+	for _, root := range roots[1:] {
+		err = ndb.Finalize([]node.Root{root})
+		require.NoError(t, err, "Finalize")
+	}
+	_, err = ndb.GetRootSummary(fork)
+	require.ErrorIs(t, err, db.ErrRootSummaryNotFound, "summary of a non-finalized root should be removed")
 
-	// Prune versions 0 and 1.
-	err = ndb.Prune(0)
-	require.NoError(t, err, "Prune")
 	err = ndb.Prune(1)
 	require.NoError(t, err, "Prune")
+	_, err = ndb.GetRootSummary(roots[0])
+	require.ErrorIs(t, err, db.ErrRootSummaryNotFound, "summary of a pruned root should be removed")
+	_, err = ndb.GetRootSummary(roots[1])
+	require.NoError(t, err, "GetRootSummary")
+}
 
-	// Reopen database to force compaction.
-	ndb.Close()
-	ndb, err = factory(testNs)
-	require.NoError(t, err, "ndb.New")
-	defer ndb.Close()
+func testListRootsUnder(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+	tree := New(nil, ndb, node.RootTypeState)
+	defer tree.Close()
 
-	// Make sure all the keys are there.
-	for _, root := range []struct {
-		Version uint64
-		Hash    hash.Hash
-		Keys    []string
+	roots, err := tree.ListRootsUnder(ctx, common.Namespace{}, 0)
+	require.NoError(t, err, "ListRootsUnder")
+	require.Empty(t, roots, "empty database should have no roots")
+
+	var expected []node.Root
+	for version := uint64(1); version <= 3; version++ {
+		err = tree.Insert(ctx, []byte(fmt.Sprintf("key %d", version)), []byte("value"))
+		require.NoError(t, err, "Insert")
+		_, rootHash, cerr := tree.Commit(ctx, testNs, version)
+		require.NoError(t, cerr, "Commit")
+		root := node.Root{Namespace: testNs, Version: version, Type: node.RootTypeState, Hash: rootHash}
+		require.NoError(t, ndb.Finalize([]node.Root{root}), "Finalize")
+		expected = append(expected, root)
+	}
+
+	// siblingNs returns a namespace sharing exactly the first bit bits with the test namespace.
+	siblingNs := func(bit int) common.Namespace {
+		ns := testNs
+		ns[bit/8] ^= 0x80 >> (bit % 8)
+		return ns
+	}
+
+	for _, tc := range []struct {
+		nsPrefix   common.Namespace
+		prefixBits int
+		match      bool
 	}{
-		{2, rootHashR2_1, []string{"foo", "moo", "dr", "yet"}},
+		{common.Namespace{}, 0, true},
+		{siblingNs(0), 0, true},
+		{testNs, 8 * common.NamespaceSize, true},
+		{siblingNs(0), 1, false},
+		{siblingNs(13), 13, true},
+		{siblingNs(13), 14, false},
+		{siblingNs(8*common.NamespaceSize - 1), 8*common.NamespaceSize - 1, true},
+		{siblingNs(8*common.NamespaceSize - 1), 8 * common.NamespaceSize, false},
 	} {
-		tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: root.Version, Type: node.RootTypeState, Hash: root.Hash})
+		roots, err = tree.ListRootsUnder(ctx, tc.nsPrefix, tc.prefixBits)
+		require.NoError(t, err, "ListRootsUnder(%s, %d)", tc.nsPrefix, tc.prefixBits)
+		switch tc.match {
+		case true:
+			require.Equal(t, expected, roots, "ListRootsUnder(%s, %d)", tc.nsPrefix, tc.prefixBits)
+		case false:
+			require.Empty(t, roots, "ListRootsUnder(%s, %d)", tc.nsPrefix, tc.prefixBits)
+		}
+	}
+
+	// Pruned versions should not be listed.
+	require.NoError(t, ndb.Prune(1), "Prune")
+	roots, err = tree.ListRootsUnder(ctx, testNs, 8*common.NamespaceSize)
+	require.NoError(t, err, "ListRootsUnder")
+	require.Equal(t, expected[1:], roots)
+
+	_, err = tree.ListRootsUnder(ctx, testNs, -1)
+	require.Error(t, err, "ListRootsUnder should fail with a negative prefix length")
+	_, err = tree.ListRootsUnder(ctx, testNs, 8*common.NamespaceSize+1)
+	require.Error(t, err, "ListRootsUnder should fail with a prefix longer than the namespace")
+}
+
+func testReadAmplification(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+
+	tree := New(nil, ndb, node.RootTypeState)
+	for _, key := range []string{"foo", "moo", "fo"} {
+		err := tree.Insert(ctx, []byte(key), []byte("value"))
+		require.NoError(t, err, "Insert")
+	}
+	_, rootHash, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+	root := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash}
+	tree.Close()
+
+	// The root internal node splits "moo" from an internal node which has the "fo" leaf as its
+	// leaf node and the "foo" leaf as a child. Looking up "moo" costs two dereferences while
+	// looking up "fo" or "foo" costs three.
+	tree = NewWithRoot(nil, ndb, root)
+	defer tree.Close()
+	keys := []node.Key{node.Key("foo"), node.Key("moo"), node.Key("foo"), node.Key("fo")}
+	amp, err := tree.MeasureReadAmplification(ctx, root, keys)
+	require.NoError(t, err, "MeasureReadAmplification")
+	require.EqualValues(t, 4, amp.Keys)
+	require.EqualValues(t, 3+2+3+3, amp.Derefs)
+	require.EqualValues(t, 5, amp.UniqueNodes)
+	// Leaf nodes of internal nodes are loaded together with the internal node.
+	require.EqualValues(t, 4, amp.Misses, "each node should be loaded once on a cold cache")
+	require.Equal(t, 11.0/4.0, amp.Ratio())
+
+	// On a warm cache, the dereferences stay the same but no nodes need to be loaded.
+	amp, err = tree.MeasureReadAmplification(ctx, root, keys)
+	require.NoError(t, err, "MeasureReadAmplification")
+	require.EqualValues(t, 11, amp.Derefs)
+	require.EqualValues(t, 5, amp.UniqueNodes)
+	require.EqualValues(t, 0, amp.Misses)
+
+	// Regular lookups should not be counted.
+	_, err = tree.Get(ctx, []byte("foo"))
+	require.NoError(t, err, "Get")
+	amp, err = tree.MeasureReadAmplification(ctx, root, nil)
+	require.NoError(t, err, "MeasureReadAmplification")
+	require.Zero(t, amp.Derefs)
+	require.Zero(t, amp.Ratio())
 
-		for _, key := range root.Keys {
-			value, err := tree.Get(ctx, []byte(key))
-			require.NoError(t, err, "Get(%d, %s)", root.Version, key)
-			require.NotNil(t, value, "value should exist (%d, %s)", root.Version, key)
+	var emptyRoot node.Root
+	emptyRoot.Empty()
+	_, err = tree.MeasureReadAmplification(ctx, emptyRoot, keys)
+	require.ErrorIs(t, err, syncer.ErrInvalidRoot, "MeasureReadAmplification should fail on a different root")
+}
+
+func testCommitment(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+	keys, values := generateKeyValuePairsEx("", 50)
+
+	commitTree := func(values [][]byte) (Tree, node.Root) {
+		tree := New(nil, ndb, node.RootTypeState)
+		for i := range keys {
+			err := tree.Insert(ctx, keys[i], values[i])
+			require.NoError(t, err, "Insert")
 		}
+		_, rootHash, err := tree.Commit(ctx, testNs, 1)
+		require.NoError(t, err, "Commit")
+		return tree, node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHash}
 	}
+
+	tree1, root1 := commitTree(values)
+	defer tree1.Close()
+	c1, err := tree1.Commitment(ctx, root1)
+	require.NoError(t, err, "Commitment")
+	require.EqualValues(t, root1.Hash, c1.RootHash)
+	require.EqualValues(t, len(keys), c1.LeafCount)
+
+	// Commitment of the same root should be identical when computed on a fresh tree.
+	tree := NewWithRoot(nil, ndb, root1)
+	defer tree.Close()
+	c, err := tree.Commitment(ctx, root1)
+	require.NoError(t, err, "Commitment")
+	require.EqualValues(t, c1, c, "commitment should be deterministic")
+
+	// Change a single value.
+	changedValues := append([][]byte{}, values...)
+	changedValues[len(keys)/2] = []byte("changed value")
+	tree2, root2 := commitTree(changedValues)
+	defer tree2.Close()
+	c2, err := tree2.Commitment(ctx, root2)
+	require.NoError(t, err, "Commitment")
+	require.EqualValues(t, c1.LeafCount, c2.LeafCount, "leaf count should be the same")
+	require.NotEqualValues(t, c1.RootHash, c2.RootHash, "root hash should differ")
+	require.NotEqualValues(t, c1.LeafHashXor, c2.LeafHashXor, "leaf hash aggregate should differ")
+
+	_, err = tree2.Commitment(ctx, root1)
+	require.ErrorIs(t, err, syncer.ErrInvalidRoot, "Commitment should fail on a different root")
 }
 
-func testPruneLoneRootsShared(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+func testExportKV(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	ctx := context.Background()
+	keys, values := generateKeyValuePairsEx("", 100)
 
-	// Create a lone root (e.g., not included among the finalized roots)
-	// that shares some nodes with a root that is among the finalized
-	// roots. Make sure that the shared nodes aren't pruned.
+	var writeLog writelog.WriteLog
+	for i := range keys {
+		writeLog = append(writeLog, writelog.LogEntry{Key: keys[i], Value: values[i]})
+	}
+	// Include keys which are prefixes of other keys.
+	writeLog = append(writeLog,
+		writelog.LogEntry{Key: []byte("key"), Value: []byte("prefix")},
+		writelog.LogEntry{Key: []byte("key 1"), Value: []byte("overwritten")},
+	)
 
 	tree := New(nil, ndb, node.RootTypeState)
-	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
-	require.NoError(t, err, "Insert")
-	err = tree.Insert(ctx, []byte("foo 2"), []byte("bar2"))
-	require.NoError(t, err, "Insert")
-	err = tree.Insert(ctx, []byte("foo 3"), []byte("bar3"))
-	require.NoError(t, err, "Insert")
-	_, rootHash1, err := tree.Commit(ctx, testNs, 0)
+	err := tree.ApplyWriteLog(ctx, writelog.NewStaticIterator(writeLog))
+	require.NoError(t, err, "ApplyWriteLog")
+	_, rootHash, err := tree.Commit(ctx, testNs, 0)
 	require.NoError(t, err, "Commit")
+	root := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash}
 
-	tree = New(nil, ndb, node.RootTypeState)
-	err = tree.Insert(ctx, []byte("foo"), []byte("bar"))
-	require.NoError(t, err, "Insert")
-	err = tree.Insert(ctx, []byte("foo 2"), []byte("bar2"))
-	require.NoError(t, err, "Insert")
-	err = tree.Insert(ctx, []byte("foo 3"), []byte("bar3"))
-	require.NoError(t, err, "Insert")
-	err = tree.Insert(ctx, []byte("__extra__"), []byte("extra"))
-	require.NoError(t, err, "Insert")
-	_, _, err = tree.Commit(ctx, testNs, 0)
-	require.NoError(t, err, "Commit")
+	// Use a fresh tree so that all nodes need to be fetched from the node database.
+	tree = NewWithRoot(nil, ndb, root)
+	defer tree.Close()
 
-	err = ndb.Finalize([]node.Root{{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash1}})
-	require.NoError(t, err, "Finalize")
+	var exported writelog.WriteLog
+	err = tree.ExportKV(ctx, root, func(key node.Key, value []byte) error {
+		exported = append(exported, writelog.LogEntry{Key: key, Value: value})
+		return nil
+	})
+	require.NoError(t, err, "ExportKV")
+	require.EqualValues(t, writeLog.Canonical(), exported, "exported key/value set should be complete and sorted")
+	require.Greater(t, len(exported), exportKVBatchSize, "export should span multiple batches")
+
+	// The callback should be able to use the tree.
+	err = tree.ExportKV(ctx, root, func(key node.Key, value []byte) error {
+		current, gErr := tree.Get(ctx, key)
+		if gErr != nil {
+			return gErr
+		}
+		return expectValue(key, current, value)
+	})
+	require.NoError(t, err, "ExportKV")
 
-	// Check that the shared nodes are still there.
-	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash1})
-	value, err := tree.Get(ctx, []byte("foo"))
-	require.NoError(t, err, "Get")
-	require.EqualValues(t, []byte("bar"), value)
-	value, err = tree.Get(ctx, []byte("foo 2"))
-	require.NoError(t, err, "Get")
-	require.EqualValues(t, []byte("bar2"), value)
-	value, err = tree.Get(ctx, []byte("foo 3"))
-	require.NoError(t, err, "Get")
-	require.EqualValues(t, []byte("bar3"), value)
+	// Modifying the tree while exporting should fail the export.
+	err = tree.ExportKV(ctx, root, func(key node.Key, _ []byte) error {
+		return tree.Insert(ctx, key, []byte("modified"))
+	})
+	require.ErrorIs(t, err, syncer.ErrDirtyRoot, "ExportKV should fail when the tree is modified")
+	require.NoError(t, tree.Rollback(), "Rollback")
+
+	// Errors returned by the callback should stop the export.
+	errStop := fmt.Errorf("stop")
+	var count int
+	err = tree.ExportKV(ctx, root, func(node.Key, []byte) error {
+		count++
+		if count == 10 {
+			return errStop
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, errStop, "ExportKV should return the callback error")
+	require.Equal(t, 10, count, "ExportKV should stop on callback error")
+
+	// Canceling the context should stop the export.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	err = tree.ExportKV(cancelCtx, root, func(node.Key, []byte) error {
+		return nil
+	})
+	require.ErrorIs(t, err, context.Canceled, "ExportKV should fail with canceled context")
 }
 
-func testPruneLoneRootsShared2(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+func testKeyDepth(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	ctx := context.Background()
 
-	type item struct {
-		Key   string
-		Value string
-	}
-	batches := []struct {
-		Namespace  common.Namespace
-		SrcVersion uint64
-		DstVersion uint64
-		SrcRoot    string
-		DstRoot    string
-		Finalized  bool
-		Items      []item
-	}{
-		{
-			Namespace:  testNs,
-			SrcVersion: 3,
-			DstVersion: 3,
-			SrcRoot:    "xnK40e9W7Sirh8NiLFEUBpvdOte4+XN0mNDAHs7wlno=", // Empty hash.
-			DstRoot:    "HDRPGZxGtdYTxcEwY8xMEQb5glc5rzc30q27u2CceVU=",
-			Finalized:  true,
-			Items: []item{
-				{
-					Key: "VFxlQ0wtW+UFzn4ojduOXMqLVlgtTzk5tN+eysKJiu7nAA==",
-					Value: "glkBGqNkYXJnc6Jja2V5eEpVbmxvY2sgdGhlIHBvdGVudGlhbCBvZiB5b3VyIGRhdGEgd2l0aG91" +
-						"dCBjb21wcm9taXNpbmcgc2VjdXJpdHkgb3IgcHJpdmFjeWV2YWx1ZXh5VGhlIHBsYXRmb3JtIHRo" +
-						"YXQgcHV0cyBkYXRhIHByaXZhY3kgZmlyc3QuIEZyb20gc2hhcmluZyBtZWRpY2FsIHJlY29yZHMs" +
-						"IHRvIGFuYWx5emluZyBwZXJzb25hbCBmaW5hbmNpYWwgaW5mb3JtYXRpb24gZXRjLmZtZXRob2Rm" +
-						"aW5zZXJ0cHByZWRpY3RlZF9yd19zZXSjaHJlYWRfc2V0gGl3cml0ZV9zZXSAa2dyYW51bGFyaXR5" +
-						"AAA=",
-				},
-			},
-		},
-		{
-			Namespace:  testNs,
-			SrcVersion: 3,
-			DstVersion: 4,
-			SrcRoot:    "HDRPGZxGtdYTxcEwY8xMEQb5glc5rzc30q27u2CceVU=",
-			DstRoot:    "1mhju3gCBswUklbJuiifvVJDY6QeNiqRx2F1MDdxcys=",
-			Finalized:  true,
-			Items: []item{
-				{
-					Key: "RWt2X2tleVxlQ0wtW+UFzn4ojduOXMqLVlgtTzk5tN+eysKJiu7n",
-					Value: "VW5sb2NrIHRoZSBwb3RlbnRpYWwgb2YgeW91ciBkYXRhIHdpdGhvdXQgY29tcHJvbWlzaW5nIHNl" +
-						"Y3VyaXR5IG9yIHByaXZhY3k=",
-				},
-				{
-					Key:   "RWt2X29wXGVDTC1b5QXOfiiN245cyotWWC1POTm0357KwomK7uc=",
-					Value: "aW5zZXJ0",
-				},
-				{
-					Key:   "VFxlQ0wtW+UFzn4ojduOXMqLVlgtTzk5tN+eysKJiu7nAQ==",
-					Value: "gUqhZ1N1Y2Nlc3P2",
-				},
-			},
-		},
-		{
-			Namespace:  testNs,
-			SrcVersion: 3,
-			DstVersion: 4,
-			SrcRoot:    "HDRPGZxGtdYTxcEwY8xMEQb5glc5rzc30q27u2CceVU=",
-			DstRoot:    "+h6pzinXfRJY1tnL7jXoGcbUfG0lFCYTX1TaDngycso=",
-			Items: []item{
-				{
-					Key: "RWt2X2tleVxlQ0wtW+UFzn4ojduOXMqLVlgtTzk5tN+eysKJiu7n",
-					Value: "VW5sb2NrIHRoZSBwb3RlbnRpYWwgb2YgeW91ciBkYXRhIHdpdGhvdXQgY29tcHJvbWlzaW5nIHNl" +
-						"Y3VyaXR5IG9yIHByaXZhY3k=",
-				},
-				{
-					Key:   "RWt2X29wXGVDTC1b5QXOfiiN245cyotWWC1POTm0357KwomK7uc=",
-					Value: "aW5zZXJ0",
-				},
-				{
-					Key:   "VFxlQ0wtW+UFzn4ojduOXMqLVlgtTzk5tN+eysKJiu7nAQ==",
-					Value: "gUqhZ1N1Y2Nlc3P2",
-				},
-				{
-					Key:   "X19ib29tX18=",
-					Value: "cG9vZg==",
-				},
-			},
-		},
+	commit := func(tree Tree, version uint64) node.Root {
+		_, rootHash, err := tree.Commit(ctx, testNs, version)
+		require.NoError(t, err, "Commit")
+		return node.Root{Namespace: testNs, Version: version, Type: node.RootTypeState, Hash: rootHash}
 	}
 
-	var finalizedRoots []node.Root
-	for _, batch := range batches {
-		if len(finalizedRoots) > 0 && finalizedRoots[0].Version != batch.DstVersion {
-			err := ndb.Finalize(finalizedRoots)
-			require.NoError(t, err, "Finalize")
-			finalizedRoots = nil
-		}
+	tree := New(nil, ndb, node.RootTypeState)
+	defer tree.Close()
 
-		srcRootHashRaw, err := base64.StdEncoding.DecodeString(batch.SrcRoot)
-		require.NoError(t, err, "base64.DecodeString")
-		var srcRootHash hash.Hash
-		err = srcRootHash.UnmarshalBinary(srcRootHashRaw)
-		require.NoError(t, err, "hash.UnmarshalBinary")
+	// Empty tree.
+	depth, exists, err := tree.KeyDepth(ctx, commit(tree, 0), node.Key("foo"))
+	require.NoError(t, err, "KeyDepth")
+	require.False(t, exists)
+	require.EqualValues(t, 0, depth)
 
-		tree := NewWithRoot(nil, ndb, node.Root{
-			Namespace: batch.Namespace,
-			Version:   batch.SrcVersion,
-			Type:      node.RootTypeState,
-			Hash:      srcRootHash,
-		})
-		defer tree.Close()
+	// Single leaf at the root.
+	err = tree.Insert(ctx, []byte("foo"), []byte("bar"))
+	require.NoError(t, err, "Insert")
+	root := commit(tree, 1)
+	depth, exists, err = tree.KeyDepth(ctx, root, node.Key("foo"))
+	require.NoError(t, err, "KeyDepth")
+	require.True(t, exists)
+	require.EqualValues(t, 0, depth)
 
-		for _, item := range batch.Items {
-			var key, value []byte
-			key, err = base64.StdEncoding.DecodeString(item.Key)
-			require.NoError(t, err, "base64.DecodeString")
-			value, err = base64.StdEncoding.DecodeString(item.Value)
-			require.NoError(t, err, "base64.DecodeString")
-			err = tree.Insert(ctx, key, value)
-			require.NoError(t, err, "Insert")
-		}
+	// Keys "foo" and "moo" first differ in the fifth bit, "fo" is a prefix of "foo".
+	err = tree.Insert(ctx, []byte("moo"), []byte("goo"))
+	require.NoError(t, err, "Insert")
+	err = tree.Insert(ctx, []byte("fo"), []byte("bar"))
+	require.NoError(t, err, "Insert")
+	root = commit(tree, 2)
 
-		_, rootHash, err := tree.Commit(ctx, batch.Namespace, batch.DstVersion)
-		require.NoError(t, err, "Commit")
+	for _, tc := range []struct {
+		key    string
+		depth  node.Depth
+		exists bool
+	}{
+		{"moo", 4, true},
+		{"fo", 16, true},
+		{"foo", 16, true},
+		{"mo", 4, false},
+		{"fooo", 16, false},
+		{"", 0, false},
+	} {
+		depth, exists, err = tree.KeyDepth(ctx, root, node.Key(tc.key))
+		require.NoError(t, err, "KeyDepth(%s)", tc.key)
+		require.Equal(t, tc.exists, exists, "existence of key %s", tc.key)
+		require.EqualValues(t, tc.depth, depth, "depth of key %s", tc.key)
+	}
 
-		dstRootHashRaw, err := base64.StdEncoding.DecodeString(batch.DstRoot)
-		require.NoError(t, err, "base64.DecodeString")
-		var dstRootHash hash.Hash
-		err = dstRootHash.UnmarshalBinary(dstRootHashRaw)
-		require.NoError(t, err, "hash.UnmarshalBinary")
-		require.EqualValues(t, dstRootHash, rootHash, "computed root hash must be as expected")
+	err = tree.Insert(ctx, []byte("dirty"), []byte("value"))
+	require.NoError(t, err, "Insert")
+	_, _, err = tree.KeyDepth(ctx, root, node.Key("foo"))
+	require.ErrorIs(t, err, syncer.ErrDirtyRoot, "KeyDepth should fail on dirty root")
+}
 
-		if batch.Finalized {
-			finalizedRoots = append(finalizedRoots, node.Root{
-				Namespace: batches[0].Namespace,
-				Version:   batch.DstVersion,
-				Type:      node.RootTypeState,
-				Hash:      rootHash,
-			})
-		}
-	}
+func testLongestPrefixMatch(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
 
-	err := ndb.Finalize(finalizedRoots)
-	require.NoError(t, err, "Finalize")
+	commit := func(tree Tree, version uint64) node.Root {
+		_, rootHash, err := tree.Commit(ctx, testNs, version)
+		require.NoError(t, err, "Commit")
+		return node.Root{Namespace: testNs, Version: version, Type: node.RootTypeState, Hash: rootHash}
+	}
 
-	tree := NewWithRoot(nil, ndb, finalizedRoots[0])
+	tree := New(nil, ndb, node.RootTypeState)
 	defer tree.Close()
 
-	it := tree.NewIterator(ctx)
-	defer it.Close()
+	// Empty tree.
+	_, _, found, err := tree.LongestPrefixMatch(ctx, commit(tree, 0), node.Key("/api/v1"))
+	require.NoError(t, err, "LongestPrefixMatch")
+	require.False(t, found, "empty tree should not match")
+
+	rules := map[string]string{
+		"/":           "root",
+		"/api":        "api",
+		"/api/v1":     "api-v1",
+		"/api/v1/foo": "api-v1-foo",
+		"/static":     "static",
+		"/apix":       "apix",
+	}
+	for prefix, target := range rules {
+		err = tree.Insert(ctx, []byte(prefix), []byte(target))
+		require.NoError(t, err, "Insert")
+	}
+	root := commit(tree, 1)
 
-	for it.Rewind(); it.Valid(); it.Next() { //nolint:revive
-		// Just iterate over the whole tree. If the tree is not consistent
-		// this iteration will throw an error that a node is missing.
+	for _, tc := range []struct {
+		key    string
+		prefix string
+		found  bool
+	}{
+		// Exact matches.
+		{"/", "/", true},
+		{"/api/v1", "/api/v1", true},
+		{"/api/v1/foo", "/api/v1/foo", true},
+		// Longest proper prefix.
+		{"/api/v1/bar", "/api/v1", true},
+		{"/api/v1/foobar", "/api/v1/foo", true},
+		{"/api/v2", "/api", true},
+		{"/apix/y", "/apix", true},
+		{"/static/index.html", "/static", true},
+		{"/other", "/", true},
+		// No matching prefix.
+		{"api", "", false},
+		{"", "", false},
+	} {
+		prefix, value, found, err := tree.LongestPrefixMatch(ctx, root, node.Key(tc.key))
+		require.NoError(t, err, "LongestPrefixMatch(%s)", tc.key)
+		require.Equal(t, tc.found, found, "match for key %s", tc.key)
+		if !tc.found {
+			continue
+		}
+		require.EqualValues(t, tc.prefix, prefix, "matched prefix for key %s", tc.key)
+		require.EqualValues(t, rules[tc.prefix], value, "value for key %s", tc.key)
 	}
-	require.NoError(t, it.Err(), "tree should still be consistent")
+
+	// Check that a remote tree produces the same results.
+	remoteTree := NewWithRoot(tree, nil, root)
+	defer remoteTree.Close()
+	prefix, value, found, err := remoteTree.LongestPrefixMatch(ctx, root, node.Key("/api/v1/bar"))
+	require.NoError(t, err, "LongestPrefixMatch")
+	require.True(t, found, "remote tree should match")
+	require.EqualValues(t, "/api/v1", prefix)
+	require.EqualValues(t, "api-v1", value)
 }
 
-func testPruneLoneRootsShared3(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
-	require := require.New(t)
+func testGetValueHistory(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	ctx := context.Background()
 
-	// Create a root in version 0.
 	tree := New(nil, ndb, node.RootTypeState)
-	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
-	require.NoError(err, "Insert")
-	_, _, err = tree.Commit(ctx, testNs, 0)
-	require.NoError(err, "Commit")
+	defer tree.Close()
 
-	// Create another root in version 0.
-	tree = New(nil, ndb, node.RootTypeState)
-	err = tree.Insert(ctx, []byte("moo"), []byte("goo"))
-	require.NoError(err, "Insert")
-	_, rootHashR0_2, err := tree.Commit(ctx, testNs, 0)
-	require.NoError(err, "Commit")
+	key := node.Key("audited")
+	rounds := []struct {
+		value  []byte
+		remove bool
+	}{
+		{value: []byte("v1")},
+		{},
+		{value: []byte("v2")},
+		{},
+		{remove: true},
+		{},
+		{value: []byte("v3")},
+	}
+
+	var (
+		roots    []node.Root
+		expected [][]byte
+		current  []byte
+	)
+	for version, round := range rounds {
+		// Also modify an unrelated key so that each round produces a new root.
+		err := tree.Insert(ctx, []byte(fmt.Sprintf("other %d", version%3)), []byte(fmt.Sprintf("value %d", version)))
+		require.NoError(t, err, "Insert")
+		switch {
+		case round.remove:
+			err = tree.Remove(ctx, key)
+			require.NoError(t, err, "Remove")
+			current = nil
+		case round.value != nil:
+			err = tree.Insert(ctx, key, round.value)
+			require.NoError(t, err, "Insert")
+			current = round.value
+		}
+
+		_, rootHash, err := tree.Commit(ctx, testNs, uint64(version))
+		require.NoError(t, err, "Commit")
+		roots = append(roots, node.Root{Namespace: testNs, Version: uint64(version), Type: node.RootTypeState, Hash: rootHash})
+		expected = append(expected, current)
+	}
+
+	values, err := tree.GetValueHistory(ctx, key, roots)
+	require.NoError(t, err, "GetValueHistory")
+	require.Len(t, values, len(roots))
+	for i := range roots {
+		require.EqualValues(t, expected[i], values[i], "value at version %d", roots[i].Version)
+	}
 
-	// Create the same root as the first root in version 1.
-	tree = New(nil, ndb, node.RootTypeState)
-	err = tree.Insert(ctx, []byte("foo"), []byte("bar"))
-	require.NoError(err, "Insert")
-	_, rootHashR1_1, err := tree.Commit(ctx, testNs, 1)
-	require.NoError(err, "Commit")
+	// Roots need not be in order and may repeat.
+	reordered := []node.Root{roots[6], roots[0], roots[0], roots[4], roots[2]}
+	values, err = tree.GetValueHistory(ctx, key, reordered)
+	require.NoError(t, err, "GetValueHistory")
+	require.EqualValues(t, [][]byte{expected[6], expected[0], expected[0], nil, expected[2]}, values)
 
-	// Finalize version 0 with the second root.
-	err = ndb.Finalize([]node.Root{{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashR0_2}})
-	require.NoError(err, "Finalize")
+	// Keys that never existed have no history.
+	values, err = tree.GetValueHistory(ctx, node.Key("missing"), roots)
+	require.NoError(t, err, "GetValueHistory")
+	require.Equal(t, make([][]byte, len(roots)), values)
 
-	// Make sure that the first root in version 1 is still valid.
-	tree = NewWithRoot(nil, ndb, node.Root{
-		Namespace: testNs,
-		Version:   1,
-		Type:      node.RootTypeState,
-		Hash:      rootHashR1_1,
-	})
-	value, err := tree.Get(ctx, []byte("foo"))
-	require.NoError(err, "Get")
-	require.EqualValues([]byte("bar"), value)
+	_, err = tree.GetValueHistory(ctx, key, []node.Root{{Namespace: testNs, Type: node.RootTypeIO, Hash: roots[0].Hash}})
+	require.ErrorIs(t, err, syncer.ErrInvalidRoot, "GetValueHistory should reject roots of a different type")
+
+	// The root the tree is at should also be available for in-memory trees.
+	memTree := New(nil, nil, node.RootTypeState)
+	defer memTree.Close()
+	err = memTree.Insert(ctx, key, []byte("in memory"))
+	require.NoError(t, err, "Insert")
+	_, rootHash, err := memTree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+	memRoot := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash}
+	values, err = memTree.GetValueHistory(ctx, key, []node.Root{memRoot, memRoot})
+	require.NoError(t, err, "GetValueHistory")
+	require.EqualValues(t, [][]byte{[]byte("in memory"), []byte("in memory")}, values)
 }
 
-func testPruneLoneRootsShared4(t *testing.T, ndb db.NodeDB, factory NodeDBFactory) {
-	require := require.New(t)
+func testExportRegion(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	ctx := context.Background()
 
-	// Create a root in version 0.
 	tree := New(nil, ndb, node.RootTypeState)
-	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
-	require.NoError(err, "Insert")
-	_, rootHashR0_1, err := tree.Commit(ctx, testNs, 0)
-	require.NoError(err, "Commit")
-
-	// Create the same root as the first root in version 1.
-	tree = New(nil, ndb, node.RootTypeState)
-	err = tree.Insert(ctx, []byte("foo"), []byte("bar"))
-	require.NoError(err, "Insert")
-	_, rootHashR1_1, err := tree.Commit(ctx, testNs, 1)
-	require.NoError(err, "Commit")
+	defer tree.Close()
 
-	// Finalize version 0.
-	err = ndb.Finalize([]node.Root{{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashR0_1}})
-	require.NoError(err, "Finalize")
-	// Finalize version 1.
-	err = ndb.Finalize([]node.Root{{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_1}})
-	require.NoError(err, "Finalize")
-	// Prune version 0.
-	err = ndb.Prune(0)
-	require.NoError(err, "Prune")
+	items := make(map[string]string)
+	for _, shard := range []string{"a", "b", "c"} {
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("%s/%02d", shard, i)
+			items[key] = fmt.Sprintf("value %s", key)
+			err := tree.Insert(ctx, []byte(key), []byte(items[key]))
+			require.NoError(t, err, "Insert")
+		}
+	}
+	_, rootHash, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+	root := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash}
+
+	var buf bytes.Buffer
+	err = tree.ExportRegion(ctx, root, node.Key("b/"), &buf)
+	require.NoError(t, err, "ExportRegion")
+
+	partial, err := ImportRegion(ctx, root, bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err, "ImportRegion")
+	defer partial.Close()
+
+	// All reads within the region should be served by the partial tree.
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("b/%02d", i)
+		value, gerr := partial.Get(ctx, []byte(key))
+		require.NoError(t, gerr, "Get(%s)", key)
+		require.EqualValues(t, items[key], value, "value of key %s", key)
+	}
+	value, err := partial.Get(ctx, []byte("b/99"))
+	require.NoError(t, err, "Get")
+	require.Nil(t, value, "missing key within the region should not exist")
 
-	// Reopen database to force compaction.
-	ndb.Close()
-	ndb, err = factory(testNs)
-	require.NoError(err, "ndb.New")
-	defer ndb.Close()
+	// Reads outside the region should fail.
+	_, err = partial.Get(ctx, []byte("a/00"))
+	require.ErrorIs(t, err, db.ErrNodeNotFound, "reads outside the region should fail")
 
-	// Make sure that the first root in version 1 is still valid.
-	tree = NewWithRoot(nil, ndb, node.Root{
-		Namespace: testNs,
-		Version:   1,
-		Type:      node.RootTypeState,
-		Hash:      rootHashR1_1,
+	// The partial tree should be able to prove keys within the region.
+	rsp, err := partial.SyncGet(ctx, &syncer.GetRequest{
+		Tree: syncer.TreeID{Root: root, Position: root.Hash},
+		Key:  []byte("b/07"),
 	})
-	value, err := tree.Get(ctx, []byte("foo"))
-	require.NoError(err, "Get")
-	require.EqualValues([]byte("bar"), value)
+	require.NoError(t, err, "SyncGet")
+	var pv syncer.ProofVerifier
+	_, err = pv.VerifyProof(ctx, root.Hash, &rsp.Proof)
+	require.NoError(t, err, "VerifyProof")
+
+	// Importing the region under a different root should fail.
+	otherRoot := root
+	otherRoot.Hash.FromBytes([]byte("other root"))
+	_, err = ImportRegion(ctx, otherRoot, bytes.NewReader(buf.Bytes()))
+	require.Error(t, err, "ImportRegion should fail for a different root")
 }
 
-func testPruneLoneRoots(t *testing.T, ndb db.NodeDB, factory NodeDBFactory) {
+func testPendingRootHash(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	ctx := context.Background()
 
-	// Create a root in version 0.
 	tree := New(nil, ndb, node.RootTypeState)
-	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
-	require.NoError(t, err, "Insert")
-	err = tree.Insert(ctx, []byte("moo"), []byte("goo"))
-	require.NoError(t, err, "Insert")
-	_, rootHashR0_1, err := tree.Commit(ctx, testNs, 0)
-	require.NoError(t, err, "Commit")
+	defer tree.Close()
 
-	// Create another root in version 0.
-	tree = New(nil, ndb, node.RootTypeState)
-	err = tree.Insert(ctx, []byte("goo"), []byte("blah"))
-	require.NoError(t, err, "Insert")
-	_, rootHashR0_2, err := tree.Commit(ctx, testNs, 0)
-	require.NoError(t, err, "Commit")
+	var emptyRoot hash.Hash
+	emptyRoot.Empty()
+	pendingHash, clean := tree.PendingRootHash()
+	require.True(t, clean, "empty tree should be clean")
+	require.Equal(t, emptyRoot, pendingHash)
 
-	// Create yet another root in version 0.
-	tree = New(nil, ndb, node.RootTypeState)
-	err = tree.Insert(ctx, []byte("yet"), []byte("another"))
-	require.NoError(t, err, "Insert")
-	_, rootHashR0_3, err := tree.Commit(ctx, testNs, 0)
-	require.NoError(t, err, "Commit")
+	var (
+		wl     writelog.WriteLog
+		hashes []hash.Hash
+	)
+	for i := 0; i < 10; i++ {
+		key, value := []byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i))
+		err := tree.Insert(ctx, key, value)
+		require.NoError(t, err, "Insert")
+		wl = append(wl, writelog.LogEntry{Key: key, Value: value})
 
-	// Create yet another root in version 0.
-	tree = New(nil, ndb, node.RootTypeState)
-	err = tree.Insert(ctx, []byte("yet2"), []byte("another2"))
-	require.NoError(t, err, "Insert")
-	_, rootHashR0_4, err := tree.Commit(ctx, testNs, 0)
-	require.NoError(t, err, "Commit")
+		pendingHash, clean = tree.PendingRootHash()
+		require.False(t, clean, "tree with pending updates should not be clean")
+		for _, h := range hashes {
+			require.NotEqual(t, h, pendingHash, "pending hash should change after each insert")
+		}
+		hashes = append(hashes, pendingHash)
 
-	// Finalize version 0.
-	var finalRoots []node.Root
-	for _, hash := range []hash.Hash{rootHashR0_1, rootHashR0_2, rootHashR0_3, rootHashR0_4} {
-		finalRoots = append(finalRoots, node.Root{
-			Namespace: testNs,
-			Version:   0,
-			Type:      node.RootTypeState,
-			Hash:      hash,
-		})
+		// Compare against a reference tree with the same updates applied.
+		refTree := New(nil, nil, node.RootTypeState)
+		err = refTree.ApplyWriteLog(ctx, writelog.NewStaticIterator(wl))
+		require.NoError(t, err, "ApplyWriteLog")
+		_, refHash, err := refTree.Commit(ctx, testNs, 0)
+		require.NoError(t, err, "Commit")
+		refTree.Close()
+		require.Equal(t, refHash, pendingHash, "pending hash should match the reference apply")
 	}
-	err = ndb.Finalize(finalRoots)
-	require.NoError(t, err, "Finalize")
-
-	// Create a distinct root in version 1.
-	tree = New(nil, ndb, node.RootTypeState)
-	err = tree.Insert(ctx, []byte("different"), []byte("boo"))
-	require.NoError(t, err, "Insert")
-	_, rootHashR1_1, err := tree.Commit(ctx, testNs, 1)
-	require.NoError(t, err, "Commit")
 
-	// Create a derived root in version 1.
-	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashR0_2})
-	err = tree.Insert(ctx, []byte("different2"), []byte("boo"))
-	require.NoError(t, err, "Insert")
-	_, rootHashR1_2, err := tree.Commit(ctx, testNs, 1)
+	// Computing the pending hash should not affect the commit.
+	_, rootHash, err := tree.Commit(ctx, testNs, 0)
 	require.NoError(t, err, "Commit")
+	require.Equal(t, hashes[len(hashes)-1], rootHash)
+	pendingHash, clean = tree.PendingRootHash()
+	require.True(t, clean, "committed tree should be clean")
+	require.Equal(t, rootHash, pendingHash)
 
-	// Create two linked roots inside version 1 which will not be referenced
-	// in subsequent versions and so should be garbage collected.
-	tree = New(nil, ndb, node.RootTypeState)
-	err = tree.Insert(ctx, []byte("first"), []byte("am i"))
-	require.NoError(t, err, "Insert")
-	_, rootHashR1_3, err := tree.Commit(ctx, testNs, 1)
-	require.NoError(t, err, "Commit")
+	// Removing a key should be reflected as well.
+	err = tree.Remove(ctx, []byte("key 9"))
+	require.NoError(t, err, "Remove")
+	pendingHash, clean = tree.PendingRootHash()
+	require.False(t, clean)
+	require.Equal(t, hashes[8], pendingHash, "pending hash should match the earlier state")
+}
 
-	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_3})
-	err = tree.Insert(ctx, []byte("second"), []byte("i am"))
-	require.NoError(t, err, "Insert")
-	_, rootHashR1_4, err := tree.Commit(ctx, testNs, 1)
-	require.NoError(t, err, "Commit")
+func testRequestStats(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
 
-	// Create three linked roots inside version 1 where the first root is
-	// derived from a root in version 0, the second root is derived from
-	// the first root and the third root is derived from the second root
-	// (both in the same version). All three should be garbage collected
-	// as they are not referenced in subsequent versions.
-	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashR0_3})
-	err = tree.Insert(ctx, []byte("first"), []byte("am i"))
-	require.NoError(t, err, "Insert")
-	_, rootHashR1_5, err := tree.Commit(ctx, testNs, 1)
-	require.NoError(t, err, "Commit")
-	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_5})
-	err = tree.Insert(ctx, []byte("second"), []byte("i am"))
-	require.NoError(t, err, "Insert")
-	err = tree.Remove(ctx, []byte("yet"))
-	require.NoError(t, err, "Remove")
-	_, rootHashR1_6, err := tree.Commit(ctx, testNs, 1)
-	require.NoError(t, err, "Commit")
-	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_6})
-	err = tree.Insert(ctx, []byte("third"), []byte("i am not"))
-	require.NoError(t, err, "Insert")
-	_, rootHashR1_7, err := tree.Commit(ctx, testNs, 1)
-	require.NoError(t, err, "Commit")
+	tree := New(nil, ndb, node.RootTypeState)
+	defer tree.Close()
 
-	// Create three linked roots inside version 1 where the first root is
-	// derived from a root in version 0, the second root is derived from
-	// the first root and the third root is derived from the second root
-	// (both in the same version). The third root is then referenced in version
-	// 2 so only intermediate nodes should be garbage collected.
-	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashR0_4})
-	err = tree.Insert(ctx, []byte("first2"), []byte("am i"))
-	require.NoError(t, err, "Insert")
-	_, rootHashR1_8, err := tree.Commit(ctx, testNs, 1)
-	require.NoError(t, err, "Commit")
-	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_8})
-	err = tree.Insert(ctx, []byte("second2"), []byte("i am"))
+	// Keys "foo" and "moo" differ in the fifth bit, so the tree consists of an internal node
+	// with the two leaves as its children.
+	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
 	require.NoError(t, err, "Insert")
-	_, rootHashR1_9, err := tree.Commit(ctx, testNs, 1)
-	require.NoError(t, err, "Commit")
-	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_9})
-	err = tree.Insert(ctx, []byte("third2"), []byte("i am not"))
+	err = tree.Insert(ctx, []byte("moo"), []byte("goo"))
 	require.NoError(t, err, "Insert")
-	_, rootHashR1_10, err := tree.Commit(ctx, testNs, 1)
+	_, rootHash, err := tree.Commit(ctx, testNs, 0)
 	require.NoError(t, err, "Commit")
-	// After these commits, 3 nodes are only referenced in intermediate roots
-	// and should be garbage collected.
+	root := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash}
 
-	// Finalize version 1.
-	finalRoots = nil
-	for _, hash := range []hash.Hash{rootHashR1_1, rootHashR1_2, rootHashR1_4, rootHashR1_7, rootHashR1_10} {
-		finalRoots = append(finalRoots, node.Root{
-			Namespace: testNs,
-			Version:   1,
-			Type:      node.RootTypeState,
-			Hash:      hash,
-		})
+	serverTree := NewWithRoot(nil, ndb, root)
+	defer serverTree.Close()
+	request := &syncer.GetRequest{
+		Tree: syncer.TreeID{Root: root, Position: root.Hash},
+		Key:  []byte("foo"),
 	}
-	err = ndb.Finalize(finalRoots)
-	require.NoError(t, err, "Finalize")
 
-	// Create a distinct root in version 2.
-	tree = New(nil, ndb, node.RootTypeState)
-	err = tree.Insert(ctx, []byte("blah"), []byte("brah"))
-	require.NoError(t, err, "Insert")
-	_, rootHashR2_1, err := tree.Commit(ctx, testNs, 2)
-	require.NoError(t, err, "Commit")
+	// The first request needs to load both the internal node and the leaf.
+	var stats RequestStats
+	_, err = serverTree.SyncGet(WithRequestStats(ctx, &stats), request)
+	require.NoError(t, err, "SyncGet")
+	require.EqualValues(t, 2, stats.Nodes)
+	require.EqualValues(t, 0, stats.Cache.Hits)
+	require.EqualValues(t, 2, stats.Cache.Misses)
+	leafSize := node.LeafNodeSize + uint64(len("foo")+len("bar"))
+	require.Greater(t, stats.Bytes, leafSize)
+
+	// The second request should be served from memory.
+	var cachedStats RequestStats
+	_, err = serverTree.SyncGet(WithRequestStats(ctx, &cachedStats), request)
+	require.NoError(t, err, "SyncGet")
+	require.EqualValues(t, 2, cachedStats.Nodes)
+	require.EqualValues(t, 2, cachedStats.Cache.Hits)
+	require.EqualValues(t, 0, cachedStats.Cache.Misses)
+	require.Equal(t, stats.Bytes, cachedStats.Bytes)
+
+	// Iterating over both keys touches all three nodes.
+	var iterStats RequestStats
+	_, err = serverTree.SyncIterate(WithRequestStats(ctx, &iterStats), &syncer.IterateRequest{
+		Tree:     syncer.TreeID{Root: root, Position: root.Hash},
+		Key:      []byte("foo"),
+		Prefetch: 10,
+	})
+	require.NoError(t, err, "SyncIterate")
+	require.EqualValues(t, 1, iterStats.Cache.Misses, "only the second leaf should be loaded")
+	require.Greater(t, iterStats.Bytes, stats.Bytes)
+}
 
-	// Create a derived root in version 2.
-	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_2})
-	err = tree.Insert(ctx, []byte("foo"), []byte("boo"))
-	require.NoError(t, err, "Insert")
-	_, rootHashR2_2, err := tree.Commit(ctx, testNs, 2)
-	require.NoError(t, err, "Commit")
+type testNodeSink struct {
+	nodes map[hash.Hash]node.Node
 
-	// Create another derived root in version 2.
-	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashR1_10})
-	err = tree.Insert(ctx, []byte("foo2"), []byte("boo"))
-	require.NoError(t, err, "Insert")
-	_, rootHashR2_3, err := tree.Commit(ctx, testNs, 2)
-	require.NoError(t, err, "Commit")
+	onPut func() error
+}
 
-	// Finalize version 2.
-	finalRoots = nil
-	for _, hash := range []hash.Hash{rootHashR2_1, rootHashR2_2, rootHashR2_3} {
-		finalRoots = append(finalRoots, node.Root{
-			Namespace: testNs,
-			Version:   2,
-			Type:      node.RootTypeState,
-			Hash:      hash,
-		})
+func (s *testNodeSink) PutNode(_ context.Context, nd node.Node) error {
+	if s.onPut != nil {
+		if err := s.onPut(); err != nil {
+			return err
+		}
 	}
-	err = ndb.Finalize(finalRoots)
-	require.NoError(t, err, "Finalize")
-
-	// Prune versions 0 and 1, all of the lone root's node should have been removed.
-	err = ndb.Prune(0)
-	require.NoError(t, err, "Prune")
-	err = ndb.Prune(1)
-	require.NoError(t, err, "Prune")
-
-	// Reopen database to force compaction.
-	ndb.Close()
-	ndb, err = factory(testNs)
-	require.NoError(t, err, "ndb.New")
-	defer ndb.Close()
+	s.nodes[nd.GetHash()] = nd
+	return nil
+}
 
-	// Check that roots in version 0 and 2 are still there.
-	for _, root := range []struct {
-		Version uint64
-		Hash    hash.Hash
-		Keys    []string
-	}{
-		{2, rootHashR2_1, []string{"blah"}},
-		{2, rootHashR2_2, []string{"goo", "different2", "foo"}},
-		{2, rootHashR2_3, []string{"yet2", "first2", "second2", "third2", "foo2"}},
-	} {
-		tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: root.Version, Type: node.RootTypeState, Hash: root.Hash})
+func testPushMissing(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+	keys, values := generateKeyValuePairsEx("", 50)
+
+	// collectNodes returns the hashes of all nodes of the given tree's root.
+	collectNodes := func(tr Tree) map[hash.Hash]struct{} {
+		nodes := make(map[hash.Hash]struct{})
+		rt := tr.(*tree)
+		err := rt.doWalk(ctx, rt.cache.pendingRoot, 0, node.Key{}, func(_ *node.Pointer, nd node.Node, _ node.Depth, _ node.Key) (bool, error) {
+			nodes[nd.GetHash()] = struct{}{}
+			return true, nil
+		})
+		require.NoError(t, err, "doWalk")
+		return nodes
+	}
 
-		for _, key := range root.Keys {
-			value, err := tree.Get(ctx, []byte(key))
-			require.NoError(t, err, "Get(%d, %s)", root.Version, key)
-			require.NotNil(t, value, "value should exist (%d, %s)", root.Version, key)
+	// The target holds an older version of the source tree.
+	target := New(nil, nil, node.RootTypeState)
+	defer target.Close()
+	for i, key := range keys[:40] {
+		err := target.Insert(ctx, key, values[i])
+		require.NoError(t, err, "Insert")
+	}
+	_, _, err := target.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+	targetNodes := collectNodes(target)
+
+	source := New(nil, ndb, node.RootTypeState)
+	defer source.Close()
+	for i, key := range keys {
+		err = source.Insert(ctx, key, values[i])
+		require.NoError(t, err, "Insert")
+	}
+	_, rootHash, err := source.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+	root := node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHash}
+	sourceNodes := collectNodes(source)
+
+	sink := &testNodeSink{nodes: make(map[hash.Hash]node.Node)}
+	var queried int
+	pushed, err := source.PushMissing(ctx, root, sink, func(h hash.Hash) bool {
+		queried++
+		_, ok := targetNodes[h]
+		return ok
+	})
+	require.NoError(t, err, "PushMissing")
+	require.Equal(t, len(sink.nodes), pushed)
+	require.Less(t, queried, len(sourceNodes), "subtrees the target has should be skipped")
+
+	// Exactly the nodes missing on the target should be pushed.
+	var missing int
+	for h := range sourceNodes {
+		_, onTarget := targetNodes[h]
+		_, wasPushed := sink.nodes[h]
+		require.NotEqual(t, onTarget, wasPushed, "node %s should be pushed iff it is missing on the target", h)
+		if !onTarget {
+			missing++
 		}
 	}
+	require.Equal(t, missing, pushed)
+
+	// Nothing should be pushed to a target which has the whole tree.
+	pushed, err = source.PushMissing(ctx, root, sink, func(hash.Hash) bool { return true })
+	require.NoError(t, err, "PushMissing")
+	require.Zero(t, pushed)
+
+	// All nodes should be pushed to an empty target.
+	pushed, err = source.PushMissing(ctx, root, sink, func(hash.Hash) bool { return false })
+	require.NoError(t, err, "PushMissing")
+	require.Equal(t, len(sourceNodes), pushed)
+
+	// Skipped subtrees should not be loaded at all.
+	fresh := NewWithRoot(nil, ndb, root)
+	defer fresh.Close()
+	pushed, err = fresh.PushMissing(ctx, root, sink, func(hash.Hash) bool { return true })
+	require.NoError(t, err, "PushMissing")
+	require.Zero(t, pushed)
+	require.Zero(t, fresh.CacheStats().Misses, "skipped subtrees should not be loaded")
+
+	// The target should be able to use the tree while nodes are pushed.
+	sink = &testNodeSink{
+		nodes: make(map[hash.Hash]node.Node),
+		onPut: func() error {
+			_, gErr := fresh.Get(ctx, keys[0])
+			return gErr
+		},
+	}
+	pushed, err = fresh.PushMissing(ctx, root, sink, func(hash.Hash) bool { return false })
+	require.NoError(t, err, "PushMissing")
+	require.Equal(t, len(sourceNodes), pushed)
+	require.Len(t, sink.nodes, len(sourceNodes))
 }
 
-func testPruneLatest(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+func testGetLeafWithSiblings(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	ctx := context.Background()
-	tree := New(nil, ndb, node.RootTypeState)
 
-	// Create and finalize a root in version 0.
-	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
-	require.NoError(t, err, "Insert")
+	// Keys like "key 1" are prefixes of other keys and are stored in internal nodes' leaf nodes.
+	keys, values := generateKeyValuePairsEx("", 50)
+
+	tree := New(nil, ndb, node.RootTypeState)
+	defer tree.Close()
+	for i := 0; i < len(keys); i++ {
+		err := tree.Insert(ctx, keys[i], values[i])
+		require.NoError(t, err, "Insert")
+	}
 	_, rootHash, err := tree.Commit(ctx, testNs, 0)
 	require.NoError(t, err, "Commit")
+	root := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash}
 
-	root := node.Root{
-		Namespace: testNs,
-		Version:   0,
-		Type:      node.RootTypeState,
-		Hash:      rootHash,
+	// The kit for every key should recompute the actual root.
+	for i := range keys {
+		kit, kerr := tree.GetLeafWithSiblings(ctx, root, node.Key(keys[i]))
+		require.NoError(t, kerr, "GetLeafWithSiblings(%s)", keys[i])
+		require.NotNil(t, kit, "GetLeafWithSiblings(%s)", keys[i])
+		require.EqualValues(t, values[i], kit.Leaf.Value)
+		require.Equal(t, rootHash, kit.ComputeRootHash(values[i]), "kit for %s should recompute the root", keys[i])
 	}
-	err = ndb.Finalize([]node.Root{root})
-	require.NoError(t, err, "Finalize")
 
-	// Attempt to prune the only finalized version.
-	err = ndb.Prune(0)
-	require.Error(t, err, "Prune should fail for the only finalized version")
+	// Missing keys have no kit.
+	kit, err := tree.GetLeafWithSiblings(ctx, root, node.Key("missing"))
+	require.NoError(t, err, "GetLeafWithSiblings")
+	require.Nil(t, kit)
+
+	// After a local change, the kit should recompute the new root.
+	kit, err = tree.GetLeafWithSiblings(ctx, root, node.Key(keys[7]))
+	require.NoError(t, err, "GetLeafWithSiblings")
+	err = tree.Insert(ctx, keys[7], []byte("updated"))
+	require.NoError(t, err, "Insert")
+	_, newRootHash, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+	require.Equal(t, newRootHash, kit.ComputeRootHash([]byte("updated")))
 }
 
-func testErrors(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+func testVerifyLeafProof(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	ctx := context.Background()
 
-	// Commit root for version 0.
+	keys, values := generateKeyValuePairsEx("", 50)
+
 	tree := New(nil, ndb, node.RootTypeState)
-	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
-	require.NoError(t, err, "Insert")
-	_, rootHashR0_1, err := tree.Commit(ctx, testNs, 0)
+	defer tree.Close()
+	for i := 0; i < len(keys); i++ {
+		err := tree.Insert(ctx, keys[i], values[i])
+		require.NoError(t, err, "Insert")
+	}
+	_, rootHash, err := tree.Commit(ctx, testNs, 0)
 	require.NoError(t, err, "Commit")
+	root := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash}
 
-	// Commit root for version 1.
-	tree = New(nil, ndb, node.RootTypeState)
-	err = tree.Insert(ctx, []byte("another"), []byte("bar"))
-	require.NoError(t, err, "Insert")
-	_, rootHashR1_1, err := tree.Commit(ctx, testNs, 1)
-	require.NoError(t, err, "Commit")
+	var otherHash hash.Hash
+	otherHash.FromBytes([]byte("other"))
 
-	// Commit root for version 2.
-	tree = New(nil, ndb, node.RootTypeState)
-	err = tree.Insert(ctx, []byte("another2"), []byte("bar"))
+	for i := range keys {
+		key := node.Key(keys[i])
+		kit, kerr := tree.GetLeafWithSiblings(ctx, root, key)
+		require.NoError(t, kerr, "GetLeafWithSiblings(%s)", key)
+		require.NoError(t, kit.Verify(rootHash), "Verify(%s)", key)
+		require.NoError(t, VerifyLeafProof(rootHash, key, values[i], kit.Steps), "VerifyLeafProof(%s)", key)
+
+		// The flat proof and the syncer proof for the same key should yield the same root.
+		rsp, kerr := tree.SyncGet(ctx, &syncer.GetRequest{
+			Tree: syncer.TreeID{Root: root, Position: rootHash},
+			Key:  key,
+		})
+		require.NoError(t, kerr, "SyncGet(%s)", key)
+		proofRootHash, kerr := rsp.Proof.RootHash()
+		require.NoError(t, kerr, "RootHash(%s)", key)
+		require.Equal(t, proofRootHash, kit.ComputeRootHash(values[i]), "flat proof for %s should match syncer proof", key)
+
+		// Wrong values, keys and roots should fail verification.
+		err = VerifyLeafProof(rootHash, key, []byte("wrong value"), kit.Steps)
+		require.ErrorIs(t, err, ErrInvalidLeafProof, "VerifyLeafProof(%s) with wrong value", key)
+		err = VerifyLeafProof(otherHash, key, values[i], kit.Steps)
+		require.ErrorIs(t, err, ErrInvalidLeafProof, "VerifyLeafProof(%s) with wrong root", key)
+		otherKey := node.Key(keys[(i+1)%len(keys)])
+		err = VerifyLeafProof(rootHash, otherKey, values[i], kit.Steps)
+		require.ErrorIs(t, err, ErrInvalidLeafProof, "VerifyLeafProof(%s) with wrong key", key)
+
+		// Tampered steps should fail verification.
+		for j := range kit.Steps {
+			steps := append([]LeafProofStep{}, kit.Steps...)
+			steps[j].ChildHashes = [3]hash.Hash{otherHash, otherHash, otherHash}
+			err = VerifyLeafProof(rootHash, key, values[i], steps)
+			require.ErrorIs(t, err, ErrInvalidLeafProof, "VerifyLeafProof(%s) with tampered sibling", key)
+
+			steps = append([]LeafProofStep{}, kit.Steps...)
+			steps[j].Position = (steps[j].Position + 1) % 3
+			err = VerifyLeafProof(rootHash, key, values[i], steps)
+			require.ErrorIs(t, err, ErrInvalidLeafProof, "VerifyLeafProof(%s) with tampered position", key)
+		}
+		if len(kit.Steps) > 0 {
+			err = VerifyLeafProof(rootHash, key, values[i], kit.Steps[1:])
+			require.ErrorIs(t, err, ErrInvalidLeafProof, "VerifyLeafProof(%s) with missing step", key)
+		}
+	}
+
+	// A tree with a single leaf has a proof without any steps.
+	single := New(nil, nil, node.RootTypeState)
+	defer single.Close()
+	err = single.Insert(ctx, keys[0], values[0])
 	require.NoError(t, err, "Insert")
-	_, rootHashR2_1, err := tree.Commit(ctx, testNs, 2)
+	_, singleRootHash, err := single.Commit(ctx, testNs, 0)
 	require.NoError(t, err, "Commit")
+	singleRoot := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: singleRootHash}
+	kit, err := single.GetLeafWithSiblings(ctx, singleRoot, node.Key(keys[0]))
+	require.NoError(t, err, "GetLeafWithSiblings")
+	require.Empty(t, kit.Steps)
+	require.NoError(t, kit.Verify(singleRootHash), "Verify")
+}
 
-	// Commit for non-following version should fail.
-	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 2, Type: node.RootTypeState, Hash: rootHashR2_1})
-	err = tree.Insert(ctx, []byte("moo"), []byte("moo"))
-	require.NoError(t, err, "Insert")
-	_, _, err = tree.Commit(ctx, testNs, 100)
-	require.Error(t, err, "Commit should fail for non-following version")
-	require.Equal(t, db.ErrRootMustFollowOld, err)
+func testSnapshot(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
 
-	// Commit with mismatched old root should fail.
-	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 99, Type: node.RootTypeState, Hash: rootHashR1_1})
-	_ = tree.Insert(ctx, []byte("moo"), []byte("moo"))
-	_, _, err = tree.Commit(ctx, testNs, 100)
-	require.Error(t, err, "Commit should fail for mismatched version")
-	require.Equal(t, db.ErrRootNotFound, err)
+	keys, values, root0, tree := generateRandomTree(t, ndb, randomTreeParams(100))
+	tree.Close()
+	err := ndb.Finalize([]node.Root{root0})
+	require.NoError(t, err, "Finalize")
 
-	// Commit with non-existent old root should fail.
-	bogusRoot := hash.NewFromBytes([]byte("bogus root"))
-	tree = NewWithRoot(nil, ndb, node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: bogusRoot})
-	_, _, err = tree.Commit(ctx, testNs, 1)
-	require.Error(t, err, "Commit should fail for invalid root")
-	require.Equal(t, db.ErrRootNotFound, err)
+	// Use a small cache to make sure the snapshot does not depend on the tree's cache.
+	tree = NewWithRoot(nil, ndb, root0, Capacity(10, 0))
+	defer tree.Close()
+	snapshot, err := tree.Snapshot(ctx, root0)
+	require.NoError(t, err, "Snapshot")
+	require.EqualValues(t, root0, snapshot.Root())
 
-	// Finalizing a version twice should fail.
-	err = ndb.Finalize([]node.Root{{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashR0_1}})
+	// Commit new roots that remove and update keys, then prune the snapshot root.
+	for i := 0; i < len(keys); i++ {
+		if i%2 == 0 {
+			err = tree.Remove(ctx, keys[i])
+			require.NoError(t, err, "Remove")
+		} else {
+			err = tree.Insert(ctx, keys[i], []byte("updated"))
+			require.NoError(t, err, "Insert")
+		}
+	}
+	_, rootHash1, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+	root1 := node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHash1}
+	err = ndb.Finalize([]node.Root{root1})
 	require.NoError(t, err, "Finalize")
-	err = ndb.Finalize([]node.Root{{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashR0_1}})
-	require.Error(t, err, "Finalize should fail as version is already finalized")
-	require.Equal(t, db.ErrAlreadyFinalized, err)
+	err = ndb.Prune(0)
+	require.NoError(t, err, "Prune")
 
-	// Finalize of version 2 should fail as version 1 is not finalized.
-	err = ndb.Finalize([]node.Root{{Namespace: testNs, Version: 2, Type: node.RootTypeState, Hash: rootHashR2_1}})
-	require.Error(t, err, "Finalize should fail as previous version not finalized")
-	require.Equal(t, db.ErrNotFinalized, err)
+	// The snapshot must still see the original state.
+	for i := 0; i < len(keys); i++ {
+		value, gerr := snapshot.Get(ctx, keys[i])
+		require.NoError(t, gerr, "Get")
+		require.EqualValues(t, values[i], value, "snapshot should see original value")
+	}
+	it := snapshot.NewIterator(ctx)
+	var count int
+	for it.Rewind(); it.Valid(); it.Next() {
+		count++
+	}
+	require.NoError(t, it.Err(), "iterator")
+	it.Close()
+	require.Equal(t, len(keys), count, "snapshot iterator should see all original keys")
 
-	// Commit into an already finalized version should fail.
-	tree = New(nil, ndb, node.RootTypeState)
-	err = tree.Insert(ctx, []byte("already finalized"), []byte("woohoo"))
+	// The tree itself sees the new state.
+	value, err := tree.Get(ctx, keys[1])
+	require.NoError(t, err, "Get")
+	require.EqualValues(t, []byte("updated"), value)
+
+	snapshot.Release()
+	_, err = snapshot.Get(ctx, keys[0])
+	require.ErrorIs(t, err, ErrClosed, "Get should fail after Release")
+
+	// Snapshots can only be taken at the current clean root.
+	_, err = tree.Snapshot(ctx, root0)
+	require.ErrorIs(t, err, syncer.ErrInvalidRoot)
+	err = tree.Insert(ctx, []byte("dirty"), []byte("value"))
 	require.NoError(t, err, "Insert")
-	_, _, err = tree.Commit(ctx, testNs, 0)
-	require.Error(t, err, "Commit should fail for already finalized version")
-	require.Equal(t, db.ErrAlreadyFinalized, err)
+	_, err = tree.Snapshot(ctx, root1)
+	require.ErrorIs(t, err, syncer.ErrDirtyRoot)
 
-	// Commit for a different namespace should fail.
-	var badNs common.Namespace
-	_ = badNs.UnmarshalText([]byte("badbadbadbadbadbadbadbadbadbadbadbadbadbadbadbadbadbadbadbadbadb"))
+	// Snapshots larger than the snapshot capacity should be rejected.
+	for _, capacity := range []Option{SnapshotCapacity(10, 0), SnapshotCapacity(0, 64)} {
+		tree = NewWithRoot(nil, ndb, root1, capacity)
+		defer tree.Close()
+		_, err = tree.Snapshot(ctx, root1)
+		require.ErrorIs(t, err, ErrSnapshotTooLarge, "Snapshot should fail when exceeding the capacity")
+	}
+	tree = NewWithRoot(nil, ndb, root1, SnapshotCapacity(0, 0))
+	defer tree.Close()
+	snapshot, err = tree.Snapshot(ctx, root1)
+	require.NoError(t, err, "Snapshot should succeed with unlimited capacity")
+	snapshot.Release()
+
+	// Snapshots of trees without a node database should use the nodes held in memory and keep
+	// the tree configuration.
+	mem := New(nil, nil, node.RootTypeState, WithFixedKeyWidth(len(keys[0])))
+	defer mem.Close()
+	err = mem.Insert(ctx, keys[0], values[0])
+	require.NoError(t, err, "Insert")
+	_, memRootHash, err := mem.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+	memRoot := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: memRootHash}
+	snapshot, err = mem.Snapshot(ctx, memRoot)
+	require.NoError(t, err, "Snapshot")
+	defer snapshot.Release()
+	err = mem.Insert(ctx, keys[0], []byte("updated"))
+	require.NoError(t, err, "Insert")
+	value, err = snapshot.Get(ctx, keys[0])
+	require.NoError(t, err, "Get")
+	require.EqualValues(t, values[0], value, "snapshot should not see later updates")
+	_, err = snapshot.Get(ctx, append([]byte{0}, keys[0]...))
+	require.ErrorIs(t, err, ErrKeyWidthMismatch, "snapshot should keep the fixed key width")
+}
 
-	tree = New(nil, ndb, node.RootTypeState)
-	err = tree.Insert(ctx, []byte("bad namespace"), []byte("woohoo"))
+func testUniqueFootprint(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+
+	keys, values, root1, tree := generateRandomTree(t, ndb, randomTreeParams(50))
+	defer tree.Close()
+
+	// Without other roots, all nodes are unique.
+	info, err := tree.RootInfo(ctx, root1)
+	require.NoError(t, err, "RootInfo")
+	size, nodes, err := tree.UniqueFootprint(ctx, root1, nil)
+	require.NoError(t, err, "UniqueFootprint")
+	require.EqualValues(t, info.NodeCount, nodes, "all nodes should be unique")
+	require.Greater(t, size, int64(0))
+
+	// A root compared against itself has no unique nodes.
+	size, nodes, err = tree.UniqueFootprint(ctx, root1, []node.Root{root1})
+	require.NoError(t, err, "UniqueFootprint")
+	require.Zero(t, size)
+	require.Zero(t, nodes)
+
+	// Update a single key, sharing most of the structure with the previous root.
+	err = tree.Insert(ctx, keys[0], []byte("updated"))
 	require.NoError(t, err, "Insert")
-	_, _, err = tree.Commit(ctx, badNs, 0)
-	require.Error(t, err, "Commit should fail for bad namespace")
-	require.Equal(t, db.ErrBadNamespace, err)
+	_, rootHash2, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+	root2 := node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHash2}
+
+	depth, exists, err := tree.KeyDepth(ctx, root2, keys[0])
+	require.NoError(t, err, "KeyDepth")
+	require.True(t, exists)
+
+	size, nodes, err = tree.UniqueFootprint(ctx, root2, []node.Root{root1})
+	require.NoError(t, err, "UniqueFootprint")
+	require.Greater(t, size, int64(0))
+	require.Less(t, nodes, int(info.NodeCount), "shared nodes should be excluded")
+	// Only the updated leaf and the internal nodes on the path to it are unique. All internal
+	// nodes except the root have a non-empty label, so there are at most depth+1 of them.
+	require.LessOrEqual(t, nodes, int(depth)+2)
+	updatedNodes := nodes
+
+	// Including the root itself among the other roots leaves nothing unique.
+	size, nodes, err = tree.UniqueFootprint(ctx, root2, []node.Root{root1, root2})
+	require.NoError(t, err, "UniqueFootprint")
+	require.Zero(t, size)
+	require.Zero(t, nodes)
+
+	// Shared nodes should also be detected when values are stored transformed.
+	xor := func(_, value []byte) ([]byte, error) {
+		transformed := make([]byte, len(value))
+		for i := range value {
+			transformed[i] = value[i] ^ 0xaa
+		}
+		return transformed, nil
+	}
+	ttree := New(nil, ndb, node.RootTypeState, WithValueTransform(xor, xor))
+	defer ttree.Close()
+	for i := 0; i < len(keys); i++ {
+		err = ttree.Insert(ctx, keys[i], []byte("transformed "+string(values[i])))
+		require.NoError(t, err, "Insert")
+	}
+	_, rootHash3, err := ttree.Commit(ctx, testNs, 2)
+	require.NoError(t, err, "Commit")
+	root3 := node.Root{Namespace: testNs, Version: 2, Type: node.RootTypeState, Hash: rootHash3}
 
-	// Using the WithoutWriteLog option together with a remote read syncer should panic.
-	require.Panics(t, func() { New(tree, nil, node.RootTypeState, WithoutWriteLog()) })
+	err = ttree.Insert(ctx, keys[0], []byte("updated"))
+	require.NoError(t, err, "Insert")
+	_, rootHash4, err := ttree.Commit(ctx, testNs, 3)
+	require.NoError(t, err, "Commit")
+	root4 := node.Root{Namespace: testNs, Version: 3, Type: node.RootTypeState, Hash: rootHash4}
+
+	// The tree has the same shape as before, so the same nodes should be unique.
+	_, nodes, err = ttree.UniqueFootprint(ctx, root4, []node.Root{root3})
+	require.NoError(t, err, "UniqueFootprint")
+	require.EqualValues(t, updatedNodes, nodes, "shared leaves should be excluded")
+
+	testUniqueFootprintEmbeddedLeaf(t, ndb)
 }
 
-func testIncompatibleDB(t *testing.T, ndb db.NodeDB, factory NodeDBFactory) {
-	// Database has been created with namespace testNs.
-	ndb.Close()
+func testUniqueFootprintEmbeddedLeaf(t *testing.T, ndb db.NodeDB) {
+	ctx := context.Background()
 
-	// Try to open the same database with a different namespace.
-	testNs2 := common.NewTestNamespaceFromSeed([]byte("oasis mkvs test ns 2"), 0)
-	_, err := factory(testNs2)
-	require.Error(t, err, "using a different namespace should fail")
+	// Leaves stored on internal nodes are serialized as part of the internal node and should
+	// not be counted twice.
+	tr := New(nil, ndb, node.RootTypeState).(*tree)
+	defer tr.Close()
+	for _, key := range []string{"foo", "foo/bar"} {
+		err := tr.Insert(ctx, []byte(key), []byte("value"))
+		require.NoError(t, err, "Insert")
+	}
+	_, rootHash, err := tr.Commit(ctx, testNs, 4)
+	require.NoError(t, err, "Commit")
+	root := node.Root{Namespace: testNs, Version: 4, Type: node.RootTypeState, Hash: rootHash}
+
+	rootNode, ok := tr.cache.pendingRoot.Node.(*node.InternalNode)
+	require.True(t, ok, "root should be an internal node")
+	require.NotNil(t, rootNode.LeafNode, "key should be stored on the root internal node")
+	rootData, err := rootNode.MarshalBinary()
+	require.NoError(t, err, "MarshalBinary")
+	leafData, err := rootNode.Left.Node.MarshalBinary()
+	require.NoError(t, err, "MarshalBinary")
+
+	size, nodes, err := tr.UniqueFootprint(ctx, root, nil)
+	require.NoError(t, err, "UniqueFootprint")
+	require.EqualValues(t, 3, nodes)
+	require.EqualValues(t, len(rootData)+len(leafData), size, "embedded leaf should not be counted twice")
 }
 
-func testSpecialCaseFromJSON(t *testing.T, ndb db.NodeDB, fixture string) {
-	data, err := os.ReadFile(filepath.Join("testdata", fixture))
-	require.NoError(t, err, "failed to read the fixture file")
+func testDeepLeafHook(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
 
-	var ops mkvsTests.TestVector
-	err = json.Unmarshal(data, &ops)
-	require.NoError(t, err, "failed to unmarshal fixture")
+	type deepLeaf struct {
+		key      string
+		bitDepth node.Depth
+	}
+	var deepLeaves []deepLeaf
+	tree := New(nil, ndb, node.RootTypeState, WithDeepLeafHook(32, func(key node.Key, bitDepth node.Depth) {
+		deepLeaves = append(deepLeaves, deepLeaf{string(key), bitDepth})
+	}))
+	defer tree.Close()
+
+	// Shallow leaves should not be reported.
+	for _, key := range []string{"a", "b", "prefix 1"} {
+		err := tree.Insert(ctx, []byte(key), []byte("value"))
+		require.NoError(t, err, "Insert")
+	}
+	require.Empty(t, deepLeaves)
+
+	// Keys sharing a long prefix end up deep in the tree.
+	err := tree.ApplyWriteLog(ctx, writelog.NewStaticIterator(writelog.WriteLog{
+		{Key: []byte("prefix 2"), Value: []byte("value")},
+	}))
+	require.NoError(t, err, "ApplyWriteLog")
+	require.Len(t, deepLeaves, 1)
+	require.Equal(t, "prefix 2", deepLeaves[0].key)
+	require.Greater(t, deepLeaves[0].bitDepth, node.Depth(32))
 
+	_, rootHash, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+	root := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash}
+	depth, exists, err := tree.KeyDepth(ctx, root, node.Key("prefix 2"))
+	require.NoError(t, err, "KeyDepth")
+	require.True(t, exists)
+	require.Equal(t, depth, deepLeaves[0].bitDepth, "reported depth should match KeyDepth")
+
+	// Updating an existing leaf should not be reported again.
+	err = tree.Insert(ctx, []byte("prefix 2"), []byte("updated"))
+	require.NoError(t, err, "Insert")
+	require.Len(t, deepLeaves, 1)
+}
+
+func testDivergenceReport(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	ctx := context.Background()
+
+	keys, values := generateKeyValuePairsEx("", 50)
+
 	tree := New(nil, ndb, node.RootTypeState)
+	defer tree.Close()
+	for i := 0; i < len(keys); i++ {
+		err := tree.Insert(ctx, keys[i], values[i])
+		require.NoError(t, err, "Insert")
+	}
+	_, rootHashA, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+	rootA := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashA}
 
-	// Also test all operations against a "remote" tree to test sync operations.
-	var (
-		root       node.Root
-		remoteTree Tree
-		value      []byte
-		version    uint64
-	)
+	// Equal roots result in an empty report.
+	report, err := tree.DivergenceReport(ctx, rootA, rootA, 10)
+	require.NoError(t, err, "DivergenceReport")
+	require.True(t, report.IsEmpty())
+	require.Nil(t, report.FirstDivergence)
 
-	commitRemote := func() {
-		// Commit everything and create a new remote tree at the root.
-		var rootHash hash.Hash
-		_, rootHash, err = tree.Commit(ctx, testNs, version)
-		require.NoError(t, err, "Commit")
+	// Add three keys, remove two and change one.
+	for _, key := range []string{"key 50", "key 51", "key 52"} {
+		err = tree.Insert(ctx, []byte(key), []byte("added"))
+		require.NoError(t, err, "Insert")
+	}
+	for _, i := range []int{3, 4} {
+		err = tree.Remove(ctx, keys[i])
+		require.NoError(t, err, "Remove")
+	}
+	err = tree.Insert(ctx, keys[7], []byte("changed"))
+	require.NoError(t, err, "Insert")
+	_, rootHashB, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+	rootB := node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashB}
+
+	report, err = tree.DivergenceReport(ctx, rootA, rootB, 2)
+	require.NoError(t, err, "DivergenceReport")
+	require.False(t, report.IsEmpty())
+	require.Equal(t, 3, report.Added)
+	require.Equal(t, 2, report.Removed)
+	require.Equal(t, 1, report.Changed)
+	require.EqualValues(t, []node.Key{node.Key("key 50"), node.Key("key 51")}, report.AddedSample)
+	require.EqualValues(t, []node.Key{node.Key(keys[3]), node.Key(keys[4])}, report.RemovedSample)
+	require.EqualValues(t, []node.Key{node.Key(keys[7])}, report.ChangedSample)
+
+	// All differing keys share the "key " prefix.
+	require.NotNil(t, report.FirstDivergence)
+	require.GreaterOrEqual(t, report.FirstDivergence.BitDepth, node.Depth(32))
+	require.True(t, bytes.HasPrefix(report.FirstDivergence.Path, []byte("key ")))
+
+	// Swapping the roots swaps additions and removals.
+	report, err = tree.DivergenceReport(ctx, rootB, rootA, 10)
+	require.NoError(t, err, "DivergenceReport")
+	require.Equal(t, 2, report.Added)
+	require.Equal(t, 3, report.Removed)
+	require.Equal(t, 1, report.Changed)
+}
 
-		root = node.Root{Namespace: testNs, Type: node.RootTypeState, Hash: rootHash, Version: version}
-		tree = NewWithRoot(nil, ndb, root)
-		remoteTree = NewWithRoot(tree, nil, root, Capacity(0, 0))
+func testNodeCountDelta(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
 
-		version++
+	countNodes := func(tr Tree, root node.Root) int {
+		var count int
+		rt := tr.(*tree)
+		rt.cache.Lock()
+		defer rt.cache.Unlock()
+		err := rt.walkRoot(ctx, root, func(*node.Pointer, node.Node, node.Depth, node.Key) (bool, error) {
+			count++
+			return true, nil
+		})
+		require.NoError(t, err, "walkRoot")
+		return count
 	}
 
-	for _, o := range ops {
-		switch o.Op {
-		case mkvsTests.OpInsert:
-			if remoteTree != nil {
-				err = remoteTree.Insert(ctx, o.Key, o.Value)
-				require.NoError(t, err, "Insert")
-			}
+	keys, values := generateKeyValuePairsEx("", 100)
+
+	tree := New(nil, ndb, node.RootTypeState)
+	defer tree.Close()
+	for i := 0; i < len(keys); i++ {
+		err := tree.Insert(ctx, keys[i], values[i])
+		require.NoError(t, err, "Insert")
+	}
+	_, rootHashA, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+	rootA := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHashA}
+
+	delta, err := tree.NodeCountDelta(ctx, rootA, rootA)
+	require.NoError(t, err, "NodeCountDelta")
+	require.Zero(t, delta, "equal roots should have no delta")
+
+	// Apply a known batch adding, removing and changing keys.
+	for i := 0; i < 20; i++ {
+		err = tree.Insert(ctx, []byte(fmt.Sprintf("added key %d", i)), []byte("added"))
+		require.NoError(t, err, "Insert")
+	}
+	for i := 0; i < 10; i++ {
+		err = tree.Remove(ctx, keys[i*3])
+		require.NoError(t, err, "Remove")
+	}
+	err = tree.Insert(ctx, keys[50], []byte("changed"))
+	require.NoError(t, err, "Insert")
+	_, rootHashB, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+	rootB := node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHashB}
+
+	countA, countB := countNodes(tree, rootA), countNodes(tree, rootB)
+	require.NotEqual(t, countA, countB)
+
+	delta, err = tree.NodeCountDelta(ctx, rootA, rootB)
+	require.NoError(t, err, "NodeCountDelta")
+	require.Equal(t, countB-countA, delta, "delta should match the actual node count change")
+
+	delta, err = tree.NodeCountDelta(ctx, rootB, rootA)
+	require.NoError(t, err, "NodeCountDelta")
+	require.Equal(t, countA-countB, delta, "swapping the roots should negate the delta")
+
+	// Removing all keys results in an empty root.
+	for i := 0; i < len(keys); i++ {
+		err = tree.Remove(ctx, keys[i])
+		require.NoError(t, err, "Remove")
+	}
+	for i := 0; i < 20; i++ {
+		err = tree.Remove(ctx, []byte(fmt.Sprintf("added key %d", i)))
+		require.NoError(t, err, "Remove")
+	}
+	_, rootHashC, err := tree.Commit(ctx, testNs, 2)
+	require.NoError(t, err, "Commit")
+	rootC := node.Root{Namespace: testNs, Version: 2, Type: node.RootTypeState, Hash: rootHashC}
 
-			err = tree.Insert(ctx, o.Key, o.Value)
-			require.NoError(t, err, "Insert")
+	delta, err = tree.NodeCountDelta(ctx, rootB, rootC)
+	require.NoError(t, err, "NodeCountDelta")
+	require.Equal(t, -countB, delta)
 
-			commitRemote()
-		case mkvsTests.OpRemove:
-			if remoteTree != nil {
-				err = remoteTree.Remove(ctx, o.Key)
-				require.NoError(t, err, "Remove")
-				value, err = remoteTree.Get(ctx, o.Key)
-				require.NoError(t, err, "Get (after Remove)")
-				require.Nil(t, value, "Get (after Remove) should return nil")
-			}
+	_, err = tree.NodeCountDelta(ctx, rootA, node.Root{Namespace: testNs, Type: node.RootTypeIO, Hash: rootHashB})
+	require.ErrorIs(t, err, syncer.ErrInvalidRoot)
+}
 
-			err = tree.Remove(ctx, o.Key)
-			require.NoError(t, err, "Remove")
-			value, err = tree.Get(ctx, o.Key)
-			require.NoError(t, err, "Get (after Remove)")
-			require.Nil(t, value, "Get (after Remove) should return nil")
+func testFixedKeyWidth(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
 
-			commitRemote()
-		case mkvsTests.OpGet:
-			if remoteTree != nil {
-				value, err = remoteTree.Get(ctx, o.Key)
-				require.NoError(t, err, "Get")
-				require.EqualValues(t, o.Value, value, "Get should return the correct value")
-			}
+	tree := New(nil, ndb, node.RootTypeState, WithFixedKeyWidth(32))
+	defer tree.Close()
 
-			value, err = tree.Get(ctx, o.Key)
-			require.NoError(t, err, "Get")
-			require.EqualValues(t, o.Value, value, "Get should return the correct value")
-		case mkvsTests.OpIteratorSeek:
-			if remoteTree != nil {
-				it := remoteTree.NewIterator(ctx)
-				it.Seek(o.Key)
-				require.NoError(t, it.Err(), "Seek")
-				require.EqualValues(t, o.ExpectedKey, it.Key(), "iterator should be at correct key")
-				require.EqualValues(t, o.Value, it.Value(), "iterator should be at correct value")
-				it.Close()
-			}
+	key := hash.NewFromBytes([]byte("key"))
+	err := tree.Insert(ctx, key[:], []byte("value"))
+	require.NoError(t, err, "Insert")
+	value, err := tree.Get(ctx, key[:])
+	require.NoError(t, err, "Get")
+	require.EqualValues(t, []byte("value"), value)
 
-			it := tree.NewIterator(ctx)
-			it.Seek(o.Key)
-			require.NoError(t, it.Err(), "Seek")
-			require.EqualValues(t, o.ExpectedKey, it.Key(), "iterator should be at correct key")
-			require.EqualValues(t, o.Value, it.Value(), "iterator should be at correct value")
-			it.Close()
-		default:
-			require.Fail(t, "unknown operation: %s", o.Op)
-		}
+	// Keys of any other width should be rejected.
+	for _, badKey := range [][]byte{
+		{},
+		key[:31],
+		append(key[:], 0x00),
+	} {
+		err = tree.Insert(ctx, badKey, []byte("value"))
+		require.ErrorIs(t, err, ErrKeyWidthMismatch, "Insert with %d byte key", len(badKey))
+		_, err = tree.Get(ctx, badKey)
+		require.ErrorIs(t, err, ErrKeyWidthMismatch, "Get with %d byte key", len(badKey))
+		err = tree.Remove(ctx, badKey)
+		require.ErrorIs(t, err, ErrKeyWidthMismatch, "Remove with %d byte key", len(badKey))
 	}
 
-	// Ensure overall tree consistency.
-	tree = NewWithRoot(nil, ndb, root)
-	it := tree.NewIterator(ctx)
-	defer it.Close()
+	err = tree.ApplyWriteLog(ctx, writelog.NewStaticIterator(writelog.WriteLog{
+		{Key: []byte("short"), Value: []byte("value")},
+	}))
+	require.ErrorIs(t, err, ErrKeyWidthMismatch, "ApplyWriteLog with short key")
 
-	for it.Rewind(); it.Valid(); it.Next() { //nolint:revive
-		// Just iterate over the whole tree. If the tree is not consistent
-		// this iteration will throw an error that a node is missing.
-	}
-	require.NoError(t, it.Err())
+	err = tree.Remove(ctx, key[:])
+	require.NoError(t, err, "Remove")
+	value, err = tree.Get(ctx, key[:])
+	require.NoError(t, err, "Get")
+	require.Nil(t, value)
 }
 
-func testSpecialCase1(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
-	testSpecialCaseFromJSON(t, ndb, "case-1.json")
-}
+func testChangedSubtrees(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
 
-func testSpecialCase2(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
-	testSpecialCaseFromJSON(t, ndb, "case-2.json")
-}
+	keys, values := generateKeyValuePairsEx("", 50)
 
-func testSpecialCase3(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
-	testSpecialCaseFromJSON(t, ndb, "case-3.json")
-}
+	tree := New(nil, ndb, node.RootTypeState)
+	defer tree.Close()
+	for i := 0; i < len(keys); i++ {
+		err := tree.Insert(ctx, keys[i], values[i])
+		require.NoError(t, err, "Insert")
+	}
+	_, rootHash1, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+	root1 := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash1}
 
-func testSpecialCase4(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
-	testSpecialCaseFromJSON(t, ndb, "case-4.json")
-}
+	// All keys share the "key " prefix, so pick a depth below it.
+	const depth = 36
 
-func testSpecialCase5(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
-	testSpecialCaseFromJSON(t, ndb, "case-5.json")
-}
+	// Identical roots have no changed subtrees.
+	changed, err := tree.ChangedSubtrees(ctx, root1, root1, depth)
+	require.NoError(t, err, "ChangedSubtrees")
+	require.Empty(t, changed)
 
-func testSpecialCase6(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
-	testSpecialCaseFromJSON(t, ndb, "case-6.json")
+	// Update a single key.
+	err = tree.Insert(ctx, keys[7], []byte("updated"))
+	require.NoError(t, err, "Insert")
+	_, rootHash2, err := tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+	root2 := node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHash2}
+
+	// Only the subtree enclosing the updated key should be reported.
+	changed, err = tree.ChangedSubtrees(ctx, root1, root2, depth)
+	require.NoError(t, err, "ChangedSubtrees")
+	require.Len(t, changed, 1)
+	require.GreaterOrEqual(t, changed[0].BitDepth, node.Depth(depth))
+	key := node.Key(keys[7])
+	require.EqualValues(t, changed[0].BitDepth, key.CommonPrefixLen(key.BitLength(), changed[0].Path, changed[0].BitDepth),
+		"changed subtree should enclose the updated key")
+
+	// The result does not depend on the order of the roots.
+	reverse, err := tree.ChangedSubtrees(ctx, root2, root1, depth)
+	require.NoError(t, err, "ChangedSubtrees")
+	require.Equal(t, changed, reverse)
+
+	// Roots of different types cannot be compared.
+	ioRoot := root1
+	ioRoot.Type = node.RootTypeIO
+	_, err = tree.ChangedSubtrees(ctx, ioRoot, root2, depth)
+	require.ErrorIs(t, err, syncer.ErrInvalidRoot)
 }
 
-func testLargeUpdates(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+func testEmptyValue(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
 	ctx := context.Background()
+
 	tree := New(nil, ndb, node.RootTypeState)
+	err := tree.Insert(ctx, []byte("empty"), []byte{})
+	require.NoError(t, err, "Insert")
+	err = tree.Insert(ctx, []byte("foo"), []byte("bar"))
+	require.NoError(t, err, "Insert")
 
-	// The number of elements is such that it would overflow the maximum number of allowed array
-	// elements in the default (untrusted) CBOR decoder.
-	for i := 0; i < 132_000; i++ {
-		err := tree.Insert(ctx, []byte(fmt.Sprintf("%d", i)), []byte(fmt.Sprintf("%d", i)))
-		require.NoError(t, err, "Insert")
+	value, err := tree.Get(ctx, []byte("empty"))
+	require.NoError(t, err, "Get")
+	require.NotNil(t, value, "zero-length value should not be absent")
+	require.Len(t, value, 0)
+
+	log, rootHash, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+	require.Len(t, log, 2)
+	for _, entry := range log {
+		require.Equal(t, writelog.LogInsert, entry.Type(), "write log entries should be insertions")
 	}
+	root := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash}
+	tree.Close()
 
-	_, rootHash, err := tree.Commit(ctx, testNs, 0)
+	// Zero-length values must survive a round trip through the node database.
+	tree = NewWithRoot(nil, ndb, root)
+	defer tree.Close()
+	value, err = tree.Get(ctx, []byte("empty"))
+	require.NoError(t, err, "Get")
+	require.NotNil(t, value, "zero-length value should not be absent")
+	require.Len(t, value, 0)
+	value, err = tree.Get(ctx, []byte("missing"))
+	require.NoError(t, err, "Get")
+	require.Nil(t, value, "missing key should be absent")
+
+	// Proofs must distinguish zero-length values from absent keys.
+	var verifier syncer.ProofVerifier
+	proof, err := tree.GetMultiproof(ctx, root, [][]byte{[]byte("empty"), []byte("missing")}, 1)
+	require.NoError(t, err, "GetMultiproof")
+	err = verifier.VerifyMultiproof(ctx, rootHash, map[string][]byte{"empty": {}, "missing": nil}, proof)
+	require.NoError(t, err, "VerifyMultiproof")
+	err = verifier.VerifyMultiproof(ctx, rootHash, map[string][]byte{"empty": nil}, proof)
+	require.Error(t, err, "VerifyMultiproof should not treat a zero-length value as absent")
+	err = verifier.VerifyMultiproof(ctx, rootHash, map[string][]byte{"missing": {}}, proof)
+	require.Error(t, err, "VerifyMultiproof should not treat an absent key as a zero-length value")
+
+	// A nil value in a write log removes the key while an empty value stores it.
+	err = tree.ApplyWriteLog(ctx, writelog.NewStaticIterator(writelog.WriteLog{
+		{Key: []byte("empty"), Value: nil},
+		{Key: []byte("foo"), Value: []byte{}},
+	}))
+	require.NoError(t, err, "ApplyWriteLog")
+	value, err = tree.Get(ctx, []byte("empty"))
+	require.NoError(t, err, "Get")
+	require.Nil(t, value, "removed key should be absent")
+	value, err = tree.Get(ctx, []byte("foo"))
+	require.NoError(t, err, "Get")
+	require.NotNil(t, value, "zero-length value should not be absent")
+	require.Len(t, value, 0)
+
+	log, _, err = tree.Commit(ctx, testNs, 1)
 	require.NoError(t, err, "Commit")
-	root := node.Root{
-		Namespace: testNs,
-		Version:   0,
-		Type:      node.RootTypeState,
-		Hash:      rootHash,
+	require.True(t, log.Canonical().Equal(writelog.WriteLog{
+		{Key: []byte("empty"), Value: nil},
+		{Key: []byte("foo"), Value: []byte{}},
+	}), "write log should distinguish removals from zero-length values")
+}
+
+func testEvictionPolicies(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+
+	keys, values, root, tr := generateRandomTree(t, ndb, randomTreeParams(100))
+	tr.Close()
+
+	for _, policy := range []struct {
+		name    string
+		factory EvictionPolicyFactory
+	}{
+		{"LRU", NewLRUPolicy},
+		{"LFU", NewLFUPolicy},
+		{"ARC", NewARCPolicy},
+	} {
+		// Use a small cache to force evictions.
+		tr := NewWithRoot(nil, ndb, root, Capacity(10, 512), WithEvictionPolicy(policy.factory)).(*tree)
+		for round := 0; round < 3; round++ {
+			for i := 0; i < len(keys); i++ {
+				value, err := tr.Get(ctx, keys[i])
+				require.NoError(t, err, "Get (policy %s)", policy.name)
+				require.EqualValues(t, values[i], value, "Get (policy %s)", policy.name)
+			}
+		}
+
+		stats := tr.CacheStats()
+		require.NotZero(t, stats.Hits, "cache should have hits (policy %s)", policy.name)
+		require.NotZero(t, stats.Misses, "cache should have misses (policy %s)", policy.name)
+
+		require.LessOrEqual(t, tr.cache.internalNodeCount, uint64(10), "cache should respect capacity (policy %s)", policy.name)
+		require.LessOrEqual(t, tr.cache.valueSize, uint64(512), "cache should respect capacity (policy %s)", policy.name)
+		tr.Close()
 	}
-	err = ndb.Finalize([]node.Root{root})
-	require.NoError(t, err, "Finalize")
 }
 
 func testBackend(
@@ -2359,7 +4714,10 @@ func testBackend(
 		{"InsertCommitEach", testInsertCommitEach},
 		{"Remove", testRemove},
 		{"ApplyWriteLog", testApplyWriteLog},
+		{"ApplyWriteLogProgress", testApplyWriteLogProgress},
+		{"CanonicalWriteLog", testCanonicalWriteLog},
 		{"SyncerBasic", testSyncerBasic},
+		{"SyncerApplyCached", testSyncerApplyCached},
 		{"SyncerRootEmptyLabelNeedsDeref", testSyncerRootEmptyLabelNeedsDeref},
 		{"SyncerRemove", testSyncerRemove},
 		{"SyncerInsert", testSyncerInsert},
@@ -2369,8 +4727,47 @@ func testBackend(
 		{"NodeEviction", testNodeEviction},
 		{"DoubleInsertWithEviction", testDoubleInsertWithEviction},
 		{"DebugDump", testDebugDumpLocal},
+		{"RenderDOT", testRenderDOT},
+		{"RootInfo", testRootInfo},
+		{"RootInfoSummary", testRootInfoSummary},
+		{"ListRootsUnder", testListRootsUnder},
+		{"ReadAmplification", testReadAmplification},
+		{"Commitment", testCommitment},
+		{"ExportKV", testExportKV},
+		{"GetNodeLeafOnly", testGetNodeLeafOnly},
+		{"GetNodeMaxValueBytes", testGetNodeMaxValueBytes},
+		{"KeyDepth", testKeyDepth},
+		{"LongestPrefixMatch", testLongestPrefixMatch},
+		{"GetValueHistory", testGetValueHistory},
+		{"ExportRegion", testExportRegion},
+		{"PendingRootHash", testPendingRootHash},
+		{"RequestStats", testRequestStats},
+		{"PushMissing", testPushMissing},
+		{"SampleKeys", testSampleKeys},
+		{"GetLeafWithSiblings", testGetLeafWithSiblings},
+		{"VerifyLeafProof", testVerifyLeafProof},
+		{"Snapshot", testSnapshot},
+		{"UniqueFootprint", testUniqueFootprint},
+		{"ChangedSubtrees", testChangedSubtrees},
+		{"FixedKeyWidth", testFixedKeyWidth},
+		{"DivergenceReport", testDivergenceReport},
+		{"NodeCountDelta", testNodeCountDelta},
+		{"VerifySubtreeAgainstLocal", testVerifySubtreeAgainstLocal},
+		{"GetNodes", testGetNodes},
+		{"Verify", testVerify},
+		{"DeepLeafHook", testDeepLeafHook},
+		{"EmptyValue", testEmptyValue},
+		{"EvictionPolicies", testEvictionPolicies},
 		{"OnCommitHooks", testOnCommitHooks},
 		{"CommitNoPersist", testCommitNoPersist},
+		{"Rollback", testRollback},
+		{"CommitPrefix", testCommitPrefix},
+		{"RandomTreeShapes", testRandomTreeShapes},
+		{"SideTreeOptions", testSideTreeOptions},
+		{"NodeLoadTimeout", testNodeLoadTimeout},
+		{"HealthCheck", testHealthCheck},
+		{"ApplyIf", testApplyIf},
+		{"ValueTransform", testValueTransform},
 		{"EmptyValueWriteLog", testEmptyValueWriteLog},
 		{"BasicWriteLog", testBasicWriteLog},
 		{"HasRoot", testHasRoot},
@@ -2553,20 +4950,38 @@ func generateLongKeyValuePairs() ([][]byte, [][]byte) {
 	return keys, values
 }
 
-func generatePopulatedTree(t *testing.T, ndb db.NodeDB) ([][]byte, [][]byte, node.Root, Tree) {
+// randomTreeParams returns the parameters of a balanced random tree with the given number of
+// keys.
+func randomTreeParams(keyCount int) mkvstest.TreeParams {
+	return mkvstest.TreeParams{
+		Shape:     mkvstest.ShapeBalanced,
+		Seed:      42,
+		KeyCount:  keyCount,
+		KeySize:   16,
+		ValueSize: 32,
+	}
+}
+
+// generateRandomTree creates a tree with the key-value pairs generated for the given parameters
+// and commits it as version zero. The keys are returned in sorted order.
+func generateRandomTree(t *testing.T, ndb db.NodeDB, p mkvstest.TreeParams, options ...Option) ([][]byte, [][]byte, node.Root, Tree) {
 	ctx := context.Background()
-	tree := New(nil, ndb, node.RootTypeState, Capacity(0, 0))
 
-	keys, values := generateKeyValuePairs()
-	for i := 0; i < len(keys); i++ {
-		err := tree.Insert(ctx, keys[i], values[i])
-		require.NoError(t, err, "Insert")
-	}
+	wl, err := mkvstest.GenerateWriteLog(p)
+	require.NoError(t, err, "GenerateWriteLog")
 
+	tree := New(nil, ndb, node.RootTypeState, options...)
+	err = tree.ApplyWriteLog(ctx, writelog.NewStaticIterator(wl))
+	require.NoError(t, err, "ApplyWriteLog")
 	_, rootHash, err := tree.Commit(ctx, testNs, 0)
 	require.NoError(t, err, "Commit")
-	require.Equal(t, allItemsRoot, rootHash.String())
 
+	keys := make([][]byte, 0, len(wl))
+	values := make([][]byte, 0, len(wl))
+	for _, entry := range wl {
+		keys = append(keys, entry.Key)
+		values = append(values, entry.Value)
+	}
 	root := node.Root{
 		Namespace: testNs,
 		Version:   0,
@@ -2575,3 +4990,466 @@ func generatePopulatedTree(t *testing.T, ndb db.NodeDB) ([][]byte, [][]byte, nod
 	}
 	return keys, values, root, tree
 }
+
+func testRandomTreeShapes(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+
+	maxDepths := make(map[mkvstest.Shape]node.Depth)
+	for _, shape := range []mkvstest.Shape{mkvstest.ShapeBalanced, mkvstest.ShapeSkewed, mkvstest.ShapeWide} {
+		p := randomTreeParams(100)
+		p.Shape = shape
+		p.Seed = int64(shape)
+		keys, values, root, tree := generateRandomTree(t, ndb, p)
+
+		// All generated keys should be readable.
+		for i, key := range keys {
+			value, err := tree.Get(ctx, key)
+			require.NoError(t, err, "Get")
+			require.Equal(t, values[i], value)
+
+			depth, ok, err := tree.KeyDepth(ctx, root, key)
+			require.NoError(t, err, "KeyDepth")
+			require.True(t, ok)
+			if depth > maxDepths[shape] {
+				maxDepths[shape] = depth
+			}
+		}
+
+		var count int
+		it := tree.NewIterator(ctx)
+		for it.Rewind(); it.Valid(); it.Next() {
+			count++
+		}
+		require.NoError(t, it.Err(), "iterator")
+		it.Close()
+		require.Equal(t, p.KeyCount, count, "tree should only contain the generated keys")
+		tree.Close()
+	}
+
+	// The skewed tree should have leaves at about one bit depth per key, while the wide tree
+	// should only have leaves below its long common prefix.
+	require.GreaterOrEqual(t, maxDepths[mkvstest.ShapeSkewed], node.Depth(100-2))
+	require.Greater(t, maxDepths[mkvstest.ShapeSkewed], maxDepths[mkvstest.ShapeBalanced])
+	require.Greater(t, maxDepths[mkvstest.ShapeWide], node.Depth(8*8))
+}
+
+func testGetNodeLeafOnly(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+
+	tree := New(nil, ndb, node.RootTypeState)
+	defer tree.Close()
+
+	err := tree.Insert(ctx, []byte("foo"), []byte("bar"))
+	require.NoError(t, err, "Insert")
+	err = tree.Insert(ctx, []byte("moo"), []byte("goo"))
+	require.NoError(t, err, "Insert")
+	_, rootHash, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+	root := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash}
+
+	rootPtr := &node.Pointer{Clean: true, Hash: rootHash}
+	nd, err := db.GetNode(ndb, root, rootPtr)
+	require.NoError(t, err, "GetNode")
+	internal, ok := nd.(*node.InternalNode)
+	require.True(t, ok, "root should be an internal node")
+
+	// Requesting a leaf should succeed under the option.
+	nd, err = db.GetNode(ndb, root, internal.Left, db.LeafOnly())
+	require.NoError(t, err, "GetNode(LeafOnly)")
+	leaf, ok := nd.(*node.LeafNode)
+	require.True(t, ok, "left child should be a leaf node")
+	require.EqualValues(t, "foo", leaf.Key)
+
+	// Requesting an internal node should fail under the option.
+	_, err = db.GetNode(ndb, root, rootPtr, db.LeafOnly())
+	require.ErrorIs(t, err, syncer.ErrNotALeaf, "GetNode(LeafOnly) on an internal node")
+}
+
+func testGetNodeMaxValueBytes(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+
+	tree := New(nil, ndb, node.RootTypeState)
+	defer tree.Close()
+
+	longValue := []byte("a rather long value that only needs a preview")
+	err := tree.Insert(ctx, []byte("foo"), longValue)
+	require.NoError(t, err, "Insert")
+	err = tree.Insert(ctx, []byte("moo"), []byte("goo"))
+	require.NoError(t, err, "Insert")
+	_, rootHash, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+	root := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash}
+
+	rootPtr := &node.Pointer{Clean: true, Hash: rootHash}
+	nd, err := db.GetNode(ndb, root, rootPtr)
+	require.NoError(t, err, "GetNode")
+	internal := nd.(*node.InternalNode)
+
+	// Long values should be truncated and the node hash invalidated.
+	var preview node.ValuePreview
+	nd, err = db.GetNode(ndb, root, internal.Left, db.MaxValueBytes(8, &preview))
+	require.NoError(t, err, "GetNode(MaxValueBytes)")
+	leaf := nd.(*node.LeafNode)
+	require.EqualValues(t, "foo", leaf.Key)
+	require.Equal(t, longValue[:8], leaf.Value)
+	require.False(t, leaf.IsClean(), "truncated node should be dirty")
+	require.NotEqual(t, internal.Left.Hash, leaf.GetHash(), "truncated node hash should be invalid")
+	require.Equal(t, longValue[:8], preview.Value)
+	require.Equal(t, len(longValue), preview.Length)
+	require.True(t, preview.Truncated)
+
+	// Short values should be returned unchanged.
+	nd, err = db.GetNode(ndb, root, internal.Right, db.MaxValueBytes(8, &preview))
+	require.NoError(t, err, "GetNode(MaxValueBytes)")
+	leaf = nd.(*node.LeafNode)
+	require.EqualValues(t, "goo", leaf.Value)
+	require.True(t, leaf.IsClean())
+	require.Equal(t, internal.Right.Hash, leaf.GetHash())
+	require.EqualValues(t, "goo", preview.Value)
+	require.Equal(t, 3, preview.Length)
+	require.False(t, preview.Truncated)
+
+	// Internal nodes should be returned unchanged.
+	nd, err = db.GetNode(ndb, root, rootPtr, db.MaxValueBytes(0, nil))
+	require.NoError(t, err, "GetNode(MaxValueBytes)")
+	require.Equal(t, rootHash, nd.GetHash())
+
+	// Get should support previews as well.
+	p, err := tree.GetPreview(ctx, []byte("foo"), 8)
+	require.NoError(t, err, "GetPreview")
+	require.Equal(t, longValue[:8], p.Value)
+	require.Equal(t, len(longValue), p.Length)
+	require.True(t, p.Truncated)
+
+	p, err = tree.GetPreview(ctx, []byte("foo"), len(longValue))
+	require.NoError(t, err, "GetPreview")
+	require.Equal(t, longValue, p.Value)
+	require.False(t, p.Truncated)
+
+	p, err = tree.GetPreview(ctx, []byte("missing"), 8)
+	require.NoError(t, err, "GetPreview")
+	require.Nil(t, p, "GetPreview should return nil for missing keys")
+
+	_, err = tree.GetPreview(ctx, []byte("foo"), -1)
+	require.Error(t, err, "GetPreview should fail with a negative maximum size")
+}
+
+func testGetNodes(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+	keys, values, root, tr := generateRandomTree(t, ndb, randomTreeParams(30))
+	local := tr.(*tree)
+	defer local.Close()
+	rootHash := root.Hash
+
+	rootNode := local.cache.pendingRoot.Node.(*node.InternalNode)
+	ids := []SubtreeID{
+		{Path: node.Key{}.Merge(0, rootNode.Label, rootNode.LabelBitLength), BitDepth: rootNode.LabelBitLength},
+		{Path: keys[7], BitDepth: node.Key(keys[7]).BitLength()},
+		{Path: node.Key("missing"), BitDepth: node.Key("missing").BitLength()},
+		{Path: keys[3], BitDepth: 0},
+		{Path: keys[21], BitDepth: node.Key(keys[21]).BitLength()},
+	}
+
+	// Nodes should be fetched both from a local and a remote tree.
+	remote := NewWithRoot(local, nil, root)
+	defer remote.Close()
+	for _, tr := range []Tree{local, remote} {
+		nodes, errs, err := tr.GetNodes(ctx, root, ids)
+		require.NoError(t, err, "GetNodes")
+		require.Len(t, nodes, len(ids))
+		require.Len(t, errs, len(ids))
+
+		require.NoError(t, errs[0])
+		require.Equal(t, rootHash, nodes[0].GetHash(), "root node should be returned")
+		for i, idx := range map[int]int{1: 7, 4: 21} {
+			require.NoError(t, errs[i])
+			leaf, ok := nodes[i].(*node.LeafNode)
+			require.True(t, ok, "leaf node should be returned")
+			require.EqualValues(t, keys[idx], leaf.Key)
+			require.EqualValues(t, values[idx], leaf.Value)
+		}
+
+		// Individual failures should not abort the batch.
+		require.Nil(t, nodes[2])
+		require.ErrorIs(t, errs[2], db.ErrNodeNotFound)
+		require.Nil(t, nodes[3])
+		require.ErrorIs(t, errs[3], ErrInvalidSubtreeID)
+	}
+
+	_, _, err := local.GetNodes(ctx, node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHash}, ids)
+	require.ErrorIs(t, err, syncer.ErrInvalidRoot)
+
+	err = local.Insert(ctx, []byte("dirty"), []byte("value"))
+	require.NoError(t, err, "Insert")
+	_, _, err = local.GetNodes(ctx, root, ids)
+	require.ErrorIs(t, err, syncer.ErrDirtyRoot)
+}
+
+func testVerify(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+	keys, values, root, tree := generateRandomTree(t, ndb, randomTreeParams(30))
+	defer tree.Close()
+
+	// Verify the first half of the tree and persist the progress.
+	progress, err := tree.Verify(ctx, root, nil, len(keys)/2)
+	require.NoError(t, err, "Verify")
+	require.False(t, progress.Complete, "verification should not be complete")
+	require.EqualValues(t, len(keys)/2, progress.VerifiedLeaves)
+	raw := cbor.Marshal(progress)
+
+	// Corrupt the smallest key, which has already been verified. Resuming the verification
+	// should not check it again.
+	leaf := &node.LeafNode{Key: keys[0], Value: values[0]}
+	leaf.UpdateHash()
+	cdb := &corruptNodeDB{NodeDB: ndb, hash: leaf.Hash}
+
+	var resumed VerifyProgress
+	err = cbor.Unmarshal(raw, &resumed)
+	require.NoError(t, err, "Unmarshal")
+	rt := NewWithRoot(nil, cdb, root)
+	defer rt.Close()
+	progress, err = rt.Verify(ctx, root, &resumed, 0)
+	require.NoError(t, err, "Verify")
+	require.True(t, progress.Complete, "verification should be complete")
+	require.EqualValues(t, len(keys), progress.VerifiedLeaves)
+	require.Nil(t, progress.NextKey)
+
+	// Complete progress should be returned as is.
+	again, err := rt.Verify(ctx, root, progress, 0)
+	require.NoError(t, err, "Verify")
+	require.EqualValues(t, progress, again)
+
+	// Verifying from the start should detect the corrupted node.
+	rt = NewWithRoot(nil, cdb, root)
+	defer rt.Close()
+	progress, err = rt.Verify(ctx, root, nil, 0)
+	require.ErrorIs(t, err, ErrNodeHashMismatch, "Verify should detect the corrupted node")
+	require.EqualValues(t, 0, progress.VerifiedLeaves)
+
+	// Verifying in small steps should eventually verify the whole tree.
+	progress = nil
+	var steps int
+	for progress == nil || !progress.Complete {
+		progress, err = tree.Verify(ctx, root, progress, 7)
+		require.NoError(t, err, "Verify")
+		steps++
+	}
+	require.EqualValues(t, len(keys), progress.VerifiedLeaves)
+	require.Equal(t, 5, steps, "verification should take the expected number of steps")
+
+	// Progress is bound to its root.
+	progress, err = tree.Verify(ctx, root, nil, 1)
+	require.NoError(t, err, "Verify")
+	otherRoot := root
+	otherRoot.Version = 1
+	otherProgress := *progress
+	otherProgress.Root = otherRoot
+	_, err = tree.Verify(ctx, root, &otherProgress, 0)
+	require.ErrorIs(t, err, syncer.ErrInvalidRoot)
+	_, err = tree.Verify(ctx, otherRoot, nil, 0)
+	require.ErrorIs(t, err, syncer.ErrInvalidRoot)
+
+	err = tree.Insert(ctx, []byte("dirty"), []byte("value"))
+	require.NoError(t, err, "Insert")
+	_, err = tree.Verify(ctx, root, nil, 0)
+	require.ErrorIs(t, err, syncer.ErrDirtyRoot)
+}
+
+func testVerifySubtreeAgainstLocal(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+	keys, values := generateKeyValuePairsEx("", 30)
+
+	local := New(nil, ndb, node.RootTypeState)
+	defer local.Close()
+	for i, key := range keys {
+		err := local.Insert(ctx, key, values[i])
+		require.NoError(t, err, "Insert")
+	}
+	_, rootHash, err := local.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+	root := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash}
+
+	// buildRemote builds an in-memory copy of the tree with the given values.
+	buildRemote := func(values [][]byte) *node.InternalNode {
+		remote := New(nil, nil, node.RootTypeState).(*tree)
+		for i, key := range keys {
+			err = remote.Insert(ctx, key, values[i])
+			require.NoError(t, err, "Insert")
+		}
+		_, _, err = remote.Commit(ctx, testNs, 0)
+		require.NoError(t, err, "Commit")
+		return remote.cache.pendingRoot.Node.(*node.InternalNode)
+	}
+	// buildProof builds a proof of the subtree rooted at ptr, including all nodes if full is set
+	// and only the subtree root otherwise.
+	var includeAll func(b *syncer.ProofBuilder, ptr *node.Pointer)
+	includeAll = func(b *syncer.ProofBuilder, ptr *node.Pointer) {
+		if ptr == nil {
+			return
+		}
+		b.Include(ptr.Node)
+		if n, ok := ptr.Node.(*node.InternalNode); ok {
+			includeAll(b, n.LeafNode)
+			includeAll(b, n.Left)
+			includeAll(b, n.Right)
+		}
+	}
+	buildProof := func(ptr *node.Pointer, full bool) *syncer.Proof {
+		builder := syncer.NewProofBuilder(rootHash, ptr.Hash)
+		if full {
+			includeAll(builder, ptr)
+		} else {
+			builder.Include(ptr.Node)
+		}
+		proof, perr := builder.Build(ctx)
+		require.NoError(t, perr, "Build")
+		return proof
+	}
+
+	// Identify the left subtree of the root.
+	rootNode := buildRemote(values)
+	rootPath := node.Key{}.Merge(0, rootNode.Label, rootNode.LabelBitLength)
+	leftNode := rootNode.Left.Node.(*node.InternalNode)
+	id := SubtreeID{
+		Path:     rootPath.Merge(rootNode.LabelBitLength, leftNode.Label, leftNode.LabelBitLength),
+		BitDepth: rootNode.LabelBitLength + leftNode.LabelBitLength,
+	}
+
+	// Matching subtrees should verify, both when fully included and when only included by hash.
+	err = local.VerifySubtreeAgainstLocal(ctx, root, id, buildProof(rootNode.Left, true))
+	require.NoError(t, err, "VerifySubtreeAgainstLocal")
+	err = local.VerifySubtreeAgainstLocal(ctx, root, id, buildProof(rootNode.Left, false))
+	require.NoError(t, err, "VerifySubtreeAgainstLocal")
+
+	// The whole tree is a subtree as well.
+	rootID := SubtreeID{Path: rootPath, BitDepth: rootNode.LabelBitLength}
+	rootPtr := &node.Pointer{Clean: true, Hash: rootHash, Node: rootNode}
+	err = local.VerifySubtreeAgainstLocal(ctx, root, rootID, buildProof(rootPtr, true))
+	require.NoError(t, err, "VerifySubtreeAgainstLocal")
+
+	// Single leaf subtrees should verify.
+	leafPtr := rootNode.Left
+	for {
+		n, ok := leafPtr.Node.(*node.InternalNode)
+		if !ok {
+			break
+		}
+		leafPtr = n.Left
+	}
+	leaf := leafPtr.Node.(*node.LeafNode)
+	leafID := SubtreeID{Path: leaf.Key, BitDepth: leaf.Key.BitLength()}
+	err = local.VerifySubtreeAgainstLocal(ctx, root, leafID, buildProof(leafPtr, true))
+	require.NoError(t, err, "VerifySubtreeAgainstLocal")
+
+	// A tampered value should be reported as the first mismatch.
+	tamperedValues := make([][]byte, len(values))
+	copy(tamperedValues, values)
+	for i, key := range keys {
+		if leaf.Key.Equal(key) {
+			tamperedValues[i] = []byte("tampered")
+		}
+	}
+	tamperedRoot := buildRemote(tamperedValues)
+	err = local.VerifySubtreeAgainstLocal(ctx, root, id, buildProof(tamperedRoot.Left, true))
+	require.ErrorIs(t, err, ErrSubtreeMismatch, "VerifySubtreeAgainstLocal should fail with a tampered subtree")
+	require.Contains(t, err.Error(), leaf.Key.String(), "mismatch should report the tampered key")
+	require.Contains(t, err.Error(), "value 74616D7065726564", "mismatch should report the tampered value")
+
+	// Tampered nodes that are only included by hash should be detected as well.
+	err = local.VerifySubtreeAgainstLocal(ctx, root, id, buildProof(tamperedRoot.Left, false))
+	require.ErrorIs(t, err, ErrSubtreeMismatch, "VerifySubtreeAgainstLocal should fail with a tampered subtree")
+	require.Contains(t, err.Error(), "node hash", "mismatch should be reported by hash")
+
+	// Subtrees that do not exist locally should be reported.
+	missingID := SubtreeID{Path: node.Key("missing"), BitDepth: 56}
+	err = local.VerifySubtreeAgainstLocal(ctx, root, missingID, buildProof(rootNode.Left, true))
+	require.ErrorIs(t, err, ErrSubtreeMismatch, "VerifySubtreeAgainstLocal should fail with a missing subtree")
+	require.Contains(t, err.Error(), "unexpected node")
+
+	// Subtree identifiers must have a path matching their bit depth.
+	for _, tc := range []struct {
+		id    SubtreeID
+		valid bool
+	}{
+		{SubtreeID{Path: node.Key{}, BitDepth: 0}, true},
+		{SubtreeID{Path: node.Key{0x80}, BitDepth: 1}, true},
+		{SubtreeID{Path: node.Key{0xab, 0xc0}, BitDepth: 12}, true},
+		{SubtreeID{Path: node.Key("key"), BitDepth: 24}, true},
+		{SubtreeID{Path: node.Key("key"), BitDepth: 0}, false},
+		{SubtreeID{Path: node.Key{}, BitDepth: 8}, false},
+		{SubtreeID{Path: node.Key{0xab, 0xc0}, BitDepth: 8}, false},
+	} {
+		err = tc.id.Validate()
+		if tc.valid {
+			require.NoError(t, err, "Validate(%+v)", tc.id)
+		} else {
+			require.ErrorIs(t, err, ErrInvalidSubtreeID, "Validate(%+v)", tc.id)
+		}
+	}
+	err = local.VerifySubtreeAgainstLocal(ctx, root, SubtreeID{Path: id.Path}, buildProof(rootNode.Left, true))
+	require.ErrorIs(t, err, ErrInvalidSubtreeID, "VerifySubtreeAgainstLocal should reject inconsistent identifiers")
+}
+
+func testSampleKeys(t *testing.T, ndb db.NodeDB, _ NodeDBFactory) {
+	ctx := context.Background()
+	keys, values := generateKeyValuePairsEx("", 100)
+
+	tree := New(nil, ndb, node.RootTypeState)
+	defer tree.Close()
+
+	// Empty tree.
+	_, rootHash, err := tree.Commit(ctx, testNs, 0)
+	require.NoError(t, err, "Commit")
+	root := node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState, Hash: rootHash}
+	sample, err := tree.SampleKeys(ctx, root, 10, 1)
+	require.NoError(t, err, "SampleKeys")
+	require.Empty(t, sample)
+
+	for i, key := range keys {
+		err = tree.Insert(ctx, key, values[i])
+		require.NoError(t, err, "Insert")
+	}
+	_, rootHash, err = tree.Commit(ctx, testNs, 1)
+	require.NoError(t, err, "Commit")
+	root = node.Root{Namespace: testNs, Version: 1, Type: node.RootTypeState, Hash: rootHash}
+
+	sample, err = tree.SampleKeys(ctx, root, 10, 42)
+	require.NoError(t, err, "SampleKeys")
+	require.Len(t, sample, 10)
+	unique := make(map[string]struct{})
+	for i, key := range sample {
+		value, gerr := tree.Get(ctx, key)
+		require.NoError(t, gerr, "Get")
+		require.NotNil(t, value, "sampled key %s should exist", key)
+		unique[string(key)] = struct{}{}
+		if i > 0 {
+			require.Equal(t, -1, sample[i-1].Compare(key), "sample should be sorted")
+		}
+	}
+	require.Len(t, unique, 10, "sampled keys should be distinct")
+
+	// The same seed should yield the same sample, also on a freshly opened tree.
+	other := NewWithRoot(nil, ndb, root)
+	defer other.Close()
+	otherSample, err := other.SampleKeys(ctx, root, 10, 42)
+	require.NoError(t, err, "SampleKeys")
+	require.Equal(t, sample, otherSample, "same seed should yield the same sample")
+
+	// A different seed should (with overwhelming probability) yield a different sample.
+	otherSample, err = tree.SampleKeys(ctx, root, 10, 43)
+	require.NoError(t, err, "SampleKeys")
+	require.NotEqual(t, sample, otherSample, "different seeds should yield different samples")
+
+	// Requesting more keys than present should return all keys.
+	sample, err = tree.SampleKeys(ctx, root, 1000, 42)
+	require.NoError(t, err, "SampleKeys")
+	require.Len(t, sample, len(keys))
+
+	sample, err = tree.SampleKeys(ctx, root, 0, 42)
+	require.NoError(t, err, "SampleKeys")
+	require.Empty(t, sample)
+
+	// Only the root the tree was created with can be sampled.
+	_, err = tree.SampleKeys(ctx, node.Root{Namespace: testNs, Version: 0, Type: node.RootTypeState}, 10, 42)
+	require.ErrorIs(t, err, syncer.ErrInvalidRoot)
+}
@@ -0,0 +1,130 @@
+package mkvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/oasisprotocol/oasis-core/go/common/crypto/hash"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/syncer"
+)
+
+// errVerifyLimitReached is the error used internally to stop a verification once the maximum
+// number of leaves for a single Verify call has been verified.
+var errVerifyLimitReached = errors.New("mkvs: verify limit reached")
+
+// VerifyProgress is the progress of a tree verification. It can be persisted and passed to a
+// later Verify call in order to resume an interrupted verification.
+type VerifyProgress struct {
+	// Root is the root being verified. Progress can only be used to resume verification of the
+	// same root.
+	Root node.Root `json:"root"`
+	// NextKey is the key at which verification resumes. All leaves with smaller keys have
+	// already been verified.
+	NextKey node.Key `json:"next_key,omitempty"`
+	// VerifiedLeaves is the total number of leaves verified so far.
+	VerifiedLeaves uint64 `json:"verified_leaves"`
+	// Complete is true when the whole tree has been verified.
+	Complete bool `json:"complete"`
+}
+
+// Implements Tree.
+func (t *tree) Verify(ctx context.Context, root node.Root, progress *VerifyProgress, maxLeaves int) (*VerifyProgress, error) {
+	t.cache.Lock()
+	defer t.cache.Unlock()
+
+	if t.cache.isClosed() {
+		return nil, ErrClosed
+	}
+	if !root.Equal(&t.cache.syncRoot) {
+		return nil, syncer.ErrInvalidRoot
+	}
+	if !t.cache.pendingRoot.IsClean() {
+		return nil, syncer.ErrDirtyRoot
+	}
+
+	p := VerifyProgress{Root: root}
+	if progress != nil {
+		if !progress.Root.Equal(&root) {
+			return nil, syncer.ErrInvalidRoot
+		}
+		p = *progress
+	}
+	if p.Complete {
+		return &p, nil
+	}
+
+	// Remember where the path from root to target node ends (will end).
+	t.cache.markPosition()
+
+	var verified int
+	err := t.doWalk(ctx, t.cache.pendingRoot, 0, node.Key{}, func(ptr *node.Pointer, nd node.Node, bitDepth node.Depth, path node.Key) (bool, error) {
+		switch n := nd.(type) {
+		case *node.InternalNode:
+			// Skip subtrees containing only keys which have already been verified. Nodes on
+			// the path to the next key are verified again, which is cheap compared to the
+			// leaves of the skipped subtrees.
+			bitLength := bitDepth + n.LabelBitLength
+			if verifiedBefore(p.NextKey, path.Merge(bitDepth, n.Label, n.LabelBitLength), bitLength) {
+				return false, nil
+			}
+
+			check := *n
+			check.UpdateHash()
+			if err := verifyNodeHash(ptr, check.Hash, path, bitDepth); err != nil {
+				return false, err
+			}
+		case *node.LeafNode:
+			if n.Key.Compare(p.NextKey) < 0 {
+				return false, nil
+			}
+			if maxLeaves > 0 && verified >= maxLeaves {
+				return false, errVerifyLimitReached
+			}
+
+			check := *n
+			check.UpdateHash()
+			if err := verifyNodeHash(ptr, check.Hash, n.Key, n.Key.BitLength()); err != nil {
+				return false, err
+			}
+
+			// The smallest key following the verified key is the key extended by a zero byte.
+			p.NextKey = append(append(node.Key{}, n.Key...), 0)
+			p.VerifiedLeaves++
+			verified++
+		}
+		return true, nil
+	})
+	switch err {
+	case nil:
+		p.NextKey = nil
+		p.Complete = true
+		return &p, nil
+	case errVerifyLimitReached:
+		return &p, nil
+	default:
+		return &p, err
+	}
+}
+
+// verifiedBefore returns true if all keys in the subtree identified by the given path of the
+// given bit length are smaller than the given next key.
+func verifiedBefore(nextKey, path node.Key, bitLength node.Depth) bool {
+	commonLength := nextKey.BitLength()
+	if bitLength < commonLength {
+		commonLength = bitLength
+	}
+	nextPrefix, _ := nextKey.Split(commonLength, nextKey.BitLength())
+	pathPrefix, _ := path.Split(commonLength, bitLength)
+	return nextPrefix.Compare(pathPrefix) > 0
+}
+
+// verifyNodeHash returns an error wrapping ErrNodeHashMismatch in case the recomputed hash of
+// the node identified by the given path and bit depth differs from the hash it is referenced by.
+func verifyNodeHash(ptr *node.Pointer, computed hash.Hash, path node.Key, bitDepth node.Depth) error {
+	if computed.Equal(&ptr.Hash) {
+		return nil
+	}
+	return fmt.Errorf("%w: node at %s/%d (expected: %s got: %s)", ErrNodeHashMismatch, path, bitDepth, ptr.Hash, computed)
+}
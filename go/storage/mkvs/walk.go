@@ -0,0 +1,95 @@
+package mkvs
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
+)
+
+// walkFunc is the function called for each node visited by doWalk.
+//
+// The bitDepth is the bit depth at which the node is located and path is the
+// key prefix leading to the node. If the function returns false, the children
+// of the visited node are not traversed.
+type walkFunc func(ptr *node.Pointer, nd node.Node, bitDepth node.Depth, path node.Key) (bool, error)
+
+// doWalk performs a pre-order traversal of the subtree rooted at ptr and calls
+// fn for each non-nil node. An internal node's leaf node is visited after the
+// internal node itself and before its left and right children.
+//
+// This may result in node database accesses or remote syncing if the nodes
+// are not available locally.
+func (t *tree) doWalk(
+	ctx context.Context,
+	ptr *node.Pointer,
+	bitDepth node.Depth,
+	path node.Key,
+	fn walkFunc,
+) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// Dereference the node, possibly making a remote request.
+	nd, err := t.cache.derefNodePtr(ctx, ptr, t.newFetcherSyncIterate(path, 0))
+	if err != nil {
+		return err
+	}
+	if nd == nil {
+		return nil
+	}
+
+	descend, err := fn(ptr, nd, bitDepth, path)
+	if err != nil {
+		return err
+	}
+	if !descend {
+		return nil
+	}
+
+	switch n := nd.(type) {
+	case *node.InternalNode:
+		bitLength := bitDepth + n.LabelBitLength
+		newPath := path.Merge(bitDepth, n.Label, n.LabelBitLength)
+
+		// Capture child pointers before descending as visiting a large subtree
+		// may cause this node to be evicted from the cache.
+		for _, child := range []*node.Pointer{n.LeafNode, n.Left, n.Right} {
+			if err = t.doWalk(ctx, child, bitLength, newPath, fn); err != nil {
+				return err
+			}
+		}
+	case *node.LeafNode:
+	default:
+		panic(fmt.Sprintf("mkvs: unknown node type: %+v", n))
+	}
+	return nil
+}
+
+// walkRoot performs a pre-order traversal of the given root, which need not be the root the tree
+// was created with, and calls fn for each non-nil node. The traversal uses a separate tree
+// sharing this tree's node database and read syncer.
+//
+// Must be called while holding the cache lock.
+func (t *tree) walkRoot(ctx context.Context, root node.Root, fn walkFunc) error {
+	return t.withRoot(root, func(rt *tree) error {
+		return rt.doWalk(ctx, rt.cache.pendingRoot, 0, node.Key{}, fn)
+	})
+}
+
+// withRoot calls fn with a separate locked tree for the given root, which has the same
+// configuration as this tree and shares its node database and read syncer. The separate tree
+// is closed once fn returns.
+//
+// Must be called while holding the cache lock.
+func (t *tree) withRoot(root node.Root, fn func(rt *tree) error) error {
+	rt := t.newWithRoot(root)
+	rt.cache.Lock()
+	defer func() {
+		rt.cache.close()
+		rt.cache.Unlock()
+	}()
+
+	return fn(rt)
+}
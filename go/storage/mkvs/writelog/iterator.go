@@ -6,8 +6,9 @@ import (
 )
 
 var (
-	_ Iterator = (*staticIterator)(nil)
-	_ Iterator = (*PipeIterator)(nil)
+	_ Iterator      = (*staticIterator)(nil)
+	_ SizedIterator = (*staticIterator)(nil)
+	_ Iterator      = (*PipeIterator)(nil)
 
 	// ErrIteratorInvalid is raised when Value() is called on an iterator that finished already or hasn't started yet.
 	ErrIteratorInvalid = errors.New("mkvs: write log iterator invalid")
@@ -26,6 +27,14 @@ type Iterator interface {
 	Value() (LogEntry, error)
 }
 
+// SizedIterator is an iterator which knows how many entries are left to iterate over.
+type SizedIterator interface {
+	Iterator
+
+	// Remaining returns the number of elements following the current one.
+	Remaining() int
+}
+
 type staticIterator struct {
 	cursor  int
 	entries WriteLog
@@ -46,6 +55,13 @@ func (i *staticIterator) Value() (LogEntry, error) {
 	return i.entries[i.cursor], nil
 }
 
+func (i *staticIterator) Remaining() int {
+	if i.cursor >= len(i.entries) {
+		return 0
+	}
+	return len(i.entries) - i.cursor - 1
+}
+
 // NewStaticIterator returns a new writelog iterator that's backed by a static in-memory array.
 func NewStaticIterator(writeLog WriteLog) Iterator {
 	return &staticIterator{
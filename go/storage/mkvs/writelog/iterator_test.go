@@ -33,18 +33,21 @@ func TestStaticIterator(t *testing.T) {
 	wl := makeWriteLog()
 
 	it := NewStaticIterator(wl)
+	require.Equal(t, len(wl), it.(SizedIterator).Remaining())
 
-	for _, ent := range wl {
+	for i, ent := range wl {
 		more, err = it.Next()
 		require.NoError(t, err, "it.Next()")
 		require.Equal(t, more, true)
 		val, err = it.Value()
 		require.NoError(t, err, "it.Value()")
 		require.Equal(t, val, ent)
+		require.Equal(t, len(wl)-i-1, it.(SizedIterator).Remaining())
 	}
 	more, err = it.Next()
 	require.NoError(t, err, "last it.Next()")
 	require.Equal(t, more, false)
+	require.Equal(t, 0, it.(SizedIterator).Remaining())
 	_, err = it.Value()
 	require.Error(t, err, "last it.Value()")
 
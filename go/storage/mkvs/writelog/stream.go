@@ -0,0 +1,72 @@
+package writelog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/oasisprotocol/oasis-core/go/common/cbor"
+)
+
+// maxStreamEntrySize is the maximum size of a single encoded write log entry in a stream.
+const maxStreamEntrySize = 64 * 1024 * 1024
+
+// ErrStreamEntryTooLarge is the error returned when decoding a write log stream containing an
+// entry that exceeds the maximum entry size.
+var ErrStreamEntryTooLarge = errors.New("mkvs: write log stream entry too large")
+
+// EncodeStream encodes the write log into the given writer as a stream of CBOR-encoded
+// entries, each prefixed by its big-endian 32-bit length.
+func (wl WriteLog) EncodeStream(w io.Writer) error {
+	var lenBuf [4]byte
+	for i := range wl {
+		data := cbor.Marshal(&wl[i])
+		if len(data) > maxStreamEntrySize {
+			return ErrStreamEntryTooLarge
+		}
+
+		binary.BigEndian.PutUint32(lenBuf[:], uint32(len(data)))
+		if _, err := w.Write(lenBuf[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DecodeWriteLogStream decodes a write log stream produced by EncodeStream, calling fn for
+// each decoded entry without materializing the whole write log.
+//
+// Decoding stops at the first error returned by fn.
+func DecodeWriteLogStream(r io.Reader, fn func(LogEntry) error) error {
+	var lenBuf [4]byte
+	for {
+		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+			if err == io.EOF {
+				// Clean end of stream.
+				return nil
+			}
+			return fmt.Errorf("mkvs: failed to read write log entry length: %w", err)
+		}
+
+		size := binary.BigEndian.Uint32(lenBuf[:])
+		if size > maxStreamEntrySize {
+			return ErrStreamEntryTooLarge
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return fmt.Errorf("mkvs: failed to read write log entry: %w", err)
+		}
+
+		var entry LogEntry
+		if err := cbor.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("mkvs: failed to decode write log entry: %w", err)
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
@@ -3,6 +3,9 @@ package writelog
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
 
 	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/node"
 )
@@ -25,7 +28,104 @@ func (wl WriteLog) Equal(cmp WriteLog) bool {
 	return true
 }
 
+// Canonical returns a copy of the write log in canonical order.
+//
+// Entries are sorted by key in the order in which they appear in the tree (bytewise
+// lexicographic order of keys). In case the write log contains multiple entries for the
+// same key, only the last one is retained as that is the entry that determines the
+// resulting tree when the write log is applied sequentially.
+//
+// Applying the canonical write log yields the same root as applying the original one.
+func (wl WriteLog) Canonical() WriteLog {
+	last := make(map[string]int, len(wl))
+	for i, entry := range wl {
+		last[string(entry.Key)] = i
+	}
+
+	canonical := make(WriteLog, 0, len(last))
+	for i, entry := range wl {
+		if last[string(entry.Key)] != i {
+			continue
+		}
+		canonical = append(canonical, entry)
+	}
+	sort.Slice(canonical, func(i, j int) bool {
+		return bytes.Compare(canonical[i].Key, canonical[j].Key) < 0
+	})
+	return canonical
+}
+
+// DuplicateKeys returns the keys that occur more than once in the write log, in order of
+// their first duplicate occurrence.
+func (wl WriteLog) DuplicateKeys() [][]byte {
+	seen := make(map[string]int, len(wl))
+	var dups [][]byte
+	for _, entry := range wl {
+		seen[string(entry.Key)]++
+		if seen[string(entry.Key)] == 2 {
+			dups = append(dups, entry.Key)
+		}
+	}
+	return dups
+}
+
+// ErrConflict is the error returned by Merge when the merged write logs contain different
+// entries for the same key and the conflict policy is ConflictError.
+var ErrConflict = errors.New("mkvs: conflicting write log entries")
+
+// ConflictPolicy decides which entry wins when merged write logs contain different entries for
+// the same key.
+type ConflictPolicy uint8
+
+const (
+	// ConflictLastWins retains the entry from the last write log containing the key.
+	ConflictLastWins ConflictPolicy = iota
+	// ConflictFirstWins retains the entry from the first write log containing the key.
+	ConflictFirstWins
+	// ConflictError fails the merge.
+	ConflictError
+)
+
+// Merge merges the given write logs into a single write log in canonical order.
+//
+// Each write log is first reduced to its canonical form, so duplicate keys within a single
+// write log are resolved as if it was applied sequentially. Entries for the same key in
+// different write logs are only considered conflicting if they differ, in which case the
+// conflict policy decides the outcome.
+func Merge(logs []WriteLog, policy ConflictPolicy) (WriteLog, error) {
+	merged := make(map[string]LogEntry)
+	for _, wl := range logs {
+		for _, entry := range wl.Canonical() {
+			existing, ok := merged[string(entry.Key)]
+			if ok && !existing.Equal(&entry) {
+				switch policy {
+				case ConflictLastWins:
+				case ConflictFirstWins:
+					continue
+				case ConflictError:
+					return nil, fmt.Errorf("%w: key %X", ErrConflict, entry.Key)
+				default:
+					return nil, fmt.Errorf("mkvs: unknown write log conflict policy: %d", policy)
+				}
+			}
+			merged[string(entry.Key)] = entry
+		}
+	}
+
+	result := make(WriteLog, 0, len(merged))
+	for _, entry := range merged {
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return bytes.Compare(result[i].Key, result[j].Key) < 0
+	})
+	return result, nil
+}
+
 // LogEntry is a write log entry.
+//
+// A nil value denotes removal of the key while an empty but non-nil value denotes storing a
+// zero-length value under the key.
 type LogEntry struct {
 	_ struct{} `cbor:",toarray"` // nolint
 
@@ -38,6 +138,10 @@ func (k *LogEntry) Equal(cmp *LogEntry) bool {
 	if !bytes.Equal(k.Key, cmp.Key) {
 		return false
 	}
+	if (k.Value == nil) != (cmp.Value == nil) {
+		// Removing a key is different from storing a zero-length value.
+		return false
+	}
 	if !bytes.Equal(k.Value, cmp.Value) {
 		return false
 	}
@@ -0,0 +1,181 @@
+package writelog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/oasisprotocol/oasis-core/go/common/cbor"
+)
+
+func TestCanonical(t *testing.T) {
+	wl := WriteLog{
+		{Key: []byte("foo"), Value: []byte("a")},
+		{Key: []byte("bar"), Value: []byte("b")},
+		{Key: []byte("foo"), Value: nil},
+		{Key: []byte("fo"), Value: []byte("c")},
+		{Key: []byte("bar"), Value: []byte("d")},
+	}
+
+	canonical := wl.Canonical()
+	require.EqualValues(t, WriteLog{
+		{Key: []byte("bar"), Value: []byte("d")},
+		{Key: []byte("fo"), Value: []byte("c")},
+		{Key: []byte("foo"), Value: nil},
+	}, canonical, "Canonical should sort entries and retain the last entry for each key")
+	require.Len(t, wl, 5, "Canonical should not modify the original write log")
+
+	require.True(t, canonical.Equal(canonical.Canonical()), "Canonical should be idempotent")
+	require.Empty(t, WriteLog(nil).Canonical(), "Canonical of an empty write log should be empty")
+}
+
+func TestEmptyValue(t *testing.T) {
+	require := require.New(t)
+
+	remove := LogEntry{Key: []byte("foo"), Value: nil}
+	empty := LogEntry{Key: []byte("foo"), Value: []byte{}}
+
+	require.Equal(LogDelete, remove.Type(), "nil value should be a removal")
+	require.Equal(LogInsert, empty.Type(), "empty value should be an insertion")
+	require.False(remove.Equal(&empty), "removal should not equal a zero-length insertion")
+	require.False(empty.Equal(&remove), "zero-length insertion should not equal a removal")
+	require.True(empty.Equal(&LogEntry{Key: []byte("foo"), Value: []byte{}}))
+
+	wl := WriteLog{remove, empty}
+
+	var decoded WriteLog
+	err := cbor.Unmarshal(cbor.Marshal(wl), &decoded)
+	require.NoError(err, "cbor.Unmarshal")
+	require.True(wl.Equal(decoded), "CBOR round trip should preserve removals and zero-length values")
+
+	data, err := json.Marshal(wl)
+	require.NoError(err, "json.Marshal")
+	decoded = nil
+	err = json.Unmarshal(data, &decoded)
+	require.NoError(err, "json.Unmarshal")
+	require.True(wl.Equal(decoded), "JSON round trip should preserve removals and zero-length values")
+}
+
+func TestStream(t *testing.T) {
+	require := require.New(t)
+
+	var wl WriteLog
+	for i := 0; i < 10000; i++ {
+		entry := LogEntry{Key: []byte(fmt.Sprintf("key %d", i))}
+		switch i % 3 {
+		case 0:
+			entry.Value = []byte(fmt.Sprintf("value %d", i))
+		case 1:
+			entry.Value = []byte{}
+		}
+		wl = append(wl, entry)
+	}
+
+	var buf bytes.Buffer
+	err := wl.EncodeStream(&buf)
+	require.NoError(err, "EncodeStream")
+
+	var decoded WriteLog
+	err = DecodeWriteLogStream(&buf, func(entry LogEntry) error {
+		decoded = append(decoded, entry)
+		return nil
+	})
+	require.NoError(err, "DecodeWriteLogStream")
+	require.True(wl.Equal(decoded), "decoded write log should match the original")
+
+	// Empty stream.
+	err = DecodeWriteLogStream(bytes.NewReader(nil), func(LogEntry) error {
+		require.Fail("callback should not be called for an empty stream")
+		return nil
+	})
+	require.NoError(err, "DecodeWriteLogStream")
+
+	// Truncated stream.
+	buf.Reset()
+	err = wl[:2].EncodeStream(&buf)
+	require.NoError(err, "EncodeStream")
+	truncated := buf.Bytes()[:buf.Len()-1]
+	var count int
+	err = DecodeWriteLogStream(bytes.NewReader(truncated), func(LogEntry) error {
+		count++
+		return nil
+	})
+	require.ErrorIs(err, io.ErrUnexpectedEOF, "DecodeWriteLogStream should fail on a truncated stream")
+	require.Equal(1, count, "entries before the truncation should be decoded")
+
+	// Callback errors abort decoding.
+	testErr := errors.New("test error")
+	err = DecodeWriteLogStream(bytes.NewReader(buf.Bytes()), func(LogEntry) error {
+		return testErr
+	})
+	require.ErrorIs(err, testErr)
+}
+
+func TestDuplicateKeys(t *testing.T) {
+	wl := WriteLog{
+		{Key: []byte("foo"), Value: []byte("a")},
+		{Key: []byte("bar"), Value: []byte("b")},
+		{Key: []byte("foo"), Value: nil},
+		{Key: []byte("baz"), Value: []byte("c")},
+		{Key: []byte("foo"), Value: []byte("d")},
+		{Key: []byte("baz"), Value: []byte("e")},
+	}
+	require.EqualValues(t, [][]byte{[]byte("foo"), []byte("baz")}, wl.DuplicateKeys())
+	require.Empty(t, wl.Canonical().DuplicateKeys(), "canonical write log should not contain duplicates")
+}
+
+func TestMerge(t *testing.T) {
+	require := require.New(t)
+
+	// Disjoint write logs are merged in canonical order under any policy.
+	a := WriteLog{
+		{Key: []byte("foo"), Value: []byte("a")},
+		{Key: []byte("bar"), Value: []byte("b")},
+	}
+	b := WriteLog{
+		{Key: []byte("baz"), Value: nil},
+	}
+	for _, policy := range []ConflictPolicy{ConflictLastWins, ConflictFirstWins, ConflictError} {
+		merged, err := Merge([]WriteLog{a, b}, policy)
+		require.NoError(err, "Merge")
+		require.EqualValues(WriteLog{a[1], b[0], a[0]}, merged)
+	}
+
+	// Overlapping keys are resolved according to the policy.
+	c := WriteLog{
+		{Key: []byte("foo"), Value: []byte("c")},
+		{Key: []byte("bar"), Value: []byte("b")},
+	}
+	merged, err := Merge([]WriteLog{a, c}, ConflictLastWins)
+	require.NoError(err, "Merge")
+	require.EqualValues(WriteLog{a[1], c[0]}, merged)
+
+	merged, err = Merge([]WriteLog{a, c}, ConflictFirstWins)
+	require.NoError(err, "Merge")
+	require.EqualValues(WriteLog{a[1], a[0]}, merged)
+
+	_, err = Merge([]WriteLog{a, c}, ConflictError)
+	require.ErrorIs(err, ErrConflict, "Merge should fail on conflicting entries")
+
+	// Identical entries and duplicates within a single write log are not conflicts.
+	d := WriteLog{
+		{Key: []byte("foo"), Value: []byte("x")},
+		{Key: []byte("foo"), Value: []byte("a")},
+	}
+	merged, err = Merge([]WriteLog{a, d}, ConflictError)
+	require.NoError(err, "Merge")
+	require.EqualValues(WriteLog{a[1], a[0]}, merged)
+	require.Empty(merged.DuplicateKeys())
+
+	// A removal conflicts with an insertion.
+	e := WriteLog{
+		{Key: []byte("foo"), Value: nil},
+	}
+	_, err = Merge([]WriteLog{a, e}, ConflictError)
+	require.ErrorIs(err, ErrConflict)
+}
@@ -51,7 +51,7 @@ func prepareWriteLog(values [][]byte) api.WriteLog {
 	return wl
 }
 
-func CalculateExpectedNewRoot(t *testing.T, wl api.WriteLog, namespace common.Namespace, round uint64) hash.Hash {
+func CalculateExpectedNewRoot(t testing.TB, wl api.WriteLog, namespace common.Namespace, round uint64) hash.Hash {
 	// Use in-memory MKVS tree to calculate the expected new root.
 	// Root type doesn't matter, we only need the hash.
 	tree := mkvs.New(nil, nil, api.RootTypeState)
@@ -89,6 +89,139 @@ func StorageImplementationTests(t *testing.T, localBackend api.LocalBackend, bac
 	t.Run("Basic", func(t *testing.T) {
 		testBasic(t, localBackend, backend, namespace, round)
 	})
+	t.Run("DuplicateKeys", func(t *testing.T) {
+		testDuplicateKeys(t, localBackend, namespace, round)
+	})
+	t.Run("MalformedNamespace", func(t *testing.T) {
+		testMalformedNamespace(t, localBackend, round)
+	})
+	t.Run("ExpectedRootMismatch", func(t *testing.T) {
+		testExpectedRootMismatch(t, localBackend, namespace, round)
+	})
+}
+
+func testExpectedRootMismatch(t *testing.T, localBackend api.LocalBackend, namespace common.Namespace, round uint64) {
+	ctx := context.Background()
+	ndb := localBackend.NodeDB()
+
+	var rootHash hash.Hash
+	rootHash.Empty()
+
+	wl := api.WriteLog{
+		{Key: []byte("expected root"), Value: []byte("value")},
+	}
+	expectedNewRoot := CalculateExpectedNewRoot(t, wl, namespace, round)
+	var bogusRoot hash.Hash
+	bogusRoot.FromBytes([]byte("bogus expected root"))
+
+	rootsBefore, err := ndb.GetRootsForVersion(round)
+	require.NoError(t, err, "GetRootsForVersion")
+
+	// A mismatching expected root should be rejected without recording any root.
+	request := &api.ApplyRequest{
+		Namespace: namespace,
+		RootType:  api.RootTypeIO,
+		SrcRound:  round,
+		SrcRoot:   rootHash,
+		DstRound:  round,
+		DstRoot:   bogusRoot,
+		WriteLog:  wl,
+	}
+	err = localBackend.Apply(ctx, request)
+	require.ErrorIs(t, err, api.ErrExpectedRootMismatch, "Apply() should reject a mismatching expected root")
+
+	newRoot := api.Root{
+		Namespace: namespace,
+		Version:   round,
+		Type:      api.RootTypeIO,
+		Hash:      expectedNewRoot,
+	}
+	require.False(t, ndb.HasRoot(newRoot), "computed root should not be recorded")
+	require.False(t, ndb.HasRoot(api.Root{Namespace: namespace, Version: round, Type: api.RootTypeIO, Hash: bogusRoot}),
+		"expected root should not be recorded",
+	)
+	rootsAfter, err := ndb.GetRootsForVersion(round)
+	require.NoError(t, err, "GetRootsForVersion")
+	require.ElementsMatch(t, rootsBefore, rootsAfter, "no roots should be added")
+
+	// A matching expected root should be applied.
+	request.DstRoot = expectedNewRoot
+	err = localBackend.Apply(ctx, request)
+	require.NoError(t, err, "Apply() should not return an error")
+	require.True(t, ndb.HasRoot(newRoot), "computed root should be recorded")
+
+	tree := mkvs.NewWithRoot(nil, ndb, newRoot)
+	defer tree.Close()
+	value, err := tree.Get(ctx, []byte("expected root"))
+	require.NoError(t, err, "Get")
+	require.EqualValues(t, []byte("value"), value)
+}
+
+func testMalformedNamespace(t *testing.T, localBackend api.LocalBackend, round uint64) {
+	var rootHash hash.Hash
+	rootHash.Empty()
+
+	// Set a reserved namespace flag.
+	var badNs common.Namespace
+	badNs[7] = 0x01
+
+	err := localBackend.Apply(context.Background(), &api.ApplyRequest{
+		Namespace: badNs,
+		RootType:  api.RootTypeState,
+		SrcRound:  round,
+		SrcRoot:   rootHash,
+		DstRound:  round,
+		DstRoot:   rootHash,
+		WriteLog:  api.WriteLog{{Key: []byte("key"), Value: []byte("value")}},
+	})
+	require.ErrorIs(t, err, common.ErrMalformedNamespace, "Apply() should reject malformed namespaces")
+}
+
+func testDuplicateKeys(t *testing.T, localBackend api.LocalBackend, namespace common.Namespace, round uint64) {
+	ctx := context.Background()
+
+	var rootHash hash.Hash
+	rootHash.Empty()
+
+	wl := api.WriteLog{
+		{Key: []byte("a"), Value: []byte("first")},
+		{Key: []byte("b"), Value: []byte("value")},
+		{Key: []byte("a"), Value: []byte("second")},
+	}
+	expectedNewRoot := CalculateExpectedNewRoot(t, wl, namespace, round)
+	newRoot := api.Root{
+		Namespace: namespace,
+		Version:   round,
+		Type:      api.RootTypeIO,
+		Hash:      expectedNewRoot,
+	}
+	request := &api.ApplyRequest{
+		Namespace:           namespace,
+		RootType:            api.RootTypeIO,
+		SrcRound:            round,
+		SrcRoot:             rootHash,
+		DstRound:            round,
+		DstRoot:             expectedNewRoot,
+		WriteLog:            wl,
+		RejectDuplicateKeys: true,
+	}
+
+	// Rejecting duplicate keys should fail without applying anything.
+	err := localBackend.Apply(ctx, request)
+	require.ErrorIs(t, err, api.ErrDuplicateKeys, "Apply() should reject duplicate keys")
+	require.Contains(t, err.Error(), "61", "error should name the duplicate key")
+	require.False(t, localBackend.NodeDB().HasRoot(newRoot), "nothing should be applied")
+
+	// By default, the last entry for a key wins.
+	request.RejectDuplicateKeys = false
+	err = localBackend.Apply(ctx, request)
+	require.NoError(t, err, "Apply() should not return an error")
+
+	tree := mkvs.NewWithRoot(nil, localBackend.NodeDB(), newRoot)
+	defer tree.Close()
+	value, err := tree.Get(ctx, []byte("a"))
+	require.NoError(t, err, "Get")
+	require.EqualValues(t, []byte("second"), value, "last entry should win")
 }
 
 func testBasic(t *testing.T, localBackend api.LocalBackend, backend api.Backend, namespace common.Namespace, round uint64) {
@@ -2,9 +2,11 @@
 package config
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/oasisprotocol/oasis-core/go/storage/mkvs/db"
+	nodedb "github.com/oasisprotocol/oasis-core/go/storage/mkvs/db/api"
 )
 
 // Config is the storage worker configuration structure.
@@ -13,6 +15,16 @@ type Config struct {
 	Backend string `yaml:"backend"`
 	// Maximum in-memory cache size.
 	MaxCacheSize string `yaml:"max_cache_size"`
+	// Sync mode controlling when applied updates are synced to disk (none, batch or always).
+	//
+	// With "none" (default) writes are only flushed by the operating system and recent
+	// updates may be lost on a crash, which is safe as storage is re-applied on crashes.
+	// With "batch" updates are synced after every batch of applied updates and with "always"
+	// every commit is synced.
+	SyncMode string `yaml:"sync_mode"`
+	// Bit depth above which leaves created by applied updates are logged as a warning to
+	// surface unbalanced trees (0 disables the warning).
+	DeepLeafWarningDepth uint16 `yaml:"deep_leaf_warning_depth,omitempty"`
 	// Number of concurrent storage diff fetchers.
 	FetcherCount uint `yaml:"fetcher_count"`
 
@@ -23,6 +35,13 @@ type Config struct {
 
 	// Storage checkpointer configuration.
 	Checkpointer CheckpointerConfig `yaml:"checkpointer,omitempty"`
+
+	// Background storage maintenance configuration. Maintenance cannot be enabled together
+	// with the runtime history pruner.
+	Maintenance MaintenanceConfig `yaml:"maintenance,omitempty"`
+
+	// Hot-key tracking configuration.
+	HotKeys HotKeysConfig `yaml:"hot_keys,omitempty"`
 }
 
 // CheckpointerConfig is the storage worker checkpointer configuration structure.
@@ -33,10 +52,54 @@ type CheckpointerConfig struct {
 	CheckInterval time.Duration `yaml:"check_interval"`
 }
 
+// MaintenanceConfig is the background storage maintenance configuration structure.
+type MaintenanceConfig struct {
+	// Interval at which old versions are pruned from storage (0 disables maintenance).
+	Interval time.Duration `yaml:"interval"`
+	// Number of versions before the latest finalized version to keep.
+	KeepLast uint64 `yaml:"keep_last"`
+}
+
+// HotKeysConfig is the storage worker hot-key tracking configuration structure.
+type HotKeysConfig struct {
+	// Interval at which the most accessed keys are logged (0 disables hot-key tracking).
+	ReportInterval time.Duration `yaml:"report_interval"`
+	// Duration of the sliding window over which key accesses are counted.
+	Window time.Duration `yaml:"window"`
+	// Only every sample_rate-th key access is counted (0 or 1 counts all accesses).
+	SampleRate uint64 `yaml:"sample_rate"`
+	// Maximum number of keys tracked per window.
+	Capacity int `yaml:"capacity"`
+	// Number of most accessed keys to log.
+	TopN int `yaml:"top_n"`
+}
+
 // Validate validates the configuration settings.
 func (c *Config) Validate() error {
-	_, err := db.GetBackendByName(c.Backend)
-	return err
+	if _, err := db.GetBackendByName(c.Backend); err != nil {
+		return err
+	}
+	if err := nodedb.SyncMode(c.SyncMode).Validate(); err != nil {
+		return err
+	}
+	if c.Maintenance.Interval < 0 {
+		return fmt.Errorf("invalid storage maintenance interval: %s", c.Maintenance.Interval)
+	}
+	if c.HotKeys.ReportInterval < 0 {
+		return fmt.Errorf("invalid storage hot-key report interval: %s", c.HotKeys.ReportInterval)
+	}
+	if c.HotKeys.ReportInterval > 0 {
+		if c.HotKeys.Window < 0 {
+			return fmt.Errorf("invalid storage hot-key window: %s", c.HotKeys.Window)
+		}
+		if c.HotKeys.Capacity <= 0 {
+			return fmt.Errorf("invalid storage hot-key capacity: %d", c.HotKeys.Capacity)
+		}
+		if c.HotKeys.TopN <= 0 {
+			return fmt.Errorf("invalid number of storage hot keys to report: %d", c.HotKeys.TopN)
+		}
+	}
+	return nil
 }
 
 // DefaultConfig returns the default configuration settings.
@@ -44,6 +107,7 @@ func DefaultConfig() Config {
 	return Config{
 		Backend:                "badger",
 		MaxCacheSize:           "64mb",
+		SyncMode:               "none",
 		FetcherCount:           4,
 		PublicRPCEnabled:       false,
 		CheckpointSyncDisabled: false,
@@ -51,5 +115,16 @@ func DefaultConfig() Config {
 			Enabled:       false,
 			CheckInterval: 1 * time.Minute,
 		},
+		Maintenance: MaintenanceConfig{
+			Interval: 0,
+			KeepLast: 600,
+		},
+		HotKeys: HotKeysConfig{
+			ReportInterval: 0,
+			Window:         10 * time.Minute,
+			SampleRate:     16,
+			Capacity:       1024,
+			TopN:           10,
+		},
 	}
 }
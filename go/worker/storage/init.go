@@ -37,6 +37,16 @@ func NewLocalBackend(
 		Namespace:    namespace,
 		MaxCacheSize: int64(config.ParseSizeInBytes(config.GlobalConfig.Storage.MaxCacheSize)),
 		NoFsync:      true, // Should be safe, storage will be re-applied on crashes.
+		SyncMode:     api.SyncMode(config.GlobalConfig.Storage.SyncMode),
+
+		DeepLeafWarningDepth: config.GlobalConfig.Storage.DeepLeafWarningDepth,
+		MaintenanceInterval:  config.GlobalConfig.Storage.Maintenance.Interval,
+		MaintenanceKeepLast:  config.GlobalConfig.Storage.Maintenance.KeepLast,
+		HotKeyReportInterval: config.GlobalConfig.Storage.HotKeys.ReportInterval,
+		HotKeyWindow:         config.GlobalConfig.Storage.HotKeys.Window,
+		HotKeySampleRate:     config.GlobalConfig.Storage.HotKeys.SampleRate,
+		HotKeyCapacity:       config.GlobalConfig.Storage.HotKeys.Capacity,
+		HotKeyTopN:           config.GlobalConfig.Storage.HotKeys.TopN,
 	}
 
 	cfg.DB = GetLocalBackendDBDir(dataDir, cfg.Backend)